@@ -4,6 +4,7 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -12,6 +13,13 @@ import (
 
 const (
 	DefaultMetricRefreshInterval = "15s"
+
+	PausedAnnotation = "coroot.com/paused"
+	// Changing the value of this annotation (e.g., to the current timestamp) regenerates the operator-generated ClickHouse password.
+	// ClickHouse is restarted first, and Coroot once all the ClickHouse replicas are ready.
+	RotateSecretsAnnotation = "coroot.com/rotate-secrets"
+	// Changing the value of this annotation (e.g., to the current timestamp) takes a snapshot set of the Coroot, ClickHouse and Keeper volumes.
+	SnapshotAnnotation = "coroot.com/snapshot"
 )
 
 type CommunityEditionSpec struct {
@@ -21,6 +29,10 @@ type CommunityEditionSpec struct {
 type EnterpriseEditionSpec struct {
 	Version    string `json:"version,omitempty"`
 	LicenseKey string `json:"licenseKey,omitempty"`
+	// Secret containing the license key, takes precedence over licenseKey.
+	LicenseKeySecret *corev1.SecretKeySelector `json:"licenseKeySecret,omitempty"`
+	// A LicenseExpiring warning event is recorded once the license expires within this period (14d by default).
+	LicenseExpiryWarning metav1.Duration `json:"licenseExpiryWarning,omitempty"`
 }
 
 type AgentsOnlySpec struct {
@@ -33,60 +45,489 @@ type ServiceSpec struct {
 	NodePort int32              `json:"nodePort,omitempty"`
 }
 
+// PodAntiAffinityPreset generates pod anti-affinity rules for the replicas of a component
+// unless the affinity already defines them.
+// +kubebuilder:validation:Enum=soft;hard
+type PodAntiAffinityPreset string
+
+const (
+	// PodAntiAffinityPresetSoft prefers scheduling replicas on different nodes and zones.
+	PodAntiAffinityPresetSoft PodAntiAffinityPreset = "soft"
+	// PodAntiAffinityPresetHard requires scheduling replicas on different nodes and prefers different zones.
+	PodAntiAffinityPresetHard PodAntiAffinityPreset = "hard"
+)
+
+// SizeProfile sets the default resources, replica counts and retention of the components for a typical cluster size:
+// small (up to 20 nodes), medium (up to 100 nodes) or large (up to 500 nodes). Custom means no defaults.
+// The ClickHouse shard count isn't affected by the profile, so switching profiles never reshards the data.
+// +kubebuilder:validation:Enum=small;medium;large;custom
+type SizeProfile string
+
+const (
+	SizeProfileSmall  SizeProfile = "small"
+	SizeProfileMedium SizeProfile = "medium"
+	SizeProfileLarge  SizeProfile = "large"
+	SizeProfileCustom SizeProfile = "custom"
+)
+
+// Architecture is a CPU architecture of nodes (the kubernetes.io/arch label).
+// Specifying architectures for a component restricts it to the nodes with these architectures,
+// e.g., to keep it off arm64 nodes if its image is amd64-only.
+// +kubebuilder:validation:Enum=amd64;arm64
+type Architecture string
+
+// CanaryMode defines how a new Coroot version is rolled out to the replicas.
+// +kubebuilder:validation:Enum=manual;auto
+type CanaryMode string
+
+const (
+	// CanaryModeManual updates only the replicas with an ordinal greater than or equal to the partition.
+	CanaryModeManual CanaryMode = "manual"
+	// CanaryModeAuto updates the replica with the highest ordinal first
+	// and the others once it has been Ready and healthy for the verification period.
+	CanaryModeAuto CanaryMode = "auto"
+)
+
+type CorootUpdateStrategySpec struct {
+	Canary CanaryMode `json:"canary,omitempty"`
+	// Replicas with a lower ordinal are kept on the previous version (manual canary).
+	Partition int32 `json:"partition,omitempty"`
+	// How long the canary must be Ready and healthy before the other replicas are updated (auto canary, 1m by default).
+	VerificationPeriod Duration `json:"verificationPeriod,omitempty"`
+}
+
+// StorageClassChangePolicy defines what happens to the existing PVCs when the storage class changes,
+// since the storage class of a PVC can't be changed.
+// +kubebuilder:validation:Enum=Keep;Recreate
+type StorageClassChangePolicy string
+
+const (
+	// StorageClassChangePolicyKeep leaves the existing PVCs with the previous storage class and reports the mismatch.
+	StorageClassChangePolicyKeep StorageClassChangePolicy = "Keep"
+	// StorageClassChangePolicyRecreate deletes the existing PVCs and their pods, so the PVCs are recreated with the new storage class.
+	// The data is lost.
+	StorageClassChangePolicyRecreate StorageClassChangePolicy = "Recreate"
+)
+
 type StorageSpec struct {
 	Size      resource.Quantity `json:"size,omitempty"`
 	ClassName *string           `json:"className,omitempty"`
+	// What happens to the existing PVCs when className changes: Keep (default) or Recreate (THE DATA IS LOST).
+	ClassChangePolicy StorageClassChangePolicy `json:"classChangePolicy,omitempty"`
+	// Labels and annotations of the PVCs, in addition to the standard ones.
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Populates new PVCs from the data source, e.g., a VolumeSnapshot to restore the data from.
+	// It's ignored for the existing PVCs, since the data source can't be changed.
+	DataSourceRef *corev1.TypedObjectReference `json:"dataSourceRef,omitempty"`
+	// Binds the PVCs to pre-created PersistentVolumes matching the selector, e.g., local PVs on clusters without a CSI driver.
+	// With a WaitForFirstConsumer storage class, the pods follow the node affinity of the local PVs.
+	// It's ignored for the existing PVCs, since the selector can't be changed.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// Stores the data in a directory on the node instead of a PVC, e.g., on single-node k3s installations.
+	// It applies to new installations only, since the volume claim templates of the existing StatefulSets can't be changed.
+	HostPath *HostPathStorageSpec `json:"hostPath,omitempty"`
+	// Stores the data in an emptyDir volume limited to the size instead of a PVC, e.g., for CI and demo environments.
+	// The data is lost when the pods are deleted. It takes precedence over hostPath and, like it, applies to new installations only.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+}
+
+type HostPathStorageSpec struct {
+	// Directory on the node. The replicas of StatefulSets store their data in subdirectories named after the pods.
+	// +kubebuilder:validation:Required
+	Path string `json:"path"`
+	// Node the pods are pinned to, so they don't lose the data when rescheduled. Required on multi-node clusters.
+	NodeName string `json:"nodeName,omitempty"`
+	// Hands the directory over to the user of the pods by an init container running as root, since hostPath volumes ignore fsGroup.
+	// Otherwise, the directory must be writable by the user of the pods (65534 by default), and all the containers run as non-root.
+	FixPermissions bool `json:"fixPermissions,omitempty"`
+}
+
+// PodDNSSpec configures the name resolution of the pods of a component, including the /etc/hosts entries.
+type PodDNSSpec struct {
+	// DNS policy of the pods, e.g., None to use only the nameservers of dnsConfig.
+	// +kubebuilder:validation:Enum=ClusterFirst;ClusterFirstWithHostNet;Default;None
+	DNSPolicy corev1.DNSPolicy `json:"dnsPolicy,omitempty"`
+	// DNS parameters of the pods merged with the ones generated from dnsPolicy, e.g., searches or the ndots option.
+	DNSConfig *corev1.PodDNSConfig `json:"dnsConfig,omitempty"`
+	// Entries added to the /etc/hosts of the pods, e.g., for on-premises hostnames missing from the cluster DNS.
+	HostAliases []corev1.HostAlias `json:"hostAliases,omitempty"`
+}
+
+type ClickhouseServiceSpec struct {
+	// Service type, LoadBalancer by default.
+	Type                     corev1.ServiceType `json:"type,omitempty"`
+	HTTPPort                 int32              `json:"httpPort,omitempty"`
+	NativePort               int32              `json:"nativePort,omitempty"`
+	Annotations              map[string]string  `json:"annotations,omitempty"`
+	LoadBalancerSourceRanges []string           `json:"loadBalancerSourceRanges,omitempty"`
 }
 
 type NodeAgentSpec struct {
 	Version string `json:"version,omitempty"`
 
 	PriorityClassName string                         `json:"priorityClassName,omitempty"`
+	SchedulerName     string                         `json:"schedulerName,omitempty"`
+	RuntimeClassName  *string                        `json:"runtimeClassName,omitempty"`
+	ServiceAccount    ServiceAccountSpec             `json:"serviceAccount,omitempty"`
 	UpdateStrategy    appsv1.DaemonSetUpdateStrategy `json:"update_strategy,omitempty"`
 	Affinity          *corev1.Affinity               `json:"affinity,omitempty"`
+	Architectures     []Architecture                 `json:"architectures,omitempty"`
 	Resources         corev1.ResourceRequirements    `json:"resources,omitempty"`
 	Tolerations       []corev1.Toleration            `json:"tolerations,omitempty"`
 	PodAnnotations    map[string]string              `json:"podAnnotations,omitempty"`
+	PodLabels         map[string]string              `json:"podLabels,omitempty"`
+	Labels            map[string]string              `json:"labels,omitempty"`
 	Env               []corev1.EnvVar                `json:"env,omitempty"`
+
+	PodDNSSpec `json:",inline"`
+
+	// Additional command-line arguments of the node-agent container.
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+	// Lifecycle hooks of the node-agent container.
+	Lifecycle *corev1.Lifecycle `json:"lifecycle,omitempty"`
+
+	// Disables parsing of container logs.
+	DisableLogParsing bool `json:"disableLogParsing,omitempty"`
+	// Disables eBPF-based tracing of application-layer protocols (HTTP, Postgres, Redis, etc.).
+	DisableL7Tracing bool `json:"disableL7Tracing,omitempty"`
+	// Disables measuring network latency to the connection peers.
+	DisablePinger bool `json:"disablePinger,omitempty"`
+	// Public IP networks (e.g., 203.0.113.0/24) to track connections to. Only private networks are tracked by default.
+	TrackPublicNetworks []string `json:"trackPublicNetworks,omitempty"`
+	// Regular expressions matching the names of the containers to monitor (e.g., /k8s/production/.*). All containers are monitored by default.
+	ContainerAllowlist []string `json:"containerAllowlist,omitempty"`
+	// Regular expressions matching the names of the containers to ignore, e.g., /k8s/batch/.*.
+	ContainerDenylist []string `json:"containerDenylist,omitempty"`
+
+	// Runs the node-agent in the host network namespace. It requires metrics.port, since the node-agent listens on it on every node.
+	HostNetwork bool `json:"hostNetwork,omitempty"`
+	// Exposes the node-agent metrics for external Prometheus installations.
+	Metrics *NodeAgentMetricsSpec `json:"metrics,omitempty"`
+	// Buffers the telemetry while Coroot is unreachable (e.g., hibernated) and sends it once it's back.
+	Spool *NodeAgentSpoolSpec `json:"spool,omitempty"`
+}
+
+type NodeAgentSpoolSpec struct {
+	// Maximum size of the buffered data (1Gi by default). The oldest data is dropped when the limit is reached.
+	Size resource.Quantity `json:"size,omitempty"`
+	// Directory on the node to buffer the data in, so it survives restarts of the node-agent.
+	// The data is buffered in an emptyDir volume limited by the size if not set.
+	Path string `json:"path,omitempty"`
+}
+
+type NodeAgentMetricsSpec struct {
+	// The port the node-agent listens on (80 by default).
+	Port     int32 `json:"port,omitempty"`
+	HostPort int32 `json:"hostPort,omitempty"`
+	// Generates a headless Service for DNS-based discovery of the node-agent pods.
+	HeadlessService bool `json:"headlessService,omitempty"`
 }
 
 type ClusterAgentSpec struct {
 	Version string `json:"version,omitempty"`
 
-	Affinity       *corev1.Affinity            `json:"affinity,omitempty"`
-	Resources      corev1.ResourceRequirements `json:"resources,omitempty"`
-	Tolerations    []corev1.Toleration         `json:"tolerations,omitempty"`
-	PodAnnotations map[string]string           `json:"podAnnotations,omitempty"`
-	Env            []corev1.EnvVar             `json:"env,omitempty"`
+	// Restricts discovery to these namespaces (the Coroot namespace is always included).
+	// The cluster-agent gets a narrower ClusterRole and a Role in each of the namespaces.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Restricts discovery to the namespaces matching the selector, in addition to the namespaces listed above.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Additional rules of the cluster-agent ClusterRole (or Role in the namespace-scoped mode), e.g., to read CRDs of other operators.
+	// Only the get, list and watch verbs are allowed, secrets and wildcards are rejected.
+	// The operator must itself be allowed to read the resources, as it can't grant permissions it doesn't have.
+	ExtraRBACRules []rbacv1.PolicyRule `json:"extraRBACRules,omitempty"`
+
+	Affinity           *corev1.Affinity            `json:"affinity,omitempty"`
+	Architectures      []Architecture              `json:"architectures,omitempty"`
+	PriorityClassName  string                      `json:"priorityClassName,omitempty"`
+	SchedulerName      string                      `json:"schedulerName,omitempty"`
+	RuntimeClassName   *string                     `json:"runtimeClassName,omitempty"`
+	ServiceAccount     ServiceAccountSpec          `json:"serviceAccount,omitempty"`
+	Resources          corev1.ResourceRequirements `json:"resources,omitempty"`
+	Tolerations        []corev1.Toleration         `json:"tolerations,omitempty"`
+	PodAnnotations     map[string]string           `json:"podAnnotations,omitempty"`
+	PodLabels          map[string]string           `json:"podLabels,omitempty"`
+	Labels             map[string]string           `json:"labels,omitempty"`
+	PodSecurityContext *corev1.PodSecurityContext  `json:"podSecurityContext,omitempty"`
+	SecurityContext    *corev1.SecurityContext     `json:"securityContext,omitempty"`
+	Env                []corev1.EnvVar             `json:"env,omitempty"`
+
+	PodDNSSpec `json:",inline"`
+
+	// Additional command-line arguments of the cluster-agent container.
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+	// Lifecycle hooks of the cluster-agent container.
+	Lifecycle *corev1.Lifecycle `json:"lifecycle,omitempty"`
+
+	// Number of cluster-agent replicas (1 by default). The agent has no leader election,
+	// so each replica collects and sends the same data, which only adds redundancy for large clusters.
+	// +kubebuilder:validation:Minimum=1
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Update strategy of the Deployment, e.g., RollingUpdate with maxSurge: 0 to avoid extra pods during updates.
+	UpdateStrategy *appsv1.DeploymentStrategy `json:"updateStrategy,omitempty"`
+	// Spreads the replicas across nodes and zones.
+	PodAntiAffinityPreset PodAntiAffinityPreset `json:"podAntiAffinityPreset,omitempty"`
+	// Collects the Kubernetes events of the discovered namespaces into Coroot's logs (the kubernetes-events service)
+	// using a single-replica OpenTelemetry Collector Deployment, so each event is exported once regardless of the replicas.
+	// The events are stored with the same retention as the other logs.
+	KubernetesEvents *KubernetesEventsSpec `json:"kubernetesEvents,omitempty"`
+}
+
+type KubernetesEventsSpec struct {
+	// Resources of the collector container.
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
 }
 
 type PrometheusSpec struct {
-	Affinity       *corev1.Affinity            `json:"affinity,omitempty"`
-	Storage        StorageSpec                 `json:"storage,omitempty"`
-	Resources      corev1.ResourceRequirements `json:"resources,omitempty"`
-	Tolerations    []corev1.Toleration         `json:"tolerations,omitempty"`
-	PodAnnotations map[string]string           `json:"podAnnotations,omitempty"`
+	Affinity           *corev1.Affinity            `json:"affinity,omitempty"`
+	Architectures      []Architecture              `json:"architectures,omitempty"`
+	PriorityClassName  string                      `json:"priorityClassName,omitempty"`
+	SchedulerName      string                      `json:"schedulerName,omitempty"`
+	RuntimeClassName   *string                     `json:"runtimeClassName,omitempty"`
+	ServiceAccount     ServiceAccountSpec          `json:"serviceAccount,omitempty"`
+	Storage            StorageSpec                 `json:"storage,omitempty"`
+	Resources          corev1.ResourceRequirements `json:"resources,omitempty"`
+	Tolerations        []corev1.Toleration         `json:"tolerations,omitempty"`
+	PodAnnotations     map[string]string           `json:"podAnnotations,omitempty"`
+	PodLabels          map[string]string           `json:"podLabels,omitempty"`
+	Labels             map[string]string           `json:"labels,omitempty"`
+	PodSecurityContext *corev1.PodSecurityContext  `json:"podSecurityContext,omitempty"`
+	SecurityContext    *corev1.SecurityContext     `json:"securityContext,omitempty"`
+
+	PodDNSSpec `json:",inline"`
+
+	// Additional command-line arguments of the Prometheus container.
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+	// Lifecycle hooks of the Prometheus container.
+	Lifecycle *corev1.Lifecycle `json:"lifecycle,omitempty"`
+
+	// Retention of the metrics (2d by default).
+	Retention Duration `json:"retention,omitempty"`
+	// Number of Prometheus replicas (1 by default). 2 replicas form an active/standby pair: Coroot writes to the first (active) replica,
+	// which forwards all the metrics to the second (standby) one, and Coroot queries both through promxy, which merges their data.
+	// The history and the queries survive the loss of either replica, but ingestion pauses while the active one is unavailable.
+	// The replicas are spread across the nodes by default and are covered by a PodDisruptionBudget.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=2
+	Replicas int `json:"replicas,omitempty"`
+	// YAML list of Prometheus scrape configs for exporters that aren't discovered by the agents
+	// (e.g., static or DNS-based targets), see https://prometheus.io/docs/prometheus/latest/configuration/configuration/#scrape_config.
+	ScrapeConfigs string `json:"scrapeConfigs,omitempty"`
+	// YAML list of relabeling rules applied to all the stored metrics, e.g., to drop high-cardinality labels.
+	// They are appended to the metric_relabel_configs of the scrape configs, and applied to the metrics written by Coroot
+	// by a vmagent sidecar, since Prometheus doesn't relabel the metrics received through remote write.
+	MetricRelabelConfigs string `json:"metricRelabelConfigs,omitempty"`
+	// YAML list of recording rule groups, see https://prometheus.io/docs/prometheus/latest/configuration/recording_rules/.
+	RecordingRules string `json:"recordingRules,omitempty"`
+	// ConfigMap key containing a Prometheus rule file, in addition to the recordingRules.
+	// Prometheus is reloaded by a sidecar once the kubelet updates the mounted file.
+	RecordingRulesConfigMap *corev1.ConfigMapKeySelector `json:"recordingRulesConfigMap,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=prometheus;victoriametrics
+type MetricsEngine string
+
+const (
+	MetricsEnginePrometheus      MetricsEngine = "prometheus"
+	MetricsEngineVictoriaMetrics MetricsEngine = "victoriametrics"
+)
+
+type VictoriaMetricsSpec struct {
+	Affinity           *corev1.Affinity            `json:"affinity,omitempty"`
+	Architectures      []Architecture              `json:"architectures,omitempty"`
+	PriorityClassName  string                      `json:"priorityClassName,omitempty"`
+	SchedulerName      string                      `json:"schedulerName,omitempty"`
+	RuntimeClassName   *string                     `json:"runtimeClassName,omitempty"`
+	Storage            StorageSpec                 `json:"storage,omitempty"`
+	Resources          corev1.ResourceRequirements `json:"resources,omitempty"`
+	Tolerations        []corev1.Toleration         `json:"tolerations,omitempty"`
+	PodAnnotations     map[string]string           `json:"podAnnotations,omitempty"`
+	PodLabels          map[string]string           `json:"podLabels,omitempty"`
+	Labels             map[string]string           `json:"labels,omitempty"`
+	PodSecurityContext *corev1.PodSecurityContext  `json:"podSecurityContext,omitempty"`
+	SecurityContext    *corev1.SecurityContext     `json:"securityContext,omitempty"`
+
+	PodDNSSpec `json:",inline"`
+
+	// Additional command-line arguments of the VictoriaMetrics container.
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+	// Lifecycle hooks of the VictoriaMetrics container.
+	Lifecycle *corev1.Lifecycle `json:"lifecycle,omitempty"`
+
+	// Retention of the metrics (2d by default).
+	Retention Duration `json:"retention,omitempty"`
+
+	// URL of an existing VictoriaMetrics (e.g., http://vmsingle:8428, or the vmselect URL of a cluster
+	// like http://vmselect:8481/select/0/prometheus). If set, vmsingle is not deployed.
+	URL string `json:"url,omitempty"`
+	// Remote write URL of the existing VictoriaMetrics if it differs from the url
+	// (e.g., http://vminsert:8480/insert/0/prometheus/api/v1/write).
+	RemoteWriteURL string `json:"remoteWriteURL,omitempty"`
 }
 
 type ClickhouseSpec struct {
 	Shards   int `json:"shards,omitempty"`
 	Replicas int `json:"replicas,omitempty"`
 
-	Affinity       *corev1.Affinity            `json:"affinity,omitempty"`
-	Storage        StorageSpec                 `json:"storage,omitempty"`
-	Resources      corev1.ResourceRequirements `json:"resources,omitempty"`
-	Tolerations    []corev1.Toleration         `json:"tolerations,omitempty"`
-	PodAnnotations map[string]string           `json:"podAnnotations,omitempty"`
+	Affinity              *corev1.Affinity            `json:"affinity,omitempty"`
+	Architectures         []Architecture              `json:"architectures,omitempty"`
+	PodAntiAffinityPreset PodAntiAffinityPreset       `json:"podAntiAffinityPreset,omitempty"`
+	PriorityClassName     string                      `json:"priorityClassName,omitempty"`
+	SchedulerName         string                      `json:"schedulerName,omitempty"`
+	RuntimeClassName      *string                     `json:"runtimeClassName,omitempty"`
+	ServiceAccount        ServiceAccountSpec          `json:"serviceAccount,omitempty"`
+	Storage               StorageSpec                 `json:"storage,omitempty"`
+	Resources             corev1.ResourceRequirements `json:"resources,omitempty"`
+	Tolerations           []corev1.Toleration         `json:"tolerations,omitempty"`
+	PodAnnotations        map[string]string           `json:"podAnnotations,omitempty"`
+	PodLabels             map[string]string           `json:"podLabels,omitempty"`
+	Labels                map[string]string           `json:"labels,omitempty"`
+	PodSecurityContext    *corev1.PodSecurityContext  `json:"podSecurityContext,omitempty"`
+	SecurityContext       *corev1.SecurityContext     `json:"securityContext,omitempty"`
+
+	PodDNSSpec `json:",inline"`
+
+	// Additional command-line arguments of the ClickHouse container.
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+	// Lifecycle hooks of the ClickHouse container, replacing the default preStop hook.
+	Lifecycle *corev1.Lifecycle `json:"lifecycle,omitempty"`
+	// Time ClickHouse is given to flush the buffered data and finish the merges before it's killed (120 by default).
+	// +kubebuilder:validation:Minimum=0
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+	// OrderedReady (default) starts the replicas of each shard one by one. Parallel starts them at once,
+	// which cuts the recovery time after a full outage. Changing it recreates the StatefulSets without restarting the pods.
+	// +kubebuilder:validation:Enum=OrderedReady;Parallel
+	PodManagementPolicy appsv1.PodManagementPolicyType `json:"podManagementPolicy,omitempty"`
+	// Time a new pod must be ready for before it's considered available, slowing down the rolling updates.
+	// +kubebuilder:validation:Minimum=0
+	MinReadySeconds int32 `json:"minReadySeconds,omitempty"`
+
+	// Exposes ClickHouse outside the cluster through an additional Service (e.g., for BI tools).
+	Service *ClickhouseServiceSpec `json:"service,omitempty"`
+
+	// Level of the ClickHouse server logs (information by default).
+	// +kubebuilder:validation:Enum=fatal;critical;error;warning;notice;information;debug;trace
+	LogLevel string `json:"logLevel,omitempty"`
+	// The system.* log tables to enable and their retention. No system log tables are enabled if not set.
+	SystemLogs *ClickhouseSystemLogsSpec `json:"systemLogs,omitempty"`
+
+	// Extra ClickHouse users, e.g., for read-only analytics access without sharing the default user's password.
+	AdditionalUsers []ClickhouseUserSpec `json:"additionalUsers,omitempty"`
+
+	// Makes the operator verify the tables created by Coroot and report the drift in the status.
+	Schema *ClickhouseSchemaSpec `json:"schema,omitempty"`
+
+	// How the shards removed by reducing the number of shards are drained before their StatefulSets are deleted.
+	ScaleDown *ClickhouseScaleDownSpec `json:"scaleDown,omitempty"`
+
+	// Raw XML (a complete <clickhouse> document) merged on top of the generated config, e.g., to tune settings not exposed by the operator.
+	ExtraConfig string `json:"extraConfig,omitempty"`
 
 	Keeper ClickhouseKeeperSpec `json:"keeper,omitempty"`
 }
 
+// +kubebuilder:validation:Enum=Retain;Delete
+type ClickhouseShardReclaimPolicy string
+
+const (
+	ClickhouseShardReclaimPolicyRetain ClickhouseShardReclaimPolicy = "Retain"
+	ClickhouseShardReclaimPolicyDelete ClickhouseShardReclaimPolicy = "Delete"
+)
+
+type ClickhouseScaleDownSpec struct {
+	// Re-inserts the data of the removed shards into the remaining ones through the Distributed tables.
+	MigrateData bool `json:"migrateData,omitempty"`
+	// Retain (default) keeps the PVCs of the removed shards, so they can be added back with their data.
+	// Delete drops their tables, which also removes the replication metadata from Keeper, and deletes the PVCs.
+	ReclaimPolicy ClickhouseShardReclaimPolicy `json:"reclaimPolicy,omitempty"`
+}
+
+type ClickhouseUserSpec struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[a-zA-Z_][a-zA-Z0-9_]*$`
+	Name string `json:"name"`
+	// +kubebuilder:validation:Required
+	PasswordSecret *corev1.SecretKeySelector `json:"passwordSecret"`
+	// Allows only read queries.
+	Readonly bool `json:"readonly,omitempty"`
+	// Limits the resources the user can consume per interval.
+	Quota *ClickhouseQuotaSpec `json:"quota,omitempty"`
+}
+
+type ClickhouseQuotaSpec struct {
+	// Interval the limits are applied to (1h by default).
+	Interval      Duration `json:"interval,omitempty"`
+	Queries       int64    `json:"queries,omitempty"`
+	Errors        int64    `json:"errors,omitempty"`
+	ResultRows    int64    `json:"resultRows,omitempty"`
+	ReadRows      int64    `json:"readRows,omitempty"`
+	ExecutionTime Duration `json:"executionTime,omitempty"`
+}
+
+type ClickhouseSystemLogsSpec struct {
+	// TTL of the enabled system log tables (rounded up to days). They are kept forever if not set.
+	TTL Duration `json:"ttl,omitempty"`
+	// System log tables to enable. The operator generates the main ClickHouse config, so the other tables are disabled.
+	Enabled []ClickhouseSystemLogTable `json:"enabled,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=query_log;query_thread_log;query_views_log;part_log;trace_log;metric_log;asynchronous_metric_log;processors_profile_log;asynchronous_insert_log;error_log
+type ClickhouseSystemLogTable string
+
+type ClickhouseSchemaSpec struct {
+	// Expected TTL of the telemetry tables (defaults to 7 days, the retention used by Coroot).
+	Retention Duration `json:"retention,omitempty"`
+	// Alters the tables with a different TTL instead of only reporting them.
+	Enforce bool `json:"enforce,omitempty"`
+	// Default compression of the data parts.
+	Compression *ClickhouseCompressionSpec `json:"compression,omitempty"`
+}
+
+type ClickhouseCompressionSpec struct {
+	// +kubebuilder:validation:Enum=lz4;zstd
+	Method string `json:"method"`
+	// Compression level (zstd only).
+	Level int `json:"level,omitempty"`
+}
+
 type ClickhouseKeeperSpec struct {
-	Affinity       *corev1.Affinity            `json:"affinity,omitempty"`
-	Storage        StorageSpec                 `json:"storage,omitempty"`
-	Resources      corev1.ResourceRequirements `json:"resources,omitempty"`
-	Tolerations    []corev1.Toleration         `json:"tolerations,omitempty"`
-	PodAnnotations map[string]string           `json:"podAnnotations,omitempty"`
+	Affinity              *corev1.Affinity            `json:"affinity,omitempty"`
+	Architectures         []Architecture              `json:"architectures,omitempty"`
+	PodAntiAffinityPreset PodAntiAffinityPreset       `json:"podAntiAffinityPreset,omitempty"`
+	PriorityClassName     string                      `json:"priorityClassName,omitempty"`
+	SchedulerName         string                      `json:"schedulerName,omitempty"`
+	RuntimeClassName      *string                     `json:"runtimeClassName,omitempty"`
+	ServiceAccount        ServiceAccountSpec          `json:"serviceAccount,omitempty"`
+	Storage               StorageSpec                 `json:"storage,omitempty"`
+	Resources             corev1.ResourceRequirements `json:"resources,omitempty"`
+	Tolerations           []corev1.Toleration         `json:"tolerations,omitempty"`
+	PodAnnotations        map[string]string           `json:"podAnnotations,omitempty"`
+	PodLabels             map[string]string           `json:"podLabels,omitempty"`
+	Labels                map[string]string           `json:"labels,omitempty"`
+	PodSecurityContext    *corev1.PodSecurityContext  `json:"podSecurityContext,omitempty"`
+	SecurityContext       *corev1.SecurityContext     `json:"securityContext,omitempty"`
+
+	PodDNSSpec `json:",inline"`
+
+	// Additional command-line arguments of the Keeper container.
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+	// Lifecycle hooks of the Keeper container.
+	Lifecycle *corev1.Lifecycle `json:"lifecycle,omitempty"`
+	// Time Keeper is given to persist its state before it's killed (60 by default).
+	// +kubebuilder:validation:Minimum=0
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+	// OrderedReady (default) starts the members one by one. Parallel starts them at once, so the quorum is restored sooner
+	// after a full outage. Changing it recreates the StatefulSet without restarting the pods.
+	// +kubebuilder:validation:Enum=OrderedReady;Parallel
+	PodManagementPolicy appsv1.PodManagementPolicyType `json:"podManagementPolicy,omitempty"`
+	// Time a new pod must be ready for before it's considered available, slowing down the rolling updates.
+	// +kubebuilder:validation:Minimum=0
+	MinReadySeconds int32 `json:"minReadySeconds,omitempty"`
+	// Forces the most up-to-date member to recover the ensemble if the quorum has been lost for a while
+	// (e.g., after a member has lost its PVC), and restarts the other members so they resync from it.
+	AutoRecovery bool `json:"autoRecovery,omitempty"`
+	// Raw XML (a complete <clickhouse> document) merged on top of the generated Keeper config.
+	ExtraConfig string `json:"extraConfig,omitempty"`
 }
 
 type ExternalClickhouseSpec struct {
@@ -95,6 +536,23 @@ type ExternalClickhouseSpec struct {
 	Database       string                    `json:"database,omitempty"`
 	Password       string                    `json:"password,omitempty"`
 	PasswordSecret *corev1.SecretKeySelector `json:"passwordSecret,omitempty"`
+
+	// Addresses of other replicas of the same cluster to fail over to. The operator checks the addresses periodically
+	// and points Coroot to the first healthy one, preferring the address and then the addresses with higher weights.
+	Addresses []ExternalClickhouseAddress `json:"addresses,omitempty"`
+
+	// Connects over TLS, e.g., to ClickHouse Cloud (port 9440) or through a TLS-terminating proxy.
+	Secure bool `json:"secure,omitempty"`
+	// Skips the verification of the server certificate.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// Secret containing the PEM-encoded CA certificate the server certificate is verified with, in addition to the system ones.
+	CASecret *corev1.SecretKeySelector `json:"caSecret,omitempty"`
+}
+
+type ExternalClickhouseAddress struct {
+	Address string `json:"address"`
+	// Preference of the address, addresses with equal weights are tried in the listed order.
+	Weight int32 `json:"weight,omitempty"`
 }
 
 type PostgresSpec struct {
@@ -112,6 +570,136 @@ type IngressSpec struct {
 	Host      string                   `json:"host,omitempty"`
 	Path      string                   `json:"path,omitempty"`
 	TLS       *networkingv1.IngressTLS `json:"tls,omitempty"`
+
+	// Generates a separate Ingress exposing only the OTLP ingestion endpoints (/v1/traces, /v1/logs, /v1/metrics).
+	// If only telemetry is configured, the Ingress for the UI is not created.
+	Telemetry *TelemetryIngressSpec `json:"telemetry,omitempty"`
+}
+
+type TelemetryIngressSpec struct {
+	ClassName   *string                  `json:"className,omitempty"`
+	Host        string                   `json:"host,omitempty"`
+	TLS         *networkingv1.IngressTLS `json:"tls,omitempty"`
+	Annotations map[string]string        `json:"annotations,omitempty"`
+}
+
+type GatewayParentRef struct {
+	// +kubebuilder:validation:Required
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// The listener of the Gateway, e.g., the HTTPS one terminating TLS.
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+type GatewaySpec struct {
+	ParentRef GatewayParentRef `json:"parentRef,omitempty"`
+	Hostnames []string         `json:"hostnames,omitempty"`
+	// Generates a separate HTTPRoute exposing only the OTLP ingestion endpoints (/v1/traces, /v1/logs, /v1/metrics) on these hostnames.
+	TelemetryHostnames []string `json:"telemetryHostnames,omitempty"`
+}
+
+type ServiceAccountSpec struct {
+	// Annotations of the ServiceAccount, e.g., eks.amazonaws.com/role-arn for AWS IRSA
+	// or iam.gke.io/gcp-service-account for GCP Workload Identity.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Name of a pre-existing ServiceAccount to use instead of the one managed by the operator.
+	// It must be labeled app.kubernetes.io/managed-by=coroot-operator, otherwise no roles or SCCs are bound to it.
+	Name string `json:"name,omitempty"`
+}
+
+type ServiceMeshSpec struct {
+	// Makes the application containers start only after the Istio sidecar is ready.
+	HoldApplicationUntilProxyStarts bool `json:"holdApplicationUntilProxyStarts,omitempty"`
+	// Generates a PeerAuthentication with the specified mTLS mode for the Coroot pods.
+	// +kubebuilder:validation:Enum=STRICT;PERMISSIVE;DISABLE
+	PeerAuthenticationMode string `json:"peerAuthenticationMode,omitempty"`
+	// Generates DestinationRules enabling Istio mutual TLS for the Coroot and Prometheus services.
+	DestinationRules bool `json:"destinationRules,omitempty"`
+}
+
+type ProxySpec struct {
+	// Proxy for HTTP requests, e.g., http://proxy.example.com:3128.
+	HTTPProxy string `json:"httpProxy,omitempty"`
+	// Proxy for HTTPS requests.
+	HTTPSProxy string `json:"httpsProxy,omitempty"`
+	// Comma-separated hosts, domains and CIDRs to reach directly.
+	// The cluster-internal addresses (the Coroot namespace, .svc, the cluster domain and the Kubernetes API) are always included.
+	NoProxy string `json:"noProxy,omitempty"`
+}
+
+// CustomCASpec references PEM-encoded CA certificates. The Secret takes precedence over the ConfigMap.
+type CustomCASpec struct {
+	Secret *corev1.SecretKeySelector `json:"secret,omitempty"`
+	// E.g., a bundle distributed by cert-manager's trust-manager.
+	ConfigMap *corev1.ConfigMapKeySelector `json:"configMap,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=Revert;Report
+type DriftPolicy string
+
+const (
+	DriftPolicyRevert DriftPolicy = "Revert"
+	DriftPolicyReport DriftPolicy = "Report"
+)
+
+type DriftDetectionSpec struct {
+	// How often the child resources are checked, in addition to the reconciliations triggered by their changes (defaults to 5m).
+	Interval Duration `json:"interval,omitempty"`
+	// Revert (default) restores the changed fields, Report keeps them until the desired values change.
+	Policy DriftPolicy `json:"policy,omitempty"`
+}
+
+type ImageDigestsSpec struct {
+	// Verifies the cosign signatures of the images. Workloads with images that aren't signed with the key aren't applied.
+	Cosign *CosignSpec `json:"cosign,omitempty"`
+}
+
+type CosignSpec struct {
+	// PEM-encoded public key (cosign.pub) the images must be signed with: ECDSA, RSA or Ed25519.
+	PublicKey string `json:"publicKey,omitempty"`
+	// Secret containing the public key, takes precedence over publicKey.
+	PublicKeySecret *corev1.SecretKeySelector `json:"publicKeySecret,omitempty"`
+	// Prefixes of the images to verify, e.g., ghcr.io/coroot/ (all the images if empty).
+	Images []string `json:"images,omitempty"`
+}
+
+type GitOpsSpec struct {
+	// Maintains the <name>-inventory ConfigMap listing the child resources with the hashes of their desired state
+	// and their generations, so drift can be detected without comparing the resources themselves.
+	Inventory bool `json:"inventory,omitempty"`
+	// Annotates the child resources so that Argo CD and Flux neither report them as out of sync nor prune them
+	// if they carry the tracking labels of the Coroot resource (e.g., through commonLabels).
+	IgnoreChildren bool `json:"ignoreChildren,omitempty"`
+}
+
+type PodMonitorSpec struct {
+	// Extra labels of the PodMonitors, e.g., the one the Prometheus Operator uses to select monitors (release: kube-prometheus-stack).
+	Labels   map[string]string `json:"labels,omitempty"`
+	Interval Duration          `json:"interval,omitempty"`
+}
+
+// VPAMode is the update mode of a VerticalPodAutoscaler: off only computes the recommendations,
+// initial applies them when pods are created, auto also evicts running pods to apply them.
+// +kubebuilder:validation:Enum=off;initial;auto
+type VPAMode string
+
+const (
+	VPAModeOff     VPAMode = "off"
+	VPAModeInitial VPAMode = "initial"
+	VPAModeAuto    VPAMode = "auto"
+)
+
+// VerticalPodAutoscalerSpec defines the components VerticalPodAutoscalers are generated for (none if the mode is not set).
+type VerticalPodAutoscalerSpec struct {
+	Coroot       VPAMode `json:"coroot,omitempty"`
+	Prometheus   VPAMode `json:"prometheus,omitempty"`
+	ClusterAgent VPAMode `json:"clusterAgent,omitempty"`
+	NodeAgent    VPAMode `json:"nodeAgent,omitempty"`
+}
+
+type GrafanaDatasourcesSpec struct {
+	// Extra labels of the Secret with the datasources. The grafana_datasource: "1" label watched by the Grafana Helm chart sidecar is always set.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type ProjectSpec struct {
@@ -122,37 +710,145 @@ type ProjectSpec struct {
 	ApiKeys []ApiKeySpec `json:"apiKeys,omitempty"`
 }
 
-type ApiKeySpec struct {
+type HibernationSpec struct {
+	// Keeps the workloads scaled to zero regardless of the schedule.
+	Enabled bool `json:"enabled,omitempty"`
+	// Scales the workloads to zero and back on a schedule.
+	Schedule *HibernationScheduleSpec `json:"schedule,omitempty"`
+}
+
+type HibernationScheduleSpec struct {
+	// Cron expression of the moments to scale the workloads to zero, e.g., "0 20 * * 1-5".
+	// +kubebuilder:validation:Required
+	Sleep string `json:"sleep"`
+	// Cron expression of the moments to scale the workloads back, e.g., "0 8 * * 1-5".
 	// +kubebuilder:validation:Required
-	Key         string `json:"key,omitempty"`
-	Description string `json:"description,omitempty"`
+	WakeUp string `json:"wakeUp"`
+	// Timezone of the cron expressions (UTC by default).
+	Timezone string `json:"timezone,omitempty"`
+}
+
+type SnapshotsSpec struct {
+	// Cron expression of the moments to take a snapshot set, e.g., "0 3 * * *".
+	// Snapshots can also be taken on demand with the coroot.com/snapshot annotation.
+	Schedule string `json:"schedule,omitempty"`
+	// Timezone of the cron expression (UTC by default).
+	Timezone string `json:"timezone,omitempty"`
+	// VolumeSnapshotClass of the snapshots (the default class if empty).
+	ClassName *string `json:"className,omitempty"`
+	// Number of the snapshot sets to keep (7 by default). The newest ready set is kept even if the newer sets are still pending.
+	// +kubebuilder:validation:Minimum=1
+	Retain int `json:"retain,omitempty"`
+	// Name of a snapshot set the new Coroot, ClickHouse and Keeper PVCs are populated from,
+	// e.g., to bootstrap a new installation with the same name and namespace. Existing PVCs aren't affected.
+	RestoreFrom string `json:"restoreFrom,omitempty"`
+}
+
+type ApiKeySpec struct {
+	// Either key or keySecret must be specified.
+	Key string `json:"key,omitempty"`
+	// Secret containing the key, takes precedence over key.
+	KeySecret   *corev1.SecretKeySelector `json:"keySecret,omitempty"`
+	Description string                    `json:"description,omitempty"`
 }
 
 type CorootSpec struct {
-	MetricsRefreshInterval     metav1.Duration `json:"metricsRefreshInterval,omitempty"`
-	CacheTTL                   metav1.Duration `json:"cacheTTL,omitempty"`
+	// Stops the operator from mutating child resources (status is still updated).
+	// The same can be achieved with the coroot.com/paused: "true" annotation.
+	Paused bool `json:"paused,omitempty"`
+	// Use Role/RoleBinding instead of cluster-scoped RBAC resources.
+	// The cluster-agent discovers only the objects of the Coroot namespace in this mode.
+	NamespaceScoped bool `json:"namespaceScoped,omitempty"`
+	// Labels and annotations added to every object created by the operator, e.g., for Velero backup selectors or ownership tagging.
+	// They don't override the labels and annotations set by the operator itself, and are removed from the objects once removed from here.
+	CommonLabels      map[string]string `json:"commonLabels,omitempty"`
+	CommonAnnotations map[string]string `json:"commonAnnotations,omitempty"`
+	// Integration with GitOps tools, such as Argo CD and Flux.
+	GitOps *GitOpsSpec `json:"gitOps,omitempty"`
+	// Periodically checks the Deployments, StatefulSets and DaemonSets for manual changes and reports them in status.drift.
+	DriftDetection *DriftDetectionSpec `json:"driftDetection,omitempty"`
+	// Namespaces CorootTenants referencing this Coroot are accepted from, in addition to its own namespace.
+	TenantNamespaceSelector *metav1.LabelSelector `json:"tenantNamespaceSelector,omitempty"`
+	// Defaults for the resources, replica counts and retention of the components depending on the cluster size.
+	// Values set for a component take precedence.
+	SizeProfile SizeProfile `json:"sizeProfile,omitempty"`
+	// Secrets used to pull the images of all the components, e.g., from a private registry or a mirror.
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// Pull policy of the images of all the containers (the Kubernetes default if empty).
+	// +kubebuilder:validation:Enum=Always;IfNotPresent;Never
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+	// Resolves the image tags to digests before the workloads are applied, so the pods run exactly the verified images
+	// and policy engines requiring digests (e.g., Kyverno verifyImages) admit them.
+	// The registries are queried in the background, and the workloads are applied once the digests are resolved.
+	ImageDigests *ImageDigestsSpec `json:"imageDigests,omitempty"`
+	// Maintains the <name>-images ConfigMap listing the images and versions of the deployed containers,
+	// so compliance tooling can inventory the stack without inspecting the workloads.
+	ImagesReport bool `json:"imagesReport,omitempty"`
+	// Scales Coroot, ClickHouse, Keeper and Prometheus to zero while retaining their PVCs, e.g., out of business hours.
+	Hibernation *HibernationSpec `json:"hibernation,omitempty"`
+	// Takes VolumeSnapshots of the Coroot, ClickHouse and Keeper PVCs if the snapshot.storage.k8s.io CRDs are installed.
+	// The snapshots aren't owned by the Coroot resource, so they outlive it.
+	Snapshots *SnapshotsSpec `json:"snapshots,omitempty"`
+
+	MetricsRefreshInterval     Duration        `json:"metricsRefreshInterval,omitempty"`
+	CacheTTL                   Duration        `json:"cacheTTL,omitempty"`
 	AuthAnonymousRole          string          `json:"authAnonymousRole,omitempty"`
 	AuthBootstrapAdminPassword string          `json:"authBootstrapAdminPassword,omitempty"`
 	Projects                   []ProjectSpec   `json:"projects,omitempty"`
 	Env                        []corev1.EnvVar `json:"env,omitempty"`
+	// Secret containing the bootstrap admin password, takes precedence over authBootstrapAdminPassword.
+	// If neither is set, the password is generated and stored in the <name>-coroot-admin Secret.
+	AuthBootstrapAdminPasswordSecret *corev1.SecretKeySelector `json:"authBootstrapAdminPasswordSecret,omitempty"`
 
 	CommunityEdition  CommunityEditionSpec   `json:"communityEdition,omitempty"`
 	EnterpriseEdition *EnterpriseEditionSpec `json:"enterpriseEdition,omitempty"`
 	AgentsOnly        *AgentsOnlySpec        `json:"agentsOnly,omitempty"`
 
-	Replicas       int                         `json:"replicas,omitempty"`
-	Service        ServiceSpec                 `json:"service,omitempty"`
-	Affinity       *corev1.Affinity            `json:"affinity,omitempty"`
-	Storage        StorageSpec                 `json:"storage,omitempty"`
-	Resources      corev1.ResourceRequirements `json:"resources,omitempty"`
-	Tolerations    []corev1.Toleration         `json:"tolerations,omitempty"`
-	PodAnnotations map[string]string           `json:"podAnnotations,omitempty"`
+	Replicas              int                         `json:"replicas,omitempty"`
+	UpdateStrategy        *CorootUpdateStrategySpec   `json:"updateStrategy,omitempty"`
+	Service               ServiceSpec                 `json:"service,omitempty"`
+	Affinity              *corev1.Affinity            `json:"affinity,omitempty"`
+	Architectures         []Architecture              `json:"architectures,omitempty"`
+	PodAntiAffinityPreset PodAntiAffinityPreset       `json:"podAntiAffinityPreset,omitempty"`
+	PriorityClassName     string                      `json:"priorityClassName,omitempty"`
+	SchedulerName         string                      `json:"schedulerName,omitempty"`
+	RuntimeClassName      *string                     `json:"runtimeClassName,omitempty"`
+	ServiceAccount        ServiceAccountSpec          `json:"serviceAccount,omitempty"`
+	Storage               StorageSpec                 `json:"storage,omitempty"`
+	Resources             corev1.ResourceRequirements `json:"resources,omitempty"`
+	Tolerations           []corev1.Toleration         `json:"tolerations,omitempty"`
+	PodAnnotations        map[string]string           `json:"podAnnotations,omitempty"`
+	PodLabels             map[string]string           `json:"podLabels,omitempty"`
+	Labels                map[string]string           `json:"labels,omitempty"`
+	PodSecurityContext    *corev1.PodSecurityContext  `json:"podSecurityContext,omitempty"`
+	SecurityContext       *corev1.SecurityContext     `json:"securityContext,omitempty"`
+
+	PodDNSSpec `json:",inline"`
+
+	// Additional command-line arguments of the Coroot container.
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+	// Lifecycle hooks of the Coroot container.
+	Lifecycle *corev1.Lifecycle `json:"lifecycle,omitempty"`
+
+	// Name of a SecretProviderClass mounted into the Coroot pods through the Secrets Store CSI driver.
+	// Mounting makes the driver sync the Kubernetes Secrets defined in its secretObjects,
+	// so Vault-managed credentials can be referenced by the passwordSecret fields.
+	SecretProviderClass string `json:"secretProviderClass,omitempty"`
+
+	ApiKey string `json:"apiKey,omitempty"`
+	// Secret containing the API key used by the agents, takes precedence over apiKey.
+	ApiKeySecret *corev1.SecretKeySelector `json:"apiKeySecret,omitempty"`
 
-	ApiKey       string           `json:"apiKey,omitempty"`
 	NodeAgent    NodeAgentSpec    `json:"nodeAgent,omitempty"`
 	ClusterAgent ClusterAgentSpec `json:"clusterAgent,omitempty"`
 
+	// Storage of the metrics: the embedded Prometheus (by default) or VictoriaMetrics.
+	MetricsEngine MetricsEngine `json:"metricsEngine,omitempty"`
+
 	Prometheus PrometheusSpec `json:"prometheus,omitempty"`
+	// Settings of VictoriaMetrics used if metricsEngine is victoriametrics.
+	// The Prometheus scrape configs, relabeling and recording rules don't apply to it.
+	VictoriaMetrics VictoriaMetricsSpec `json:"victoriaMetrics,omitempty"`
 
 	Clickhouse         ClickhouseSpec          `json:"clickhouse,omitempty"`
 	ExternalClickhouse *ExternalClickhouseSpec `json:"externalClickhouse,omitempty"`
@@ -160,6 +856,81 @@ type CorootSpec struct {
 	Postgres *PostgresSpec `json:"postgres,omitempty"`
 
 	Ingress *IngressSpec `json:"ingress,omitempty"`
+	// Generates Gateway API HTTPRoutes instead of Ingresses.
+	Gateway *GatewaySpec `json:"gateway,omitempty"`
+	// DNS domain of the cluster used in the fully qualified names of the Services (cluster.local by default).
+	ClusterDomain string `json:"clusterDomain,omitempty"`
+	// Enables compatibility with Istio: the ClickHouse and Keeper ports are excluded from sidecar interception,
+	// since their protocols are not supported by the proxy.
+	ServiceMesh *ServiceMeshSpec `json:"serviceMesh,omitempty"`
+	// Egress proxy used by Coroot, the cluster-agent and the node-agent to reach external endpoints
+	// (e.g., Coroot in the agentsOnly mode, or AI and notification integrations).
+	Proxy *ProxySpec `json:"proxy,omitempty"`
+	// CA certificates trusted by Coroot, the cluster-agent and the node-agent in addition to the system ones,
+	// e.g., for TLS-intercepting proxies or ClickHouse and webhook endpoints with a corporate CA.
+	CustomCA *CustomCASpec `json:"customCA,omitempty"`
+
+	// Generates Prometheus Operator PodMonitors for the Coroot components if the monitoring.coreos.com CRDs are installed.
+	PodMonitor *PodMonitorSpec `json:"podMonitor,omitempty"`
+	// Generates VerticalPodAutoscalers for the components if the autoscaling.k8s.io CRDs are installed.
+	VerticalPodAutoscaler *VerticalPodAutoscalerSpec `json:"verticalPodAutoscaler,omitempty"`
+	// Generates a Secret with Grafana datasources for the Prometheus and ClickHouse used by Coroot.
+	GrafanaDatasources *GrafanaDatasourcesSpec `json:"grafanaDatasources,omitempty"`
+	// Deploys a small demo workload into the Coroot namespace to validate the telemetry pipeline end-to-end.
+	DemoApp *DemoAppSpec `json:"demoApp,omitempty"`
+	// Synthetic checks of HTTP, TCP and ICMP targets run by blackbox exporters and scraped by the embedded Prometheus
+	// (probes aren't run if victoriaMetrics is used).
+	Probes *ProbesSpec `json:"probes,omitempty"`
+}
+
+type ProbesSpec struct {
+	// Regions the probes are run from, each by a blackbox exporter scheduled onto the nodes matching the node selector.
+	// A single default region on any node is used if empty.
+	Regions []ProbeRegionSpec `json:"regions,omitempty"`
+	Targets []ProbeTargetSpec `json:"targets,omitempty"`
+	// Resources of the blackbox exporters.
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	PodDNSSpec `json:",inline"`
+}
+
+type ProbeRegionSpec struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=30
+	Name         string            `json:"name"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=http;tcp;icmp
+type ProbeProtocol string
+
+const (
+	ProbeProtocolHTTP ProbeProtocol = "http"
+	ProbeProtocolTCP  ProbeProtocol = "tcp"
+	ProbeProtocolICMP ProbeProtocol = "icmp"
+)
+
+type ProbeTargetSpec struct {
+	// Name of the probe. Its metrics (e.g., probe_success and probe_duration_seconds) have the job="probe-<name>" label
+	// and the region label, so they can be used in custom dashboards and alerts.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+	// HTTP probes expect a 2xx response, TCP probes only check the connection.
+	// +kubebuilder:validation:Required
+	Protocol ProbeProtocol `json:"protocol"`
+	// URL for HTTP, host:port for TCP, or host for ICMP probes.
+	// +kubebuilder:validation:Required
+	Target string `json:"target"`
+	// How often the target is probed (the metrics refresh interval by default).
+	Interval Duration `json:"interval,omitempty"`
+}
+
+type DemoAppSpec struct {
+	// Deploys the demo-backend (nginx) and demo-load (a curl loop sending requests to it, some failing with 404).
+	// The node-agent reports their traffic to the project of the agents' API key without any instrumentation.
+	Enabled bool `json:"enabled,omitempty"`
 }
 
 type CorootStatus struct { // TODO
@@ -173,10 +944,150 @@ type CorootStatus struct { // TODO
 	// For further information see: https://github.com/kubernetes/community/blob/master/contributors/devel/sig-architecture/api-conventions.md#typical-status-properties
 
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
+
+	// Results of the pre-flight checks of the external dependencies (ClickHouse, Postgres, Coroot).
+	Dependencies []DependencyStatus `json:"dependencies,omitempty"`
+
+	// Address of the external ClickHouse Coroot is pointed to, if several addresses are configured.
+	ExternalClickhouseAddress string `json:"externalClickhouseAddress,omitempty"`
+	// When Coroot was last switched to another ClickHouse address. Failing back is held off for a while after a switch.
+	ExternalClickhouseSwitchedAt *metav1.Time `json:"externalClickhouseSwitchedAt,omitempty"`
+
+	// States of the ClickHouse Keeper members reported by the mntr command.
+	Keeper []KeeperMemberStatus `json:"keeper,omitempty"`
+
+	// Summary of the ClickHouse Keeper ensemble: the current leader and whether the quorum is available.
+	ClickhouseKeeper *ClickhouseKeeperStatus `json:"clickhouseKeeper,omitempty"`
+
+	// ClickHouse tables whose TTL differs from clickhouse.schema.retention.
+	ClickhouseSchema []ClickhouseTableStatus `json:"clickhouseSchema,omitempty"`
+
+	// Shards beyond clickhouse.shards that are being drained before their StatefulSets are deleted.
+	ClickhouseShardDrains []ClickhouseShardDrainStatus `json:"clickhouseShardDrains,omitempty"`
+
+	// Version of Coroot the StatefulSet is rolled out with.
+	Version string `json:"version,omitempty"`
+
+	// Progress of the rollout of the Coroot StatefulSet.
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+
+	// License of the Enterprise Edition as reported by Coroot once it is rolled out.
+	License *LicenseStatus `json:"license,omitempty"`
+
+	// Problems of the component pods, such as unschedulable pods, image pull errors, OOM kills or pending PVCs.
+	ComponentIssues []ComponentIssueStatus `json:"componentIssues,omitempty"`
+
+	// Secret with the bootstrap admin password (the password key) generated when none is configured.
+	AdminPasswordSecret string `json:"adminPasswordSecret,omitempty"`
+
+	// Snapshot sets of the Coroot, ClickHouse and Keeper volumes, from the oldest to the newest.
+	Snapshots []SnapshotSetStatus `json:"snapshots,omitempty"`
+	// Value of the coroot.com/snapshot annotation the last on-demand snapshot set was taken for.
+	LastSnapshotTrigger string `json:"lastSnapshotTrigger,omitempty"`
+
+	// Child resources with fields changed since the operator applied them, if drift detection is enabled.
+	Drift []DriftStatus `json:"drift,omitempty"`
+}
+
+type LicenseStatus struct {
+	Valid     bool         `json:"valid"`
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// Time of the last successful check.
+	CheckedAt *metav1.Time `json:"checkedAt,omitempty"`
+	// Revision of the Coroot StatefulSet the license was checked with, so a new license key is checked once rolled out.
+	Revision string `json:"revision,omitempty"`
+	// Why the license is invalid.
+	Message string `json:"message,omitempty"`
+	// Why the license couldn't be checked, the other fields are kept from the last successful check.
+	Error string `json:"error,omitempty"`
+}
+
+type DriftStatus struct {
+	// Kind/name of the resource.
+	Resource string `json:"resource"`
+	// Paths of the changed fields, e.g., spec.template.spec.containers.
+	Fields []string `json:"fields"`
+	// Whether the fields have been restored (the Revert policy).
+	Reverted bool `json:"reverted"`
+}
+
+type SnapshotSetStatus struct {
+	Name string      `json:"name"`
+	Time metav1.Time `json:"time"`
+	// VolumeSnapshots of the set.
+	VolumeSnapshots []string `json:"volumeSnapshots,omitempty"`
+	// All the VolumeSnapshots are ready to be restored from.
+	ReadyToUse bool `json:"readyToUse"`
+}
+
+type RolloutStatus struct {
+	Replicas        int32  `json:"replicas"`
+	ReadyReplicas   int32  `json:"readyReplicas"`
+	UpdatedReplicas int32  `json:"updatedReplicas"`
+	Revision        string `json:"revision,omitempty"`
+	// Partition applied by the auto canary.
+	Partition *int32 `json:"partition,omitempty"`
+	// Revision rolled out to all the replicas after the canary verification.
+	PromotedRevision string `json:"promotedRevision,omitempty"`
+}
+
+type ComponentIssueStatus struct {
+	Component string `json:"component"`
+	// Unschedulable, PVCPending, ImagePullError, ConfigError, CrashLoopBackOff or OOMKilled.
+	Reason string `json:"reason"`
+	// Number of the pods with the issue.
+	Pods int32 `json:"pods"`
+	// Message of one of the pods.
+	Message string `json:"message,omitempty"`
+}
+
+type DependencyStatus struct {
+	Name          string `json:"name"`
+	Address       string `json:"address,omitempty"`
+	Reachable     bool   `json:"reachable"`
+	Authenticated bool   `json:"authenticated"`
+	Version       string `json:"version,omitempty"`
+	Message       string `json:"message,omitempty"`
+}
+
+type ClickhouseShardDrainStatus struct {
+	Shard int `json:"shard"`
+	// Draining (waiting for the writes to stop), Migrating, Deleting (dropping the tables), or Drained.
+	Phase     string      `json:"phase"`
+	StartedAt metav1.Time `json:"startedAt"`
+	// Rows left in the tables of the shard.
+	Rows uint64 `json:"rows,omitempty"`
+	// Partitions (<table>/<partition id>) that have been migrated and dropped from the shard.
+	MigratedPartitions []string `json:"migratedPartitions,omitempty"`
+	Message            string   `json:"message,omitempty"`
+}
+
+type ClickhouseTableStatus struct {
+	Name string `json:"name"`
+	TTL  string `json:"ttl,omitempty"`
+}
+
+type KeeperMemberStatus struct {
+	Name         string `json:"name"`
+	State        string `json:"state,omitempty"`
+	LastLogIndex uint64 `json:"lastLogIndex,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+type ClickhouseKeeperStatus struct {
+	Leader          string `json:"leader,omitempty"`
+	QuorumAvailable bool   `json:"quorumAvailable"`
+	Members         int32  `json:"members"`
+	ActiveMembers   int32  `json:"activeMembers"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.conditions[?(@.type=="Reconciled")].reason`
+// +kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.status.version`
+// +kubebuilder:printcolumn:name="ClickHouse-Shards",type=integer,JSONPath=`.spec.clickhouse.shards`
+// +kubebuilder:printcolumn:name="ClickHouse-Replicas",type=integer,JSONPath=`.spec.clickhouse.replicas`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 type Coroot struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -194,6 +1105,10 @@ type CorootList struct {
 	Items           []Coroot `json:"items"`
 }
 
+func (c *Coroot) IsPaused() bool {
+	return c.Spec.Paused || c.Annotations[PausedAnnotation] == "true"
+}
+
 func init() {
 	SchemeBuilder.Register(&Coroot{}, &CorootList{})
 }
@@ -0,0 +1,69 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CorootTenantSpec declares a project of a Coroot instance, so teams can get their projects without editing the Coroot resource.
+type CorootTenantSpec struct {
+	// Name of the Coroot the project is added to.
+	// +kubebuilder:validation:Required
+	Coroot string `json:"coroot"`
+	// Namespace of the Coroot, the namespace of the tenant by default.
+	// Tenants from other namespaces are accepted only if the Coroot's tenantNamespaceSelector matches their namespace.
+	CorootNamespace string `json:"corootNamespace,omitempty"`
+	// Name of the project, the name of the tenant by default.
+	Project string `json:"project,omitempty"`
+	// API keys of the project. The keySecrets are looked up in the namespace of the tenant.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	ApiKeys []ApiKeySpec `json:"apiKeys"`
+}
+
+type CorootTenantStatus struct {
+	// The Accepted condition reports whether the project has been added to the Coroot.
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
+	// Name of the project in Coroot.
+	Project string `json:"project,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Coroot",type=string,JSONPath=`.spec.coroot`
+// +kubebuilder:printcolumn:name="Project",type=string,JSONPath=`.status.project`
+// +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.conditions[?(@.type=="Accepted")].reason`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+type CorootTenant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CorootTenantSpec   `json:"spec,omitempty"`
+	Status CorootTenantStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+type CorootTenantList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CorootTenant `json:"items"`
+}
+
+func (t *CorootTenant) CorootNamespace() string {
+	if t.Spec.CorootNamespace != "" {
+		return t.Spec.CorootNamespace
+	}
+	return t.Namespace
+}
+
+func (t *CorootTenant) ProjectName() string {
+	if t.Spec.Project != "" {
+		return t.Spec.Project
+	}
+	return t.Name
+}
+
+func init() {
+	SchemeBuilder.Register(&CorootTenant{}, &CorootTenantList{})
+}
@@ -0,0 +1,72 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	durationExtraUnitRe = regexp.MustCompile(`([0-9]*\.?[0-9]+)([dwy])`)
+	durationExtraUnits  = map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+		"y": 365 * 24 * time.Hour,
+	}
+)
+
+// Duration is a metav1.Duration that also accepts the d, w and y units of Prometheus durations, e.g., 2d or 1w12h.
+// +kubebuilder:validation:Type=string
+// +kubebuilder:validation:Pattern=`^(0|([0-9]*\.?[0-9]+(ns|us|µs|ms|s|m|h|d|w|y))+)$`
+type Duration struct {
+	time.Duration `json:"-"`
+}
+
+// ParseDuration parses a Go duration string, extended with the d (24h), w (7d) and y (365d) units.
+func ParseDuration(s string) (time.Duration, error) {
+	var err error
+	expanded := durationExtraUnitRe.ReplaceAllStringFunc(s, func(m string) string {
+		parts := durationExtraUnitRe.FindStringSubmatch(m)
+		v, e := strconv.ParseFloat(parts[1], 64)
+		if e != nil {
+			err = e
+			return m
+		}
+		ns := v * float64(durationExtraUnits[parts[2]])
+		// Converting a float64 beyond the int64 range to int64 doesn't fail, but yields an arbitrary value.
+		if ns >= math.MaxInt64 {
+			err = fmt.Errorf("%s is out of range", m)
+			return m
+		}
+		return fmt.Sprintf("%dns", int64(ns))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %w", s, err)
+	}
+	d, err := time.ParseDuration(expanded)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	pd, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = pd
+	return nil
+}
+
+// MarshalJSON encodes the duration in the Go format (e.g., 48h0m0s), which is understood by Coroot and the other components.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
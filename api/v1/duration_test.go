@@ -0,0 +1,57 @@
+package v1
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		expected time.Duration
+		err      bool
+	}{
+		{s: "0", expected: 0},
+		{s: "15s", expected: 15 * time.Second},
+		{s: "1h30m", expected: 90 * time.Minute},
+		{s: "2d", expected: 48 * time.Hour},
+		{s: "1.5d", expected: 36 * time.Hour},
+		{s: "1w12h", expected: 180 * time.Hour},
+		{s: "1y", expected: 365 * 24 * time.Hour},
+		{s: "292y", expected: 292 * 365 * 24 * time.Hour},
+		{s: "293y", err: true},
+		{s: "100000000000000000000y", err: true},
+		{s: "200y200y", err: true},
+		{s: "", err: true},
+		{s: "2", err: true},
+		{s: "2x", err: true},
+		{s: "d", err: true},
+	} {
+		d, err := ParseDuration(c.s)
+		switch {
+		case c.err && err == nil:
+			t.Errorf("%q: expected an error, got %s", c.s, d)
+		case !c.err && err != nil:
+			t.Errorf("%q: unexpected error: %s", c.s, err)
+		case !c.err && d != c.expected:
+			t.Errorf("%q: expected %s, got %s", c.s, c.expected, d)
+		}
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	var d Duration
+	if err := d.UnmarshalJSON([]byte(`"1w"`)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := d.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `"168h0m0s"` {
+		t.Errorf("unexpected JSON: %s", data)
+	}
+	if err = d.UnmarshalJSON([]byte(`"1000y"`)); err == nil {
+		t.Error("expected an error for an out of range duration")
+	}
+}
@@ -5,8 +5,10 @@
 package v1
 
 import (
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
@@ -29,6 +31,11 @@ func (in *AgentsOnlySpec) DeepCopy() *AgentsOnlySpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ApiKeySpec) DeepCopyInto(out *ApiKeySpec) {
 	*out = *in
+	if in.KeySecret != nil {
+		in, out := &in.KeySecret, &out.KeySecret
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ApiKeySpec.
@@ -41,6 +48,21 @@ func (in *ApiKeySpec) DeepCopy() *ApiKeySpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickhouseCompressionSpec) DeepCopyInto(out *ClickhouseCompressionSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseCompressionSpec.
+func (in *ClickhouseCompressionSpec) DeepCopy() *ClickhouseCompressionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickhouseCompressionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClickhouseKeeperSpec) DeepCopyInto(out *ClickhouseKeeperSpec) {
 	*out = *in
@@ -49,6 +71,17 @@ func (in *ClickhouseKeeperSpec) DeepCopyInto(out *ClickhouseKeeperSpec) {
 		*out = new(corev1.Affinity)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Architectures != nil {
+		in, out := &in.Architectures, &out.Architectures
+		*out = make([]Architecture, len(*in))
+		copy(*out, *in)
+	}
+	if in.RuntimeClassName != nil {
+		in, out := &in.RuntimeClassName, &out.RuntimeClassName
+		*out = new(string)
+		**out = **in
+	}
+	in.ServiceAccount.DeepCopyInto(&out.ServiceAccount)
 	in.Storage.DeepCopyInto(&out.Storage)
 	in.Resources.DeepCopyInto(&out.Resources)
 	if in.Tolerations != nil {
@@ -65,6 +98,46 @@ func (in *ClickhouseKeeperSpec) DeepCopyInto(out *ClickhouseKeeperSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.PodLabels != nil {
+		in, out := &in.PodLabels, &out.PodLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PodSecurityContext != nil {
+		in, out := &in.PodSecurityContext, &out.PodSecurityContext
+		*out = new(corev1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(corev1.SecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	in.PodDNSSpec.DeepCopyInto(&out.PodDNSSpec)
+	if in.ExtraArgs != nil {
+		in, out := &in.ExtraArgs, &out.ExtraArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Lifecycle != nil {
+		in, out := &in.Lifecycle, &out.Lifecycle
+		*out = new(corev1.Lifecycle)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TerminationGracePeriodSeconds != nil {
+		in, out := &in.TerminationGracePeriodSeconds, &out.TerminationGracePeriodSeconds
+		*out = new(int64)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseKeeperSpec.
@@ -77,6 +150,122 @@ func (in *ClickhouseKeeperSpec) DeepCopy() *ClickhouseKeeperSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickhouseKeeperStatus) DeepCopyInto(out *ClickhouseKeeperStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseKeeperStatus.
+func (in *ClickhouseKeeperStatus) DeepCopy() *ClickhouseKeeperStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickhouseKeeperStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickhouseQuotaSpec) DeepCopyInto(out *ClickhouseQuotaSpec) {
+	*out = *in
+	out.Interval = in.Interval
+	out.ExecutionTime = in.ExecutionTime
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseQuotaSpec.
+func (in *ClickhouseQuotaSpec) DeepCopy() *ClickhouseQuotaSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickhouseQuotaSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickhouseScaleDownSpec) DeepCopyInto(out *ClickhouseScaleDownSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseScaleDownSpec.
+func (in *ClickhouseScaleDownSpec) DeepCopy() *ClickhouseScaleDownSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickhouseScaleDownSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickhouseSchemaSpec) DeepCopyInto(out *ClickhouseSchemaSpec) {
+	*out = *in
+	out.Retention = in.Retention
+	if in.Compression != nil {
+		in, out := &in.Compression, &out.Compression
+		*out = new(ClickhouseCompressionSpec)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseSchemaSpec.
+func (in *ClickhouseSchemaSpec) DeepCopy() *ClickhouseSchemaSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickhouseSchemaSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickhouseServiceSpec) DeepCopyInto(out *ClickhouseServiceSpec) {
+	*out = *in
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.LoadBalancerSourceRanges != nil {
+		in, out := &in.LoadBalancerSourceRanges, &out.LoadBalancerSourceRanges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseServiceSpec.
+func (in *ClickhouseServiceSpec) DeepCopy() *ClickhouseServiceSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickhouseServiceSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickhouseShardDrainStatus) DeepCopyInto(out *ClickhouseShardDrainStatus) {
+	*out = *in
+	in.StartedAt.DeepCopyInto(&out.StartedAt)
+	if in.MigratedPartitions != nil {
+		in, out := &in.MigratedPartitions, &out.MigratedPartitions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseShardDrainStatus.
+func (in *ClickhouseShardDrainStatus) DeepCopy() *ClickhouseShardDrainStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickhouseShardDrainStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClickhouseSpec) DeepCopyInto(out *ClickhouseSpec) {
 	*out = *in
@@ -85,6 +274,17 @@ func (in *ClickhouseSpec) DeepCopyInto(out *ClickhouseSpec) {
 		*out = new(corev1.Affinity)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Architectures != nil {
+		in, out := &in.Architectures, &out.Architectures
+		*out = make([]Architecture, len(*in))
+		copy(*out, *in)
+	}
+	if in.RuntimeClassName != nil {
+		in, out := &in.RuntimeClassName, &out.RuntimeClassName
+		*out = new(string)
+		**out = **in
+	}
+	in.ServiceAccount.DeepCopyInto(&out.ServiceAccount)
 	in.Storage.DeepCopyInto(&out.Storage)
 	in.Resources.DeepCopyInto(&out.Resources)
 	if in.Tolerations != nil {
@@ -101,6 +301,73 @@ func (in *ClickhouseSpec) DeepCopyInto(out *ClickhouseSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.PodLabels != nil {
+		in, out := &in.PodLabels, &out.PodLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PodSecurityContext != nil {
+		in, out := &in.PodSecurityContext, &out.PodSecurityContext
+		*out = new(corev1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(corev1.SecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	in.PodDNSSpec.DeepCopyInto(&out.PodDNSSpec)
+	if in.ExtraArgs != nil {
+		in, out := &in.ExtraArgs, &out.ExtraArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Lifecycle != nil {
+		in, out := &in.Lifecycle, &out.Lifecycle
+		*out = new(corev1.Lifecycle)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TerminationGracePeriodSeconds != nil {
+		in, out := &in.TerminationGracePeriodSeconds, &out.TerminationGracePeriodSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.Service != nil {
+		in, out := &in.Service, &out.Service
+		*out = new(ClickhouseServiceSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SystemLogs != nil {
+		in, out := &in.SystemLogs, &out.SystemLogs
+		*out = new(ClickhouseSystemLogsSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AdditionalUsers != nil {
+		in, out := &in.AdditionalUsers, &out.AdditionalUsers
+		*out = make([]ClickhouseUserSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Schema != nil {
+		in, out := &in.Schema, &out.Schema
+		*out = new(ClickhouseSchemaSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ScaleDown != nil {
+		in, out := &in.ScaleDown, &out.ScaleDown
+		*out = new(ClickhouseScaleDownSpec)
+		**out = **in
+	}
 	in.Keeper.DeepCopyInto(&out.Keeper)
 }
 
@@ -114,14 +381,103 @@ func (in *ClickhouseSpec) DeepCopy() *ClickhouseSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickhouseSystemLogsSpec) DeepCopyInto(out *ClickhouseSystemLogsSpec) {
+	*out = *in
+	out.TTL = in.TTL
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = make([]ClickhouseSystemLogTable, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseSystemLogsSpec.
+func (in *ClickhouseSystemLogsSpec) DeepCopy() *ClickhouseSystemLogsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickhouseSystemLogsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickhouseTableStatus) DeepCopyInto(out *ClickhouseTableStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseTableStatus.
+func (in *ClickhouseTableStatus) DeepCopy() *ClickhouseTableStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickhouseTableStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClickhouseUserSpec) DeepCopyInto(out *ClickhouseUserSpec) {
+	*out = *in
+	if in.PasswordSecret != nil {
+		in, out := &in.PasswordSecret, &out.PasswordSecret
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Quota != nil {
+		in, out := &in.Quota, &out.Quota
+		*out = new(ClickhouseQuotaSpec)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClickhouseUserSpec.
+func (in *ClickhouseUserSpec) DeepCopy() *ClickhouseUserSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClickhouseUserSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClusterAgentSpec) DeepCopyInto(out *ClusterAgentSpec) {
 	*out = *in
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ExtraRBACRules != nil {
+		in, out := &in.ExtraRBACRules, &out.ExtraRBACRules
+		*out = make([]rbacv1.PolicyRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.Affinity != nil {
 		in, out := &in.Affinity, &out.Affinity
 		*out = new(corev1.Affinity)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Architectures != nil {
+		in, out := &in.Architectures, &out.Architectures
+		*out = make([]Architecture, len(*in))
+		copy(*out, *in)
+	}
+	if in.RuntimeClassName != nil {
+		in, out := &in.RuntimeClassName, &out.RuntimeClassName
+		*out = new(string)
+		**out = **in
+	}
+	in.ServiceAccount.DeepCopyInto(&out.ServiceAccount)
 	in.Resources.DeepCopyInto(&out.Resources)
 	if in.Tolerations != nil {
 		in, out := &in.Tolerations, &out.Tolerations
@@ -137,6 +493,30 @@ func (in *ClusterAgentSpec) DeepCopyInto(out *ClusterAgentSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.PodLabels != nil {
+		in, out := &in.PodLabels, &out.PodLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PodSecurityContext != nil {
+		in, out := &in.PodSecurityContext, &out.PodSecurityContext
+		*out = new(corev1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(corev1.SecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Env != nil {
 		in, out := &in.Env, &out.Env
 		*out = make([]corev1.EnvVar, len(*in))
@@ -144,6 +524,32 @@ func (in *ClusterAgentSpec) DeepCopyInto(out *ClusterAgentSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	in.PodDNSSpec.DeepCopyInto(&out.PodDNSSpec)
+	if in.ExtraArgs != nil {
+		in, out := &in.ExtraArgs, &out.ExtraArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Lifecycle != nil {
+		in, out := &in.Lifecycle, &out.Lifecycle
+		*out = new(corev1.Lifecycle)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = new(int32)
+		**out = **in
+	}
+	if in.UpdateStrategy != nil {
+		in, out := &in.UpdateStrategy, &out.UpdateStrategy
+		*out = new(appsv1.DeploymentStrategy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.KubernetesEvents != nil {
+		in, out := &in.KubernetesEvents, &out.KubernetesEvents
+		*out = new(KubernetesEventsSpec)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterAgentSpec.
@@ -171,6 +577,21 @@ func (in *CommunityEditionSpec) DeepCopy() *CommunityEditionSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ComponentIssueStatus) DeepCopyInto(out *ComponentIssueStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ComponentIssueStatus.
+func (in *ComponentIssueStatus) DeepCopy() *ComponentIssueStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ComponentIssueStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Coroot) DeepCopyInto(out *Coroot) {
 	*out = *in
@@ -233,39 +654,109 @@ func (in *CorootList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CorootSpec) DeepCopyInto(out *CorootSpec) {
 	*out = *in
-	out.MetricsRefreshInterval = in.MetricsRefreshInterval
-	out.CacheTTL = in.CacheTTL
-	if in.Projects != nil {
-		in, out := &in.Projects, &out.Projects
-		*out = make([]ProjectSpec, len(*in))
-		for i := range *in {
-			(*in)[i].DeepCopyInto(&(*out)[i])
+	if in.CommonLabels != nil {
+		in, out := &in.CommonLabels, &out.CommonLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
 		}
 	}
-	if in.Env != nil {
-		in, out := &in.Env, &out.Env
-		*out = make([]corev1.EnvVar, len(*in))
+	if in.CommonAnnotations != nil {
+		in, out := &in.CommonAnnotations, &out.CommonAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.GitOps != nil {
+		in, out := &in.GitOps, &out.GitOps
+		*out = new(GitOpsSpec)
+		**out = **in
+	}
+	if in.DriftDetection != nil {
+		in, out := &in.DriftDetection, &out.DriftDetection
+		*out = new(DriftDetectionSpec)
+		**out = **in
+	}
+	if in.TenantNamespaceSelector != nil {
+		in, out := &in.TenantNamespaceSelector, &out.TenantNamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ImagePullSecrets != nil {
+		in, out := &in.ImagePullSecrets, &out.ImagePullSecrets
+		*out = make([]corev1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.ImageDigests != nil {
+		in, out := &in.ImageDigests, &out.ImageDigests
+		*out = new(ImageDigestsSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Hibernation != nil {
+		in, out := &in.Hibernation, &out.Hibernation
+		*out = new(HibernationSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Snapshots != nil {
+		in, out := &in.Snapshots, &out.Snapshots
+		*out = new(SnapshotsSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	out.MetricsRefreshInterval = in.MetricsRefreshInterval
+	out.CacheTTL = in.CacheTTL
+	if in.Projects != nil {
+		in, out := &in.Projects, &out.Projects
+		*out = make([]ProjectSpec, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make([]corev1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.AuthBootstrapAdminPasswordSecret != nil {
+		in, out := &in.AuthBootstrapAdminPasswordSecret, &out.AuthBootstrapAdminPasswordSecret
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
 	out.CommunityEdition = in.CommunityEdition
 	if in.EnterpriseEdition != nil {
 		in, out := &in.EnterpriseEdition, &out.EnterpriseEdition
 		*out = new(EnterpriseEditionSpec)
-		**out = **in
+		(*in).DeepCopyInto(*out)
 	}
 	if in.AgentsOnly != nil {
 		in, out := &in.AgentsOnly, &out.AgentsOnly
 		*out = new(AgentsOnlySpec)
 		**out = **in
 	}
+	if in.UpdateStrategy != nil {
+		in, out := &in.UpdateStrategy, &out.UpdateStrategy
+		*out = new(CorootUpdateStrategySpec)
+		**out = **in
+	}
 	out.Service = in.Service
 	if in.Affinity != nil {
 		in, out := &in.Affinity, &out.Affinity
 		*out = new(corev1.Affinity)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Architectures != nil {
+		in, out := &in.Architectures, &out.Architectures
+		*out = make([]Architecture, len(*in))
+		copy(*out, *in)
+	}
+	if in.RuntimeClassName != nil {
+		in, out := &in.RuntimeClassName, &out.RuntimeClassName
+		*out = new(string)
+		**out = **in
+	}
+	in.ServiceAccount.DeepCopyInto(&out.ServiceAccount)
 	in.Storage.DeepCopyInto(&out.Storage)
 	in.Resources.DeepCopyInto(&out.Resources)
 	if in.Tolerations != nil {
@@ -282,9 +773,50 @@ func (in *CorootSpec) DeepCopyInto(out *CorootSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.PodLabels != nil {
+		in, out := &in.PodLabels, &out.PodLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PodSecurityContext != nil {
+		in, out := &in.PodSecurityContext, &out.PodSecurityContext
+		*out = new(corev1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(corev1.SecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	in.PodDNSSpec.DeepCopyInto(&out.PodDNSSpec)
+	if in.ExtraArgs != nil {
+		in, out := &in.ExtraArgs, &out.ExtraArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Lifecycle != nil {
+		in, out := &in.Lifecycle, &out.Lifecycle
+		*out = new(corev1.Lifecycle)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ApiKeySecret != nil {
+		in, out := &in.ApiKeySecret, &out.ApiKeySecret
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
 	in.NodeAgent.DeepCopyInto(&out.NodeAgent)
 	in.ClusterAgent.DeepCopyInto(&out.ClusterAgent)
 	in.Prometheus.DeepCopyInto(&out.Prometheus)
+	in.VictoriaMetrics.DeepCopyInto(&out.VictoriaMetrics)
 	in.Clickhouse.DeepCopyInto(&out.Clickhouse)
 	if in.ExternalClickhouse != nil {
 		in, out := &in.ExternalClickhouse, &out.ExternalClickhouse
@@ -301,6 +833,51 @@ func (in *CorootSpec) DeepCopyInto(out *CorootSpec) {
 		*out = new(IngressSpec)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Gateway != nil {
+		in, out := &in.Gateway, &out.Gateway
+		*out = new(GatewaySpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ServiceMesh != nil {
+		in, out := &in.ServiceMesh, &out.ServiceMesh
+		*out = new(ServiceMeshSpec)
+		**out = **in
+	}
+	if in.Proxy != nil {
+		in, out := &in.Proxy, &out.Proxy
+		*out = new(ProxySpec)
+		**out = **in
+	}
+	if in.CustomCA != nil {
+		in, out := &in.CustomCA, &out.CustomCA
+		*out = new(CustomCASpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PodMonitor != nil {
+		in, out := &in.PodMonitor, &out.PodMonitor
+		*out = new(PodMonitorSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.VerticalPodAutoscaler != nil {
+		in, out := &in.VerticalPodAutoscaler, &out.VerticalPodAutoscaler
+		*out = new(VerticalPodAutoscalerSpec)
+		**out = **in
+	}
+	if in.GrafanaDatasources != nil {
+		in, out := &in.GrafanaDatasources, &out.GrafanaDatasources
+		*out = new(GrafanaDatasourcesSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DemoApp != nil {
+		in, out := &in.DemoApp, &out.DemoApp
+		*out = new(DemoAppSpec)
+		**out = **in
+	}
+	if in.Probes != nil {
+		in, out := &in.Probes, &out.Probes
+		*out = new(ProbesSpec)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CorootSpec.
@@ -323,6 +900,66 @@ func (in *CorootStatus) DeepCopyInto(out *CorootStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Dependencies != nil {
+		in, out := &in.Dependencies, &out.Dependencies
+		*out = make([]DependencyStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExternalClickhouseSwitchedAt != nil {
+		in, out := &in.ExternalClickhouseSwitchedAt, &out.ExternalClickhouseSwitchedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.Keeper != nil {
+		in, out := &in.Keeper, &out.Keeper
+		*out = make([]KeeperMemberStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.ClickhouseKeeper != nil {
+		in, out := &in.ClickhouseKeeper, &out.ClickhouseKeeper
+		*out = new(ClickhouseKeeperStatus)
+		**out = **in
+	}
+	if in.ClickhouseSchema != nil {
+		in, out := &in.ClickhouseSchema, &out.ClickhouseSchema
+		*out = make([]ClickhouseTableStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.ClickhouseShardDrains != nil {
+		in, out := &in.ClickhouseShardDrains, &out.ClickhouseShardDrains
+		*out = make([]ClickhouseShardDrainStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Rollout != nil {
+		in, out := &in.Rollout, &out.Rollout
+		*out = new(RolloutStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.License != nil {
+		in, out := &in.License, &out.License
+		*out = new(LicenseStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ComponentIssues != nil {
+		in, out := &in.ComponentIssues, &out.ComponentIssues
+		*out = make([]ComponentIssueStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Snapshots != nil {
+		in, out := &in.Snapshots, &out.Snapshots
+		*out = make([]SnapshotSetStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Drift != nil {
+		in, out := &in.Drift, &out.Drift
+		*out = make([]DriftStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CorootStatus.
@@ -336,214 +973,1107 @@ func (in *CorootStatus) DeepCopy() *CorootStatus {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *EnterpriseEditionSpec) DeepCopyInto(out *EnterpriseEditionSpec) {
+func (in *CorootTenant) DeepCopyInto(out *CorootTenant) {
 	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EnterpriseEditionSpec.
-func (in *EnterpriseEditionSpec) DeepCopy() *EnterpriseEditionSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CorootTenant.
+func (in *CorootTenant) DeepCopy() *CorootTenant {
 	if in == nil {
 		return nil
 	}
-	out := new(EnterpriseEditionSpec)
+	out := new(CorootTenant)
 	in.DeepCopyInto(out)
 	return out
 }
 
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *CorootTenant) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *ExternalClickhouseSpec) DeepCopyInto(out *ExternalClickhouseSpec) {
+func (in *CorootTenantList) DeepCopyInto(out *CorootTenantList) {
 	*out = *in
-	if in.PasswordSecret != nil {
-		in, out := &in.PasswordSecret, &out.PasswordSecret
-		*out = new(corev1.SecretKeySelector)
-		(*in).DeepCopyInto(*out)
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]CorootTenant, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalClickhouseSpec.
-func (in *ExternalClickhouseSpec) DeepCopy() *ExternalClickhouseSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CorootTenantList.
+func (in *CorootTenantList) DeepCopy() *CorootTenantList {
 	if in == nil {
 		return nil
 	}
-	out := new(ExternalClickhouseSpec)
+	out := new(CorootTenantList)
 	in.DeepCopyInto(out)
 	return out
 }
 
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *CorootTenantList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *IngressSpec) DeepCopyInto(out *IngressSpec) {
+func (in *CorootTenantSpec) DeepCopyInto(out *CorootTenantSpec) {
 	*out = *in
-	if in.ClassName != nil {
-		in, out := &in.ClassName, &out.ClassName
-		*out = new(string)
-		**out = **in
-	}
-	if in.TLS != nil {
-		in, out := &in.TLS, &out.TLS
-		*out = new(networkingv1.IngressTLS)
-		(*in).DeepCopyInto(*out)
+	if in.ApiKeys != nil {
+		in, out := &in.ApiKeys, &out.ApiKeys
+		*out = make([]ApiKeySpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IngressSpec.
-func (in *IngressSpec) DeepCopy() *IngressSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CorootTenantSpec.
+func (in *CorootTenantSpec) DeepCopy() *CorootTenantSpec {
 	if in == nil {
 		return nil
 	}
-	out := new(IngressSpec)
+	out := new(CorootTenantSpec)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *NodeAgentSpec) DeepCopyInto(out *NodeAgentSpec) {
+func (in *CorootTenantStatus) DeepCopyInto(out *CorootTenantStatus) {
 	*out = *in
-	in.UpdateStrategy.DeepCopyInto(&out.UpdateStrategy)
-	if in.Affinity != nil {
-		in, out := &in.Affinity, &out.Affinity
-		*out = new(corev1.Affinity)
-		(*in).DeepCopyInto(*out)
-	}
-	in.Resources.DeepCopyInto(&out.Resources)
-	if in.Tolerations != nil {
-		in, out := &in.Tolerations, &out.Tolerations
-		*out = make([]corev1.Toleration, len(*in))
-		for i := range *in {
-			(*in)[i].DeepCopyInto(&(*out)[i])
-		}
-	}
-	if in.PodAnnotations != nil {
-		in, out := &in.PodAnnotations, &out.PodAnnotations
-		*out = make(map[string]string, len(*in))
-		for key, val := range *in {
-			(*out)[key] = val
-		}
-	}
-	if in.Env != nil {
-		in, out := &in.Env, &out.Env
-		*out = make([]corev1.EnvVar, len(*in))
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeAgentSpec.
-func (in *NodeAgentSpec) DeepCopy() *NodeAgentSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CorootTenantStatus.
+func (in *CorootTenantStatus) DeepCopy() *CorootTenantStatus {
 	if in == nil {
 		return nil
 	}
-	out := new(NodeAgentSpec)
+	out := new(CorootTenantStatus)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *PostgresSpec) DeepCopyInto(out *PostgresSpec) {
+func (in *CorootUpdateStrategySpec) DeepCopyInto(out *CorootUpdateStrategySpec) {
 	*out = *in
-	if in.PasswordSecret != nil {
-		in, out := &in.PasswordSecret, &out.PasswordSecret
-		*out = new(corev1.SecretKeySelector)
-		(*in).DeepCopyInto(*out)
-	}
-	if in.Params != nil {
-		in, out := &in.Params, &out.Params
-		*out = make(map[string]string, len(*in))
-		for key, val := range *in {
-			(*out)[key] = val
-		}
-	}
+	out.VerificationPeriod = in.VerificationPeriod
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresSpec.
-func (in *PostgresSpec) DeepCopy() *PostgresSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CorootUpdateStrategySpec.
+func (in *CorootUpdateStrategySpec) DeepCopy() *CorootUpdateStrategySpec {
 	if in == nil {
 		return nil
 	}
-	out := new(PostgresSpec)
+	out := new(CorootUpdateStrategySpec)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *ProjectSpec) DeepCopyInto(out *ProjectSpec) {
+func (in *CosignSpec) DeepCopyInto(out *CosignSpec) {
 	*out = *in
-	if in.ApiKeys != nil {
-		in, out := &in.ApiKeys, &out.ApiKeys
-		*out = make([]ApiKeySpec, len(*in))
+	if in.PublicKeySecret != nil {
+		in, out := &in.PublicKeySecret, &out.PublicKeySecret
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProjectSpec.
-func (in *ProjectSpec) DeepCopy() *ProjectSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CosignSpec.
+func (in *CosignSpec) DeepCopy() *CosignSpec {
 	if in == nil {
 		return nil
 	}
-	out := new(ProjectSpec)
+	out := new(CosignSpec)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *PrometheusSpec) DeepCopyInto(out *PrometheusSpec) {
+func (in *CustomCASpec) DeepCopyInto(out *CustomCASpec) {
 	*out = *in
-	if in.Affinity != nil {
-		in, out := &in.Affinity, &out.Affinity
-		*out = new(corev1.Affinity)
+	if in.Secret != nil {
+		in, out := &in.Secret, &out.Secret
+		*out = new(corev1.SecretKeySelector)
 		(*in).DeepCopyInto(*out)
 	}
-	in.Storage.DeepCopyInto(&out.Storage)
-	in.Resources.DeepCopyInto(&out.Resources)
-	if in.Tolerations != nil {
-		in, out := &in.Tolerations, &out.Tolerations
-		*out = make([]corev1.Toleration, len(*in))
-		for i := range *in {
-			(*in)[i].DeepCopyInto(&(*out)[i])
-		}
-	}
-	if in.PodAnnotations != nil {
-		in, out := &in.PodAnnotations, &out.PodAnnotations
-		*out = make(map[string]string, len(*in))
-		for key, val := range *in {
-			(*out)[key] = val
-		}
+	if in.ConfigMap != nil {
+		in, out := &in.ConfigMap, &out.ConfigMap
+		*out = new(corev1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PrometheusSpec.
-func (in *PrometheusSpec) DeepCopy() *PrometheusSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CustomCASpec.
+func (in *CustomCASpec) DeepCopy() *CustomCASpec {
 	if in == nil {
 		return nil
 	}
-	out := new(PrometheusSpec)
+	out := new(CustomCASpec)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *ServiceSpec) DeepCopyInto(out *ServiceSpec) {
+func (in *DemoAppSpec) DeepCopyInto(out *DemoAppSpec) {
 	*out = *in
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceSpec.
-func (in *ServiceSpec) DeepCopy() *ServiceSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DemoAppSpec.
+func (in *DemoAppSpec) DeepCopy() *DemoAppSpec {
 	if in == nil {
 		return nil
 	}
-	out := new(ServiceSpec)
+	out := new(DemoAppSpec)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *StorageSpec) DeepCopyInto(out *StorageSpec) {
+func (in *DependencyStatus) DeepCopyInto(out *DependencyStatus) {
 	*out = *in
-	out.Size = in.Size.DeepCopy()
-	if in.ClassName != nil {
-		in, out := &in.ClassName, &out.ClassName
-		*out = new(string)
-		**out = **in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DependencyStatus.
+func (in *DependencyStatus) DeepCopy() *DependencyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DependencyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DriftDetectionSpec) DeepCopyInto(out *DriftDetectionSpec) {
+	*out = *in
+	out.Interval = in.Interval
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DriftDetectionSpec.
+func (in *DriftDetectionSpec) DeepCopy() *DriftDetectionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DriftDetectionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DriftStatus) DeepCopyInto(out *DriftStatus) {
+	*out = *in
+	if in.Fields != nil {
+		in, out := &in.Fields, &out.Fields
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DriftStatus.
+func (in *DriftStatus) DeepCopy() *DriftStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DriftStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Duration) DeepCopyInto(out *Duration) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Duration.
+func (in *Duration) DeepCopy() *Duration {
+	if in == nil {
+		return nil
+	}
+	out := new(Duration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *EnterpriseEditionSpec) DeepCopyInto(out *EnterpriseEditionSpec) {
+	*out = *in
+	if in.LicenseKeySecret != nil {
+		in, out := &in.LicenseKeySecret, &out.LicenseKeySecret
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	out.LicenseExpiryWarning = in.LicenseExpiryWarning
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new EnterpriseEditionSpec.
+func (in *EnterpriseEditionSpec) DeepCopy() *EnterpriseEditionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(EnterpriseEditionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalClickhouseAddress) DeepCopyInto(out *ExternalClickhouseAddress) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalClickhouseAddress.
+func (in *ExternalClickhouseAddress) DeepCopy() *ExternalClickhouseAddress {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalClickhouseAddress)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalClickhouseSpec) DeepCopyInto(out *ExternalClickhouseSpec) {
+	*out = *in
+	if in.PasswordSecret != nil {
+		in, out := &in.PasswordSecret, &out.PasswordSecret
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Addresses != nil {
+		in, out := &in.Addresses, &out.Addresses
+		*out = make([]ExternalClickhouseAddress, len(*in))
+		copy(*out, *in)
+	}
+	if in.CASecret != nil {
+		in, out := &in.CASecret, &out.CASecret
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalClickhouseSpec.
+func (in *ExternalClickhouseSpec) DeepCopy() *ExternalClickhouseSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalClickhouseSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GatewayParentRef) DeepCopyInto(out *GatewayParentRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GatewayParentRef.
+func (in *GatewayParentRef) DeepCopy() *GatewayParentRef {
+	if in == nil {
+		return nil
+	}
+	out := new(GatewayParentRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GatewaySpec) DeepCopyInto(out *GatewaySpec) {
+	*out = *in
+	out.ParentRef = in.ParentRef
+	if in.Hostnames != nil {
+		in, out := &in.Hostnames, &out.Hostnames
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.TelemetryHostnames != nil {
+		in, out := &in.TelemetryHostnames, &out.TelemetryHostnames
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GatewaySpec.
+func (in *GatewaySpec) DeepCopy() *GatewaySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(GatewaySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitOpsSpec) DeepCopyInto(out *GitOpsSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitOpsSpec.
+func (in *GitOpsSpec) DeepCopy() *GitOpsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(GitOpsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GrafanaDatasourcesSpec) DeepCopyInto(out *GrafanaDatasourcesSpec) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GrafanaDatasourcesSpec.
+func (in *GrafanaDatasourcesSpec) DeepCopy() *GrafanaDatasourcesSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(GrafanaDatasourcesSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HibernationScheduleSpec) DeepCopyInto(out *HibernationScheduleSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HibernationScheduleSpec.
+func (in *HibernationScheduleSpec) DeepCopy() *HibernationScheduleSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(HibernationScheduleSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HibernationSpec) DeepCopyInto(out *HibernationSpec) {
+	*out = *in
+	if in.Schedule != nil {
+		in, out := &in.Schedule, &out.Schedule
+		*out = new(HibernationScheduleSpec)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HibernationSpec.
+func (in *HibernationSpec) DeepCopy() *HibernationSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(HibernationSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HostPathStorageSpec) DeepCopyInto(out *HostPathStorageSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HostPathStorageSpec.
+func (in *HostPathStorageSpec) DeepCopy() *HostPathStorageSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(HostPathStorageSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageDigestsSpec) DeepCopyInto(out *ImageDigestsSpec) {
+	*out = *in
+	if in.Cosign != nil {
+		in, out := &in.Cosign, &out.Cosign
+		*out = new(CosignSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageDigestsSpec.
+func (in *ImageDigestsSpec) DeepCopy() *ImageDigestsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageDigestsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IngressSpec) DeepCopyInto(out *IngressSpec) {
+	*out = *in
+	if in.ClassName != nil {
+		in, out := &in.ClassName, &out.ClassName
+		*out = new(string)
+		**out = **in
+	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(networkingv1.IngressTLS)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Telemetry != nil {
+		in, out := &in.Telemetry, &out.Telemetry
+		*out = new(TelemetryIngressSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IngressSpec.
+func (in *IngressSpec) DeepCopy() *IngressSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(IngressSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeeperMemberStatus) DeepCopyInto(out *KeeperMemberStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeeperMemberStatus.
+func (in *KeeperMemberStatus) DeepCopy() *KeeperMemberStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(KeeperMemberStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KubernetesEventsSpec) DeepCopyInto(out *KubernetesEventsSpec) {
+	*out = *in
+	in.Resources.DeepCopyInto(&out.Resources)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KubernetesEventsSpec.
+func (in *KubernetesEventsSpec) DeepCopy() *KubernetesEventsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(KubernetesEventsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LicenseStatus) DeepCopyInto(out *LicenseStatus) {
+	*out = *in
+	if in.ExpiresAt != nil {
+		in, out := &in.ExpiresAt, &out.ExpiresAt
+		*out = (*in).DeepCopy()
+	}
+	if in.CheckedAt != nil {
+		in, out := &in.CheckedAt, &out.CheckedAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LicenseStatus.
+func (in *LicenseStatus) DeepCopy() *LicenseStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(LicenseStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeAgentMetricsSpec) DeepCopyInto(out *NodeAgentMetricsSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeAgentMetricsSpec.
+func (in *NodeAgentMetricsSpec) DeepCopy() *NodeAgentMetricsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeAgentMetricsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeAgentSpec) DeepCopyInto(out *NodeAgentSpec) {
+	*out = *in
+	if in.RuntimeClassName != nil {
+		in, out := &in.RuntimeClassName, &out.RuntimeClassName
+		*out = new(string)
+		**out = **in
+	}
+	in.ServiceAccount.DeepCopyInto(&out.ServiceAccount)
+	in.UpdateStrategy.DeepCopyInto(&out.UpdateStrategy)
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(corev1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Architectures != nil {
+		in, out := &in.Architectures, &out.Architectures
+		*out = make([]Architecture, len(*in))
+		copy(*out, *in)
+	}
+	in.Resources.DeepCopyInto(&out.Resources)
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]corev1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PodAnnotations != nil {
+		in, out := &in.PodAnnotations, &out.PodAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PodLabels != nil {
+		in, out := &in.PodLabels, &out.PodLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make([]corev1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.PodDNSSpec.DeepCopyInto(&out.PodDNSSpec)
+	if in.ExtraArgs != nil {
+		in, out := &in.ExtraArgs, &out.ExtraArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Lifecycle != nil {
+		in, out := &in.Lifecycle, &out.Lifecycle
+		*out = new(corev1.Lifecycle)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TrackPublicNetworks != nil {
+		in, out := &in.TrackPublicNetworks, &out.TrackPublicNetworks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ContainerAllowlist != nil {
+		in, out := &in.ContainerAllowlist, &out.ContainerAllowlist
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ContainerDenylist != nil {
+		in, out := &in.ContainerDenylist, &out.ContainerDenylist
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Metrics != nil {
+		in, out := &in.Metrics, &out.Metrics
+		*out = new(NodeAgentMetricsSpec)
+		**out = **in
+	}
+	if in.Spool != nil {
+		in, out := &in.Spool, &out.Spool
+		*out = new(NodeAgentSpoolSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeAgentSpec.
+func (in *NodeAgentSpec) DeepCopy() *NodeAgentSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeAgentSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeAgentSpoolSpec) DeepCopyInto(out *NodeAgentSpoolSpec) {
+	*out = *in
+	out.Size = in.Size.DeepCopy()
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeAgentSpoolSpec.
+func (in *NodeAgentSpoolSpec) DeepCopy() *NodeAgentSpoolSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeAgentSpoolSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodDNSSpec) DeepCopyInto(out *PodDNSSpec) {
+	*out = *in
+	if in.DNSConfig != nil {
+		in, out := &in.DNSConfig, &out.DNSConfig
+		*out = new(corev1.PodDNSConfig)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HostAliases != nil {
+		in, out := &in.HostAliases, &out.HostAliases
+		*out = make([]corev1.HostAlias, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodDNSSpec.
+func (in *PodDNSSpec) DeepCopy() *PodDNSSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PodDNSSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodMonitorSpec) DeepCopyInto(out *PodMonitorSpec) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	out.Interval = in.Interval
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodMonitorSpec.
+func (in *PodMonitorSpec) DeepCopy() *PodMonitorSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PodMonitorSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PostgresSpec) DeepCopyInto(out *PostgresSpec) {
+	*out = *in
+	if in.PasswordSecret != nil {
+		in, out := &in.PasswordSecret, &out.PasswordSecret
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Params != nil {
+		in, out := &in.Params, &out.Params
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PostgresSpec.
+func (in *PostgresSpec) DeepCopy() *PostgresSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PostgresSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProbeRegionSpec) DeepCopyInto(out *ProbeRegionSpec) {
+	*out = *in
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProbeRegionSpec.
+func (in *ProbeRegionSpec) DeepCopy() *ProbeRegionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProbeRegionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProbeTargetSpec) DeepCopyInto(out *ProbeTargetSpec) {
+	*out = *in
+	out.Interval = in.Interval
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProbeTargetSpec.
+func (in *ProbeTargetSpec) DeepCopy() *ProbeTargetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProbeTargetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProbesSpec) DeepCopyInto(out *ProbesSpec) {
+	*out = *in
+	if in.Regions != nil {
+		in, out := &in.Regions, &out.Regions
+		*out = make([]ProbeRegionSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Targets != nil {
+		in, out := &in.Targets, &out.Targets
+		*out = make([]ProbeTargetSpec, len(*in))
+		copy(*out, *in)
+	}
+	in.Resources.DeepCopyInto(&out.Resources)
+	in.PodDNSSpec.DeepCopyInto(&out.PodDNSSpec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProbesSpec.
+func (in *ProbesSpec) DeepCopy() *ProbesSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProbesSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProjectSpec) DeepCopyInto(out *ProjectSpec) {
+	*out = *in
+	if in.ApiKeys != nil {
+		in, out := &in.ApiKeys, &out.ApiKeys
+		*out = make([]ApiKeySpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProjectSpec.
+func (in *ProjectSpec) DeepCopy() *ProjectSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProjectSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PrometheusSpec) DeepCopyInto(out *PrometheusSpec) {
+	*out = *in
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(corev1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Architectures != nil {
+		in, out := &in.Architectures, &out.Architectures
+		*out = make([]Architecture, len(*in))
+		copy(*out, *in)
+	}
+	if in.RuntimeClassName != nil {
+		in, out := &in.RuntimeClassName, &out.RuntimeClassName
+		*out = new(string)
+		**out = **in
+	}
+	in.ServiceAccount.DeepCopyInto(&out.ServiceAccount)
+	in.Storage.DeepCopyInto(&out.Storage)
+	in.Resources.DeepCopyInto(&out.Resources)
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]corev1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PodAnnotations != nil {
+		in, out := &in.PodAnnotations, &out.PodAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PodLabels != nil {
+		in, out := &in.PodLabels, &out.PodLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PodSecurityContext != nil {
+		in, out := &in.PodSecurityContext, &out.PodSecurityContext
+		*out = new(corev1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(corev1.SecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	in.PodDNSSpec.DeepCopyInto(&out.PodDNSSpec)
+	if in.ExtraArgs != nil {
+		in, out := &in.ExtraArgs, &out.ExtraArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Lifecycle != nil {
+		in, out := &in.Lifecycle, &out.Lifecycle
+		*out = new(corev1.Lifecycle)
+		(*in).DeepCopyInto(*out)
+	}
+	out.Retention = in.Retention
+	if in.RecordingRulesConfigMap != nil {
+		in, out := &in.RecordingRulesConfigMap, &out.RecordingRulesConfigMap
+		*out = new(corev1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PrometheusSpec.
+func (in *PrometheusSpec) DeepCopy() *PrometheusSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PrometheusSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProxySpec) DeepCopyInto(out *ProxySpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProxySpec.
+func (in *ProxySpec) DeepCopy() *ProxySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProxySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutStatus) DeepCopyInto(out *RolloutStatus) {
+	*out = *in
+	if in.Partition != nil {
+		in, out := &in.Partition, &out.Partition
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutStatus.
+func (in *RolloutStatus) DeepCopy() *RolloutStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceAccountSpec) DeepCopyInto(out *ServiceAccountSpec) {
+	*out = *in
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceAccountSpec.
+func (in *ServiceAccountSpec) DeepCopy() *ServiceAccountSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceAccountSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceMeshSpec) DeepCopyInto(out *ServiceMeshSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceMeshSpec.
+func (in *ServiceMeshSpec) DeepCopy() *ServiceMeshSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceMeshSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceSpec) DeepCopyInto(out *ServiceSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceSpec.
+func (in *ServiceSpec) DeepCopy() *ServiceSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotSetStatus) DeepCopyInto(out *SnapshotSetStatus) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	if in.VolumeSnapshots != nil {
+		in, out := &in.VolumeSnapshots, &out.VolumeSnapshots
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotSetStatus.
+func (in *SnapshotSetStatus) DeepCopy() *SnapshotSetStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotSetStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SnapshotsSpec) DeepCopyInto(out *SnapshotsSpec) {
+	*out = *in
+	if in.ClassName != nil {
+		in, out := &in.ClassName, &out.ClassName
+		*out = new(string)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotsSpec.
+func (in *SnapshotsSpec) DeepCopy() *SnapshotsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SnapshotsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageSpec) DeepCopyInto(out *StorageSpec) {
+	*out = *in
+	out.Size = in.Size.DeepCopy()
+	if in.ClassName != nil {
+		in, out := &in.ClassName, &out.ClassName
+		*out = new(string)
+		**out = **in
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.DataSourceRef != nil {
+		in, out := &in.DataSourceRef, &out.DataSourceRef
+		*out = new(corev1.TypedObjectReference)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HostPath != nil {
+		in, out := &in.HostPath, &out.HostPath
+		*out = new(HostPathStorageSpec)
+		**out = **in
 	}
 }
 
@@ -556,3 +2086,132 @@ func (in *StorageSpec) DeepCopy() *StorageSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TelemetryIngressSpec) DeepCopyInto(out *TelemetryIngressSpec) {
+	*out = *in
+	if in.ClassName != nil {
+		in, out := &in.ClassName, &out.ClassName
+		*out = new(string)
+		**out = **in
+	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(networkingv1.IngressTLS)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TelemetryIngressSpec.
+func (in *TelemetryIngressSpec) DeepCopy() *TelemetryIngressSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TelemetryIngressSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VerticalPodAutoscalerSpec) DeepCopyInto(out *VerticalPodAutoscalerSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VerticalPodAutoscalerSpec.
+func (in *VerticalPodAutoscalerSpec) DeepCopy() *VerticalPodAutoscalerSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VerticalPodAutoscalerSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VictoriaMetricsSpec) DeepCopyInto(out *VictoriaMetricsSpec) {
+	*out = *in
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(corev1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Architectures != nil {
+		in, out := &in.Architectures, &out.Architectures
+		*out = make([]Architecture, len(*in))
+		copy(*out, *in)
+	}
+	if in.RuntimeClassName != nil {
+		in, out := &in.RuntimeClassName, &out.RuntimeClassName
+		*out = new(string)
+		**out = **in
+	}
+	in.Storage.DeepCopyInto(&out.Storage)
+	in.Resources.DeepCopyInto(&out.Resources)
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]corev1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PodAnnotations != nil {
+		in, out := &in.PodAnnotations, &out.PodAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PodLabels != nil {
+		in, out := &in.PodLabels, &out.PodLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.PodSecurityContext != nil {
+		in, out := &in.PodSecurityContext, &out.PodSecurityContext
+		*out = new(corev1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(corev1.SecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	in.PodDNSSpec.DeepCopyInto(&out.PodDNSSpec)
+	if in.ExtraArgs != nil {
+		in, out := &in.ExtraArgs, &out.ExtraArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Lifecycle != nil {
+		in, out := &in.Lifecycle, &out.Lifecycle
+		*out = new(corev1.Lifecycle)
+		(*in).DeepCopyInto(*out)
+	}
+	out.Retention = in.Retention
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VictoriaMetricsSpec.
+func (in *VictoriaMetricsSpec) DeepCopy() *VictoriaMetricsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VictoriaMetricsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
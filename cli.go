@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"github.io/coroot/operator/controller"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"os"
+	"path/filepath"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"text/tabwriter"
+	"time"
+)
+
+// The binary works as a kubectl plugin when it's installed on the PATH under this name: kubectl coroot status coroot
+const kubectlPluginName = "kubectl-coroot"
+
+var commands = map[string]func(args []string){
+	"render":  render,
+	"status":  status,
+	"restart": restart,
+}
+
+// The components that can be restarted and their app.kubernetes.io/component labels.
+var restartableComponents = map[string]string{
+	"coroot":            "coroot",
+	"prometheus":        "prometheus",
+	"clickhouse":        "clickhouse",
+	"clickhouse-keeper": "clickhouse-keeper",
+	"node-agent":        "coroot-node-agent",
+	"cluster-agent":     "coroot-cluster-agent",
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s <command> [flags]
+
+Commands:
+  render -f coroot.yaml               print the manifests for the Coroot resources without touching the cluster
+  status [-n namespace] <name>        print the status of a Coroot resource
+  restart [-n namespace] <name> <component>
+                                      restart the pods of a component (coroot, prometheus, clickhouse,
+                                      clickhouse-keeper, node-agent, cluster-agent)
+`, filepath.Base(os.Args[0]))
+}
+
+// render prints the manifests the operator would apply for the given Coroot resources without touching the cluster:
+// coroot-operator render -f coroot.yaml
+func render(args []string) {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	filename := fs.String("f", "-", "file with Coroot resources (- for stdin)")
+	fetchVersions := fs.Bool("fetch-versions", true, "resolve the latest component versions (otherwise the latest tag is used)")
+	appVersionsURL := fs.String("app-versions-url", "", "a URL of a JSON manifest with the component versions")
+	_ = fs.Parse(args)
+
+	in := os.Stdin
+	if *filename != "-" {
+		f, err := os.Open(*filename)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	if err := controller.RenderManifests(scheme, in, os.Stdout, *fetchVersions, *appVersionsURL); err != nil {
+		fatal(err)
+	}
+}
+
+// status prints the status of a Coroot resource: coroot-operator status -n coroot coroot
+func status(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	namespace := fs.String("n", "", "namespace of the Coroot resource (the one of the current context by default)")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	c, ns := cliClient(*namespace)
+	cr := &corootv1.Coroot{}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: ns, Name: fs.Arg(0)}, cr); err != nil {
+		fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	s := cr.Status
+	fmt.Fprintf(w, "Name:\t%s\nNamespace:\t%s\nVersion:\t%s\n", cr.Name, cr.Namespace, s.Version)
+	if r := s.Rollout; r != nil {
+		fmt.Fprintf(w, "Rollout:\t%d/%d ready, %d updated\n", r.ReadyReplicas, r.Replicas, r.UpdatedReplicas)
+	}
+	if s.AdminPasswordSecret != "" {
+		fmt.Fprintf(w, "Admin password secret:\t%s\n", s.AdminPasswordSecret)
+	}
+	fmt.Fprintln(w, "\nCONDITION\tSTATUS\tREASON\tAGE\tMESSAGE")
+	for _, c := range s.Conditions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Type, c.Status, c.Reason, age(c.LastTransitionTime.Time), c.Message)
+	}
+	if len(s.ComponentIssues) > 0 {
+		fmt.Fprintln(w, "\nCOMPONENT\tISSUE\tPODS\tMESSAGE")
+		for _, i := range s.ComponentIssues {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", i.Component, i.Reason, i.Pods, i.Message)
+		}
+	}
+	if len(s.Dependencies) > 0 {
+		fmt.Fprintln(w, "\nDEPENDENCY\tADDRESS\tREACHABLE\tAUTHENTICATED\tVERSION\tMESSAGE")
+		for _, d := range s.Dependencies {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%t\t%s\t%s\n", d.Name, d.Address, d.Reachable, d.Authenticated, d.Version, d.Message)
+		}
+	}
+	if len(s.Keeper) > 0 {
+		fmt.Fprintln(w, "\nKEEPER\tSTATE\tLAST LOG INDEX\tMESSAGE")
+		for _, m := range s.Keeper {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", m.Name, m.State, m.LastLogIndex, m.Message)
+		}
+	}
+	if len(s.Snapshots) > 0 {
+		fmt.Fprintln(w, "\nSNAPSHOT SET\tAGE\tREADY\tVOLUME SNAPSHOTS")
+		for _, set := range s.Snapshots {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%d\n", set.Name, age(set.Time.Time), set.ReadyToUse, len(set.VolumeSnapshots))
+		}
+	}
+}
+
+// restart rolls out the workloads of a component the same way as kubectl rollout restart:
+// coroot-operator restart -n coroot coroot clickhouse
+func restart(args []string) {
+	fs := flag.NewFlagSet("restart", flag.ExitOnError)
+	namespace := fs.String("n", "", "namespace of the Coroot resource (the one of the current context by default)")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+		os.Exit(2)
+	}
+	name, component := fs.Arg(0), fs.Arg(1)
+	label, ok := restartableComponents[component]
+	if !ok {
+		fatal(fmt.Errorf("unknown component: %s", component))
+	}
+	c, ns := cliClient(*namespace)
+	ctx := context.Background()
+	ls := controller.Labels(&corootv1.Coroot{ObjectMeta: metav1.ObjectMeta{Name: name}}, label)
+	opts := []client.ListOption{client.InNamespace(ns), client.MatchingLabels(ls)}
+
+	type workload struct {
+		kind string
+		obj  client.Object
+	}
+	var objs []workload
+	deployments, statefulSets, daemonSets := &appsv1.DeploymentList{}, &appsv1.StatefulSetList{}, &appsv1.DaemonSetList{}
+	for _, list := range []client.ObjectList{deployments, statefulSets, daemonSets} {
+		if err := c.List(ctx, list, opts...); err != nil {
+			fatal(err)
+		}
+	}
+	for i := range deployments.Items {
+		objs = append(objs, workload{kind: "Deployment", obj: &deployments.Items[i]})
+	}
+	for i := range statefulSets.Items {
+		objs = append(objs, workload{kind: "StatefulSet", obj: &statefulSets.Items[i]})
+	}
+	for i := range daemonSets.Items {
+		objs = append(objs, workload{kind: "DaemonSet", obj: &daemonSets.Items[i]})
+	}
+	if len(objs) == 0 {
+		fatal(fmt.Errorf("no workloads of %s found for %s/%s", component, ns, name))
+	}
+
+	// The operator keeps the annotations it doesn't manage, so the restart isn't reverted.
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":%q}}}}}`, time.Now().Format(time.RFC3339))
+	for _, w := range objs {
+		if err := c.Patch(ctx, w.obj, client.RawPatch(types.MergePatchType, []byte(patch))); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%s %s restarted\n", w.kind, w.obj.GetName())
+	}
+}
+
+func cliClient(namespace string) (client.Client, string) {
+	if namespace == "" {
+		ns, _, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).Namespace()
+		if err != nil {
+			fatal(err)
+		}
+		namespace = ns
+	}
+	cfg, err := ctrl.GetConfig()
+	if err != nil {
+		fatal(err)
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		fatal(err)
+	}
+	return c, namespace
+}
+
+func age(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return time.Since(t).Truncate(time.Second).String()
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"strings"
+	"time"
+)
+
+// BackgroundCheckTimeout limits a single run of a background check, e.g., probing several unreachable addresses one by one.
+const BackgroundCheckTimeout = time.Minute
+
+// backgroundCheck holds the last result of a network check of a Coroot instance.
+// The checks run outside of Reconcile, so unreachable dependencies don't block the workers.
+type backgroundCheck struct {
+	running bool
+	// The checksum of the inputs the result was produced for, e.g., the addresses and credentials.
+	input  string
+	result any
+	at     time.Time
+}
+
+func backgroundCheckKey(cr *corootv1.Coroot, name string) string {
+	return fmt.Sprintf("%s/%s/%s", cr.Namespace, cr.Name, name)
+}
+
+// backgroundCheckInput returns the checksum of the check inputs, so the secrets aren't kept in memory as is.
+func backgroundCheckInput(values ...any) string {
+	data, _ := json.Marshal(values)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// runBackgroundCheck returns the last result of the check produced for the same input, and false if there is none yet.
+// The check is started in a goroutine if it hasn't run for the input or its result is older than the interval,
+// and the instance is reconciled again once the result is ready.
+func runBackgroundCheck[T any](r *CorootReconciler, cr *corootv1.Coroot, name, input string, interval time.Duration, check func(ctx context.Context) T) (T, bool) {
+	r.backgroundChecksLock.Lock()
+	defer r.backgroundChecksLock.Unlock()
+	if r.backgroundChecks == nil {
+		r.backgroundChecks = map[string]*backgroundCheck{}
+	}
+	key := backgroundCheckKey(cr, name)
+	c := r.backgroundChecks[key]
+	if c == nil {
+		c = &backgroundCheck{}
+		r.backgroundChecks[key] = c
+	}
+	var res T
+	ok := c.result != nil && c.input == input
+	if ok {
+		res = c.result.(T)
+	}
+	if c.running || (ok && time.Since(c.at) < interval) {
+		return res, ok
+	}
+	c.running = true
+	cr = cr.DeepCopy()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), BackgroundCheckTimeout)
+		defer cancel()
+		result := check(ctx)
+		r.backgroundChecksLock.Lock()
+		c.running, c.input, c.result, c.at = false, input, result, time.Now()
+		r.backgroundChecksLock.Unlock()
+		if r.refresh != nil {
+			r.refresh <- event.GenericEvent{Object: cr}
+		}
+	}()
+	return res, ok
+}
+
+// forgetBackgroundChecks drops the results of the checks of a deleted instance.
+func (r *CorootReconciler) forgetBackgroundChecks(cr *corootv1.Coroot) {
+	r.backgroundChecksLock.Lock()
+	defer r.backgroundChecksLock.Unlock()
+	prefix := backgroundCheckKey(cr, "")
+	for key := range r.backgroundChecks {
+		if strings.HasPrefix(key, prefix) {
+			delete(r.backgroundChecks, key)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunBackgroundCheck(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	var runs atomic.Int32
+	check := func(input string) (string, bool) {
+		return runBackgroundCheck(r, cr, "test", input, time.Hour, func(context.Context) string {
+			runs.Add(1)
+			return input
+		})
+	}
+	waitResult := func(input string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			r.backgroundChecksLock.Lock()
+			c := r.backgroundChecks[backgroundCheckKey(cr, "test")]
+			done := !c.running && c.input == input
+			r.backgroundChecksLock.Unlock()
+			if done {
+				return
+			}
+		}
+		t.Fatalf("the check for %s hasn't completed", input)
+	}
+
+	if _, ok := check("a"); ok {
+		t.Fatal("expected no result before the first check completes")
+	}
+	waitResult("a")
+	if res, ok := check("a"); !ok || res != "a" {
+		t.Errorf("expected the cached result, got %q %v", res, ok)
+	}
+	if runs.Load() != 1 {
+		t.Errorf("expected the fresh result to be reused, got %d runs", runs.Load())
+	}
+
+	// The result produced for other inputs, e.g., before a password change, isn't returned.
+	if _, ok := check("b"); ok {
+		t.Error("expected no result for the changed input")
+	}
+	waitResult("b")
+	if res, ok := check("b"); !ok || res != "b" {
+		t.Errorf("expected the result for the changed input, got %q %v", res, ok)
+	}
+
+	r.forgetBackgroundChecks(cr)
+	if len(r.backgroundChecks) != 0 {
+		t.Errorf("expected the checks to be forgotten")
+	}
+}
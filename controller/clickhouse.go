@@ -1,22 +1,46 @@
 package controller
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	corootv1 "github.io/coroot/operator/api/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
-	"text/template"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
 	ClickhouseImage          = "ghcr.io/coroot/clickhouse:24.8.4-ubi9-0"
 	ClickhouseKeeperReplicas = 3
+
+	ClickhouseTerminationGracePeriod       int64 = 120
+	ClickhouseKeeperTerminationGracePeriod int64 = 60
 )
 
+// clickhousePreStop flushes the buffered inserts and logs and stops the merges before the server is terminated,
+// so node drains don't leave broken parts to be fetched from the other replicas.
+var clickhousePreStop = &corev1.Lifecycle{
+	PreStop: &corev1.LifecycleHandler{
+		Exec: &corev1.ExecAction{
+			Command: []string{"/bin/sh", "-c",
+				`clickhouse-client --password "$CLICKHOUSE_PASSWORD" --multiquery --query "SYSTEM FLUSH ASYNC INSERT QUEUE; SYSTEM FLUSH LOGS; SYSTEM STOP MERGES" || true`,
+			},
+		},
+	},
+}
+
+func terminationGracePeriod(seconds *int64, defaultSeconds int64) *int64 {
+	if seconds != nil {
+		return seconds
+	}
+	return &defaultSeconds
+}
+
 func (r *CorootReconciler) clickhouseSecret(cr *corootv1.Coroot) *corev1.Secret {
 	ls := Labels(cr, "clickhouse")
 	s := &corev1.Secret{
@@ -30,6 +54,78 @@ func (r *CorootReconciler) clickhouseSecret(cr *corootv1.Coroot) *corev1.Secret
 	return s
 }
 
+// CreateOrRotateClickhouseSecret creates the ClickHouse password secret and regenerates the password
+// whenever the rotate-secrets annotation of the Coroot changes. The previous password is kept in the secret for a rollback.
+func (r *CorootReconciler) CreateOrRotateClickhouseSecret(ctx context.Context, cr *corootv1.Coroot) error {
+	s := r.clickhouseSecret(cr)
+	rotation := cr.Annotations[corootv1.RotateSecretsAnnotation]
+	return r.CreateOrUpdate(ctx, cr, s, false, func() error {
+		if s.CreationTimestamp.IsZero() {
+			metav1.SetMetaDataAnnotation(&s.ObjectMeta, corootv1.RotateSecretsAnnotation, rotation)
+			return nil
+		}
+		if s.Annotations[corootv1.RotateSecretsAnnotation] == rotation {
+			return nil
+		}
+		ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Info("rotating ClickHouse password")
+		s.Data["previousPassword"] = s.Data["password"]
+		s.Data["password"] = []byte(RandomString(16))
+		metav1.SetMetaDataAnnotation(&s.ObjectMeta, corootv1.RotateSecretsAnnotation, rotation)
+		return nil
+	})
+}
+
+// secretsRotationAnnotations adds the rotate-secrets annotation to the pod annotations of the components using the generated secrets,
+// so they are restarted with the new values.
+func secretsRotationAnnotations(cr *corootv1.Coroot, annotations map[string]string) map[string]string {
+	rotation := cr.Annotations[corootv1.RotateSecretsAnnotation]
+	if rotation == "" {
+		return annotations
+	}
+	res := map[string]string{corootv1.RotateSecretsAnnotation: rotation}
+	for k, v := range annotations {
+		res[k] = v
+	}
+	return res
+}
+
+// holdSecretsRotation keeps the Coroot pods on the previous rotation of the generated secrets until ClickHouse is rolled out
+// with the new password, so ClickHouse and Coroot aren't restarted at the same time.
+func (r *CorootReconciler) holdSecretsRotation(ctx context.Context, cr *corootv1.Coroot, ss *appsv1.StatefulSet) error {
+	if cr.Spec.ExternalClickhouse != nil {
+		return nil
+	}
+	rotation := cr.Annotations[corootv1.RotateSecretsAnnotation]
+	current := &appsv1.StatefulSet{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(ss), current); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	applied := current.Spec.Template.Annotations[corootv1.RotateSecretsAnnotation]
+	if applied == rotation {
+		return nil
+	}
+	for _, desired := range r.clickhouseStatefulSets(cr) {
+		clickhouse := &appsv1.StatefulSet{}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(desired), clickhouse); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if clickhouse.Spec.Template.Annotations[corootv1.RotateSecretsAnnotation] == rotation && statefulSetRolledOut(clickhouse) {
+			continue
+		}
+		ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Info("waiting for ClickHouse to restart with the new password before restarting Coroot")
+		if applied == "" {
+			delete(ss.Spec.Template.Annotations, corootv1.RotateSecretsAnnotation)
+		} else {
+			metav1.SetMetaDataAnnotation(&ss.Spec.Template.ObjectMeta, corootv1.RotateSecretsAnnotation, applied)
+		}
+		return nil
+	}
+	return nil
+}
+
 func (r *CorootReconciler) clickhouseService(cr *corootv1.Coroot) *corev1.Service {
 	ls := Labels(cr, "clickhouse")
 	s := &corev1.Service{
@@ -62,6 +158,56 @@ func (r *CorootReconciler) clickhouseService(cr *corootv1.Coroot) *corev1.Servic
 	return s
 }
 
+func (r *CorootReconciler) clickhouseExternalService(cr *corootv1.Coroot) *corev1.Service {
+	ls := Labels(cr, "clickhouse")
+	s := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-clickhouse-external", cr.Name),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+	}
+	spec := cr.Spec.Clickhouse.Service
+	if spec == nil {
+		return s
+	}
+	s.Annotations = spec.Annotations
+
+	serviceType := spec.Type
+	if serviceType == "" {
+		serviceType = corev1.ServiceTypeLoadBalancer
+	}
+	httpPort := spec.HTTPPort
+	if httpPort == 0 {
+		httpPort = 8123
+	}
+	nativePort := spec.NativePort
+	if nativePort == 0 {
+		nativePort = 9000
+	}
+	s.Spec = corev1.ServiceSpec{
+		Selector:                 ls,
+		Type:                     serviceType,
+		LoadBalancerSourceRanges: spec.LoadBalancerSourceRanges,
+		Ports: []corev1.ServicePort{
+			{
+				Name:       "http",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       httpPort,
+				TargetPort: intstr.FromString("http"),
+			},
+			{
+				Name:       "tcp",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       nativePort,
+				TargetPort: intstr.FromString("tcp"),
+			},
+		},
+	}
+
+	return s
+}
+
 func (r *CorootReconciler) clickhouseServiceHeadless(cr *corootv1.Coroot) *corev1.Service {
 	ls := Labels(cr, "clickhouse")
 	s := &corev1.Service{
@@ -97,6 +243,9 @@ func (r *CorootReconciler) clickhouseServiceHeadless(cr *corootv1.Coroot) *corev
 }
 
 func (r *CorootReconciler) clickhousePVCs(cr *corootv1.Coroot) []*corev1.PersistentVolumeClaim {
+	if !pvcStorage(cr.Spec.Clickhouse.Storage) {
+		return nil
+	}
 	ls := Labels(cr, "clickhouse")
 	shards := cr.Spec.Clickhouse.Shards
 	if shards == 0 {
@@ -108,7 +257,7 @@ func (r *CorootReconciler) clickhousePVCs(cr *corootv1.Coroot) []*corev1.Persist
 	}
 	size := cr.Spec.Clickhouse.Storage.Size
 	if size.IsZero() {
-		size, _ = resource.ParseQuantity("100Gi")
+		size, _ = resource.ParseQuantity(DefaultClickhouseStorageSize)
 	}
 
 	var res []*corev1.PersistentVolumeClaim
@@ -116,9 +265,10 @@ func (r *CorootReconciler) clickhousePVCs(cr *corootv1.Coroot) []*corev1.Persist
 		for replica := 0; replica < replicas; replica++ {
 			pvc := &corev1.PersistentVolumeClaim{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      fmt.Sprintf("data-%s-clickhouse-shard-%d-%d", cr.Name, shard, replica),
-					Namespace: cr.Namespace,
-					Labels:    ls,
+					Name:        fmt.Sprintf("data-%s-clickhouse-shard-%d-%d", cr.Name, shard, replica),
+					Namespace:   cr.Namespace,
+					Labels:      mergeLabels(ls, cr.Spec.Clickhouse.Storage.Labels),
+					Annotations: cr.Spec.Clickhouse.Storage.Annotations,
 				},
 				Spec: corev1.PersistentVolumeClaimSpec{
 					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
@@ -127,16 +277,31 @@ func (r *CorootReconciler) clickhousePVCs(cr *corootv1.Coroot) []*corev1.Persist
 							corev1.ResourceStorage: size,
 						},
 					},
-					StorageClassName: cr.Spec.Storage.ClassName,
+					StorageClassName: storageClassName(cr.Spec.Clickhouse.Storage, cr),
+					DataSourceRef:    cr.Spec.Clickhouse.Storage.DataSourceRef,
+					Selector:         cr.Spec.Clickhouse.Storage.Selector,
 				},
 			}
 			res = append(res, pvc)
 		}
 	}
-	return res
+	return snapshotDataSource(cr, res)
 }
 
 func (r *CorootReconciler) clickhouseStatefulSets(cr *corootv1.Coroot) []*appsv1.StatefulSet {
+	shards := cr.Spec.Clickhouse.Shards
+	if shards == 0 {
+		shards = 1
+	}
+	var res []*appsv1.StatefulSet
+	for shard := 0; shard < shards; shard++ {
+		res = append(res, r.clickhouseStatefulSet(cr, shard))
+	}
+	return res
+}
+
+// clickhouseStatefulSet builds the StatefulSet of the shard, including the ones being drained, which are beyond spec.clickhouse.shards.
+func (r *CorootReconciler) clickhouseStatefulSet(cr *corootv1.Coroot, shard int) *appsv1.StatefulSet {
 	ls := Labels(cr, "clickhouse")
 
 	shards := cr.Spec.Clickhouse.Shards
@@ -148,209 +313,153 @@ func (r *CorootReconciler) clickhouseStatefulSets(cr *corootv1.Coroot) []*appsv1
 		replicas = 1
 	}
 
-	var res []*appsv1.StatefulSet
-	for shard := 0; shard < shards; shard++ {
-		ss := &appsv1.StatefulSet{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      fmt.Sprintf("%s-clickhouse-shard-%d", cr.Name, shard),
-				Namespace: cr.Namespace,
-				Labels:    ls,
-			},
-		}
+	// The config is still rendered for all the replicas, so it doesn't change on hibernation.
+	ssReplicas := replicas
+	if hibernated(cr) {
+		ssReplicas = 0
+	}
 
-		ss.Spec = appsv1.StatefulSetSpec{
-			Selector: &metav1.LabelSelector{
-				MatchLabels: ls,
-			},
-			Replicas:    &replicas,
-			ServiceName: fmt.Sprintf("%s-clickhouse-headless", cr.Name),
-			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
-				{
-					ObjectMeta: metav1.ObjectMeta{
-						Name:      "data",
-						Namespace: cr.Namespace,
-					},
+	ss := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-clickhouse-shard-%d", cr.Name, shard),
+			Namespace: cr.Namespace,
+			Labels:    mergeLabels(ls, cr.Spec.Clickhouse.Labels),
+		},
+	}
+
+	ss.Spec = appsv1.StatefulSetSpec{
+		Selector: &metav1.LabelSelector{
+			MatchLabels: ls,
+		},
+		Replicas:            &ssReplicas,
+		ServiceName:         fmt.Sprintf("%s-clickhouse-headless", cr.Name),
+		PodManagementPolicy: cr.Spec.Clickhouse.PodManagementPolicy,
+		MinReadySeconds:     cr.Spec.Clickhouse.MinReadySeconds,
+		VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "data",
+					Namespace:   cr.Namespace,
+					Labels:      mergeLabels(Labels(cr, "clickhouse"), cr.Spec.Clickhouse.Storage.Labels),
+					Annotations: cr.Spec.Clickhouse.Storage.Annotations,
 				},
 			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels:      ls,
-					Annotations: cr.Spec.Clickhouse.PodAnnotations,
+		},
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:      mergeLabels(ls, cr.Spec.Clickhouse.PodLabels),
+				Annotations: podAnnotations(cr, secretsRotationAnnotations(cr, cr.Spec.Clickhouse.PodAnnotations), true),
+			},
+			Spec: corev1.PodSpec{
+				ServiceAccountName:            serviceAccountName(cr, "clickhouse"),
+				DNSPolicy:                     cr.Spec.Clickhouse.DNSPolicy,
+				DNSConfig:                     cr.Spec.Clickhouse.DNSConfig,
+				HostAliases:                   cr.Spec.Clickhouse.HostAliases,
+				SecurityContext:               podSecurityContext(cr.Spec.Clickhouse.PodSecurityContext),
+				Affinity:                      affinity(archAffinity(cr.Spec.Clickhouse.Affinity, cr.Spec.Clickhouse.Architectures), cr.Spec.Clickhouse.PodAntiAffinityPreset, ls),
+				Tolerations:                   cr.Spec.Clickhouse.Tolerations,
+				NodeSelector:                  linuxNodeSelector,
+				PriorityClassName:             cr.Spec.Clickhouse.PriorityClassName,
+				SchedulerName:                 cr.Spec.Clickhouse.SchedulerName,
+				RuntimeClassName:              cr.Spec.Clickhouse.RuntimeClassName,
+				TerminationGracePeriodSeconds: terminationGracePeriod(cr.Spec.Clickhouse.TerminationGracePeriodSeconds, ClickhouseTerminationGracePeriod),
+				InitContainers: []corev1.Container{
+					{
+						Image:           UBIMinimalImage,
+						Name:            "config",
+						Command:         []string{"/bin/sh", "-c"},
+						Args:            []string{clickhouseConfigCmd("/config/config.xml", cr, shards, int(replicas), ClickhouseKeeperReplicas)},
+						VolumeMounts:    []corev1.VolumeMount{{Name: "config", MountPath: "/config"}},
+						SecurityContext: containerSecurityContext(cr.Spec.Clickhouse.SecurityContext),
+					},
 				},
-				Spec: corev1.PodSpec{
-					ServiceAccountName: cr.Name + "-clickhouse",
-					SecurityContext:    nonRootSecurityContext,
-					Affinity:           cr.Spec.Clickhouse.Affinity,
-					Tolerations:        cr.Spec.Clickhouse.Tolerations,
-					InitContainers: []corev1.Container{
-						{
-							Image:        UBIMinimalImage,
-							Name:         "config",
-							Command:      []string{"/bin/sh", "-c"},
-							Args:         []string{clickhouseConfigCmd("/config/config.xml", cr, shards, int(replicas), ClickhouseKeeperReplicas)},
-							VolumeMounts: []corev1.VolumeMount{{Name: "config", MountPath: "/config"}},
+				Containers: []corev1.Container{
+					{
+						Image:   ClickhouseImage,
+						Name:    "clickhouse-server",
+						Command: []string{"clickhouse-server"},
+						Args: []string{
+							"--config-file=/config/config.xml",
 						},
-					},
-					Containers: []corev1.Container{
-						{
-							Image:   ClickhouseImage,
-							Name:    "clickhouse-server",
-							Command: []string{"clickhouse-server"},
-							Args: []string{
-								"--config-file=/config/config.xml",
-							},
-							Ports: []corev1.ContainerPort{
-								{Name: "http", ContainerPort: 8123, Protocol: corev1.ProtocolTCP},
-								{Name: "tcp", ContainerPort: 9000, Protocol: corev1.ProtocolTCP},
-							},
-							Resources: cr.Spec.Clickhouse.Resources,
-							VolumeMounts: []corev1.VolumeMount{
-								{Name: "config", MountPath: "/config"},
-								{Name: "data", MountPath: "/var/lib/clickhouse"},
-							},
-							Env: []corev1.EnvVar{
-								{Name: "CLICKHOUSE_SHARD_ID", Value: fmt.Sprintf("shard-%d", shard)},
-								{Name: "CLICKHOUSE_REPLICA_ID", ValueFrom: &corev1.EnvVarSource{
-									FieldRef: &corev1.ObjectFieldSelector{
-										FieldPath: "metadata.name",
-									},
-								}},
-								{Name: "CLICKHOUSE_PASSWORD", ValueFrom: &corev1.EnvVarSource{
-									SecretKeyRef: &corev1.SecretKeySelector{
-										LocalObjectReference: corev1.LocalObjectReference{
-											Name: fmt.Sprintf("%s-clickhouse", cr.Name),
-										},
-										Key: "password",
+						Ports: []corev1.ContainerPort{
+							{Name: "http", ContainerPort: 8123, Protocol: corev1.ProtocolTCP},
+							{Name: "tcp", ContainerPort: 9000, Protocol: corev1.ProtocolTCP},
+							{Name: "metrics", ContainerPort: 9363, Protocol: corev1.ProtocolTCP},
+						},
+						Resources:       cr.Spec.Clickhouse.Resources,
+						SecurityContext: containerSecurityContext(cr.Spec.Clickhouse.SecurityContext),
+						Lifecycle:       clickhousePreStop,
+						VolumeMounts: []corev1.VolumeMount{
+							{Name: "config", MountPath: "/config"},
+							{Name: "tmp", MountPath: "/tmp"},
+							{Name: "data", MountPath: "/var/lib/clickhouse"},
+						},
+						Env: append([]corev1.EnvVar{
+							{Name: "CLICKHOUSE_SHARD_ID", Value: fmt.Sprintf("shard-%d", shard)},
+							{Name: "CLICKHOUSE_REPLICA_ID", ValueFrom: &corev1.EnvVarSource{
+								FieldRef: &corev1.ObjectFieldSelector{
+									FieldPath: "metadata.name",
+								},
+							}},
+							{Name: "CLICKHOUSE_PASSWORD", ValueFrom: &corev1.EnvVarSource{
+								SecretKeyRef: &corev1.SecretKeySelector{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: fmt.Sprintf("%s-clickhouse", cr.Name),
 									},
-								}},
-							},
-							ReadinessProbe: &corev1.Probe{
-								ProbeHandler: corev1.ProbeHandler{
-									HTTPGet: &corev1.HTTPGetAction{Path: "/ping", Port: intstr.FromString("http")},
+									Key: "password",
 								},
-								TimeoutSeconds: 10,
+							}},
+						}, clickhouseUsersEnv(cr)...),
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{Path: "/ping", Port: intstr.FromString("http")},
 							},
+							TimeoutSeconds: 10,
 						},
 					},
-					Volumes: []corev1.Volume{
-						{
-							Name: "config",
-							VolumeSource: corev1.VolumeSource{
-								EmptyDir: &corev1.EmptyDirVolumeSource{},
-							},
+				},
+				Volumes: []corev1.Volume{
+					{
+						Name: "config",
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
 						},
-						//{
-						//	Name: "data",
-						//	VolumeSource: corev1.VolumeSource{
-						//		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-						//			ClaimName: fmt.Sprintf("data-%s-clickhouse-shard-%d", cr.Name, shard),
-						//		},
-						//	},
-						//},
 					},
+					{
+						Name: "tmp",
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
+						},
+					},
+					//{
+					//	Name: "data",
+					//	VolumeSource: corev1.VolumeSource{
+					//		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					//			ClaimName: fmt.Sprintf("data-%s-clickhouse-shard-%d", cr.Name, shard),
+					//		},
+					//	},
+					//},
 				},
 			},
-		}
-
-		res = append(res, ss)
+		},
 	}
-	return res
+	applyStatefulSetStorage(cr.Spec.Clickhouse.Storage, ss)
+	applyContainerOverrides(&ss.Spec.Template.Spec.Containers[0], cr.Spec.Clickhouse.ExtraArgs, cr.Spec.Clickhouse.Lifecycle)
+	return ss
 }
 
 func clickhouseConfigCmd(filename string, cr *corootv1.Coroot, shards, replicas, keepers int) string {
-	params := struct {
-		Namespace string
-		Name      string
-		Shards    []int
-		Replicas  []int
-		Keepers   []int
-	}{
-		Namespace: cr.Namespace,
-		Name:      cr.Name,
-	}
-	for i := 0; i < shards; i++ {
-		params.Shards = append(params.Shards, i)
-	}
-	for i := 0; i < replicas; i++ {
-		params.Replicas = append(params.Replicas, i)
-	}
-	for i := 0; i < keepers; i++ {
-		params.Keepers = append(params.Keepers, i)
-	}
-	var out bytes.Buffer
-	_ = clickhouseConfigTemplate.Execute(&out, params)
-	return "cat <<EOF > " + filename + out.String() + "EOF"
+	return configCmd(filename, clickhouseConfig(cr, shards, replicas, keepers), cr.Spec.Clickhouse.ExtraConfig, "")
 }
 
-var clickhouseConfigTemplate = template.Must(template.New("").Parse(`
-<clickhouse>
-
-<display_name from_env="CLICKHOUSE_REPLICA_ID"/>
-
-<profiles>
-    <default>
-    </default>
-</profiles>
-
-<users>
-    <default>
-        <password from_env="CLICKHOUSE_PASSWORD"/>
-    </default>
-</users>
-
-<logger>
-    <console>1</console>
-    <level>information</level>
-</logger>
-
-<listen_host>0.0.0.0</listen_host>
-<http_port>8123</http_port>
-<tcp_port>9000</tcp_port>
-<interserver_http_port>9009</interserver_http_port>
-
-<concurrent_threads_soft_limit_num>0</concurrent_threads_soft_limit_num>
-<concurrent_threads_soft_limit_ratio_to_cores>2</concurrent_threads_soft_limit_ratio_to_cores>
-<max_concurrent_queries>1000</max_concurrent_queries>
-<max_server_memory_usage>0</max_server_memory_usage>
-<max_thread_pool_size>10000</max_thread_pool_size>
-<async_load_databases>true</async_load_databases>
-<mlock_executable>true</mlock_executable>
-
-<macros>
-    <shard from_env="CLICKHOUSE_SHARD_ID"/>
-    <replica from_env="CLICKHOUSE_REPLICA_ID"/>
-</macros>
-
-<remote_servers>
-    <default>
-        {{- range $shard := .Shards }}
-        <shard>
-            <internal_replication>true</internal_replication>
-            {{- range $replica := $.Replicas }}
-            <replica>
-                <host>{{$.Name}}-clickhouse-shard-{{$shard}}-{{$replica}}.{{$.Name}}-clickhouse-headless.{{$.Namespace}}</host>
-                <port>9000</port>
-                <user>default</user>
-                <password from_env="CLICKHOUSE_PASSWORD"/>
-            </replica>
-            {{- end }}
-        </shard>
-        {{- end }}
-    </default>
-</remote_servers>
-
-<zookeeper>
-    {{- range $keeper := .Keepers }}
-    <node>
-        <host>{{$.Name}}-clickhouse-keeper-{{$keeper}}.{{$.Name}}-clickhouse-keeper-headless.{{$.Namespace}}</host>
-        <port>9181</port>
-    </node>
-    {{- end }}
-</zookeeper>
-
-<distributed_ddl>
-    <path>/clickhouse/task_queue/ddl</path>
-</distributed_ddl>
+func clickhouseUsersEnv(cr *corootv1.Coroot) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for i, u := range cr.Spec.Clickhouse.AdditionalUsers {
+		env = append(env, corev1.EnvVar{Name: clickhouseUserPasswordEnv(i), ValueFrom: &corev1.EnvVarSource{SecretKeyRef: u.PasswordSecret}})
+	}
+	return env
+}
 
-</clickhouse>
-`))
+func clickhouseUserPasswordEnv(i int) string {
+	return fmt.Sprintf("CLICKHOUSE_USER_%d_PASSWORD", i)
+}
@@ -0,0 +1,310 @@
+package controller
+
+import (
+	"encoding/xml"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"math"
+	"path"
+	"slices"
+)
+
+// The structure of the ClickHouse server config. Elements named after users or tables use XMLName.
+type clickhouseServerConfig struct {
+	XMLName         xml.Name                    `xml:"clickhouse"`
+	DisplayName     xmlFromEnv                  `xml:"display_name"`
+	Profiles        clickhouseProfilesConfig    `xml:"profiles"`
+	Users           []clickhouseUserConfig      `xml:"users>user"`
+	Quotas          *clickhouseQuotasConfig     `xml:"quotas"`
+	Logger          xmlLogger                   `xml:"logger"`
+	SystemLogs      []clickhouseSystemLogConfig `xml:"system_log"`
+	ListenHost      string                      `xml:"listen_host"`
+	HTTPPort        int                         `xml:"http_port"`
+	TCPPort         int                         `xml:"tcp_port"`
+	InterserverPort int                         `xml:"interserver_http_port"`
+	Prometheus      xmlPrometheus               `xml:"prometheus"`
+
+	ConcurrentThreadsSoftLimitNum          int   `xml:"concurrent_threads_soft_limit_num"`
+	ConcurrentThreadsSoftLimitRatioToCores int   `xml:"concurrent_threads_soft_limit_ratio_to_cores"`
+	MaxConcurrentQueries                   int   `xml:"max_concurrent_queries"`
+	MaxServerMemoryUsage                   int64 `xml:"max_server_memory_usage"`
+	MaxThreadPoolSize                      int   `xml:"max_thread_pool_size"`
+	AsyncLoadDatabases                     bool  `xml:"async_load_databases"`
+	MlockExecutable                        bool  `xml:"mlock_executable"`
+
+	Compression    *clickhouseCompressionConfig `xml:"compression"`
+	Macros         clickhouseMacrosConfig       `xml:"macros"`
+	Shards         []clickhouseShardConfig      `xml:"remote_servers>default>shard"`
+	Zookeeper      []xmlHostPort                `xml:"zookeeper>node"`
+	DistributedDDL string                       `xml:"distributed_ddl>path"`
+}
+
+type xmlFromEnv struct {
+	Env string `xml:"from_env,attr"`
+}
+
+type xmlLogger struct {
+	Console int    `xml:"console"`
+	Level   string `xml:"level"`
+}
+
+type xmlPrometheus struct {
+	Endpoint            string `xml:"endpoint"`
+	Port                int    `xml:"port"`
+	Metrics             bool   `xml:"metrics"`
+	Events              bool   `xml:"events"`
+	AsynchronousMetrics bool   `xml:"asynchronous_metrics"`
+}
+
+type xmlHostPort struct {
+	Host string `xml:"host"`
+	Port int    `xml:"port"`
+}
+
+type clickhouseProfilesConfig struct {
+	Default  struct{}                         `xml:"default"`
+	Readonly *clickhouseReadonlyProfileConfig `xml:"readonly"`
+}
+
+type clickhouseReadonlyProfileConfig struct {
+	Readonly int `xml:"readonly"`
+}
+
+type clickhouseUserConfig struct {
+	XMLName  xml.Name
+	Password xmlFromEnv `xml:"password"`
+	Profile  string     `xml:"profile,omitempty"`
+	Quota    string     `xml:"quota,omitempty"`
+}
+
+type clickhouseQuotasConfig struct {
+	Quotas []clickhouseQuotaConfig `xml:"quota"`
+}
+
+// Zero values mean no limit.
+type clickhouseQuotaConfig struct {
+	XMLName  xml.Name
+	Interval *clickhouseQuotaIntervalConfig `xml:"interval"`
+}
+
+type clickhouseQuotaIntervalConfig struct {
+	Duration      int64 `xml:"duration"`
+	Queries       int64 `xml:"queries"`
+	Errors        int64 `xml:"errors"`
+	ResultRows    int64 `xml:"result_rows"`
+	ReadRows      int64 `xml:"read_rows"`
+	ExecutionTime int64 `xml:"execution_time"`
+}
+
+type clickhouseSystemLogConfig struct {
+	XMLName  xml.Name
+	Database string `xml:"database"`
+	Table    string `xml:"table"`
+	TTL      string `xml:"ttl,omitempty"`
+}
+
+type clickhouseCompressionConfig struct {
+	Method string `xml:"case>method"`
+	Level  int    `xml:"case>level,omitempty"`
+}
+
+type clickhouseMacrosConfig struct {
+	Shard   xmlFromEnv `xml:"shard"`
+	Replica xmlFromEnv `xml:"replica"`
+}
+
+type clickhouseShardConfig struct {
+	InternalReplication bool                      `xml:"internal_replication"`
+	Replicas            []clickhouseReplicaConfig `xml:"replica"`
+}
+
+type clickhouseReplicaConfig struct {
+	Host     string     `xml:"host"`
+	Port     int        `xml:"port"`
+	User     string     `xml:"user"`
+	Password xmlFromEnv `xml:"password"`
+}
+
+// The structure of the ClickHouse Keeper config. SERVER_ID is replaced with the pod ordinal by the init container.
+type clickhouseKeeperServerConfig struct {
+	XMLName    xml.Name      `xml:"clickhouse"`
+	Logger     xmlLogger     `xml:"logger"`
+	ListenHost string        `xml:"listen_host"`
+	Prometheus xmlPrometheus `xml:"prometheus"`
+
+	TCPPort             int    `xml:"keeper_server>tcp_port"`
+	ServerID            string `xml:"keeper_server>server_id"`
+	LogStoragePath      string `xml:"keeper_server>log_storage_path"`
+	SnapshotStoragePath string `xml:"keeper_server>snapshot_storage_path"`
+
+	OperationTimeoutMs int    `xml:"keeper_server>coordination_settings>operation_timeout_ms"`
+	SessionTimeoutMs   int    `xml:"keeper_server>coordination_settings>session_timeout_ms"`
+	RaftLogsLevel      string `xml:"keeper_server>coordination_settings>raft_logs_level"`
+
+	CheckNotExists    int `xml:"keeper_server>feature_flags>check_not_exists"`
+	CreateIfNotExists int `xml:"keeper_server>feature_flags>create_if_not_exists"`
+
+	ControlPort       int    `xml:"keeper_server>http_control>port"`
+	ReadinessEndpoint string `xml:"keeper_server>http_control>readiness>endpoint"`
+
+	Servers []clickhouseKeeperRaftServerConfig `xml:"keeper_server>raft_configuration>server"`
+}
+
+type clickhouseKeeperRaftServerConfig struct {
+	ID       int    `xml:"id"`
+	Hostname string `xml:"hostname"`
+	Port     int    `xml:"port"`
+}
+
+var clickhousePrometheus = xmlPrometheus{Endpoint: "/metrics", Port: 9363, Metrics: true, Events: true, AsynchronousMetrics: true}
+
+func clickhouseConfig(cr *corootv1.Coroot, shards, replicas, keepers int) string {
+	cfg := clickhouseServerConfig{
+		DisplayName:     xmlFromEnv{Env: "CLICKHOUSE_REPLICA_ID"},
+		Users:           []clickhouseUserConfig{{XMLName: xml.Name{Local: "default"}, Password: xmlFromEnv{Env: "CLICKHOUSE_PASSWORD"}}},
+		Logger:          xmlLogger{Console: 1, Level: cr.Spec.Clickhouse.LogLevel},
+		ListenHost:      "0.0.0.0",
+		HTTPPort:        8123,
+		TCPPort:         9000,
+		InterserverPort: 9009,
+		Prometheus:      clickhousePrometheus,
+
+		ConcurrentThreadsSoftLimitRatioToCores: 2,
+		MaxConcurrentQueries:                   1000,
+		MaxThreadPoolSize:                      10000,
+		AsyncLoadDatabases:                     true,
+		MlockExecutable:                        true,
+
+		Macros:         clickhouseMacrosConfig{Shard: xmlFromEnv{Env: "CLICKHOUSE_SHARD_ID"}, Replica: xmlFromEnv{Env: "CLICKHOUSE_REPLICA_ID"}},
+		DistributedDDL: "/clickhouse/task_queue/ddl",
+	}
+	if cfg.Logger.Level == "" {
+		cfg.Logger.Level = "information"
+	}
+	if _, ok := sizeProfiles[cr.Spec.SizeProfile]; ok {
+		// Leaves headroom below the container limit for the memory ClickHouse doesn't track.
+		if limit := cr.Spec.Clickhouse.Resources.Limits.Memory(); !limit.IsZero() {
+			cfg.MaxServerMemoryUsage = limit.Value() * 8 / 10
+		}
+	}
+
+	if len(cr.Spec.Clickhouse.AdditionalUsers) > 0 {
+		cfg.Profiles.Readonly = &clickhouseReadonlyProfileConfig{Readonly: 1}
+		cfg.Quotas = &clickhouseQuotasConfig{Quotas: []clickhouseQuotaConfig{{XMLName: xml.Name{Local: "default"}}}}
+	}
+	for i, u := range cr.Spec.Clickhouse.AdditionalUsers {
+		user := clickhouseUserConfig{XMLName: xml.Name{Local: u.Name}, Password: xmlFromEnv{Env: clickhouseUserPasswordEnv(i)}, Profile: "default"}
+		if u.Readonly {
+			user.Profile = "readonly"
+		}
+		if q := u.Quota; q != nil {
+			user.Quota = u.Name
+			interval := &clickhouseQuotaIntervalConfig{
+				Duration:      int64(q.Interval.Duration.Seconds()),
+				Queries:       q.Queries,
+				Errors:        q.Errors,
+				ResultRows:    q.ResultRows,
+				ReadRows:      q.ReadRows,
+				ExecutionTime: int64(q.ExecutionTime.Duration.Seconds()),
+			}
+			if interval.Duration == 0 {
+				interval.Duration = 3600
+			}
+			cfg.Quotas.Quotas = append(cfg.Quotas.Quotas, clickhouseQuotaConfig{XMLName: xml.Name{Local: u.Name}, Interval: interval})
+		}
+		cfg.Users = append(cfg.Users, user)
+	}
+
+	// This is the main config rather than an override in config.d, so a system log is enabled by its element
+	// and disabled by leaving it out. The remove and replace attributes only apply to the overrides.
+	if sl := cr.Spec.Clickhouse.SystemLogs; sl != nil {
+		ttlDays := int(math.Ceil(sl.TTL.Duration.Hours() / 24))
+		var enabled []string
+		for _, t := range sl.Enabled {
+			if table := string(t); !slices.Contains(enabled, table) {
+				enabled = append(enabled, table)
+			}
+		}
+		for _, table := range enabled {
+			l := clickhouseSystemLogConfig{XMLName: xml.Name{Local: table}, Database: "system", Table: table}
+			if ttlDays > 0 {
+				l.TTL = fmt.Sprintf("event_date + INTERVAL %d DAY DELETE", ttlDays)
+			}
+			cfg.SystemLogs = append(cfg.SystemLogs, l)
+		}
+	}
+
+	if s := cr.Spec.Clickhouse.Schema; s != nil && s.Compression != nil {
+		cfg.Compression = &clickhouseCompressionConfig{Method: s.Compression.Method, Level: s.Compression.Level}
+	}
+
+	for shard := 0; shard < shards; shard++ {
+		sc := clickhouseShardConfig{InternalReplication: true}
+		for replica := 0; replica < replicas; replica++ {
+			sc.Replicas = append(sc.Replicas, clickhouseReplicaConfig{
+				Host:     clickhouseReplicaHost(cr, shard, replica),
+				Port:     9000,
+				User:     "default",
+				Password: xmlFromEnv{Env: "CLICKHOUSE_PASSWORD"},
+			})
+		}
+		cfg.Shards = append(cfg.Shards, sc)
+	}
+	for keeper := 0; keeper < keepers; keeper++ {
+		cfg.Zookeeper = append(cfg.Zookeeper, xmlHostPort{
+			Host: fmt.Sprintf("%s-clickhouse-keeper-%d.%s-clickhouse-keeper-headless.%s", cr.Name, keeper, cr.Name, cr.Namespace),
+			Port: 9181,
+		})
+	}
+
+	data, _ := xml.MarshalIndent(cfg, "", "    ")
+	return string(data)
+}
+
+func clickhouseKeeperConfig(cr *corootv1.Coroot, replicas int) string {
+	cfg := clickhouseKeeperServerConfig{
+		Logger:     xmlLogger{Console: 1, Level: "information"},
+		ListenHost: "0.0.0.0",
+		Prometheus: clickhousePrometheus,
+
+		TCPPort:             9181,
+		ServerID:            "SERVER_ID",
+		LogStoragePath:      "/var/lib/clickhouse-keeper/coordination/log",
+		SnapshotStoragePath: "/var/lib/clickhouse-keeper/coordination/snapshots",
+
+		OperationTimeoutMs: 10000,
+		SessionTimeoutMs:   30000,
+		RaftLogsLevel:      "trace",
+
+		ControlPort:       9182,
+		ReadinessEndpoint: "/ready",
+	}
+	for id := 0; id < replicas; id++ {
+		cfg.Servers = append(cfg.Servers, clickhouseKeeperRaftServerConfig{
+			ID:       id,
+			Hostname: fmt.Sprintf("%s-clickhouse-keeper-%d.%s-clickhouse-keeper-headless.%s", cr.Name, id, cr.Name, cr.Namespace),
+			Port:     9234,
+		})
+	}
+	data, _ := xml.MarshalIndent(cfg, "", "    ")
+	return string(data)
+}
+
+func clickhouseReplicaHost(cr *corootv1.Coroot, shard, replica int) string {
+	return fmt.Sprintf("%s-clickhouse-shard-%d-%d.%s-clickhouse-headless.%s", cr.Name, shard, replica, cr.Name, cr.Namespace)
+}
+
+// configCmd returns a shell command for the init containers writing the config and, if set, the user overrides
+// into the config.d directory, which ClickHouse merges on top of the main config. The heredocs are quoted to prevent expansion.
+func configCmd(filename, config, extra, sedExpr string) string {
+	cmd := "cat <<'EOF'"
+	if sedExpr != "" {
+		cmd += " | sed " + sedExpr
+	}
+	cmd += " > " + filename + "\n" + config + "\nEOF"
+	if extra != "" {
+		dir := path.Join(path.Dir(filename), "config.d")
+		cmd += "\nmkdir -p " + dir + " && cat <<'EOF' > " + path.Join(dir, "extra.xml") + "\n" + extra + "\nEOF"
+	}
+	return cmd
+}
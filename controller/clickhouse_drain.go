@@ -0,0 +1,472 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Gives the Distributed tables of the remaining shards time to send the data queued for a removed shard.
+	ClickhouseDrainGracePeriod   = 2 * time.Minute
+	ClickhouseDrainCheckInterval = 30 * time.Second
+	ClickhouseDrainQueryTimeout  = time.Hour
+
+	ClickhouseShardDraining  = "Draining"
+	ClickhouseShardMigrating = "Migrating"
+	ClickhouseShardDeleting  = "Deleting"
+	ClickhouseShardDrained   = "Drained"
+)
+
+var (
+	clickhouseDistributedRe = regexp.MustCompile(`^Distributed\('?(\w+)'?,\s*'?(\w+)'?,\s*'?(\w+)'?`)
+	clickhouseDrainClient   = &http.Client{Timeout: ClickhouseDrainQueryTimeout}
+)
+
+// clickhouseShardDrain counts the rows of a removed shard, migrates its data, and drops its tables in the background,
+// as it may take hours. Reconcile only reads its state.
+type clickhouseShardDrain struct {
+	lock      sync.Mutex
+	phase     string
+	rows      uint64
+	rowsErr   error
+	migrated  []string
+	scaleDown *corootv1.ClickhouseScaleDownSpec
+	started   bool
+	start     chan struct{}
+	err       error
+	done      bool
+	cancel    context.CancelFunc
+}
+
+type clickhouseShardDrainState struct {
+	phase    string
+	rows     uint64
+	rowsErr  error
+	migrated []string
+	done     bool
+	err      error
+}
+
+func (d *clickhouseShardDrain) setPhase(phase string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.phase = phase
+}
+
+func (d *clickhouseShardDrain) setRows(rows uint64, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err == nil {
+		d.rows = rows
+	}
+	d.rowsErr = err
+}
+
+func (d *clickhouseShardDrain) addMigrated(partition string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.migrated = append(d.migrated, partition)
+}
+
+// begin lets the drain proceed from counting the rows to migrating and deleting the data.
+func (d *clickhouseShardDrain) begin() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.started {
+		d.started = true
+		close(d.start)
+	}
+}
+
+func (d *clickhouseShardDrain) finish(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.done, d.err = true, err
+}
+
+func (d *clickhouseShardDrain) state() clickhouseShardDrainState {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return clickhouseShardDrainState{
+		phase:    d.phase,
+		rows:     d.rows,
+		rowsErr:  d.rowsErr,
+		migrated: append([]string(nil), d.migrated...),
+		done:     d.done,
+		err:      d.err,
+	}
+}
+
+func clickhouseShardDrainKey(cr *corootv1.Coroot, shard int) string {
+	return fmt.Sprintf("%s/%s/%d", cr.Namespace, cr.Name, shard)
+}
+
+func clickhouseShardDrainPhase(cr *corootv1.Coroot, shard int) string {
+	for _, s := range cr.Status.ClickhouseShardDrains {
+		if s.Shard == shard {
+			return s.Phase
+		}
+	}
+	return ""
+}
+
+// drainingClickhouseShards returns the shards that still have StatefulSets but are beyond spec.clickhouse.shards.
+func (r *CorootReconciler) drainingClickhouseShards(ctx context.Context, cr *corootv1.Coroot) ([]int, error) {
+	shards := cr.Spec.Clickhouse.Shards
+	if shards == 0 {
+		shards = 1
+	}
+	list := &appsv1.StatefulSetList{}
+	if err := r.List(ctx, list, client.InNamespace(cr.Namespace), client.MatchingLabels(Labels(cr, "clickhouse"))); err != nil {
+		return nil, err
+	}
+	prefix := cr.Name + "-clickhouse-shard-"
+	var res []int
+	for i := range list.Items {
+		ss := &list.Items[i]
+		if !metav1.IsControlledBy(ss, cr) || !strings.HasPrefix(ss.Name, prefix) {
+			continue
+		}
+		shard, err := strconv.Atoi(strings.TrimPrefix(ss.Name, prefix))
+		if err != nil || shard < shards {
+			continue
+		}
+		res = append(res, shard)
+	}
+	sort.Ints(res)
+	return res, nil
+}
+
+// reconcileClickhouseDrains keeps the StatefulSets of the shards being drained and deletes the drained ones,
+// along with their PVCs if the reclaim policy is Delete.
+func (r *CorootReconciler) reconcileClickhouseDrains(ctx context.Context, cr *corootv1.Coroot) []error {
+	shards, err := r.drainingClickhouseShards(ctx, cr)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, shard := range shards {
+		ss := r.clickhouseStatefulSet(cr, shard)
+		if clickhouseShardDrainPhase(cr, shard) != ClickhouseShardDrained {
+			errs = append(errs, r.CreateOrUpdateStatefulSet(ctx, cr, ss))
+			continue
+		}
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, ss, true, nil))
+		if sd := cr.Spec.Clickhouse.ScaleDown; sd == nil || sd.ReclaimPolicy != corootv1.ClickhouseShardReclaimPolicyDelete {
+			continue
+		}
+		pvcs := &corev1.PersistentVolumeClaimList{}
+		if err = r.List(ctx, pvcs, client.InNamespace(cr.Namespace), client.MatchingLabels(Labels(cr, "clickhouse"))); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		prefix := fmt.Sprintf("data-%s-", ss.Name)
+		for i := range pvcs.Items {
+			if pvc := &pvcs.Items[i]; strings.HasPrefix(pvc.Name, prefix) {
+				errs = append(errs, r.CreateOrUpdate(ctx, cr, pvc, true, nil))
+			}
+		}
+	}
+	return errs
+}
+
+// checkClickhouseDrains advances the drains of the shards beyond spec.clickhouse.shards and reports them in the status.
+// A removed shard is excluded from the cluster config right away, so Coroot stops writing to it and it becomes read-only.
+// After a grace period, its data is migrated to the remaining shards and its tables are dropped if configured.
+// Then the shard is Drained, and its StatefulSet is deleted by the next reconciliation.
+// The queries run in the background, and their progress is persisted in the status, so a restarted drain resumes.
+func (r *CorootReconciler) checkClickhouseDrains(ctx context.Context, cr *corootv1.Coroot) time.Duration {
+	var shards []int
+	if cr.Spec.AgentsOnly == nil && cr.Spec.ExternalClickhouse == nil {
+		var err error
+		if shards, err = r.drainingClickhouseShards(ctx, cr); err != nil {
+			ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Error(err, "failed to list ClickHouse shards")
+			return ClickhouseDrainCheckInterval
+		}
+	}
+	r.stopClickhouseDrains(cr, shards)
+	if len(shards) == 0 {
+		cr.Status.ClickhouseShardDrains = nil
+		return 0
+	}
+	previous := map[int]corootv1.ClickhouseShardDrainStatus{}
+	for _, s := range cr.Status.ClickhouseShardDrains {
+		previous[s.Shard] = s
+	}
+	now := time.Now()
+	var drains []corootv1.ClickhouseShardDrainStatus
+	for _, shard := range shards {
+		s, ok := previous[shard]
+		if !ok {
+			s = corootv1.ClickhouseShardDrainStatus{Shard: shard, Phase: ClickhouseShardDraining, StartedAt: metav1.NewTime(now)}
+		}
+		// The pods of a hibernated shard are stopped, so the drain waits for the wake-up.
+		if s.Phase != ClickhouseShardDrained && !hibernated(cr) {
+			r.advanceClickhouseDrain(cr, &s, now)
+		}
+		drains = append(drains, s)
+	}
+	cr.Status.ClickhouseShardDrains = drains
+	return ClickhouseDrainCheckInterval
+}
+
+func (r *CorootReconciler) advanceClickhouseDrain(cr *corootv1.Coroot, s *corootv1.ClickhouseShardDrainStatus, now time.Time) {
+	sd := cr.Spec.Clickhouse.ScaleDown
+	migrate := sd != nil && (sd.MigrateData || sd.ReclaimPolicy == corootv1.ClickhouseShardReclaimPolicyDelete)
+	grace := s.Phase == ClickhouseShardDraining && now.Sub(s.StartedAt.Time) < ClickhouseDrainGracePeriod
+	if grace || migrate {
+		d := r.startClickhouseDrain(cr, s)
+		if !grace {
+			d.begin()
+		}
+		state := d.state()
+		s.Message = ""
+		if state.rowsErr != nil {
+			s.Message = state.rowsErr.Error()
+		} else {
+			s.Rows = state.rows
+		}
+		s.MigratedPartitions = state.migrated
+		switch {
+		case !state.done:
+			s.Phase = state.phase
+			return
+		case state.err != nil:
+			// The drain is restarted by the next check and resumes from the migrated partitions.
+			r.forgetClickhouseDrain(cr, s.Shard)
+			s.Message = state.err.Error()
+			return
+		}
+	}
+	r.forgetClickhouseDrain(cr, s.Shard)
+	s.Phase = ClickhouseShardDrained
+	ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Info("ClickHouse shard drained", "shard", s.Shard)
+	if r.recorder != nil {
+		r.recorder.Event(cr, corev1.EventTypeNormal, "ShardDrained", fmt.Sprintf("ClickHouse shard %d has been drained and will be deleted", s.Shard))
+	}
+}
+
+// startClickhouseDrain returns the background drain of the shard, starting it if it isn't running
+// or restarting it if spec.clickhouse.scaleDown has changed.
+func (r *CorootReconciler) startClickhouseDrain(cr *corootv1.Coroot, s *corootv1.ClickhouseShardDrainStatus) *clickhouseShardDrain {
+	r.clickhouseDrainsLock.Lock()
+	defer r.clickhouseDrainsLock.Unlock()
+	key := clickhouseShardDrainKey(cr, s.Shard)
+	if d := r.clickhouseDrains[key]; d != nil {
+		if reflect.DeepEqual(d.scaleDown, cr.Spec.Clickhouse.ScaleDown) {
+			return d
+		}
+		d.cancel()
+	}
+	if r.clickhouseDrains == nil {
+		r.clickhouseDrains = map[string]*clickhouseShardDrain{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &clickhouseShardDrain{
+		phase:     s.Phase,
+		rows:      s.Rows,
+		migrated:  append([]string(nil), s.MigratedPartitions...),
+		scaleDown: cr.Spec.Clickhouse.ScaleDown.DeepCopy(),
+		start:     make(chan struct{}),
+		cancel:    cancel,
+	}
+	r.clickhouseDrains[key] = d
+	cr = cr.DeepCopy()
+	shard := s.Shard
+	go func() {
+		logger := ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name, "shard", shard)
+		err := r.drainClickhouseShard(ctx, cr, shard, d)
+		if err != nil {
+			logger.Error(err, "failed to drain ClickHouse shard")
+		}
+		d.finish(err)
+		select {
+		case <-ctx.Done():
+		case r.refresh <- event.GenericEvent{Object: cr}:
+		}
+	}()
+	return d
+}
+
+func (r *CorootReconciler) forgetClickhouseDrain(cr *corootv1.Coroot, shard int) {
+	r.clickhouseDrainsLock.Lock()
+	defer r.clickhouseDrainsLock.Unlock()
+	key := clickhouseShardDrainKey(cr, shard)
+	if d := r.clickhouseDrains[key]; d != nil {
+		d.cancel()
+		delete(r.clickhouseDrains, key)
+	}
+}
+
+// stopClickhouseDrains cancels the background drains of the instance except for the given shards,
+// e.g., if the shards have been added back.
+func (r *CorootReconciler) stopClickhouseDrains(cr *corootv1.Coroot, keep []int) {
+	r.clickhouseDrainsLock.Lock()
+	defer r.clickhouseDrainsLock.Unlock()
+	keys := map[string]bool{}
+	for _, shard := range keep {
+		keys[clickhouseShardDrainKey(cr, shard)] = true
+	}
+	prefix := fmt.Sprintf("%s/%s/", cr.Namespace, cr.Name)
+	for key, d := range r.clickhouseDrains {
+		if strings.HasPrefix(key, prefix) && !keys[key] {
+			d.cancel()
+			delete(r.clickhouseDrains, key)
+		}
+	}
+}
+
+func (r *CorootReconciler) drainClickhouseShard(ctx context.Context, cr *corootv1.Coroot, shard int, d *clickhouseShardDrain) error {
+	// The rows are counted until the grace period is over.
+	for {
+		d.setRows(r.clickhouseShardRows(ctx, cr, shard))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.start:
+		case <-time.After(ClickhouseDrainCheckInterval):
+			continue
+		}
+		break
+	}
+	sd := cr.Spec.Clickhouse.ScaleDown
+	if sd == nil {
+		return nil
+	}
+	if sd.MigrateData {
+		d.setPhase(ClickhouseShardMigrating)
+		err := r.migrateClickhouseShard(ctx, cr, shard, d)
+		d.setRows(r.clickhouseShardRows(ctx, cr, shard))
+		if err != nil {
+			return err
+		}
+	}
+	if sd.ReclaimPolicy != corootv1.ClickhouseShardReclaimPolicyDelete {
+		return nil
+	}
+	d.setPhase(ClickhouseShardDeleting)
+	replicas := cr.Spec.Clickhouse.Replicas
+	if replicas == 0 {
+		replicas = 1
+	}
+	// Dropping the replicated tables removes the metadata of the shard from Keeper. Views go first, as they depend on the tables.
+	q := "SELECT name FROM system.tables WHERE database = 'default' AND (engine = 'MaterializedView' OR engine LIKE 'Replicated%') " +
+		"AND NOT startsWith(name, '.inner') ORDER BY engine = 'MaterializedView' DESC"
+	for replica := 0; replica < replicas; replica++ {
+		host := clickhouseReplicaHost(cr, shard, replica)
+		rows, err := r.clickhouseQueryAt(ctx, cr, clickhouseDrainClient, host, nil, q)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if _, err = r.clickhouseQueryAt(ctx, cr, clickhouseDrainClient, host, nil, fmt.Sprintf("DROP TABLE IF EXISTS default.`%s` SYNC", row[0])); err != nil {
+				return fmt.Errorf("failed to drop %s on %s: %w", row[0], host, err)
+			}
+		}
+	}
+	return nil
+}
+
+// migrateClickhouseShard re-inserts the rows of the shard's tables into the Distributed tables, which spread them across
+// the remaining shards, partition by partition, and drops each migrated partition from the shard.
+// A dropped partition is gone from the source, so it's never migrated twice. If the operator stops between the insert
+// and the drop, the partition is inserted again with the same deduplication token, and the replicated tables
+// of the remaining shards skip the blocks they already have. The rows are sorted, so the blocks are the same.
+func (r *CorootReconciler) migrateClickhouseShard(ctx context.Context, cr *corootv1.Coroot, shard int, d *clickhouseShardDrain) error {
+	logger := ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name, "shard", shard)
+	source, target := clickhouseReplicaHost(cr, shard, 0), clickhouseReplicaHost(cr, 0, 0)
+	password, err := r.clickhousePassword(ctx, cr)
+	if err != nil {
+		return err
+	}
+	rows, err := r.clickhouseQueryAt(ctx, cr, clickhouseDrainClient, target, nil,
+		"SELECT name, engine_full FROM system.tables WHERE database = 'default' AND engine = 'Distributed'")
+	if err != nil {
+		return err
+	}
+	distributed := map[string]string{}
+	for _, row := range rows {
+		if len(row) != 2 {
+			continue
+		}
+		if m := clickhouseDistributedRe.FindStringSubmatch(row[1]); m != nil && m[1] == "default" && m[2] == "default" {
+			distributed[m[3]] = row[0]
+		}
+	}
+	partitions, err := r.clickhouseQueryAt(ctx, cr, clickhouseDrainClient, source, nil,
+		"SELECT table, partition_id, sum(rows) FROM system.parts WHERE active AND database = 'default' AND NOT startsWith(table, '.inner') "+
+			"GROUP BY table, partition_id ORDER BY table, partition_id")
+	if err != nil {
+		return err
+	}
+	skipped := map[string]bool{}
+	for _, row := range partitions {
+		if len(row) != 3 {
+			continue
+		}
+		table, partition, rows := row[0], row[1], row[2]
+		dt, ok := distributed[table]
+		if !ok {
+			if !skipped[table] {
+				logger.Info("no Distributed table, skipping", "table", table)
+				skipped[table] = true
+			}
+			continue
+		}
+		// The rows are sent to the remaining shards before the query completes, so they can be deleted from the source.
+		// The query contains the password, so it's kept out of system.query_log and system.query_thread_log.
+		settings := url.Values{
+			"insert_distributed_sync":    {"1"},
+			"insert_deduplicate":         {"1"},
+			"insert_deduplication_token": {fmt.Sprintf("coroot-drain-%s-%d-%s-%s-%s", cr.UID, shard, table, partition, rows)},
+			"max_block_size":             {"65536"},
+			"log_queries":                {"0"},
+			"log_query_threads":          {"0"},
+		}
+		q := fmt.Sprintf("INSERT INTO default.`%s` SELECT * FROM remote(%s, default.`%s`, 'default', %s) WHERE _partition_id = %s ORDER BY ALL",
+			dt, clickhouseString(source+":9000"), table, clickhouseString(password), clickhouseString(partition))
+		if _, err = r.clickhouseQueryAt(ctx, cr, clickhouseDrainClient, target, settings, q); err != nil {
+			return fmt.Errorf("failed to migrate %s/%s: %w", table, partition, err)
+		}
+		q = fmt.Sprintf("ALTER TABLE default.`%s` DROP PARTITION ID %s", table, clickhouseString(partition))
+		if _, err = r.clickhouseQueryAt(ctx, cr, clickhouseDrainClient, source, nil, q); err != nil {
+			return fmt.Errorf("failed to drop %s/%s: %w", table, partition, err)
+		}
+		d.addMigrated(table + "/" + partition)
+		logger.Info("ClickHouse partition migrated", "table", table, "partition", partition)
+	}
+	return nil
+}
+
+// clickhouseString quotes a string literal for a ClickHouse query.
+func clickhouseString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func (r *CorootReconciler) clickhouseShardRows(ctx context.Context, cr *corootv1.Coroot, shard int) (uint64, error) {
+	rows, err := r.clickhouseQueryAt(ctx, cr, clickhouseSchemaClient, clickhouseReplicaHost(cr, shard, 0), nil,
+		"SELECT sum(rows) FROM system.parts WHERE active AND database = 'default'")
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 || len(rows[0]) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(rows[0][0], 10, 64)
+}
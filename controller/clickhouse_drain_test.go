@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+	"time"
+)
+
+func TestClickhouseShardDrain(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.UID = "uid"
+	cr.Spec.Clickhouse.Shards = 1
+	owned := func(obj client.Object) client.Object {
+		obj.SetNamespace(cr.Namespace)
+		obj.SetLabels(Labels(cr, "clickhouse"))
+		if err := ctrl.SetControllerReference(cr, obj, r.Scheme); err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+	remaining := owned(&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-shard-0"}})
+	removed := owned(&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-shard-1"}})
+	remainingPVC := owned(&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-coroot-clickhouse-shard-0-0"}})
+	removedPVC := owned(&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-coroot-clickhouse-shard-1-0"}})
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(remaining, removed, remainingPVC, removedPVC).Build()
+	ctx := context.Background()
+
+	shards, err := r.drainingClickhouseShards(ctx, cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{1}; !reflect.DeepEqual(shards, expected) {
+		t.Fatalf("expected %v, got %v", expected, shards)
+	}
+
+	// The removed shard is kept running until the writes stop.
+	r.checkClickhouseDrains(ctx, cr)
+	if phase := clickhouseShardDrainPhase(cr, 1); phase != ClickhouseShardDraining {
+		t.Fatalf("expected %s, got %q", ClickhouseShardDraining, phase)
+	}
+	cr.Status.ClickhouseShardDrains[0].StartedAt = metav1.NewTime(time.Now().Add(-ClickhouseDrainGracePeriod))
+	r.checkClickhouseDrains(ctx, cr)
+	if phase := clickhouseShardDrainPhase(cr, 1); phase != ClickhouseShardDrained {
+		t.Fatalf("expected %s, got %q", ClickhouseShardDrained, phase)
+	}
+
+	cr.Spec.Clickhouse.ScaleDown = &corootv1.ClickhouseScaleDownSpec{ReclaimPolicy: corootv1.ClickhouseShardReclaimPolicyDelete}
+	for _, err = range r.reconcileClickhouseDrains(ctx, cr) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for obj, deleted := range map[client.Object]bool{remaining: false, remainingPVC: false, removed: true, removedPVC: true} {
+		err = r.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+		if deleted != errors.IsNotFound(err) {
+			t.Errorf("%T %s: expected deleted=%v, got %v", obj, obj.GetName(), deleted, err)
+		}
+	}
+	r.checkClickhouseDrains(ctx, cr)
+	if cr.Status.ClickhouseShardDrains != nil {
+		t.Errorf("expected no drains, got %v", cr.Status.ClickhouseShardDrains)
+	}
+}
+
+func TestClickhouseShardDrainResume(t *testing.T) {
+	r := testReconciler(t)
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).Build()
+	cr := testCoroot()
+	cr.Spec.Clickhouse.ScaleDown = &corootv1.ClickhouseScaleDownSpec{MigrateData: true}
+	s := &corootv1.ClickhouseShardDrainStatus{
+		Shard:              1,
+		Phase:              ClickhouseShardMigrating,
+		StartedAt:          metav1.NewTime(time.Now().Add(-time.Hour)),
+		Rows:               100,
+		MigratedPartitions: []string{"logs/20240101"},
+	}
+	r.advanceClickhouseDrain(cr, s, time.Now())
+	defer r.stopClickhouseDrains(cr, nil)
+	if s.Phase != ClickhouseShardMigrating {
+		t.Errorf("expected %s, got %q", ClickhouseShardMigrating, s.Phase)
+	}
+	if expected := []string{"logs/20240101"}; !reflect.DeepEqual(s.MigratedPartitions, expected) {
+		t.Errorf("expected %v, got %v", expected, s.MigratedPartitions)
+	}
+	d := r.startClickhouseDrain(cr, s)
+	cr.Spec.Clickhouse.ScaleDown = &corootv1.ClickhouseScaleDownSpec{ReclaimPolicy: corootv1.ClickhouseShardReclaimPolicyDelete}
+	if r.startClickhouseDrain(cr, s) == d {
+		t.Error("expected the drain to be restarted after changing spec.clickhouse.scaleDown")
+	}
+}
+
+func TestClickhouseString(t *testing.T) {
+	for s, expected := range map[string]string{
+		"password":     `'password'`,
+		`it's`:         `'it\'s'`,
+		`a\', 'b`:      `'a\\\', \'b'`,
+		"shard-1:9000": `'shard-1:9000'`,
+	} {
+		if actual := clickhouseString(s); actual != expected {
+			t.Errorf("%q: expected %s, got %s", s, expected, actual)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package controller
 
 import (
-	"bytes"
 	"fmt"
 	corootv1 "github.io/coroot/operator/api/v1"
 	appsv1 "k8s.io/api/apps/v1"
@@ -9,7 +8,6 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
-	"text/template"
 )
 
 func (r *CorootReconciler) clickhouseKeeperServiceHeadless(cr *corootv1.Coroot) *corev1.Service {
@@ -46,20 +44,56 @@ func (r *CorootReconciler) clickhouseKeeperServiceHeadless(cr *corootv1.Coroot)
 	return s
 }
 
+// clickhouseKeeperServiceMetrics exposes the Prometheus endpoint of the Keeper members for scraping.
+func (r *CorootReconciler) clickhouseKeeperServiceMetrics(cr *corootv1.Coroot) *corev1.Service {
+	ls := Labels(cr, "clickhouse-keeper")
+	s := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-clickhouse-keeper-metrics", cr.Name),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+			Annotations: map[string]string{
+				"prometheus.io/scrape": "true",
+				"prometheus.io/port":   "9363",
+			},
+		},
+	}
+
+	s.Spec = corev1.ServiceSpec{
+		Selector:  ls,
+		ClusterIP: corev1.ClusterIPNone,
+		Type:      corev1.ServiceTypeClusterIP,
+		Ports: []corev1.ServicePort{
+			{
+				Name:       "metrics",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       9363,
+				TargetPort: intstr.FromString("metrics"),
+			},
+		},
+	}
+
+	return s
+}
+
 func (r *CorootReconciler) clickhouseKeeperPVCs(cr *corootv1.Coroot) []*corev1.PersistentVolumeClaim {
+	if !pvcStorage(cr.Spec.Clickhouse.Keeper.Storage) {
+		return nil
+	}
 	ls := Labels(cr, "clickhouse-keeper")
 	size := cr.Spec.Clickhouse.Keeper.Storage.Size
 	if size.IsZero() {
-		size, _ = resource.ParseQuantity("10Gi")
+		size, _ = resource.ParseQuantity(DefaultStorageSize)
 	}
 
 	var res []*corev1.PersistentVolumeClaim
 	for replica := 0; replica < ClickhouseKeeperReplicas; replica++ {
 		pvc := &corev1.PersistentVolumeClaim{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      fmt.Sprintf("data-%s-clickhouse-keeper-%d", cr.Name, replica),
-				Namespace: cr.Namespace,
-				Labels:    ls,
+				Name:        fmt.Sprintf("data-%s-clickhouse-keeper-%d", cr.Name, replica),
+				Namespace:   cr.Namespace,
+				Labels:      mergeLabels(ls, cr.Spec.Clickhouse.Keeper.Storage.Labels),
+				Annotations: cr.Spec.Clickhouse.Keeper.Storage.Annotations,
 			},
 			Spec: corev1.PersistentVolumeClaimSpec{
 				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
@@ -68,12 +102,14 @@ func (r *CorootReconciler) clickhouseKeeperPVCs(cr *corootv1.Coroot) []*corev1.P
 						corev1.ResourceStorage: size,
 					},
 				},
-				StorageClassName: cr.Spec.Storage.ClassName,
+				StorageClassName: storageClassName(cr.Spec.Clickhouse.Keeper.Storage, cr),
+				DataSourceRef:    cr.Spec.Clickhouse.Keeper.Storage.DataSourceRef,
+				Selector:         cr.Spec.Clickhouse.Keeper.Storage.Selector,
 			},
 		}
 		res = append(res, pvc)
 	}
-	return res
+	return snapshotDataSource(cr, res)
 }
 
 func (r *CorootReconciler) clickhouseKeeperStatefulSet(cr *corootv1.Coroot) *appsv1.StatefulSet {
@@ -82,40 +118,57 @@ func (r *CorootReconciler) clickhouseKeeperStatefulSet(cr *corootv1.Coroot) *app
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-clickhouse-keeper",
 			Namespace: cr.Namespace,
-			Labels:    ls,
+			Labels:    mergeLabels(ls, cr.Spec.Clickhouse.Keeper.Labels),
 		},
 	}
 
 	replicas := int32(ClickhouseKeeperReplicas)
+	ssReplicas := replicas
+	if hibernated(cr) {
+		ssReplicas = 0
+	}
 	ss.Spec = appsv1.StatefulSetSpec{
 		Selector: &metav1.LabelSelector{
 			MatchLabels: ls,
 		},
-		Replicas:    &replicas,
-		ServiceName: fmt.Sprintf("%s-clickhouse-keeper-headless", cr.Name),
+		Replicas:            &ssReplicas,
+		ServiceName:         fmt.Sprintf("%s-clickhouse-keeper-headless", cr.Name),
+		PodManagementPolicy: cr.Spec.Clickhouse.Keeper.PodManagementPolicy,
+		MinReadySeconds:     cr.Spec.Clickhouse.Keeper.MinReadySeconds,
 		VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      "data",
-				Namespace: cr.Namespace,
+				Name:        "data",
+				Namespace:   cr.Namespace,
+				Labels:      mergeLabels(Labels(cr, "clickhouse-keeper"), cr.Spec.Clickhouse.Keeper.Storage.Labels),
+				Annotations: cr.Spec.Clickhouse.Keeper.Storage.Annotations,
 			},
 		}},
 		Template: corev1.PodTemplateSpec{
 			ObjectMeta: metav1.ObjectMeta{
-				Labels:      ls,
-				Annotations: cr.Spec.Clickhouse.Keeper.PodAnnotations,
+				Labels:      mergeLabels(ls, cr.Spec.Clickhouse.Keeper.PodLabels),
+				Annotations: podAnnotations(cr, cr.Spec.Clickhouse.Keeper.PodAnnotations, true),
 			},
 			Spec: corev1.PodSpec{
-				ServiceAccountName: cr.Name + "-clickhouse-keeper",
-				SecurityContext:    nonRootSecurityContext,
-				Affinity:           cr.Spec.Clickhouse.Keeper.Affinity,
-				Tolerations:        cr.Spec.Clickhouse.Keeper.Tolerations,
+				ServiceAccountName:            serviceAccountName(cr, "clickhouse-keeper"),
+				DNSPolicy:                     cr.Spec.Clickhouse.Keeper.DNSPolicy,
+				DNSConfig:                     cr.Spec.Clickhouse.Keeper.DNSConfig,
+				HostAliases:                   cr.Spec.Clickhouse.Keeper.HostAliases,
+				SecurityContext:               podSecurityContext(cr.Spec.Clickhouse.Keeper.PodSecurityContext),
+				Affinity:                      affinity(archAffinity(cr.Spec.Clickhouse.Keeper.Affinity, cr.Spec.Clickhouse.Keeper.Architectures), cr.Spec.Clickhouse.Keeper.PodAntiAffinityPreset, ls),
+				Tolerations:                   cr.Spec.Clickhouse.Keeper.Tolerations,
+				NodeSelector:                  linuxNodeSelector,
+				PriorityClassName:             cr.Spec.Clickhouse.Keeper.PriorityClassName,
+				SchedulerName:                 cr.Spec.Clickhouse.Keeper.SchedulerName,
+				RuntimeClassName:              cr.Spec.Clickhouse.Keeper.RuntimeClassName,
+				TerminationGracePeriodSeconds: terminationGracePeriod(cr.Spec.Clickhouse.Keeper.TerminationGracePeriodSeconds, ClickhouseKeeperTerminationGracePeriod),
 				InitContainers: []corev1.Container{
 					{
-						Image:        UBIMinimalImage,
-						Name:         "config",
-						Command:      []string{"/bin/sh", "-c"},
-						Args:         []string{clickhouseKeeperConfigCmd("/config/config.xml", cr, int(replicas))},
-						VolumeMounts: []corev1.VolumeMount{{Name: "config", MountPath: "/config"}},
+						Image:           UBIMinimalImage,
+						Name:            "config",
+						Command:         []string{"/bin/sh", "-c"},
+						Args:            []string{clickhouseKeeperConfigCmd("/config/config.xml", cr, int(replicas))},
+						VolumeMounts:    []corev1.VolumeMount{{Name: "config", MountPath: "/config"}},
+						SecurityContext: containerSecurityContext(cr.Spec.Clickhouse.Keeper.SecurityContext),
 					},
 				},
 				Containers: []corev1.Container{
@@ -130,12 +183,15 @@ func (r *CorootReconciler) clickhouseKeeperStatefulSet(cr *corootv1.Coroot) *app
 							{Name: "client", ContainerPort: 9181, Protocol: corev1.ProtocolTCP},
 							{Name: "control", ContainerPort: 9182, Protocol: corev1.ProtocolTCP},
 							{Name: "inter", ContainerPort: 9234, Protocol: corev1.ProtocolTCP},
+							{Name: "metrics", ContainerPort: 9363, Protocol: corev1.ProtocolTCP},
 						},
 						VolumeMounts: []corev1.VolumeMount{
 							{Name: "config", MountPath: "/config"},
+							{Name: "tmp", MountPath: "/tmp"},
 							{Name: "data", MountPath: "/var/lib/clickhouse-keeper"},
 						},
-						Resources: cr.Spec.Clickhouse.Keeper.Resources,
+						Resources:       cr.Spec.Clickhouse.Keeper.Resources,
+						SecurityContext: containerSecurityContext(cr.Spec.Clickhouse.Keeper.SecurityContext),
 						//ReadinessProbe: &corev1.Probe{
 						//	ProbeHandler: corev1.ProbeHandler{
 						//		//HTTPGet: &corev1.HTTPGetAction{Path: "/ready", Port: intstr.FromString("control")},
@@ -152,71 +208,22 @@ func (r *CorootReconciler) clickhouseKeeperStatefulSet(cr *corootv1.Coroot) *app
 							EmptyDir: &corev1.EmptyDirVolumeSource{},
 						},
 					},
+					{
+						Name: "tmp",
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
+						},
+					},
 				},
 			},
 		},
 	}
+	applyStatefulSetStorage(cr.Spec.Clickhouse.Keeper.Storage, ss)
+	applyContainerOverrides(&ss.Spec.Template.Spec.Containers[0], cr.Spec.Clickhouse.Keeper.ExtraArgs, cr.Spec.Clickhouse.Keeper.Lifecycle)
 
 	return ss
 }
 
 func clickhouseKeeperConfigCmd(filename string, cr *corootv1.Coroot, replicas int) string {
-	params := struct {
-		Namespace string
-		Name      string
-		Ids       []int
-	}{
-		Namespace: cr.Namespace,
-		Name:      cr.Name,
-	}
-	for id := 0; id < replicas; id++ {
-		params.Ids = append(params.Ids, id)
-	}
-	var out bytes.Buffer
-	_ = clickhouseKeeperConfigTemplate.Execute(&out, params)
-	return "cat <<EOF | sed s/SERVER_ID/$(echo $HOSTNAME | sed -E 's/.*-([0-9]+)$/\\1/')/ > " + filename + out.String() + "EOF"
+	return configCmd(filename, clickhouseKeeperConfig(cr, replicas), cr.Spec.Clickhouse.Keeper.ExtraConfig, "s/SERVER_ID/$(echo $HOSTNAME | sed -E 's/.*-([0-9]+)$/\\1/')/")
 }
-
-var clickhouseKeeperConfigTemplate = template.Must(template.New("").Parse(`
-<clickhouse>
-<logger>
-    <console>1</console>
-    <level>information</level>
-</logger>
-<listen_host>0.0.0.0</listen_host>
-<keeper_server>
-    <tcp_port>9181</tcp_port>
-    <server_id>SERVER_ID</server_id>
-    <log_storage_path>/var/lib/clickhouse-keeper/coordination/log</log_storage_path>
-    <snapshot_storage_path>/var/lib/clickhouse-keeper/coordination/snapshots</snapshot_storage_path>
-
-    <coordination_settings>
-        <operation_timeout_ms>10000</operation_timeout_ms>
-        <session_timeout_ms>30000</session_timeout_ms>
-        <raft_logs_level>trace</raft_logs_level>
-    </coordination_settings>
-
-    <feature_flags>
-        <check_not_exists>0</check_not_exists>
-        <create_if_not_exists>0</create_if_not_exists>
-    </feature_flags>
-
-    <http_control>
-        <port>9182</port>
-        <readiness>
-            <endpoint>/ready</endpoint>
-        </readiness>
-    </http_control>
-
-    <raft_configuration>
-        {{- range $id := .Ids }}
-        <server>
-            <id>{{$id}}</id>
-            <hostname>{{$.Name}}-clickhouse-keeper-{{$id}}.{{$.Name}}-clickhouse-keeper-headless.{{$.Namespace}}</hostname>
-            <port>9234</port>
-        </server>
-        {{- end }}
-    </raft_configuration>
-</keeper_server>
-</clickhouse>
-`))
@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ConditionTypeKeeperQuorum = "KeeperQuorum"
+
+	KeeperCheckInterval = 30 * time.Second
+	// Quorum must be lost for this long before the recovery is forced, to not interfere with rolling restarts.
+	KeeperRecoveryDelay = 2 * time.Minute
+	// The recovery is forced again if the quorum hasn't been restored within this time.
+	KeeperRecoveryTimeout = 5 * time.Minute
+)
+
+// checkClickhouseKeeper publishes the states of the Keeper members, probed in the background using the four-letter-word commands, into the status.
+// If the quorum has been lost (e.g., a member has lost its PVC and rejoined with an empty state) and autoRecovery is enabled,
+// it forces the most up-to-date member to recover the ensemble and restarts the others so they resync from it.
+// The recovery relies on the PVCs to find the member with the data, so it's skipped with hostPath and ephemeral storage.
+// It returns false if the ensemble is not healthy and should be checked again.
+func (r *CorootReconciler) checkClickhouseKeeper(ctx context.Context, cr *corootv1.Coroot) bool {
+	if cr.Spec.AgentsOnly != nil || cr.Spec.ExternalClickhouse != nil || hibernated(cr) {
+		cr.Status.Keeper = nil
+		cr.Status.ClickhouseKeeper = nil
+		meta.RemoveStatusCondition(&cr.Status.Conditions, ConditionTypeKeeperQuorum)
+		return true
+	}
+
+	members, ok := runBackgroundCheck(r, cr, "keeper", "", KeeperCheckInterval, func(ctx context.Context) []corootv1.KeeperMemberStatus {
+		var res []corootv1.KeeperMemberStatus
+		for id := 0; id < ClickhouseKeeperReplicas; id++ {
+			res = append(res, checkKeeperMember(ctx, keeperMemberName(cr, id), keeperMemberAddress(cr, id)))
+		}
+		return res
+	})
+	if !ok {
+		return false
+	}
+	summary := &corootv1.ClickhouseKeeperStatus{Members: ClickhouseKeeperReplicas}
+	for _, m := range members {
+		switch m.State {
+		case "leader", "standalone":
+			summary.Leader = m.Name
+			summary.ActiveMembers++
+		case "follower":
+			summary.ActiveMembers++
+		}
+	}
+	hasLeader := summary.Leader != ""
+	summary.QuorumAvailable = hasLeader
+	cr.Status.Keeper = members
+	cr.Status.ClickhouseKeeper = summary
+
+	condition := metav1.Condition{
+		Type:               ConditionTypeKeeperQuorum,
+		Status:             metav1.ConditionTrue,
+		Reason:             "QuorumAvailable",
+		ObservedGeneration: cr.Generation,
+	}
+	var unhealthy []string
+	for _, m := range members {
+		switch {
+		case m.Message != "":
+			unhealthy = append(unhealthy, fmt.Sprintf("%s: %s", m.Name, m.Message))
+		case m.State != "leader" && m.State != "follower" && m.State != "standalone":
+			unhealthy = append(unhealthy, fmt.Sprintf("%s: %s", m.Name, m.State))
+		}
+	}
+	condition.Message = strings.Join(unhealthy, "; ")
+	if hasLeader {
+		meta.SetStatusCondition(&cr.Status.Conditions, condition)
+		return len(unhealthy) == 0
+	}
+
+	condition.Status = metav1.ConditionFalse
+	condition.Reason = "NoQuorum"
+	prev := meta.FindStatusCondition(cr.Status.Conditions, ConditionTypeKeeperQuorum)
+	if prev == nil || prev.Status != metav1.ConditionFalse {
+		meta.SetStatusCondition(&cr.Status.Conditions, condition)
+		return false
+	}
+	since := time.Since(prev.LastTransitionTime.Time)
+	switch {
+	case !cr.Spec.Clickhouse.Keeper.AutoRecovery:
+	case !pvcStorage(cr.Spec.Clickhouse.Keeper.Storage):
+		condition.Message = "autoRecovery isn't supported with hostPath and ephemeral storage, the ensemble has to be recovered manually"
+	case prev.Reason == "NoQuorum" && since < KeeperRecoveryDelay:
+	case prev.Reason == "Recovering" && since < KeeperRecoveryTimeout:
+		condition.Reason = prev.Reason
+		condition.Message = prev.Message
+	default:
+		r.startClickhouseKeeperRecovery(cr, members)
+		condition.Reason = "Recovering"
+		condition.Message = "forcing recovery"
+		// The transition time is used to track the recovery timeout, so it's reset.
+		meta.RemoveStatusCondition(&cr.Status.Conditions, ConditionTypeKeeperQuorum)
+	}
+	meta.SetStatusCondition(&cr.Status.Conditions, condition)
+	return false
+}
+
+// startClickhouseKeeperRecovery runs the recovery in the background. If it fails, it's retried after KeeperRecoveryTimeout.
+func (r *CorootReconciler) startClickhouseKeeperRecovery(cr *corootv1.Coroot, members []corootv1.KeeperMemberStatus) {
+	cr = cr.DeepCopy()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), BackgroundCheckTimeout)
+		defer cancel()
+		logger := ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name)
+		recovered, err := r.recoverClickhouseKeeper(ctx, cr, members)
+		if err != nil {
+			logger.Error(err, "failed to recover ClickHouse Keeper")
+			if r.recorder != nil {
+				r.recorder.Event(cr, corev1.EventTypeWarning, "KeeperRecoveryFailed", fmt.Sprintf("ClickHouse Keeper quorum is lost, recovery failed: %s", err))
+			}
+			return
+		}
+		logger.Info("ClickHouse Keeper quorum is lost, forced recovery", "member", recovered)
+		if r.recorder != nil {
+			r.recorder.Event(cr, corev1.EventTypeWarning, "KeeperRecovery", fmt.Sprintf("ClickHouse Keeper quorum is lost, forced recovery on %s", recovered))
+		}
+	}()
+}
+
+// recoverClickhouseKeeper sends the rcvr command to the member with the most recent log and restarts the other members.
+// Members with the same log index are ordered by the creation time of their PVCs, since a recreated PVC holds no data.
+func (r *CorootReconciler) recoverClickhouseKeeper(ctx context.Context, cr *corootv1.Coroot, members []corootv1.KeeperMemberStatus) (string, error) {
+	type candidate struct {
+		id      int
+		index   uint64
+		created time.Time
+	}
+	var candidates []candidate
+	for id, m := range members {
+		if m.Message != "" {
+			continue
+		}
+		pvc := &corev1.PersistentVolumeClaim{}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: fmt.Sprintf("data-%s", m.Name)}, pvc); err != nil {
+			return "", err
+		}
+		candidates = append(candidates, candidate{id: id, index: m.LastLogIndex, created: pvc.CreationTimestamp.Time})
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no reachable members")
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].index != candidates[j].index {
+			return candidates[i].index > candidates[j].index
+		}
+		return candidates[i].created.Before(candidates[j].created)
+	})
+	leader := candidates[0].id
+	if _, err := keeperCommand(ctx, keeperMemberAddress(cr, leader), "rcvr"); err != nil {
+		return "", err
+	}
+	for id := 0; id < ClickhouseKeeperReplicas; id++ {
+		if id == leader {
+			continue
+		}
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: cr.Namespace, Name: keeperMemberName(cr, id)}}
+		if err := r.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+			return "", err
+		}
+	}
+	return keeperMemberName(cr, leader), nil
+}
+
+func keeperMemberName(cr *corootv1.Coroot, id int) string {
+	return fmt.Sprintf("%s-clickhouse-keeper-%d", cr.Name, id)
+}
+
+func keeperMemberAddress(cr *corootv1.Coroot, id int) string {
+	return fmt.Sprintf("%s.%s-clickhouse-keeper-headless.%s:9181", keeperMemberName(cr, id), cr.Name, cr.Namespace)
+}
+
+func checkKeeperMember(ctx context.Context, name, address string) corootv1.KeeperMemberStatus {
+	res := corootv1.KeeperMemberStatus{Name: name}
+	mntr, err := keeperCommand(ctx, address, "mntr")
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	// Members without a quorum don't serve most of the commands.
+	res.State = mntr["zk_server_state"]
+	if res.State == "" {
+		res.State = "not serving"
+	}
+	if lgif, err := keeperCommand(ctx, address, "lgif"); err == nil {
+		res.LastLogIndex, _ = strconv.ParseUint(lgif["last_log_idx"], 10, 64)
+	}
+	return res
+}
+
+// keeperCommand sends a four-letter-word command and parses the tab-separated key-value response.
+func keeperCommand(ctx context.Context, address, cmd string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, PreflightTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write([]byte(cmd)); err != nil {
+		return nil, err
+	}
+	res := map[string]string{}
+	rd := bufio.NewReader(io.LimitReader(conn, 1<<20))
+	for {
+		line, err := rd.ReadString('\n')
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), "\t"); ok {
+			res[k] = v
+		}
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"io"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/url"
+	"regexp"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ConditionTypeClickhouseSchemaInSync = "ClickhouseSchemaInSync"
+
+	ClickhouseSchemaCheckInterval = 10 * time.Minute
+	ClickhouseDefaultRetention    = 7 * 24 * time.Hour
+)
+
+var (
+	clickhouseTTLRe        = regexp.MustCompile(`TTL (.+?) \+ toInterval(Second|Minute|Hour|Day|Week|Month)\((\d+)\)`)
+	clickhouseTTLUnits     = map[string]time.Duration{"Second": time.Second, "Minute": time.Minute, "Hour": time.Hour, "Day": 24 * time.Hour, "Week": 7 * 24 * time.Hour, "Month": 30 * 24 * time.Hour}
+	clickhouseSchemaClient = &http.Client{Timeout: PreflightTimeout}
+)
+
+// checkClickhouseSchema compares the TTL of the tables created by Coroot in the operator-managed ClickHouse with the configured retention
+// and publishes the tables that have drifted into the status. If enforce is set, these tables are altered.
+// ClickHouse is queried in the background, so the status reflects the last completed check.
+func (r *CorootReconciler) checkClickhouseSchema(ctx context.Context, cr *corootv1.Coroot) {
+	s := cr.Spec.Clickhouse.Schema
+	if s == nil || cr.Spec.AgentsOnly != nil || cr.Spec.ExternalClickhouse != nil || hibernated(cr) {
+		cr.Status.ClickhouseSchema = nil
+		meta.RemoveStatusCondition(&cr.Status.Conditions, ConditionTypeClickhouseSchemaInSync)
+		return
+	}
+	retention := s.Retention.Duration
+	if retention == 0 {
+		retention = ClickhouseDefaultRetention
+	}
+
+	check, ok := runBackgroundCheck(r, cr, "clickhouse-schema", backgroundCheckInput(retention, s.Enforce), ClickhouseSchemaCheckInterval, func(ctx context.Context) clickhouseSchemaCheck {
+		var res clickhouseSchemaCheck
+		res.drift, res.err = r.clickhouseSchemaDrift(ctx, cr, retention)
+		if res.err == nil && len(res.drift) > 0 && s.Enforce {
+			res.enforceErr = r.enforceClickhouseTTL(ctx, cr, res.drift, retention)
+		}
+		return res
+	})
+	if !ok {
+		return
+	}
+
+	condition := metav1.Condition{
+		Type:               ConditionTypeClickhouseSchemaInSync,
+		Status:             metav1.ConditionTrue,
+		Reason:             "InSync",
+		ObservedGeneration: cr.Generation,
+	}
+	drift := check.drift
+	switch {
+	case check.err != nil:
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "CheckFailed"
+		condition.Message = check.err.Error()
+	case len(drift) > 0:
+		var tables []string
+		for _, t := range drift {
+			tables = append(tables, t.Name)
+		}
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Drift"
+		condition.Message = "TTL differs from the retention: " + strings.Join(tables, ", ")
+		if s.Enforce {
+			if check.enforceErr != nil {
+				condition.Reason = "EnforceFailed"
+				condition.Message = check.enforceErr.Error()
+			} else {
+				condition.Reason = "Enforced"
+				condition.Message = "TTL altered: " + strings.Join(tables, ", ")
+			}
+		}
+	}
+	cr.Status.ClickhouseSchema = drift
+	meta.SetStatusCondition(&cr.Status.Conditions, condition)
+}
+
+// clickhouseSchemaCheck is the result of a background schema check.
+type clickhouseSchemaCheck struct {
+	drift      []corootv1.ClickhouseTableStatus
+	err        error
+	enforceErr error
+}
+
+func (r *CorootReconciler) clickhouseSchemaDrift(ctx context.Context, cr *corootv1.Coroot, retention time.Duration) ([]corootv1.ClickhouseTableStatus, error) {
+	rows, err := r.clickhouseQuery(ctx, cr, "SELECT name, engine_full FROM system.tables WHERE database = 'default' AND engine LIKE '%MergeTree'")
+	if err != nil {
+		return nil, err
+	}
+	var res []corootv1.ClickhouseTableStatus
+	for _, row := range rows {
+		if len(row) != 2 {
+			continue
+		}
+		m := clickhouseTTLRe.FindStringSubmatch(row[1])
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.ParseInt(m[3], 10, 64)
+		if time.Duration(n)*clickhouseTTLUnits[m[2]] == retention {
+			continue
+		}
+		res = append(res, corootv1.ClickhouseTableStatus{Name: row[0], TTL: strings.TrimPrefix(m[0], "TTL ")})
+	}
+	return res, nil
+}
+
+func (r *CorootReconciler) enforceClickhouseTTL(ctx context.Context, cr *corootv1.Coroot, tables []corootv1.ClickhouseTableStatus, retention time.Duration) error {
+	logger := ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name)
+	for _, t := range tables {
+		m := clickhouseTTLRe.FindStringSubmatch("TTL " + t.TTL)
+		if m == nil {
+			continue
+		}
+		ttl := fmt.Sprintf("%s + toIntervalSecond(%d)", m[1], int64(retention.Seconds()))
+		q := fmt.Sprintf("ALTER TABLE default.`%s` ON CLUSTER default MODIFY TTL %s", t.Name, ttl)
+		if _, err := r.clickhouseQuery(ctx, cr, q); err != nil {
+			return fmt.Errorf("failed to alter %s: %w", t.Name, err)
+		}
+		logger.Info("ClickHouse table TTL altered", "table", t.Name, "ttl", ttl)
+	}
+	return nil
+}
+
+// clickhouseQuery runs a query through the HTTP interface of the operator-managed ClickHouse and returns the rows
+// (in the default TabSeparated format of the interface).
+func (r *CorootReconciler) clickhouseQuery(ctx context.Context, cr *corootv1.Coroot, query string) ([][]string, error) {
+	return r.clickhouseQueryAt(ctx, cr, clickhouseSchemaClient, fmt.Sprintf("%s-clickhouse.%s", cr.Name, cr.Namespace), nil, query)
+}
+
+// clickhouseQueryAt runs a query on the given ClickHouse host, e.g., a replica of a particular shard, with the given settings.
+func (r *CorootReconciler) clickhouseQueryAt(ctx context.Context, cr *corootv1.Coroot, c *http.Client, host string, settings url.Values, query string) ([][]string, error) {
+	password, err := r.clickhousePassword(ctx, cr)
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("http://%s:8123/", host)
+	if len(settings) > 0 {
+		u += "?" + settings.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-ClickHouse-User", "default")
+	req.Header.Set("X-ClickHouse-Key", password)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var rows [][]string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		rows = append(rows, strings.Split(scanner.Text(), "\t"))
+	}
+	return rows, scanner.Err()
+}
+
+func (r *CorootReconciler) clickhousePassword(ctx context.Context, cr *corootv1.Coroot) (string, error) {
+	return r.secretValue(ctx, cr, "", secretKeySelector(fmt.Sprintf("%s-clickhouse", cr.Name), "password"))
+}
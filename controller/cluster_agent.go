@@ -1,12 +1,19 @@
 package controller
 
 import (
+	"context"
 	"fmt"
 	corootv1 "github.io/coroot/operator/api/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sort"
+	"strings"
 )
 
 const (
@@ -16,41 +23,125 @@ const (
 func (r *CorootReconciler) clusterAgentClusterRoleBinding(cr *corootv1.Coroot) *rbacv1.ClusterRoleBinding {
 	b := &rbacv1.ClusterRoleBinding{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   cr.Name + "-cluster-agent",
-			Labels: Labels(cr, "coroot-cluster-agent"),
+			Name:   ClusterScopedName(cr, "cluster-agent"),
+			Labels: ClusterScopedLabels(cr, "coroot-cluster-agent"),
 		},
 		Subjects: []rbacv1.Subject{
 			{
 				Kind:      rbacv1.ServiceAccountKind,
-				Name:      cr.Name + "-cluster-agent",
+				Name:      serviceAccountName(cr, "cluster-agent"),
 				Namespace: cr.Namespace,
 			},
 		},
 		RoleRef: rbacv1.RoleRef{
 			APIGroup: rbacv1.GroupName,
 			Kind:     "ClusterRole",
-			Name:     cr.Name + "-cluster-agent",
+			Name:     ClusterScopedName(cr, "cluster-agent"),
 		},
 	}
 	return b
 }
 
-func (r *CorootReconciler) clusterAgentClusterRole(cr *corootv1.Coroot) *rbacv1.ClusterRole {
-	verbs := []string{"get", "list", "watch"}
+// clusterAgentClusterRole returns the ClusterRole of the cluster-agent.
+// If discovery is restricted to a set of namespaces, it only grants access to cluster-scoped resources,
+// while namespaced ones are granted by clusterAgentDiscoveryRole in each of the namespaces.
+func (r *CorootReconciler) clusterAgentClusterRole(cr *corootv1.Coroot, namespaces []string) *rbacv1.ClusterRole {
 	role := &rbacv1.ClusterRole{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   cr.Name + "-cluster-agent",
-			Labels: Labels(cr, "coroot-cluster-agent"),
+			Name:   ClusterScopedName(cr, "cluster-agent"),
+			Labels: ClusterScopedLabels(cr, "coroot-cluster-agent"),
 		},
-		Rules: []rbacv1.PolicyRule{
+		Rules: clusterAgentRules(cr, false),
+	}
+	if len(namespaces) > 0 {
+		role.Rules = clusterAgentClusterScopedRules()
+	}
+	role.Rules = append(role.Rules, cr.Spec.ClusterAgent.ExtraRBACRules...)
+	return role
+}
+
+func (r *CorootReconciler) clusterAgentDiscoveryRole(cr *corootv1.Coroot, namespace string) *rbacv1.Role {
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ClusterScopedName(cr, "cluster-agent"),
+			Namespace: namespace,
+			Labels:    ClusterScopedLabels(cr, "coroot-cluster-agent"),
+		},
+		Rules: clusterAgentRules(cr, true),
+	}
+	return role
+}
+
+func (r *CorootReconciler) clusterAgentDiscoveryRoleBinding(cr *corootv1.Coroot, namespace string) *rbacv1.RoleBinding {
+	b := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ClusterScopedName(cr, "cluster-agent"),
+			Namespace: namespace,
+			Labels:    ClusterScopedLabels(cr, "coroot-cluster-agent"),
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      serviceAccountName(cr, "cluster-agent"),
+				Namespace: cr.Namespace,
+			},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     ClusterScopedName(cr, "cluster-agent"),
+		},
+	}
+	return b
+}
+
+func (r *CorootReconciler) clusterAgentRole(cr *corootv1.Coroot) *rbacv1.Role {
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-cluster-agent",
+			Namespace: cr.Namespace,
+			Labels:    Labels(cr, "coroot-cluster-agent"),
+		},
+		Rules: append(clusterAgentRules(cr, true), cr.Spec.ClusterAgent.ExtraRBACRules...),
+	}
+	return role
+}
+
+func (r *CorootReconciler) clusterAgentRoleBinding(cr *corootv1.Coroot) *rbacv1.RoleBinding {
+	b := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-cluster-agent",
+			Namespace: cr.Namespace,
+			Labels:    Labels(cr, "coroot-cluster-agent"),
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      serviceAccountName(cr, "cluster-agent"),
+				Namespace: cr.Namespace,
+			},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     cr.Name + "-cluster-agent",
+		},
+	}
+	return b
+}
+
+func clusterAgentRules(cr *corootv1.Coroot, namespaced bool) []rbacv1.PolicyRule {
+	verbs := []string{"get", "list", "watch"}
+	if namespaced {
+		return append([]rbacv1.PolicyRule{
 			{
 				APIGroups: []string{""},
-				Resources: []string{"namespaces", "nodes", "pods", "services", "endpoints", "persistentvolumeclaims", "persistentvolumes"},
+				Resources: []string{"pods", "services", "endpoints", "persistentvolumeclaims"},
 				Verbs:     verbs,
 			},
 			{
 				APIGroups: []string{"apps"},
-				Resources: []string{"deployments", "replicasets", "daemonsets", "statefulsets", "cronjobs"},
+				Resources: []string{"deployments", "replicasets", "daemonsets", "statefulsets"},
 				Verbs:     verbs,
 			},
 			{
@@ -58,23 +149,151 @@ func (r *CorootReconciler) clusterAgentClusterRole(cr *corootv1.Coroot) *rbacv1.
 				Resources: []string{"cronjobs", "jobs"},
 				Verbs:     verbs,
 			},
-			{
-				APIGroups: []string{"storage.k8s.io"},
-				Resources: []string{"storageclasses", "volumeattachments"},
-				Verbs:     verbs,
-			},
+		}, kubernetesEventsRules(cr)...)
+	}
+	return append([]rbacv1.PolicyRule{
+		{
+			APIGroups: []string{""},
+			Resources: []string{"namespaces", "nodes", "pods", "services", "endpoints", "persistentvolumeclaims", "persistentvolumes"},
+			Verbs:     verbs,
+		},
+		{
+			APIGroups: []string{"apps"},
+			Resources: []string{"deployments", "replicasets", "daemonsets", "statefulsets", "cronjobs"},
+			Verbs:     verbs,
+		},
+		{
+			APIGroups: []string{"batch"},
+			Resources: []string{"cronjobs", "jobs"},
+			Verbs:     verbs,
+		},
+		{
+			APIGroups: []string{"storage.k8s.io"},
+			Resources: []string{"storageclasses", "volumeattachments"},
+			Verbs:     verbs,
+		},
+	}, kubernetesEventsRules(cr)...)
+}
+
+func clusterAgentClusterScopedRules() []rbacv1.PolicyRule {
+	verbs := []string{"get", "list", "watch"}
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{""},
+			Resources: []string{"namespaces", "nodes", "persistentvolumes"},
+			Verbs:     verbs,
+		},
+		{
+			APIGroups: []string{"storage.k8s.io"},
+			Resources: []string{"storageclasses", "volumeattachments"},
+			Verbs:     verbs,
 		},
 	}
-	return role
 }
 
-func (r *CorootReconciler) clusterAgentDeployment(cr *corootv1.Coroot) *appsv1.Deployment {
+// clusterAgentNamespaces returns the namespaces the discovery is restricted to, or nil if it isn't restricted.
+// selected are the namespaces matching the namespace selector.
+func (r *CorootReconciler) clusterAgentNamespaces(cr *corootv1.Coroot, selected []string) []string {
+	ca := cr.Spec.ClusterAgent
+	if r.namespaceScoped(cr) || (len(ca.Namespaces) == 0 && ca.NamespaceSelector == nil) {
+		return nil
+	}
+	set := map[string]bool{cr.Namespace: true}
+	for _, ns := range ca.Namespaces {
+		set[ns] = true
+	}
+	for _, ns := range selected {
+		set[ns] = true
+	}
+	res := make([]string, 0, len(set))
+	for ns := range set {
+		res = append(res, ns)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// discoveryNamespaces resolves the namespaces the cluster-agent discovery is restricted to.
+func (r *CorootReconciler) discoveryNamespaces(ctx context.Context, cr *corootv1.Coroot) ([]string, error) {
+	var selected []string
+	if sel := cr.Spec.ClusterAgent.NamespaceSelector; sel != nil && !r.namespaceScoped(cr) {
+		// On errors, the discovery is restricted to the explicitly listed namespaces rather than widened to the whole cluster.
+		selector, err := metav1.LabelSelectorAsSelector(sel)
+		if err != nil {
+			return r.clusterAgentNamespaces(cr, nil), fmt.Errorf("invalid clusterAgent.namespaceSelector: %w", err)
+		}
+		list := &corev1.NamespaceList{}
+		if err = r.List(ctx, list, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return r.clusterAgentNamespaces(cr, nil), fmt.Errorf("failed to list namespaces: %w", err)
+		}
+		for _, ns := range list.Items {
+			selected = append(selected, ns.Name)
+		}
+	}
+	return r.clusterAgentNamespaces(cr, selected), nil
+}
+
+// namespaceRequests enqueues the Coroot instances which cluster-agent discovery or tenants depend on namespace labels.
+func (r *CorootReconciler) namespaceRequests(ctx context.Context, _ client.Object) []reconcile.Request {
+	list := &corootv1.CorootList{}
+	if err := r.List(ctx, list); err != nil {
+		ctrl.Log.Error(err, "failed to list Coroot instances")
+		return nil
+	}
+	var res []reconcile.Request
+	for _, cr := range list.Items {
+		if cr.Spec.ClusterAgent.NamespaceSelector != nil || cr.Spec.TenantNamespaceSelector != nil {
+			res = append(res, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&cr)})
+		}
+	}
+	return res
+}
+
+func (r *CorootReconciler) CreateOrUpdateClusterAgentDiscoveryRoles(ctx context.Context, cr *corootv1.Coroot, namespaces []string) []error {
+	var errs []error
+	keep := map[string]bool{}
+	for _, ns := range namespaces {
+		keep[ns] = true
+		errs = append(errs, r.CreateOrUpdateRole(ctx, cr, r.clusterAgentDiscoveryRole(cr, ns)))
+		errs = append(errs, r.CreateOrUpdateRoleBinding(ctx, cr, r.clusterAgentDiscoveryRoleBinding(cr, ns)))
+	}
+	errs = append(errs, r.deleteClusterAgentDiscoveryRoles(ctx, cr, keep))
+	return errs
+}
+
+// deleteClusterAgentDiscoveryRoles deletes the discovery Roles and RoleBindings in the namespaces that are not kept.
+// They are looked up by labels since they can't be owned by a Coroot from another namespace.
+func (r *CorootReconciler) deleteClusterAgentDiscoveryRoles(ctx context.Context, cr *corootv1.Coroot, keep map[string]bool) error {
+	ls := client.MatchingLabels(ClusterScopedLabels(cr, "coroot-cluster-agent"))
+	bindings := &rbacv1.RoleBindingList{}
+	if err := r.List(ctx, bindings, ls); err != nil {
+		return fmt.Errorf("failed to list cluster-agent RoleBindings: %w", err)
+	}
+	roles := &rbacv1.RoleList{}
+	if err := r.List(ctx, roles, ls); err != nil {
+		return fmt.Errorf("failed to list cluster-agent Roles: %w", err)
+	}
+	var errs []error
+	for i := range bindings.Items {
+		if b := &bindings.Items[i]; !keep[b.Namespace] {
+			errs = append(errs, r.CreateOrUpdate(ctx, cr, b, true, nil))
+		}
+	}
+	for i := range roles.Items {
+		if role := &roles.Items[i]; !keep[role.Namespace] {
+			errs = append(errs, r.CreateOrUpdate(ctx, cr, role, true, nil))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (r *CorootReconciler) clusterAgentDeployment(cr *corootv1.Coroot, namespaces []string) *appsv1.Deployment {
 	ls := Labels(cr, "coroot-cluster-agent")
 	d := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-cluster-agent",
 			Namespace: cr.Namespace,
-			Labels:    ls,
+			Labels:    mergeLabels(ls, cr.Spec.ClusterAgent.Labels),
 		},
 	}
 
@@ -88,27 +307,61 @@ func (r *CorootReconciler) clusterAgentDeployment(cr *corootv1.Coroot) *appsv1.D
 	}
 	env := []corev1.EnvVar{
 		{Name: "COROOT_URL", Value: corootUrl},
-		{Name: "API_KEY", Value: cr.Spec.ApiKey},
+		secretEnv("API_KEY", cr.Spec.ApiKey, cr.Spec.ApiKeySecret),
 		{Name: "METRICS_SCRAPE_INTERVAL", Value: scrapeInterval},
 		{Name: "KUBE_STATE_METRICS_ADDRESS", Value: "127.0.0.1:10302"},
 	}
+	env = append(env, proxyEnv(cr)...)
 	for _, e := range cr.Spec.ClusterAgent.Env {
 		env = append(env, e)
 	}
+
+	ksmArgs := []string{
+		"--host=127.0.0.1",
+		"--port=10302",
+		"--resources=namespaces,nodes,daemonsets,deployments,cronjobs,jobs,persistentvolumeclaims,persistentvolumes,pods,replicasets,services,statefulsets,storageclasses,volumeattachments",
+		"--metric-labels-allowlist=pods=[*]",
+	}
+	if len(namespaces) > 0 {
+		ksmArgs = []string{
+			"--host=127.0.0.1",
+			"--port=10302",
+			"--resources=namespaces,nodes,daemonsets,deployments,cronjobs,jobs,persistentvolumeclaims,persistentvolumes,pods,replicasets,services,statefulsets,storageclasses,volumeattachments",
+			"--namespaces=" + strings.Join(namespaces, ","),
+			"--metric-labels-allowlist=pods=[*]",
+		}
+	}
+	if r.namespaceScoped(cr) {
+		ksmArgs = []string{
+			"--host=127.0.0.1",
+			"--port=10302",
+			"--resources=daemonsets,deployments,cronjobs,jobs,persistentvolumeclaims,pods,replicasets,services,statefulsets",
+			"--namespaces=" + cr.Namespace,
+			"--metric-labels-allowlist=pods=[*]",
+		}
+	}
 	d.Spec = appsv1.DeploymentSpec{
 		Selector: &metav1.LabelSelector{
 			MatchLabels: ls,
 		},
+		Replicas: cr.Spec.ClusterAgent.Replicas,
 		Template: corev1.PodTemplateSpec{
 			ObjectMeta: metav1.ObjectMeta{
-				Labels:      ls,
-				Annotations: cr.Spec.ClusterAgent.PodAnnotations,
+				Labels:      mergeLabels(ls, cr.Spec.ClusterAgent.PodLabels),
+				Annotations: podAnnotations(cr, cr.Spec.ClusterAgent.PodAnnotations, false),
 			},
 			Spec: corev1.PodSpec{
-				ServiceAccountName: cr.Name + "-cluster-agent",
-				SecurityContext:    nonRootSecurityContext,
-				Affinity:           cr.Spec.ClusterAgent.Affinity,
+				ServiceAccountName: serviceAccountName(cr, "cluster-agent"),
+				DNSPolicy:          cr.Spec.ClusterAgent.DNSPolicy,
+				DNSConfig:          cr.Spec.ClusterAgent.DNSConfig,
+				HostAliases:        cr.Spec.ClusterAgent.HostAliases,
+				SecurityContext:    podSecurityContext(cr.Spec.ClusterAgent.PodSecurityContext),
+				Affinity:           affinity(archAffinity(cr.Spec.ClusterAgent.Affinity, cr.Spec.ClusterAgent.Architectures), cr.Spec.ClusterAgent.PodAntiAffinityPreset, ls),
 				Tolerations:        cr.Spec.ClusterAgent.Tolerations,
+				NodeSelector:       linuxNodeSelector,
+				PriorityClassName:  cr.Spec.ClusterAgent.PriorityClassName,
+				SchedulerName:      cr.Spec.ClusterAgent.SchedulerName,
+				RuntimeClassName:   cr.Spec.ClusterAgent.RuntimeClassName,
 				Containers: []corev1.Container{
 					{
 						Image: r.getAppImage(cr, AppClusterAgent),
@@ -117,21 +370,18 @@ func (r *CorootReconciler) clusterAgentDeployment(cr *corootv1.Coroot) *appsv1.D
 							"--listen=127.0.0.1:10301",
 							"--metrics-wal-dir=/tmp",
 						},
-						Resources: cr.Spec.ClusterAgent.Resources,
+						Resources:       cr.Spec.ClusterAgent.Resources,
+						SecurityContext: containerSecurityContext(cr.Spec.ClusterAgent.SecurityContext),
 						VolumeMounts: []corev1.VolumeMount{
 							{Name: "tmp", MountPath: "/tmp"},
 						},
-						Env: env,
+						Env: goRuntimeEnv(env, cr.Spec.ClusterAgent.Resources),
 					},
 					{
-						Image: KubeStateMetricsImage,
-						Name:  "kube-state-metrics",
-						Args: []string{
-							"--host=127.0.0.1",
-							"--port=10302",
-							"--resources=namespaces,nodes,daemonsets,deployments,cronjobs,jobs,persistentvolumeclaims,persistentvolumes,pods,replicasets,services,statefulsets,storageclasses,volumeattachments",
-							"--metric-labels-allowlist=pods=[*]",
-						},
+						Image:           KubeStateMetricsImage,
+						Name:            "kube-state-metrics",
+						Args:            ksmArgs,
+						SecurityContext: containerSecurityContext(cr.Spec.ClusterAgent.SecurityContext),
 						Resources: corev1.ResourceRequirements{
 							Requests: cr.Spec.ClusterAgent.Resources.Requests,
 							Limits:   cr.Spec.ClusterAgent.Resources.Limits,
@@ -149,6 +399,11 @@ func (r *CorootReconciler) clusterAgentDeployment(cr *corootv1.Coroot) *appsv1.D
 			},
 		},
 	}
+	if s := cr.Spec.ClusterAgent.UpdateStrategy; s != nil {
+		d.Spec.Strategy = *s
+	}
+	applyCustomCA(cr, &d.Spec.Template.Spec)
+	applyContainerOverrides(&d.Spec.Template.Spec.Containers[0], cr.Spec.ClusterAgent.ExtraArgs, cr.Spec.ClusterAgent.Lifecycle)
 
 	return d
 }
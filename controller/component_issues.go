@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A container killed by the OOM killer is reported for a while after it has been restarted.
+const oomKilledReportPeriod = 15 * time.Minute
+
+// checkComponentIssues summarizes the problems of the component pods into the status,
+// so it's visible why a component is down without inspecting its pods.
+// It returns when to check again to clear the reported OOM kills.
+func (r *CorootReconciler) checkComponentIssues(ctx context.Context, cr *corootv1.Coroot) time.Duration {
+	pods := &corev1.PodList{}
+	err := r.List(ctx, pods, client.InNamespace(cr.Namespace), client.MatchingLabels{
+		"app.kubernetes.io/managed-by": "coroot-operator",
+		"app.kubernetes.io/part-of":    cr.Name,
+	})
+	if err != nil {
+		ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Error(err, "failed to list pods")
+		return 0
+	}
+	issues := map[[2]string]*corootv1.ComponentIssueStatus{}
+	for _, pod := range pods.Items {
+		reason, message := podIssue(&pod, time.Now())
+		if reason == "" {
+			continue
+		}
+		component := pod.Labels["app.kubernetes.io/component"]
+		key := [2]string{component, reason}
+		if issues[key] == nil {
+			issues[key] = &corootv1.ComponentIssueStatus{Component: component, Reason: reason, Message: fmt.Sprintf("%s: %s", pod.Name, message)}
+		}
+		issues[key].Pods++
+	}
+	var res []corootv1.ComponentIssueStatus
+	var requeue time.Duration
+	for _, i := range issues {
+		res = append(res, *i)
+		if i.Reason == "OOMKilled" {
+			requeue = oomKilledReportPeriod
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Component != res[j].Component {
+			return res[i].Component < res[j].Component
+		}
+		return res[i].Reason < res[j].Reason
+	})
+	cr.Status.ComponentIssues = res
+	return requeue
+}
+
+// podIssue returns the reason and the message of the most relevant problem of the pod, or an empty reason if it's fine.
+func podIssue(pod *corev1.Pod, now time.Time) (string, string) {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded {
+		return "", ""
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionFalse && c.Reason == corev1.PodReasonUnschedulable {
+			if strings.Contains(c.Message, "PersistentVolumeClaim") {
+				return "PVCPending", c.Message
+			}
+			return "Unschedulable", c.Message
+		}
+	}
+	var statuses []corev1.ContainerStatus
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, s := range statuses {
+		if last := s.LastTerminationState.Terminated; last != nil && last.Reason == "OOMKilled" {
+			if s.State.Waiting != nil || now.Sub(last.FinishedAt.Time) < oomKilledReportPeriod {
+				return "OOMKilled", fmt.Sprintf("container %s was killed by the OOM killer (%d restarts)", s.Name, s.RestartCount)
+			}
+		}
+		w := s.State.Waiting
+		if w == nil {
+			continue
+		}
+		switch w.Reason {
+		case "ErrImagePull", "ImagePullBackOff", "InvalidImageName":
+			return "ImagePullError", fmt.Sprintf("container %s: %s", s.Name, w.Message)
+		case "CreateContainerConfigError", "CreateContainerError":
+			return "ConfigError", fmt.Sprintf("container %s: %s", s.Name, w.Message)
+		case "CrashLoopBackOff":
+			return "CrashLoopBackOff", fmt.Sprintf("container %s: %s", s.Name, w.Message)
+		}
+	}
+	return "", ""
+}
+
+// podRequests maps the component pods to their Coroot instances.
+func podRequests(_ context.Context, obj client.Object) []reconcile.Request {
+	name := obj.GetLabels()["app.kubernetes.io/part-of"]
+	if name == "" || obj.GetLabels()["app.kubernetes.io/managed-by"] != "coroot-operator" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}}}
+}
+
+// podIssueChanged filters out the pod events that don't change the issues, e.g., readiness updates.
+var podIssueChanged = predicate.Funcs{
+	CreateFunc: func(event.CreateEvent) bool { return false },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		now := time.Now()
+		prev, _ := podIssue(e.ObjectOld.(*corev1.Pod), now)
+		curr, _ := podIssue(e.ObjectNew.(*corev1.Pod), now)
+		return prev != curr
+	},
+	DeleteFunc: func(e event.DeleteEvent) bool {
+		pod, ok := e.Object.(*corev1.Pod)
+		if !ok {
+			return true
+		}
+		reason, _ := podIssue(pod, time.Now())
+		return reason != ""
+	},
+}
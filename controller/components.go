@@ -0,0 +1,314 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"runtime/debug"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"strings"
+	"time"
+)
+
+// Components reconciled independently of each other, each reported in the <Component>Reconciled condition.
+const (
+	ComponentAgents       = "Agents"
+	ComponentCoroot       = "Coroot"
+	ComponentPrometheus   = "Prometheus"
+	ComponentKeeper       = "Keeper"
+	ComponentClickhouse   = "Clickhouse"
+	ComponentIntegrations = "Integrations"
+)
+
+var components = []string{ComponentAgents, ComponentCoroot, ComponentPrometheus, ComponentKeeper, ComponentClickhouse, ComponentIntegrations}
+
+const (
+	ComponentRetryMinInterval = 5 * time.Second
+	ComponentRetryMaxInterval = 5 * time.Minute
+)
+
+// componentResult is the outcome of applying the child resources of a component.
+type componentResult struct {
+	Component string
+	Errors    []error
+}
+
+func (res componentResult) Err() error {
+	return utilerrors.NewAggregate(res.Errors)
+}
+
+func componentConditionType(component string) string {
+	return component + "Reconciled"
+}
+
+// reconcileChildren applies the child resources component by component. A failing component doesn't stop the others,
+// so the healthy ones make progress, except for the ones waiting for their storage.
+func (r *CorootReconciler) reconcileChildren(ctx context.Context, cr *corootv1.Coroot) []componentResult {
+	results := []componentResult{r.reconcileComponent(ctx, cr, ComponentAgents, r.reconcileAgents)}
+	if cr.Spec.AgentsOnly != nil {
+		// The resources of the other components are pruned, except for the PVCs and Secrets.
+		cr.Status.AdminPasswordSecret = ""
+		cr.Status.Version = ""
+		meta.RemoveStatusCondition(&cr.Status.Conditions, ConditionTypeStorageReady)
+		return results
+	}
+
+	if cr.Spec.Replicas > 1 && cr.Spec.Postgres == nil {
+		ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Error(fmt.Errorf("postgres not configured"), "Coroot requires Postgres to run multiple replicas (will run only one replica)")
+		cr.Spec.Replicas = 1
+	}
+	// PVCs that can't be satisfied would leave the components Pending, so the components with storage aren't applied instead.
+	storageErr := r.checkStorage(ctx, cr)
+	for _, c := range []struct {
+		name      string
+		reconcile func(context.Context, *corootv1.Coroot) []error
+	}{
+		{ComponentCoroot, r.reconcileCoroot},
+		{ComponentPrometheus, r.reconcilePrometheus},
+		{ComponentKeeper, r.reconcileKeeper},
+		{ComponentClickhouse, r.reconcileClickhouse},
+	} {
+		if storageErr != nil {
+			results = append(results, componentResult{Component: c.name, Errors: []error{storageErr}})
+			continue
+		}
+		results = append(results, r.reconcileComponent(ctx, cr, c.name, c.reconcile))
+	}
+	results = append(results, r.reconcileComponent(ctx, cr, ComponentIntegrations, r.reconcileIntegrations))
+	return results
+}
+
+func (r *CorootReconciler) reconcileComponent(ctx context.Context, cr *corootv1.Coroot, component string, reconcile func(context.Context, *corootv1.Coroot) []error) (res componentResult) {
+	res.Component = component
+	// Unexpected input must fail the reconciliation of this component only, not crash-loop the operator.
+	defer func() {
+		if p := recover(); p != nil {
+			err := fmt.Errorf("panic: %v", p)
+			ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name, "component", component).Error(err, "failed to reconcile child resources", "stack", string(debug.Stack()))
+			res.Errors = append(res.Errors, err)
+		}
+	}()
+	for _, err := range reconcile(ctx, cr) {
+		if err != nil {
+			res.Errors = append(res.Errors, err)
+		}
+	}
+	return res
+}
+
+// setComponentConditions reports the results in the <Component>Reconciled conditions and returns the errors
+// prefixed with the names of the failed components.
+func setComponentConditions(cr *corootv1.Coroot, results []componentResult) error {
+	var errs []error
+	reconciled := map[string]bool{}
+	for _, res := range results {
+		reconciled[res.Component] = true
+		c := metav1.Condition{Type: componentConditionType(res.Component), Status: metav1.ConditionTrue, Reason: "Reconciled", ObservedGeneration: cr.Generation}
+		if err := res.Err(); err != nil {
+			c.Status = metav1.ConditionFalse
+			c.Reason = "ApplyFailed"
+			c.Message = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", strings.ToLower(res.Component), err))
+		}
+		meta.SetStatusCondition(&cr.Status.Conditions, c)
+	}
+	for _, component := range components {
+		if !reconciled[component] {
+			meta.RemoveStatusCondition(&cr.Status.Conditions, componentConditionType(component))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// componentRetryInterval returns when the failed components must be retried. Each component backs off on its own:
+// the interval doubles while it keeps failing and is reset once it's applied, so a component that fails persistently
+// doesn't slow down the retries of one that failed once, and a healthy instance isn't requeued at all.
+func (r *CorootReconciler) componentRetryInterval(cr *corootv1.Coroot, results []componentResult) time.Duration {
+	r.componentRetriesLock.Lock()
+	defer r.componentRetriesLock.Unlock()
+	if r.componentRetries == nil {
+		r.componentRetries = map[string]time.Duration{}
+	}
+	var retry time.Duration
+	for _, res := range results {
+		key := backgroundCheckKey(cr, res.Component)
+		if res.Err() == nil {
+			delete(r.componentRetries, key)
+			continue
+		}
+		backoff := min(max(2*r.componentRetries[key], ComponentRetryMinInterval), ComponentRetryMaxInterval)
+		r.componentRetries[key] = backoff
+		if retry == 0 || backoff < retry {
+			retry = backoff
+		}
+	}
+	return retry
+}
+
+// forgetComponentRetries drops the backoffs of the components of a deleted instance.
+func (r *CorootReconciler) forgetComponentRetries(cr *corootv1.Coroot) {
+	r.componentRetriesLock.Lock()
+	defer r.componentRetriesLock.Unlock()
+	prefix := backgroundCheckKey(cr, "")
+	for key := range r.componentRetries {
+		if strings.HasPrefix(key, prefix) {
+			delete(r.componentRetries, key)
+		}
+	}
+}
+
+func (r *CorootReconciler) reconcileAgents(ctx context.Context, cr *corootv1.Coroot) []error {
+	var errs []error
+	errs = append(errs, r.CreateOrUpdateRole(ctx, cr, r.openshiftSCCRole(cr, sccNonroot)))
+	errs = append(errs, r.CreateOrUpdateRole(ctx, cr, r.openshiftSCCRole(cr, sccPrivileged)))
+
+	errs = append(errs, r.CreateOrUpdateServiceAccount(ctx, cr, "node-agent", sccPrivileged))
+	errs = append(errs, r.CreateOrUpdateDaemonSet(ctx, cr, r.nodeAgentDaemonSet(cr)))
+	if m := cr.Spec.NodeAgent.Metrics; m != nil && m.HeadlessService {
+		errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.nodeAgentServiceHeadless(cr)))
+	} else {
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.nodeAgentServiceHeadless(cr), true, nil))
+	}
+
+	errs = append(errs, r.CreateOrUpdateServiceAccount(ctx, cr, "cluster-agent", sccNonroot))
+	namespaces, err := r.discoveryNamespaces(ctx, cr)
+	errs = append(errs, err)
+	switch {
+	case r.checkServiceAccount(ctx, cr, "cluster-agent") != nil:
+		// The error is reported by CreateOrUpdateServiceAccount.
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.clusterAgentRoleBinding(cr), true, nil))
+		if len(r.watchNamespaces) == 0 {
+			errs = append(errs, r.CreateOrUpdate(ctx, cr, r.clusterAgentClusterRoleBinding(cr), true, nil))
+			errs = append(errs, r.deleteClusterAgentDiscoveryRoles(ctx, cr, nil))
+		}
+	case r.namespaceScoped(cr):
+		errs = append(errs, r.CreateOrUpdateRole(ctx, cr, r.clusterAgentRole(cr)))
+		errs = append(errs, r.CreateOrUpdateRoleBinding(ctx, cr, r.clusterAgentRoleBinding(cr)))
+		if len(r.watchNamespaces) == 0 {
+			errs = append(errs, r.CreateOrUpdate(ctx, cr, r.clusterAgentClusterRoleBinding(cr), true, nil))
+			errs = append(errs, r.CreateOrUpdate(ctx, cr, r.clusterAgentClusterRole(cr, nil), true, nil))
+			errs = append(errs, r.deleteClusterAgentDiscoveryRoles(ctx, cr, nil))
+		}
+	default:
+		errs = append(errs, r.CreateOrUpdateClusterRole(ctx, cr, r.clusterAgentClusterRole(cr, namespaces)))
+		errs = append(errs, r.CreateOrUpdateClusterRoleBinding(ctx, cr, r.clusterAgentClusterRoleBinding(cr)))
+		errs = append(errs, r.CreateOrUpdateClusterAgentDiscoveryRoles(ctx, cr, namespaces)...)
+		r.deleteLegacyClusterScopedResources(ctx, cr)
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.clusterAgentRoleBinding(cr), true, nil))
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.clusterAgentRole(cr), true, nil))
+	}
+	errs = append(errs, r.CreateOrUpdateDeployment(ctx, cr, r.clusterAgentDeployment(cr, namespaces)))
+	if kubernetesEventsEnabled(cr) {
+		errs = append(errs, r.CreateOrUpdateDeployment(ctx, cr, r.kubernetesEventsDeployment(cr, namespaces)))
+	} else {
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.kubernetesEventsDeployment(cr, namespaces), true, nil))
+	}
+	errs = append(errs, r.CreateOrUpdateVerticalPodAutoscalers(ctx, cr)...)
+	return errs
+}
+
+func (r *CorootReconciler) reconcileCoroot(ctx context.Context, cr *corootv1.Coroot) []error {
+	var errs []error
+	errs = append(errs, r.CreateOrUpdateServiceAccount(ctx, cr, "coroot", sccNonroot))
+	for _, pvc := range r.corootPVCs(cr) {
+		errs = append(errs, r.CreateOrUpdatePVC(ctx, cr, pvc, cr.Spec.Storage.ClassChangePolicy))
+	}
+	cr.Status.AdminPasswordSecret = ""
+	if generatedAdminPassword(cr) {
+		s := r.corootAdminSecret(cr)
+		errs = append(errs, r.CreateSecret(ctx, cr, s))
+		cr.Status.AdminPasswordSecret = s.Name
+	}
+	// Coroot isn't rolled out with references to secrets that don't exist yet, the error makes the reconciliation retried.
+	missing, err := r.missingSecrets(ctx, cr)
+	switch {
+	case err != nil:
+		errs = append(errs, err)
+	case len(missing) > 0:
+		errs = append(errs, fmt.Errorf("waiting for secrets: %s", strings.Join(missing, ", ")))
+	default:
+		secrets, err := r.corootConfigSecrets(ctx, cr)
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		errs = append(errs, r.CreateOrUpdateCorootConfig(ctx, cr, secrets))
+		ss := r.corootStatefulSet(cr, secrets)
+		if err = r.holdSecretsRotation(ctx, cr, ss); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		cr.Status.Version = imageVersion(ss.Spec.Template.Spec.Containers[0].Image)
+		errs = append(errs, r.createOrUpdateStatefulSet(ctx, cr, ss, corootCanaryPartition(cr)))
+	}
+	errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.corootService(cr)))
+	errs = append(errs, r.CreateOrUpdateIngress(ctx, cr, r.corootIngress(cr), !uiIngressEnabled(cr)))
+	errs = append(errs, r.CreateOrUpdateIngress(ctx, cr, r.corootTelemetryIngress(cr), !telemetryIngressEnabled(cr)))
+	errs = append(errs, r.CreateOrUpdateHTTPRoutes(ctx, cr)...)
+	return errs
+}
+
+// reconcilePrometheus applies the metrics storage, either Prometheus or VictoriaMetrics.
+func (r *CorootReconciler) reconcilePrometheus(ctx context.Context, cr *corootv1.Coroot) []error {
+	var errs []error
+	errs = append(errs, r.CreateOrUpdateServiceAccount(ctx, cr, "prometheus", sccNonroot))
+	vm := victoriaMetricsEnabled(cr)
+	errs = append(errs, r.CreateOrUpdatePrometheus(ctx, cr, vm)...)
+	errs = append(errs, r.CreateOrUpdateVictoriaMetrics(ctx, cr, !vm || cr.Spec.VictoriaMetrics.URL != "")...)
+	return errs
+}
+
+func (r *CorootReconciler) reconcileKeeper(ctx context.Context, cr *corootv1.Coroot) []error {
+	if cr.Spec.ExternalClickhouse != nil {
+		// The in-cluster resources are pruned, except for the PVCs and Secrets.
+		return nil
+	}
+	var errs []error
+	errs = append(errs, r.CreateOrUpdateServiceAccount(ctx, cr, "clickhouse-keeper", sccNonroot))
+	errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.clickhouseKeeperServiceHeadless(cr)))
+	errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.clickhouseKeeperServiceMetrics(cr)))
+	for _, pvc := range r.clickhouseKeeperPVCs(cr) {
+		errs = append(errs, r.CreateOrUpdatePVC(ctx, cr, pvc, cr.Spec.Clickhouse.Keeper.Storage.ClassChangePolicy))
+	}
+	errs = append(errs, r.CreateOrUpdateStatefulSet(ctx, cr, r.clickhouseKeeperStatefulSet(cr)))
+	return errs
+}
+
+func (r *CorootReconciler) reconcileClickhouse(ctx context.Context, cr *corootv1.Coroot) []error {
+	if cr.Spec.ExternalClickhouse != nil {
+		// The in-cluster resources are pruned, except for the PVCs and Secrets.
+		return nil
+	}
+	var errs []error
+	errs = append(errs, r.CreateOrRotateClickhouseSecret(ctx, cr))
+	errs = append(errs, r.CreateOrUpdateServiceAccount(ctx, cr, "clickhouse", sccNonroot))
+	errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.clickhouseServiceHeadless(cr)))
+	for _, pvc := range r.clickhousePVCs(cr) {
+		errs = append(errs, r.CreateOrUpdatePVC(ctx, cr, pvc, cr.Spec.Clickhouse.Storage.ClassChangePolicy))
+	}
+	for _, clickhouse := range r.clickhouseStatefulSets(cr) {
+		errs = append(errs, r.CreateOrUpdateStatefulSet(ctx, cr, clickhouse))
+	}
+	errs = append(errs, r.reconcileClickhouseDrains(ctx, cr)...)
+	errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.clickhouseService(cr)))
+	if cr.Spec.Clickhouse.Service != nil {
+		errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.clickhouseExternalService(cr)))
+	} else {
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.clickhouseExternalService(cr), true, nil))
+	}
+	return errs
+}
+
+// reconcileIntegrations applies the optional resources that don't depend on the storage.
+func (r *CorootReconciler) reconcileIntegrations(ctx context.Context, cr *corootv1.Coroot) []error {
+	var errs []error
+	errs = append(errs, r.CreateOrUpdatePodMonitors(ctx, cr)...)
+	errs = append(errs, r.CreateOrUpdateServiceMesh(ctx, cr)...)
+	errs = append(errs, r.CreateOrUpdateGrafanaDatasources(ctx, cr))
+	errs = append(errs, r.CreateOrUpdateDemoApp(ctx, cr)...)
+	errs = append(errs, r.CreateOrUpdateProbes(ctx, cr)...)
+	return errs
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"testing"
+	"time"
+)
+
+func TestComponentConditions(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	ctx := context.Background()
+
+	results := []componentResult{
+		r.reconcileComponent(ctx, cr, ComponentAgents, func(context.Context, *corootv1.Coroot) []error { return []error{nil} }),
+		r.reconcileComponent(ctx, cr, ComponentCoroot, func(context.Context, *corootv1.Coroot) []error { panic("unexpected") }),
+		r.reconcileComponent(ctx, cr, ComponentClickhouse, func(context.Context, *corootv1.Coroot) []error {
+			return []error{nil, errors.New("failed to apply")}
+		}),
+	}
+	if err := setComponentConditions(cr, results); err == nil {
+		t.Fatal("expected an error")
+	}
+	for component, expected := range map[string]bool{ComponentAgents: true, ComponentCoroot: false, ComponentClickhouse: false} {
+		if actual := meta.IsStatusConditionTrue(cr.Status.Conditions, componentConditionType(component)); actual != expected {
+			t.Errorf("%s: expected the condition to be %v", component, expected)
+		}
+	}
+
+	// Components that are no longer reconciled, e.g., in the agents-only mode, have no conditions.
+	if err := setComponentConditions(cr, results[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if c := meta.FindStatusCondition(cr.Status.Conditions, componentConditionType(ComponentCoroot)); c != nil {
+		t.Errorf("expected the %s condition to be removed", ComponentCoroot)
+	}
+}
+
+func TestComponentRetryInterval(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	failed := errors.New("failed to apply")
+
+	if d := r.componentRetryInterval(cr, []componentResult{{Component: ComponentAgents}}); d != 0 {
+		t.Fatalf("expected no retry, got %s", d)
+	}
+	for _, expected := range []time.Duration{ComponentRetryMinInterval, 2 * ComponentRetryMinInterval, 4 * ComponentRetryMinInterval} {
+		if d := r.componentRetryInterval(cr, []componentResult{{Component: ComponentClickhouse, Errors: []error{failed}}}); d != expected {
+			t.Fatalf("expected %s, got %s", expected, d)
+		}
+	}
+	// A newly failed component is retried sooner than the one that keeps failing.
+	results := []componentResult{{Component: ComponentClickhouse, Errors: []error{failed}}, {Component: ComponentCoroot, Errors: []error{failed}}}
+	if d := r.componentRetryInterval(cr, results); d != ComponentRetryMinInterval {
+		t.Fatalf("expected %s, got %s", ComponentRetryMinInterval, d)
+	}
+	// The backoff is reset once the component is applied.
+	r.componentRetryInterval(cr, []componentResult{{Component: ComponentClickhouse}})
+	if d := r.componentRetryInterval(cr, []componentResult{{Component: ComponentClickhouse, Errors: []error{failed}}}); d != ComponentRetryMinInterval {
+		t.Fatalf("expected %s, got %s", ComponentRetryMinInterval, d)
+	}
+	for i := 0; i < 10; i++ {
+		r.componentRetryInterval(cr, []componentResult{{Component: ComponentClickhouse, Errors: []error{failed}}})
+	}
+	if d := r.componentRetries[backgroundCheckKey(cr, ComponentClickhouse)]; d != ComponentRetryMaxInterval {
+		t.Fatalf("expected %s, got %s", ComponentRetryMaxInterval, d)
+	}
+
+	r.forgetComponentRetries(cr)
+	if len(r.componentRetries) > 0 {
+		t.Fatalf("expected the backoffs to be dropped, got %v", r.componentRetries)
+	}
+}
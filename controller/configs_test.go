@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"flag"
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// checkGolden compares the generated config with testdata/<name>, run go test ./controller -update after intended changes.
+func checkGolden(t *testing.T, name, actual string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(actual), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expected) != actual {
+		t.Errorf("%s: expected:\n%s\ngot:\n%s", name, expected, actual)
+	}
+}
+
+func TestGeneratedConfigs(t *testing.T) {
+	cr := testCoroot()
+	checkGolden(t, "clickhouse-cluster.xml", clickhouseConfig(cr, 2, 2, 3))
+	checkGolden(t, "clickhouse-keeper.xml", clickhouseKeeperConfig(cr, 3))
+
+	cr = testCoroot()
+	cr.Spec.Clickhouse.LogLevel = "warning"
+	cr.Spec.Clickhouse.AdditionalUsers = []corootv1.ClickhouseUserSpec{
+		{Name: "grafana", PasswordSecret: &corev1.SecretKeySelector{Key: "password"}, Readonly: true, Quota: &corootv1.ClickhouseQuotaSpec{Queries: 1000, ExecutionTime: corootv1.Duration{Duration: time.Minute}}},
+		{Name: "etl", PasswordSecret: &corev1.SecretKeySelector{Key: "password"}},
+	}
+	cr.Spec.Clickhouse.SystemLogs = &corootv1.ClickhouseSystemLogsSpec{
+		TTL:     corootv1.Duration{Duration: 36 * time.Hour},
+		Enabled: []corootv1.ClickhouseSystemLogTable{"query_log", "part_log", "query_log"},
+	}
+	checkGolden(t, "clickhouse-users.xml", clickhouseConfig(cr, 1, 1, 1))
+
+	cr = testCoroot()
+	cr.Spec.Prometheus.Replicas = 2
+	cr.Spec.Prometheus.ScrapeConfigs = `
+- job_name: node
+  static_configs:
+  - targets: ["node-exporter:9100"]`
+	cr.Spec.Prometheus.MetricRelabelConfigs = `
+- action: labeldrop
+  regex: pod_template_hash`
+	cr.Spec.Prometheus.RecordingRules = `
+- name: example
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)`
+	for replica := 0; replica < 2; replica++ {
+		config, err := prometheusConfig(cr, replica)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, prometheusConfigFile(replica), config)
+	}
+	rules, err := prometheusRules(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "prometheus-rules.yml", rules)
+}
@@ -2,20 +2,37 @@ package controller
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	corootv1 "github.io/coroot/operator/api/v1"
-	"golang.org/x/exp/maps"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
+	"maps"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"slices"
 	"sync"
 	"time"
 )
@@ -23,59 +40,114 @@ import (
 const (
 	AppVersionsUpdateInterval = time.Hour
 	UBIMinimalImage           = "registry.access.redhat.com/ubi9/ubi-minimal"
+
+	ConditionTypePaused     = "Paused"
+	ConditionTypeReconciled = "Reconciled"
+
+	ConditionTypeVersionFetchFailed = "VersionFetchFailed"
+
+	Finalizer = "coroot.com/finalizer"
 )
 
 type CorootReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
-
-	instances     map[ctrl.Request]bool
-	instancesLock sync.Mutex
+	// Reads the objects that aren't worth caching, like pods.
+	apiReader client.Reader
 
 	versions     map[App]string
 	versionsLock sync.Mutex
 
-	deploymentDeleted bool
+	clickhouseDrains     map[string]*clickhouseShardDrain
+	clickhouseDrainsLock sync.Mutex
+
+	backgroundChecks     map[string]*backgroundCheck
+	backgroundChecksLock sync.Mutex
+
+	componentRetries     map[string]time.Duration
+	componentRetriesLock sync.Mutex
+
+	imageDigests     map[string]cachedImageDigest
+	verifiedImages   map[imageDigestKey]string
+	workloadImages   map[string][]string
+	registryClients  map[string]*registryClient
+	imageDigestsLock sync.Mutex
+
+	// If set, the operator manages only Coroot instances in these namespaces and never touches cluster-scoped resources.
+	watchNamespaces []string
+
+	appVersionsUpdateInterval time.Duration
+	// Override the source of the app versions, see fetchAppVersions.
+	appVersionsURL       string
+	appVersionsConfigMap string
+	// A ConfigMap (namespace/name) persisting the last known app versions across restarts.
+	appVersionsCacheConfigMap string
+	maxConcurrentReconciles   int
+	// Coroot instances sent to this channel are put to the controller's work queue.
+	refresh chan event.GenericEvent
+
+	recorder record.EventRecorder
+}
+
+type Options struct {
+	WatchNamespaces           []string
+	AppVersionsUpdateInterval time.Duration
+	// A URL of a JSON manifest with the app versions, e.g., on an internal mirror.
+	AppVersionsURL string
+	// A ConfigMap (namespace/name) with the app versions, for air-gapped clusters. Takes precedence over AppVersionsURL.
+	AppVersionsConfigMap string
+	// A ConfigMap (namespace/name) the last known app versions are saved to and restored from at startup.
+	AppVersionsCacheConfigMap string
+	MaxConcurrentReconciles   int
 }
 
-func NewCorootReconciler(mgr ctrl.Manager) *CorootReconciler {
+func NewCorootReconciler(mgr ctrl.Manager, opts Options) *CorootReconciler {
 	r := &CorootReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-
-		instances: map[ctrl.Request]bool{},
-		versions:  map[App]string{},
-	}
-
-	r.fetchAppVersions()
-	go func() {
-		for range time.Tick(AppVersionsUpdateInterval) {
-			r.fetchAppVersions()
-			r.instancesLock.Lock()
-			instances := maps.Keys(r.instances)
-			r.instancesLock.Unlock()
-			for _, i := range instances {
-				_, _ = r.Reconcile(nil, i)
-			}
-		}
-	}()
+		Client:                    mgr.GetClient(),
+		Scheme:                    mgr.GetScheme(),
+		apiReader:                 mgr.GetAPIReader(),
+		watchNamespaces:           opts.WatchNamespaces,
+		appVersionsUpdateInterval: opts.AppVersionsUpdateInterval,
+		appVersionsURL:            opts.AppVersionsURL,
+		appVersionsConfigMap:      opts.AppVersionsConfigMap,
+		appVersionsCacheConfigMap: opts.AppVersionsCacheConfigMap,
+		maxConcurrentReconciles:   opts.MaxConcurrentReconciles,
 
+		versions: map[App]string{},
+		refresh:  make(chan event.GenericEvent),
+		recorder: mgr.GetEventRecorderFor("coroot-operator"),
+	}
+	if r.appVersionsUpdateInterval <= 0 {
+		r.appVersionsUpdateInterval = AppVersionsUpdateInterval
+	}
 	return r
 }
 
 // +kubebuilder:rbac:groups=coroot.com,resources=coroots,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=coroot.com,resources=coroots/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=coroot.com,resources=coroots/finalizers,verbs=update
-// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
-// +kubebuilder:rbac:groups="",resources=secrets,verbs=list;watch;create
+// +kubebuilder:rbac:groups="",resources=events,verbs=get;list;watch;create;patch
+// +kubebuilder:rbac:groups=events.k8s.io,resources=events,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=namespaces;nodes;pods;endpoints;persistentvolumes,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=resourcequotas,verbs=list
 // +kubebuilder:rbac:groups="",resources=services;persistentvolumeclaims;serviceaccounts,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=deployments;replicasets;daemonsets;statefulsets;cronjobs,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=batch,resources=cronjobs;jobs,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses;volumeattachments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles;clusterrolebindings;roles;rolebindings,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=security.openshift.io,resources=securitycontextconstraints,verbs=use
+// +kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=httproutes,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=security.istio.io,resources=peerauthentications,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.istio.io,resources=destinationrules,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=monitoring.coreos.com,resources=podmonitors,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=autoscaling.k8s.io,resources=verticalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
 
 func (r *CorootReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := ctrl.Log.WithValues("namespace", req.Namespace, "name", req.Name)
@@ -84,208 +156,659 @@ func (r *CorootReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	err := r.Get(ctx, req.NamespacedName, cr)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			r.instancesLock.Lock()
-			if r.instances[req] {
-				logger.Info("Coroot has been deleted")
-				delete(r.instances, req)
-				cr = &corootv1.Coroot{}
-				cr.Name = req.Name
-				cr.Namespace = req.Namespace
-				_ = r.Delete(ctx, r.clusterAgentClusterRoleBinding(cr))
-				_ = r.Delete(ctx, r.clusterAgentClusterRole(cr))
-			}
-			r.instancesLock.Unlock()
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
 	}
-	r.instancesLock.Lock()
-	r.instances[req] = true
-	r.instancesLock.Unlock()
-
-	r.CreateOrUpdateRole(ctx, cr, r.openshiftSCCRole(cr, sccNonroot))
-	r.CreateOrUpdateRole(ctx, cr, r.openshiftSCCRole(cr, sccPrivileged))
-
-	r.CreateOrUpdateServiceAccount(ctx, cr, "node-agent", sccPrivileged)
-	r.CreateOrUpdateDaemonSet(ctx, cr, r.nodeAgentDaemonSet(cr))
 
-	r.CreateOrUpdateServiceAccount(ctx, cr, "cluster-agent", sccNonroot)
-	r.CreateOrUpdateClusterRole(ctx, cr, r.clusterAgentClusterRole(cr))
-	r.CreateOrUpdateClusterRoleBinding(ctx, cr, r.clusterAgentClusterRoleBinding(cr))
-	r.CreateOrUpdateDeployment(ctx, cr, r.clusterAgentDeployment(cr))
-
-	if cr.Spec.AgentsOnly != nil {
-		// TODO: delete
+	if !cr.DeletionTimestamp.IsZero() {
+		r.forgetBackgroundChecks(cr)
+		r.forgetImageDigests(cr)
+		r.forgetComponentRetries(cr)
+		if controllerutil.ContainsFinalizer(cr, Finalizer) {
+			// The finalizer may have been added before the operator was restricted to WATCH_NAMESPACE.
+			// It can't access cluster-scoped resources then, so they're left to be deleted manually.
+			if len(r.watchNamespaces) == 0 {
+				logger.Info("Coroot is being deleted, cleaning up cluster-scoped resources")
+				if err = r.deleteClusterScopedResources(ctx, cr); err != nil {
+					return ctrl.Result{}, err
+				}
+			} else {
+				logger.Info("Coroot is being deleted, skipping cleanup of cluster-scoped resources in namespaced mode")
+			}
+			controllerutil.RemoveFinalizer(cr, Finalizer)
+			if err = r.Update(ctx, cr); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
 		return ctrl.Result{}, nil
 	}
+	// Cluster-scoped resources can't be owned by a namespaced Coroot, so they are cleaned up using a finalizer.
+	if len(r.watchNamespaces) == 0 && !controllerutil.ContainsFinalizer(cr, Finalizer) {
+		controllerutil.AddFinalizer(cr, Finalizer)
+		if err = r.Update(ctx, cr); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
-	if cr.Spec.Replicas > 1 && cr.Spec.Postgres == nil {
-		logger.Error(fmt.Errorf("postgres not configured"), "Coroot requires Postgres to run multiple replicas (will run only one replica)")
-		cr.Spec.Replicas = 1
+	status := cr.Status.DeepCopy()
+	r.validateCoroot(ctx, cr)
+	paused := metav1.Condition{Type: ConditionTypePaused, Status: metav1.ConditionFalse, Reason: "Reconciling", ObservedGeneration: cr.Generation}
+	if cr.IsPaused() {
+		paused.Status = metav1.ConditionTrue
+		paused.Reason = "Paused"
+		paused.Message = fmt.Sprintf("reconciliation of child resources is paused (spec.paused or %s annotation)", corootv1.PausedAnnotation)
 	}
-	r.CreateOrUpdateServiceAccount(ctx, cr, "coroot", sccNonroot)
-	for _, pvc := range r.corootPVCs(cr) {
-		r.CreateOrUpdatePVC(ctx, cr, pvc)
+	meta.SetStatusCondition(&cr.Status.Conditions, paused)
+	r.UpdateStatus(ctx, cr, status)
+	if cr.IsPaused() {
+		logger.Info("Coroot is paused, skipping reconciliation of child resources")
+		return ctrl.Result{}, nil
 	}
-	r.CreateOrUpdateStatefulSet(ctx, cr, r.corootStatefulSet(cr))
-	r.CreateOrUpdateService(ctx, cr, r.corootService(cr))
-	if !r.deploymentDeleted {
-		_ = r.Delete(ctx, r.corootDeployment(cr))
-		r.deploymentDeleted = true
+
+	status = cr.Status.DeepCopy()
+	// Invalid values stop the reconciliation instead of breaking the child resources. Fixing the spec triggers it again.
+	if invalid := validateSpec(cr); len(invalid) > 0 {
+		err = invalid.ToAggregate()
+		logger.Error(err, "invalid spec, skipping reconciliation of child resources")
+		if r.recorder != nil {
+			r.recorder.Event(cr, corev1.EventTypeWarning, "Misconfigured", err.Error())
+		}
+		meta.SetStatusCondition(&cr.Status.Conditions, metav1.Condition{
+			Type:               ConditionTypeReconciled,
+			Status:             metav1.ConditionFalse,
+			Reason:             "Misconfigured",
+			Message:            err.Error(),
+			ObservedGeneration: cr.Generation,
+		})
+		r.UpdateStatus(ctx, cr, status)
+		return ctrl.Result{}, nil
 	}
-	r.CreateOrUpdateIngress(ctx, cr, r.corootIngress(cr), cr.Spec.Ingress == nil)
 
-	r.CreateOrUpdateServiceAccount(ctx, cr, "prometheus", sccNonroot)
-	r.CreateOrUpdatePVC(ctx, cr, r.prometheusPVC(cr))
-	r.CreateOrUpdateDeployment(ctx, cr, r.prometheusDeployment(cr))
-	r.CreateOrUpdateService(ctx, cr, r.prometheusService(cr))
+	if cr.Spec.AgentsOnly == nil {
+		if err = r.applyTenants(ctx, cr); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
-	if cr.Spec.ExternalClickhouse == nil {
-		r.CreateSecret(ctx, cr, r.clickhouseSecret(cr))
+	applySizeProfile(cr)
+	status = cr.Status.DeepCopy()
+	transition := checkHibernation(cr, time.Now())
+	ctx, inv := withInventory(ctx)
+	ctx, drift := withDriftReport(ctx, cr)
+	results := r.reconcileChildren(ctx, cr)
+	componentsErr := setComponentConditions(cr, results)
+	r.setDriftStatus(cr, drift)
+	// A partial inventory would report the skipped resources as removed, and pruning would delete them.
+	if componentsErr == nil {
+		err = r.CreateOrUpdateImagesReport(ctx, cr, inv)
+	}
+	if err == nil {
+		err = r.CreateOrUpdateInventory(ctx, cr, inv)
+	}
+	if err == nil {
+		err = r.pruneObsolete(ctx, cr, inv)
+	}
+	// The failed components are retried with their own backoffs instead of the rate limiter of the whole instance.
+	var res ctrl.Result
+	requeueAfter(&res, r.componentRetryInterval(cr, results))
+	if !r.checkClickhouseKeeper(ctx, cr) {
+		requeueAfter(&res, KeeperCheckInterval)
+	}
+	r.checkClickhouseSchema(ctx, cr)
+	requeueAfter(&res, r.checkClickhouseDrains(ctx, cr))
+	if cr.Spec.Clickhouse.Schema != nil && res.RequeueAfter == 0 {
+		// Coroot creates tables on demand, so the schema is checked periodically.
+		res.RequeueAfter = ClickhouseSchemaCheckInterval
+	}
+	if ec := cr.Spec.ExternalClickhouse; ec != nil && len(ec.Addresses) > 0 {
+		requeueAfter(&res, ExternalClickhouseCheckInterval)
+	}
+	requeueAfter(&res, r.checkCorootRollout(ctx, cr))
+	requeueAfter(&res, r.checkLicense(ctx, cr, time.Now()))
+	requeueAfter(&res, r.checkComponentIssues(ctx, cr))
+	requeueAfter(&res, transition)
+	requeueAfter(&res, driftDetectionInterval(cr))
+	requeueAfter(&res, r.checkSnapshots(ctx, cr, time.Now()))
+	meta.SetStatusCondition(&cr.Status.Conditions, r.versionFetchFailedCondition(cr))
+	reconciled := metav1.Condition{Type: ConditionTypeReconciled, Status: metav1.ConditionTrue, Reason: "Reconciled", ObservedGeneration: cr.Generation}
+	if failed := utilerrors.NewAggregate([]error{componentsErr, err}); failed != nil {
+		reconciled.Status = metav1.ConditionFalse
+		reconciled.Reason = "ApplyFailed"
+		reconciled.Message = failed.Error()
+	}
+	meta.SetStatusCondition(&cr.Status.Conditions, reconciled)
+	r.UpdateStatus(ctx, cr, status)
+	return res, err
+}
 
-		r.CreateOrUpdateServiceAccount(ctx, cr, "clickhouse-keeper", sccNonroot)
-		r.CreateOrUpdateService(ctx, cr, r.clickhouseKeeperServiceHeadless(cr))
-		for _, pvc := range r.clickhouseKeeperPVCs(cr) {
-			r.CreateOrUpdatePVC(ctx, cr, pvc)
-		}
-		r.CreateOrUpdateStatefulSet(ctx, cr, r.clickhouseKeeperStatefulSet(cr))
+// versionFetchFailedCondition reports the components that aren't applied because their versions are unknown.
+// They are applied once the versions are fetched, as the updater requeues the instances on new versions.
+func (r *CorootReconciler) versionFetchFailedCondition(cr *corootv1.Coroot) metav1.Condition {
+	c := metav1.Condition{Type: ConditionTypeVersionFetchFailed, Status: metav1.ConditionFalse, Reason: "VersionsKnown", ObservedGeneration: cr.Generation}
+	if missing := r.missingAppImages(cr); len(missing) > 0 {
+		c.Status = metav1.ConditionTrue
+		c.Reason = "VersionFetchFailed"
+		c.Message = fmt.Sprintf("failed to get the versions of %v: set them in the spec or check the app versions source of the operator", missing)
+	}
+	return c
+}
 
-		r.CreateOrUpdateServiceAccount(ctx, cr, "clickhouse", sccNonroot)
-		r.CreateOrUpdateService(ctx, cr, r.clickhouseServiceHeadless(cr))
-		for _, pvc := range r.clickhousePVCs(cr) {
-			r.CreateOrUpdatePVC(ctx, cr, pvc)
-		}
-		for _, clickhouse := range r.clickhouseStatefulSets(cr) {
-			r.CreateOrUpdateStatefulSet(ctx, cr, clickhouse)
-		}
-		r.CreateOrUpdateService(ctx, cr, r.clickhouseService(cr))
-	} else {
-		// TODO: delete
+// requeueAfter shortens the requeue interval of the result to d if it's set.
+func requeueAfter(res *ctrl.Result, d time.Duration) {
+	if d > 0 && (res.RequeueAfter == 0 || d < res.RequeueAfter) {
+		res.RequeueAfter = d
 	}
+}
 
-	return ctrl.Result{}, nil
+func (r *CorootReconciler) UpdateStatus(ctx context.Context, cr *corootv1.Coroot, original *corootv1.CorootStatus) {
+	if equality.Semantic.DeepEqual(original, &cr.Status) {
+		return
+	}
+	if err := r.Status().Update(ctx, cr); err != nil {
+		ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Error(err, "failed to update status")
+	}
 }
 
-func (r *CorootReconciler) CreateOrUpdate(ctx context.Context, cr *corootv1.Coroot, obj client.Object, delete bool, f controllerutil.MutateFn) {
+func (r *CorootReconciler) CreateOrUpdate(ctx context.Context, cr *corootv1.Coroot, obj client.Object, delete bool, f controllerutil.MutateFn) error {
 	logger := ctrl.Log.WithValues("namespace", obj.GetNamespace(), "name", obj.GetName(), "type", fmt.Sprintf("%T", obj))
 	if delete {
 		err := r.Delete(ctx, obj)
-		if err == nil {
+		switch {
+		case err == nil:
 			logger.Info("deleted")
+		case errors.IsNotFound(err):
+		default:
+			logger.Error(err, "failed to delete")
+			return r.applyError(cr, obj, "delete", err)
 		}
-		return
+		return nil
+	}
+	// An empty image would be defaulted to docker.io/library/latest, so the current workload is kept instead.
+	if c := containerWithoutImage(obj); c != "" {
+		err := fmt.Errorf("container %s has no image", c)
+		logger.Error(err, "refusing to apply")
+		return r.applyError(cr, obj, "apply", err)
 	}
 	_ = ctrl.SetControllerReference(cr, obj, r.Scheme)
+	hash := objectHash(obj)
 	errMsg := "failed to create or update"
 	if f == nil {
 		f = func() error { return nil }
 		errMsg = "failed to create"
 	}
-	res, err := ctrl.CreateOrUpdate(ctx, r.Client, obj, f)
+	labels, annotations := maps.Clone(obj.GetLabels()), maps.Clone(obj.GetAnnotations())
+	res, err := ctrl.CreateOrUpdate(ctx, r.Client, obj, func() error {
+		err := f()
+		setCommonMetadata(cr, obj, labels, annotations)
+		pruneMetadata(cr, obj, labels, annotations)
+		return err
+	})
 	if err != nil {
 		logger.Error(err, errMsg)
-		return
+		return r.applyError(cr, obj, "apply", err)
 	}
 	if res != controllerutil.OperationResultNone {
 		logger.Info(fmt.Sprintf("%s", res))
 	}
+	inventoryFrom(ctx).add(r.Scheme, obj, hash)
+	return nil
+}
+
+// workloadPodSpec returns the pod spec of the Deployment, DaemonSet or StatefulSet, or nil for other objects.
+func workloadPodSpec(obj client.Object) *corev1.PodSpec {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return &o.Spec.Template.Spec
+	case *appsv1.DaemonSet:
+		return &o.Spec.Template.Spec
+	case *appsv1.StatefulSet:
+		return &o.Spec.Template.Spec
+	}
+	return nil
 }
 
-func (r *CorootReconciler) CreateSecret(ctx context.Context, cr *corootv1.Coroot, s *corev1.Secret) {
-	r.CreateOrUpdate(ctx, cr, s, false, nil)
+// applyImagePullSettings adds the image pull secrets and policy of the Coroot to the pod spec of the workload.
+func applyImagePullSettings(cr *corootv1.Coroot, obj client.Object) {
+	spec := workloadPodSpec(obj)
+	if spec == nil {
+		return
+	}
+	for _, s := range cr.Spec.ImagePullSecrets {
+		if !slices.Contains(spec.ImagePullSecrets, s) {
+			spec.ImagePullSecrets = append(spec.ImagePullSecrets, s)
+		}
+	}
+	if cr.Spec.ImagePullPolicy == "" {
+		return
+	}
+	for i := range spec.InitContainers {
+		spec.InitContainers[i].ImagePullPolicy = cr.Spec.ImagePullPolicy
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].ImagePullPolicy = cr.Spec.ImagePullPolicy
+	}
+}
+
+func containerWithoutImage(obj client.Object) string {
+	spec := workloadPodSpec(obj)
+	if spec == nil {
+		return ""
+	}
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for _, c := range containers {
+			if c.Image == "" {
+				return c.Name
+			}
+		}
+	}
+	return ""
+}
+
+func (r *CorootReconciler) applyError(cr *corootv1.Coroot, obj client.Object, action string, err error) error {
+	err = fmt.Errorf("failed to %s %T %s: %w", action, obj, obj.GetName(), err)
+	if r.recorder != nil {
+		r.recorder.Event(cr, corev1.EventTypeWarning, "ApplyFailed", err.Error())
+	}
+	return err
+}
+
+func (r *CorootReconciler) CreateSecret(ctx context.Context, cr *corootv1.Coroot, s *corev1.Secret) error {
+	return r.CreateOrUpdate(ctx, cr, s, false, nil)
 }
 
-func (r *CorootReconciler) CreateOrUpdateDeployment(ctx context.Context, cr *corootv1.Coroot, d *appsv1.Deployment) {
+func (r *CorootReconciler) CreateOrUpdateDeployment(ctx context.Context, cr *corootv1.Coroot, d *appsv1.Deployment) error {
+	applyImagePullSettings(cr, d)
+	if err := r.pinImageDigests(ctx, cr, d); err != nil {
+		return r.applyError(cr, d, "pin the images of", err)
+	}
 	spec := d.Spec
-	r.CreateOrUpdate(ctx, cr, d, false, func() error {
-		return MergeSpecs(d, &d.Spec, spec)
+	labels := d.Labels
+	return r.CreateOrUpdate(ctx, cr, d, false, func() error {
+		setLabels(d, labels)
+		return mergeSpecsDetectingDrift(ctx, r, cr, d, &d.Spec, spec)
 	})
 }
 
-func (r *CorootReconciler) CreateOrUpdateDaemonSet(ctx context.Context, cr *corootv1.Coroot, ds *appsv1.DaemonSet) {
+func (r *CorootReconciler) CreateOrUpdateDaemonSet(ctx context.Context, cr *corootv1.Coroot, ds *appsv1.DaemonSet) error {
+	applyImagePullSettings(cr, ds)
+	if err := r.pinImageDigests(ctx, cr, ds); err != nil {
+		return r.applyError(cr, ds, "pin the images of", err)
+	}
 	spec := ds.Spec
-	r.CreateOrUpdate(ctx, cr, ds, false, func() error {
-		return MergeSpecs(ds, &ds.Spec, spec)
+	labels := ds.Labels
+	return r.CreateOrUpdate(ctx, cr, ds, false, func() error {
+		setLabels(ds, labels)
+		return mergeSpecsDetectingDrift(ctx, r, cr, ds, &ds.Spec, spec)
 	})
 }
 
-func (r *CorootReconciler) CreateOrUpdateStatefulSet(ctx context.Context, cr *corootv1.Coroot, ss *appsv1.StatefulSet) {
+func (r *CorootReconciler) CreateOrUpdateStatefulSet(ctx context.Context, cr *corootv1.Coroot, ss *appsv1.StatefulSet) error {
+	return r.createOrUpdateStatefulSet(ctx, cr, ss, nil)
+}
+
+// createOrUpdateStatefulSet applies the StatefulSet. If set, afterMerge is called with the existing StatefulSet
+// (nil if it's being created) and the merged one, which it can adjust, e.g., depending on whether the pod template changes.
+func (r *CorootReconciler) createOrUpdateStatefulSet(ctx context.Context, cr *corootv1.Coroot, ss *appsv1.StatefulSet, afterMerge func(existing, merged *appsv1.StatefulSet)) error {
+	if recreating, err := r.recreateStatefulSetOnPolicyChange(ctx, cr, ss); recreating || err != nil {
+		return err
+	}
+	applyImagePullSettings(cr, ss)
+	if err := r.pinImageDigests(ctx, cr, ss); err != nil {
+		return r.applyError(cr, ss, "pin the images of", err)
+	}
 	spec := ss.Spec
-	r.CreateOrUpdate(ctx, cr, ss, false, func() error {
+	labels := ss.Labels
+	return r.CreateOrUpdate(ctx, cr, ss, false, func() error {
+		setLabels(ss, labels)
+		var existing *appsv1.StatefulSet
+		if ss.ResourceVersion != "" {
+			existing = ss.DeepCopy()
+		}
 		volumeClaimTemplates := ss.Spec.VolumeClaimTemplates[:]
-		err := MergeSpecs(ss, &ss.Spec, spec)
+		err := mergeSpecsDetectingDrift(ctx, r, cr, ss, &ss.Spec, spec)
 		ss.Spec.VolumeClaimTemplates = volumeClaimTemplates
+		if err == nil && afterMerge != nil {
+			afterMerge(existing, ss)
+		}
 		return err
 	})
 }
 
-func (r *CorootReconciler) CreateOrUpdatePVC(ctx context.Context, cr *corootv1.Coroot, pvc *corev1.PersistentVolumeClaim) {
+// recreateStatefulSetOnPolicyChange deletes the StatefulSet, orphaning its pods, if its pod management policy differs,
+// as the policy is immutable. The StatefulSet is then recreated by the reconciliation triggered by the deletion and adopts the pods.
+func (r *CorootReconciler) recreateStatefulSetOnPolicyChange(ctx context.Context, cr *corootv1.Coroot, ss *appsv1.StatefulSet) (bool, error) {
+	current := &appsv1.StatefulSet{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(ss), current); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	policy := ss.Spec.PodManagementPolicy
+	if policy == "" {
+		policy = appsv1.OrderedReadyPodManagement
+	}
+	if current.Spec.PodManagementPolicy == "" || current.Spec.PodManagementPolicy == policy {
+		return false, nil
+	}
+	// Keeps the StatefulSet from being pruned with its pods before the deletion is observed.
+	inventoryFrom(ctx).add(r.Scheme, ss, objectHash(ss))
+	if !current.DeletionTimestamp.IsZero() {
+		return true, nil
+	}
+	logger := ctrl.Log.WithValues("namespace", ss.Namespace, "name", ss.Name)
+	// The StatefulSets are recreated one at a time. The next one waits until the previous one has adopted its pods
+	// and they are ready. Its status change triggers the reconciliation.
+	if settled, err := r.statefulSetsSettled(ctx, cr, ss); err != nil || !settled {
+		if err == nil {
+			logger.Info("waiting for the other StatefulSets to be ready before changing the pod management policy")
+		}
+		return true, err
+	}
+	if err := r.Delete(ctx, current, client.PropagationPolicy(metav1.DeletePropagationOrphan)); err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "failed to delete StatefulSet to change its pod management policy")
+		return true, r.applyError(cr, ss, "recreate", err)
+	}
+	logger.Info("StatefulSet deleted to change its pod management policy", "from", current.Spec.PodManagementPolicy, "to", policy)
+	return true, nil
+}
+
+// statefulSetsSettled reports whether the StatefulSets of the instance, except for the given one, are ready
+// and none of them is being recreated, i.e., there are no orphaned pods waiting to be adopted.
+func (r *CorootReconciler) statefulSetsSettled(ctx context.Context, cr *corootv1.Coroot, except *appsv1.StatefulSet) (bool, error) {
+	ls := client.MatchingLabels{"app.kubernetes.io/managed-by": "coroot-operator", "app.kubernetes.io/part-of": cr.Name}
+	list := &appsv1.StatefulSetList{}
+	if err := r.List(ctx, list, client.InNamespace(cr.Namespace), ls); err != nil {
+		return false, err
+	}
+	for _, ss := range list.Items {
+		if ss.Name == except.Name {
+			continue
+		}
+		replicas := int32(1)
+		if ss.Spec.Replicas != nil {
+			replicas = *ss.Spec.Replicas
+		}
+		if !ss.DeletionTimestamp.IsZero() || ss.Status.ObservedGeneration < ss.Generation || ss.Status.ReadyReplicas < replicas {
+			return false, nil
+		}
+	}
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(cr.Namespace), ls); err != nil {
+		return false, err
+	}
+	for _, pod := range pods.Items {
+		if metav1.GetControllerOf(&pod) == nil && pod.DeletionTimestamp.IsZero() {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// statefulSetRolledOut reports whether all the replicas of the StatefulSet run the current revision and are ready.
+func statefulSetRolledOut(ss *appsv1.StatefulSet) bool {
+	replicas := int32(1)
+	if ss.Spec.Replicas != nil {
+		replicas = *ss.Spec.Replicas
+	}
+	return ss.Status.ObservedGeneration >= ss.Generation &&
+		ss.Status.UpdatedReplicas == replicas && ss.Status.ReadyReplicas == replicas &&
+		ss.Status.CurrentRevision == ss.Status.UpdateRevision
+}
+
+func (r *CorootReconciler) CreateOrUpdatePVC(ctx context.Context, cr *corootv1.Coroot, pvc *corev1.PersistentVolumeClaim, classChangePolicy corootv1.StorageClassChangePolicy) error {
+	if err := r.checkPVCStorageClass(ctx, cr, pvc, classChangePolicy); err != nil {
+		return err
+	}
 	spec := pvc.Spec
-	r.CreateOrUpdate(ctx, cr, pvc, false, func() error {
-		return MergeSpecs(pvc, &pvc.Spec, spec)
+	labels, annotations := pvc.Labels, pvc.Annotations
+	return r.CreateOrUpdate(ctx, cr, pvc, false, func() error {
+		setLabels(pvc, labels)
+		for k, v := range annotations {
+			metav1.SetMetaDataAnnotation(&pvc.ObjectMeta, k, v)
+		}
+		if pvc.CreationTimestamp.IsZero() {
+			return MergeSpecs(pvc, &pvc.Spec, spec)
+		}
+		// The data source, the selector and the storage class of an existing PVC are immutable.
+		dataSource, dataSourceRef, selector, className := pvc.Spec.DataSource, pvc.Spec.DataSourceRef, pvc.Spec.Selector, pvc.Spec.StorageClassName
+		err := MergeSpecs(pvc, &pvc.Spec, spec)
+		pvc.Spec.DataSource, pvc.Spec.DataSourceRef, pvc.Spec.Selector, pvc.Spec.StorageClassName = dataSource, dataSourceRef, selector, className
+		return err
 	})
 }
 
-func (r *CorootReconciler) CreateOrUpdateService(ctx context.Context, cr *corootv1.Coroot, s *corev1.Service) {
+func (r *CorootReconciler) CreateOrUpdateService(ctx context.Context, cr *corootv1.Coroot, s *corev1.Service) error {
 	spec := s.Spec
-	r.CreateOrUpdate(ctx, cr, s, false, func() error {
+	annotations := s.Annotations
+	return r.CreateOrUpdate(ctx, cr, s, false, func() error {
 		err := MergeSpecs(s, &s.Spec, spec)
 		s.Spec.Ports = spec.Ports
+		for k, v := range annotations {
+			metav1.SetMetaDataAnnotation(&s.ObjectMeta, k, v)
+		}
 		return err
 	})
 }
 
-func (r *CorootReconciler) CreateOrUpdateServiceAccount(ctx context.Context, cr *corootv1.Coroot, component, scc string) {
-	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
-		Name:      cr.Name + "-" + component,
-		Namespace: cr.Namespace,
-		Labels:    Labels(cr, component),
+func (r *CorootReconciler) CreateOrUpdatePDB(ctx context.Context, cr *corootv1.Coroot, pdb *policyv1.PodDisruptionBudget) error {
+	spec := pdb.Spec
+	labels := pdb.Labels
+	return r.CreateOrUpdate(ctx, cr, pdb, false, func() error {
+		setLabels(pdb, labels)
+		return MergeSpecs(pdb, &pdb.Spec, spec)
+	})
+}
+
+func serviceAccountSpec(cr *corootv1.Coroot, component string) corootv1.ServiceAccountSpec {
+	switch component {
+	case "coroot":
+		return cr.Spec.ServiceAccount
+	case "node-agent":
+		return cr.Spec.NodeAgent.ServiceAccount
+	case "cluster-agent":
+		return cr.Spec.ClusterAgent.ServiceAccount
+	case "prometheus":
+		return cr.Spec.Prometheus.ServiceAccount
+	case "clickhouse":
+		return cr.Spec.Clickhouse.ServiceAccount
+	case "clickhouse-keeper":
+		return cr.Spec.Clickhouse.Keeper.ServiceAccount
+	}
+	return corootv1.ServiceAccountSpec{}
+}
+
+// serviceAccountName returns the name of the ServiceAccount the component's pods run as.
+func serviceAccountName(cr *corootv1.Coroot, component string) string {
+	if name := serviceAccountSpec(cr, component).Name; name != "" {
+		return name
+	}
+	return cr.Name + "-" + component
+}
+
+func (r *CorootReconciler) serviceAccount(cr *corootv1.Coroot, component string) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name:        cr.Name + "-" + component,
+		Namespace:   cr.Namespace,
+		Labels:      Labels(cr, component),
+		Annotations: serviceAccountSpec(cr, component).Annotations,
 	}}
-	r.CreateOrUpdate(ctx, cr, sa, false, nil)
-	r.CreateOrUpdate(ctx, cr, r.openshiftSCCRoleBinding(cr, component, scc), false, nil)
 }
 
-func (r *CorootReconciler) CreateOrUpdateRole(ctx context.Context, cr *corootv1.Coroot, role *rbacv1.Role) {
+// checkServiceAccount checks that the pre-existing ServiceAccount of the component, if any, is labeled as managed by the operator.
+// Roles and SCCs are bound only to such ServiceAccounts, so editing the Coroot can't grant permissions to the ServiceAccounts of other workloads.
+func (r *CorootReconciler) checkServiceAccount(ctx context.Context, cr *corootv1.Coroot, component string) error {
+	name := serviceAccountSpec(cr, component).Name
+	if name == "" {
+		return nil
+	}
+	sa := &corev1.ServiceAccount{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: name}, sa); err != nil {
+		return fmt.Errorf("failed to get ServiceAccount %s: %w", name, err)
+	}
+	if sa.Labels["app.kubernetes.io/managed-by"] != "coroot-operator" {
+		return fmt.Errorf("ServiceAccount %s must be labeled app.kubernetes.io/managed-by=coroot-operator to be used by %s", name, component)
+	}
+	return nil
+}
+
+func (r *CorootReconciler) CreateOrUpdateServiceAccount(ctx context.Context, cr *corootv1.Coroot, component, scc string) error {
+	sa := r.serviceAccount(cr, component)
+	annotations := sa.Annotations
+	// The managed ServiceAccount is removed if a pre-existing one is used instead.
+	external := serviceAccountSpec(cr, component).Name != ""
+	binding := r.openshiftSCCRoleBinding(cr, component, scc)
+	checkErr := r.checkServiceAccount(ctx, cr, component)
+	var bindingErr error
+	if checkErr != nil {
+		bindingErr = r.CreateOrUpdate(ctx, cr, binding, true, nil)
+	} else {
+		bindingErr = r.CreateOrUpdateRoleBinding(ctx, cr, binding)
+	}
+	return utilerrors.NewAggregate([]error{
+		r.CreateOrUpdate(ctx, cr, sa, external, func() error {
+			for k, v := range annotations {
+				metav1.SetMetaDataAnnotation(&sa.ObjectMeta, k, v)
+			}
+			return nil
+		}),
+		checkErr,
+		bindingErr,
+	})
+}
+
+func (r *CorootReconciler) CreateOrUpdateRole(ctx context.Context, cr *corootv1.Coroot, role *rbacv1.Role) error {
 	rules := role.Rules
-	r.CreateOrUpdate(ctx, cr, role, false, func() error {
+	return r.CreateOrUpdate(ctx, cr, role, false, func() error {
 		role.Rules = rules
 		return nil
 	})
 }
 
-func (r *CorootReconciler) CreateOrUpdateClusterRole(ctx context.Context, cr *corootv1.Coroot, role *rbacv1.ClusterRole) {
+func (r *CorootReconciler) CreateOrUpdateClusterRole(ctx context.Context, cr *corootv1.Coroot, role *rbacv1.ClusterRole) error {
 	rules := role.Rules
-	r.CreateOrUpdate(ctx, cr, role, false, func() error {
+	return r.CreateOrUpdate(ctx, cr, role, false, func() error {
 		role.Rules = rules
 		return nil
 	})
 }
 
-func (r *CorootReconciler) CreateOrUpdateClusterRoleBinding(ctx context.Context, cr *corootv1.Coroot, b *rbacv1.ClusterRoleBinding) {
-	r.CreateOrUpdate(ctx, cr, b, false, nil)
+// The subjects are updated since the ServiceAccount can be changed (the role reference is immutable).
+func (r *CorootReconciler) CreateOrUpdateRoleBinding(ctx context.Context, cr *corootv1.Coroot, b *rbacv1.RoleBinding) error {
+	subjects := b.Subjects
+	return r.CreateOrUpdate(ctx, cr, b, false, func() error {
+		b.Subjects = subjects
+		return nil
+	})
 }
 
-func (r *CorootReconciler) CreateOrUpdateIngress(ctx context.Context, cr *corootv1.Coroot, i *networkingv1.Ingress, delete bool) {
+func (r *CorootReconciler) CreateOrUpdateClusterRoleBinding(ctx context.Context, cr *corootv1.Coroot, b *rbacv1.ClusterRoleBinding) error {
+	subjects := b.Subjects
+	return r.CreateOrUpdate(ctx, cr, b, false, func() error {
+		b.Subjects = subjects
+		return nil
+	})
+}
+
+func (r *CorootReconciler) CreateOrUpdateIngress(ctx context.Context, cr *corootv1.Coroot, i *networkingv1.Ingress, delete bool) error {
 	spec := i.Spec
-	r.CreateOrUpdate(ctx, cr, i, delete, func() error {
+	annotations := i.Annotations
+	return r.CreateOrUpdate(ctx, cr, i, delete, func() error {
+		for k, v := range annotations {
+			metav1.SetMetaDataAnnotation(&i.ObjectMeta, k, v)
+		}
 		return MergeSpecs(i, &i.Spec, spec)
 	})
 }
 
+// CreateOrUpdateUnstructured applies objects of the kinds defined by optional CRDs (Prometheus Operator, Gateway API, etc.).
+func (r *CorootReconciler) CreateOrUpdateUnstructured(ctx context.Context, cr *corootv1.Coroot, obj *unstructured.Unstructured, delete bool) error {
+	labels, spec := obj.GetLabels(), obj.Object["spec"]
+	return r.CreateOrUpdate(ctx, cr, obj, delete, func() error {
+		obj.SetLabels(labels)
+		obj.Object["spec"] = spec
+		return nil
+	})
+}
+
 func (r *CorootReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corootv1.Coroot{}).
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&corootv1.Coroot{}, builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}))).
 		Owns(&appsv1.Deployment{}).
 		Owns(&appsv1.StatefulSet{}).
 		Owns(&appsv1.DaemonSet{}).
 		Owns(&corev1.Service{}).
 		Owns(&corev1.ServiceAccount{}).
-		Owns(&rbacv1.ClusterRole{}).
-		Owns(&rbacv1.ClusterRoleBinding{}).
+		Owns(&rbacv1.Role{}).
+		Owns(&rbacv1.RoleBinding{}).
 		Owns(&corev1.PersistentVolumeClaim{}).
 		Owns(&corev1.Secret{}).
 		Owns(&networkingv1.Ingress{}).
-		Complete(r)
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(podRequests), builder.WithPredicates(podIssueChanged)).
+		WatchesRawSource(source.Channel(r.refresh, &handler.EnqueueRequestForObject{})).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.maxConcurrentReconciles})
+	if r.kindSupported(corootv1.GroupVersion.WithKind("CorootTenant")) {
+		b = b.Watches(&corootv1.CorootTenant{}, handler.EnqueueRequestsFromMapFunc(tenantRequests), builder.WithPredicates(predicate.GenerationChangedPredicate{}))
+	}
+	if len(r.watchNamespaces) == 0 {
+		b = b.Owns(&rbacv1.ClusterRole{}).Owns(&rbacv1.ClusterRoleBinding{}).
+			Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.namespaceRequests),
+				builder.WithPredicates(predicate.LabelChangedPredicate{}))
+	}
+	if err := mgr.Add(&appVersionsUpdater{r: r}); err != nil {
+		return err
+	}
+	return b.Complete(r)
+}
+
+// kindSupported reports whether the CRD of the kind is installed in the cluster.
+func (r *CorootReconciler) kindSupported(gvk schema.GroupVersionKind) bool {
+	_, err := r.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil && !meta.IsNoMatchError(err) {
+		ctrl.Log.Error(err, "failed to check if kind is supported", "kind", gvk.String())
+	}
+	return err == nil
+}
+
+func (r *CorootReconciler) namespaceScoped(cr *corootv1.Coroot) bool {
+	return cr.Spec.NamespaceScoped || len(r.watchNamespaces) > 0
+}
+
+func (r *CorootReconciler) deleteClusterScopedResources(ctx context.Context, cr *corootv1.Coroot) error {
+	for _, obj := range []client.Object{r.clusterAgentClusterRoleBinding(cr), r.clusterAgentClusterRole(cr, nil)} {
+		if err := r.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	if err := r.deleteClusterAgentDiscoveryRoles(ctx, cr, nil); err != nil {
+		return err
+	}
+	r.deleteLegacyClusterScopedResources(ctx, cr)
+	return nil
+}
+
+// deleteLegacyClusterScopedResources deletes the cluster-scoped resources created by previous versions of the operator,
+// whose names didn't include the namespace and could therefore collide between Coroot instances.
+func (r *CorootReconciler) deleteLegacyClusterScopedResources(ctx context.Context, cr *corootv1.Coroot) {
+	key := client.ObjectKey{Name: cr.Name + "-cluster-agent"}
+	for _, obj := range []client.Object{&rbacv1.ClusterRoleBinding{}, &rbacv1.ClusterRole{}} {
+		if err := r.Get(ctx, key, obj); err != nil {
+			continue
+		}
+		if obj.GetLabels()["app.kubernetes.io/managed-by"] == "coroot-operator" {
+			_ = r.Delete(ctx, obj)
+		}
+	}
+}
+
+// ClusterScopedName returns a name unique across all Coroot instances in the cluster.
+func ClusterScopedName(cr *corootv1.Coroot, component string) string {
+	h := sha256.Sum256([]byte(cr.Namespace + "/" + cr.Name))
+	return fmt.Sprintf("%s-%s-%x", cr.Name, component, h[:4])
+}
+
+func ClusterScopedLabels(cr *corootv1.Coroot, component string) map[string]string {
+	ls := Labels(cr, component)
+	ls["operator.coroot.com/namespace"] = cr.Namespace
+	return ls
 }
 
 func Labels(cr *corootv1.Coroot, component string) map[string]string {
@@ -297,9 +820,213 @@ func Labels(cr *corootv1.Coroot, component string) map[string]string {
 	}
 }
 
+// setCommonMetadata adds the common labels and annotations to the object, except for the ones the operator sets itself.
+func setCommonMetadata(cr *corootv1.Coroot, obj client.Object, own, ownAnnotations map[string]string) {
+	if len(cr.Spec.CommonLabels) > 0 {
+		labels := map[string]string{}
+		for k, v := range cr.Spec.CommonLabels {
+			if _, ok := own[k]; !ok {
+				labels[k] = v
+			}
+		}
+		setLabels(obj, labels)
+	}
+	if common := commonAnnotations(cr); len(common) > 0 {
+		annotations := maps.Clone(obj.GetAnnotations())
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		for k, v := range common {
+			if _, ok := ownAnnotations[k]; !ok {
+				annotations[k] = v
+			}
+		}
+		obj.SetAnnotations(annotations)
+	}
+}
+
+// commonAnnotations returns the annotations added to every object, including the ones making GitOps tools ignore them.
+func commonAnnotations(cr *corootv1.Coroot) map[string]string {
+	common := cr.Spec.CommonAnnotations
+	if g := cr.Spec.GitOps; g != nil && g.IgnoreChildren {
+		common = maps.Clone(common)
+		if common == nil {
+			common = map[string]string{}
+		}
+		maps.Copy(common, gitOpsIgnoreAnnotations)
+	}
+	return common
+}
+
+type appliedMetadata struct {
+	Labels      []string `json:"labels,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// pruneMetadata removes the labels and annotations the operator set on the object before but no longer sets,
+// e.g., the ones removed from the Coroot spec. The keys set by the operator are recorded in an annotation,
+// so the labels and annotations added by others are kept.
+func pruneMetadata(cr *corootv1.Coroot, obj client.Object, own, ownAnnotations map[string]string) {
+	applied := appliedMetadata{
+		Labels:      metadataKeys(own, cr.Spec.CommonLabels),
+		Annotations: metadataKeys(ownAnnotations, commonAnnotations(cr)),
+	}
+	annotations := maps.Clone(obj.GetAnnotations())
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	var previous appliedMetadata
+	_ = json.Unmarshal([]byte(annotations[AppliedMetadataAnnotation]), &previous)
+
+	labels := maps.Clone(obj.GetLabels())
+	for _, k := range previous.Labels {
+		if !slices.Contains(applied.Labels, k) {
+			delete(labels, k)
+		}
+	}
+	obj.SetLabels(labels)
+	for _, k := range previous.Annotations {
+		if !slices.Contains(applied.Annotations, k) {
+			delete(annotations, k)
+		}
+	}
+	if len(applied.Labels) > 0 || len(applied.Annotations) > 0 {
+		data, _ := json.Marshal(applied)
+		annotations[AppliedMetadataAnnotation] = string(data)
+	} else {
+		delete(annotations, AppliedMetadataAnnotation)
+	}
+	obj.SetAnnotations(annotations)
+}
+
+func metadataKeys(ms ...map[string]string) []string {
+	var keys []string
+	for _, m := range ms {
+		for k := range m {
+			if !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// setLabels adds the labels to the object, keeping the ones added by others.
+func setLabels(obj client.Object, labels map[string]string) {
+	// The map is copied, since builders share it with the selectors.
+	ls := maps.Clone(obj.GetLabels())
+	if ls == nil {
+		ls = map[string]string{}
+	}
+	for k, v := range labels {
+		ls[k] = v
+	}
+	obj.SetLabels(ls)
+}
+
+// mergeLabels returns the standard labels extended with the user-defined ones.
+// The standard labels take precedence, since they are used by the selectors.
+func mergeLabels(ls, extra map[string]string) map[string]string {
+	if len(extra) == 0 {
+		return ls
+	}
+	res := map[string]string{}
+	for k, v := range extra {
+		res[k] = v
+	}
+	for k, v := range ls {
+		res[k] = v
+	}
+	return res
+}
+
+// archAffinity returns the user-defined affinity extended with a node affinity requirement for the architectures.
+func archAffinity(a *corev1.Affinity, archs []corootv1.Architecture) *corev1.Affinity {
+	if len(archs) == 0 {
+		return a
+	}
+	req := corev1.NodeSelectorRequirement{Key: corev1.LabelArchStable, Operator: corev1.NodeSelectorOpIn}
+	for _, arch := range archs {
+		req.Values = append(req.Values, string(arch))
+	}
+	res := &corev1.Affinity{}
+	if a != nil {
+		res = a.DeepCopy()
+	}
+	if res.NodeAffinity == nil {
+		res.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	required := res.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		required = &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{}}}
+		res.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required
+	}
+	// Node selector terms are ORed, so the requirement is added to each of them.
+	for i := range required.NodeSelectorTerms {
+		required.NodeSelectorTerms[i].MatchExpressions = append(required.NodeSelectorTerms[i].MatchExpressions, req)
+	}
+	return res
+}
+
+// affinity returns the user-defined affinity extended with the anti-affinity rules of the preset.
+// Explicitly configured pod anti-affinity always takes precedence over the preset.
+func affinity(a *corev1.Affinity, preset corootv1.PodAntiAffinityPreset, ls map[string]string) *corev1.Affinity {
+	if preset == "" || (a != nil && a.PodAntiAffinity != nil) {
+		return a
+	}
+	res := &corev1.Affinity{}
+	if a != nil {
+		res = a.DeepCopy()
+	}
+	selector := &metav1.LabelSelector{MatchLabels: ls}
+	zone := corev1.WeightedPodAffinityTerm{
+		Weight:          50,
+		PodAffinityTerm: corev1.PodAffinityTerm{LabelSelector: selector, TopologyKey: corev1.LabelTopologyZone},
+	}
+	host := corev1.PodAffinityTerm{LabelSelector: selector, TopologyKey: corev1.LabelHostname}
+	res.PodAntiAffinity = &corev1.PodAntiAffinity{}
+	switch preset {
+	case corootv1.PodAntiAffinityPresetHard:
+		res.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = []corev1.PodAffinityTerm{host}
+		res.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = []corev1.WeightedPodAffinityTerm{zone}
+	default:
+		res.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = []corev1.WeightedPodAffinityTerm{
+			{Weight: 100, PodAffinityTerm: host},
+			zone,
+		}
+	}
+	return res
+}
+
 var nonRootSecurityContext = &corev1.PodSecurityContext{
-	RunAsNonRoot: ptr.To(true),
-	RunAsUser:    ptr.To(int64(65534)),
-	RunAsGroup:   ptr.To(int64(65534)),
-	FSGroup:      ptr.To(int64(65534)),
+	RunAsNonRoot:   ptr.To(true),
+	RunAsUser:      ptr.To(int64(65534)),
+	RunAsGroup:     ptr.To(int64(65534)),
+	FSGroup:        ptr.To(int64(65534)),
+	SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+}
+
+// All the components are Linux-only, so they must never be scheduled onto Windows nodes of mixed clusters.
+var linuxNodeSelector = map[string]string{corev1.LabelOSStable: "linux"}
+
+// restrictedSecurityContext complies with the restricted Pod Security Standard.
+var restrictedSecurityContext = &corev1.SecurityContext{
+	AllowPrivilegeEscalation: ptr.To(false),
+	ReadOnlyRootFilesystem:   ptr.To(true),
+	Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+}
+
+func podSecurityContext(override *corev1.PodSecurityContext) *corev1.PodSecurityContext {
+	if override != nil {
+		return override
+	}
+	return nonRootSecurityContext
+}
+
+func containerSecurityContext(override *corev1.SecurityContext) *corev1.SecurityContext {
+	if override != nil {
+		return override
+	}
+	return restrictedSecurityContext
 }
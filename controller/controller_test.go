@@ -0,0 +1,313 @@
+package controller
+
+import (
+	"context"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"testing"
+	"time"
+)
+
+func TestStatefulSetPodManagementPolicyChange(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	ss := func(policy appsv1.PodManagementPolicyType) *appsv1.StatefulSet {
+		return &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-keeper", Namespace: cr.Namespace},
+			Spec:       appsv1.StatefulSetSpec{PodManagementPolicy: policy},
+		}
+	}
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(ss(appsv1.OrderedReadyPodManagement)).Build()
+	ctx, inv := withInventory(context.Background())
+
+	// The default policy is the same.
+	if recreating, err := r.recreateStatefulSetOnPolicyChange(ctx, cr, ss("")); recreating || err != nil {
+		t.Fatalf("expected no recreation, got %v (%v)", recreating, err)
+	}
+	if recreating, err := r.recreateStatefulSetOnPolicyChange(ctx, cr, ss(appsv1.ParallelPodManagement)); !recreating || err != nil {
+		t.Fatalf("expected recreation, got %v (%v)", recreating, err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(ss("")), &appsv1.StatefulSet{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the StatefulSet to be deleted, got %v", err)
+	}
+	if !inv.has("StatefulSet", ss("")) {
+		t.Errorf("expected the StatefulSet to be kept from pruning")
+	}
+	if err := r.CreateOrUpdateStatefulSet(ctx, cr, ss(appsv1.ParallelPodManagement)); err != nil {
+		t.Fatal(err)
+	}
+	current := &appsv1.StatefulSet{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(ss("")), current); err != nil {
+		t.Fatal(err)
+	}
+	if current.Spec.PodManagementPolicy != appsv1.ParallelPodManagement {
+		t.Errorf("expected the StatefulSet to be recreated with the Parallel policy, got %q", current.Spec.PodManagementPolicy)
+	}
+}
+
+func TestStatefulSetsRecreatedOneAtATime(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	keeper := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-keeper", Namespace: cr.Namespace, Labels: Labels(cr, "clickhouse-keeper")},
+		Spec:       appsv1.StatefulSetSpec{PodManagementPolicy: appsv1.OrderedReadyPodManagement},
+	}
+	clickhouse := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-shard-0", Namespace: cr.Namespace, Labels: Labels(cr, "clickhouse")},
+		Spec:       appsv1.StatefulSetSpec{PodManagementPolicy: appsv1.OrderedReadyPodManagement},
+	}
+	// The pod of the ClickHouse StatefulSet, which has just been recreated, hasn't been adopted yet.
+	orphan := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-shard-0-0", Namespace: cr.Namespace, Labels: Labels(cr, "clickhouse")}}
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(keeper, orphan).Build()
+	ctx, _ := withInventory(context.Background())
+
+	parallel := keeper.DeepCopy()
+	parallel.Spec.PodManagementPolicy = appsv1.ParallelPodManagement
+	if recreating, err := r.recreateStatefulSetOnPolicyChange(ctx, cr, parallel); !recreating || err != nil {
+		t.Fatalf("expected waiting, got %v (%v)", recreating, err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(keeper), &appsv1.StatefulSet{}); err != nil {
+		t.Fatalf("expected the StatefulSet to be kept until the other one is ready, got %v", err)
+	}
+
+	// The ClickHouse StatefulSet has adopted its pod, but the pod isn't ready yet.
+	if err := r.Delete(ctx, orphan); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(ctx, clickhouse); err != nil {
+		t.Fatal(err)
+	}
+	if settled, err := r.statefulSetsSettled(ctx, cr, keeper); settled || err != nil {
+		t.Fatalf("expected not settled, got %v (%v)", settled, err)
+	}
+	clickhouse.Status.ReadyReplicas = 1
+	if err := r.Status().Update(ctx, clickhouse); err != nil {
+		t.Fatal(err)
+	}
+	if recreating, err := r.recreateStatefulSetOnPolicyChange(ctx, cr, parallel); !recreating || err != nil {
+		t.Fatalf("expected recreation, got %v (%v)", recreating, err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(keeper), &appsv1.StatefulSet{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the StatefulSet to be deleted, got %v", err)
+	}
+}
+
+func TestPreExistingServiceAccount(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.Spec.ClusterAgent.ServiceAccount.Name = "other-team"
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "other-team", Namespace: cr.Namespace}}
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(sa).Build()
+	ctx := context.Background()
+
+	// Nothing is bound to ServiceAccounts that aren't meant to be used by the operator.
+	if err := r.CreateOrUpdateServiceAccount(ctx, cr, "cluster-agent", sccNonroot); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(r.openshiftSCCRoleBinding(cr, "cluster-agent", sccNonroot)), &rbacv1.RoleBinding{}); !errors.IsNotFound(err) {
+		t.Errorf("expected no SCC RoleBinding, got %v", err)
+	}
+
+	sa.Labels = map[string]string{"app.kubernetes.io/managed-by": "coroot-operator"}
+	if err := r.Update(ctx, sa); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateOrUpdateServiceAccount(ctx, cr, "cluster-agent", sccNonroot); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(r.openshiftSCCRoleBinding(cr, "cluster-agent", sccNonroot)), &rbacv1.RoleBinding{}); err != nil {
+		t.Errorf("expected the SCC RoleBinding, got %v", err)
+	}
+}
+
+func TestDeletionInNamespacedMode(t *testing.T) {
+	r := testReconciler(t)
+	r.watchNamespaces = []string{"coroot"}
+	cr := testCoroot()
+	cr.Finalizers = []string{Finalizer}
+	cr.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	// The operator limited to WATCH_NAMESPACE has no access to cluster-scoped resources.
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(cr).WithInterceptorFuncs(interceptor.Funcs{
+		Delete: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.DeleteOption) error {
+			if obj.GetNamespace() == "" {
+				return errors.NewForbidden(schema.GroupResource{}, obj.GetName(), nil)
+			}
+			return c.Delete(ctx, obj, opts...)
+		},
+	}).Build()
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cr)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(cr), &corootv1.Coroot{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the Coroot to be deleted once the finalizer is removed, got %v", err)
+	}
+}
+
+func TestRemovedAnnotationsPruned(t *testing.T) {
+	r := testReconciler(t)
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).Build()
+	cr := testCoroot()
+	cr.Spec.Clickhouse.Service = &corootv1.ClickhouseServiceSpec{Annotations: map[string]string{
+		"service.beta.kubernetes.io/aws-load-balancer-internal": "true",
+		"external-dns.alpha.kubernetes.io/hostname":             "clickhouse.example.com",
+	}}
+	ctx := context.Background()
+	if err := r.CreateOrUpdateService(ctx, cr, r.clickhouseExternalService(cr)); err != nil {
+		t.Fatal(err)
+	}
+	s := &corev1.Service{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(r.clickhouseExternalService(cr)), s); err != nil {
+		t.Fatal(err)
+	}
+	s.Annotations["cloud.example.com/allocated-ip"] = "203.0.113.10"
+	if err := r.Update(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+
+	delete(cr.Spec.Clickhouse.Service.Annotations, "external-dns.alpha.kubernetes.io/hostname")
+	if err := r.CreateOrUpdateService(ctx, cr, r.clickhouseExternalService(cr)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(s), s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Annotations["external-dns.alpha.kubernetes.io/hostname"]; ok {
+		t.Error("expected the removed annotation to be deleted")
+	}
+	for _, k := range []string{"service.beta.kubernetes.io/aws-load-balancer-internal", "cloud.example.com/allocated-ip"} {
+		if _, ok := s.Annotations[k]; !ok {
+			t.Errorf("expected the %s annotation to be kept", k)
+		}
+	}
+}
+
+func TestRemovedIngressAnnotationsPruned(t *testing.T) {
+	r := testReconciler(t)
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).Build()
+	cr := testCoroot()
+	cr.Spec.Ingress = &corootv1.IngressSpec{Telemetry: &corootv1.TelemetryIngressSpec{
+		Host:        "otlp.example.com",
+		Annotations: map[string]string{"nginx.ingress.kubernetes.io/proxy-body-size": "16m"},
+	}}
+	ctx := context.Background()
+	if err := r.CreateOrUpdateIngress(ctx, cr, r.corootTelemetryIngress(cr), false); err != nil {
+		t.Fatal(err)
+	}
+
+	cr.Spec.Ingress.Telemetry.Annotations = nil
+	i := r.corootTelemetryIngress(cr)
+	if err := r.CreateOrUpdateIngress(ctx, cr, i, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(i), i); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := i.Annotations["nginx.ingress.kubernetes.io/proxy-body-size"]; ok {
+		t.Error("expected the removed annotation to be deleted")
+	}
+}
+
+func TestRemovedWorkloadLabelsPruned(t *testing.T) {
+	r := testReconciler(t)
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).Build()
+	cr := testCoroot()
+	cr.Spec.ClusterAgent.Labels = map[string]string{"team": "observability", "cost-center": "platform"}
+	ctx := context.Background()
+	if err := r.CreateOrUpdateDeployment(ctx, cr, r.clusterAgentDeployment(cr, nil)); err != nil {
+		t.Fatal(err)
+	}
+	d := &appsv1.Deployment{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(r.clusterAgentDeployment(cr, nil)), d); err != nil {
+		t.Fatal(err)
+	}
+	d.Labels["argocd.argoproj.io/instance"] = "coroot"
+	if err := r.Update(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	delete(cr.Spec.ClusterAgent.Labels, "cost-center")
+	if err := r.CreateOrUpdateDeployment(ctx, cr, r.clusterAgentDeployment(cr, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(d), d); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Labels["cost-center"]; ok {
+		t.Error("expected the removed label to be deleted")
+	}
+	for _, k := range []string{"team", "argocd.argoproj.io/instance", "app.kubernetes.io/component"} {
+		if _, ok := d.Labels[k]; !ok {
+			t.Errorf("expected the %s label to be kept", k)
+		}
+	}
+}
+
+func TestRemovedCommonMetadataPruned(t *testing.T) {
+	r := testReconciler(t)
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).Build()
+	cr := testCoroot()
+	cr.Spec.CommonLabels = map[string]string{"velero.io/backup": "coroot"}
+	cr.Spec.CommonAnnotations = map[string]string{"owner": "observability"}
+	cr.Spec.GitOps = &corootv1.GitOpsSpec{IgnoreChildren: true}
+	ctx := context.Background()
+	if err := r.CreateOrUpdateRole(ctx, cr, r.clusterAgentRole(cr)); err != nil {
+		t.Fatal(err)
+	}
+
+	cr.Spec.CommonLabels, cr.Spec.CommonAnnotations, cr.Spec.GitOps = nil, nil, nil
+	role := r.clusterAgentRole(cr)
+	if err := r.CreateOrUpdateRole(ctx, cr, role); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(role), role); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := role.Labels["velero.io/backup"]; ok {
+		t.Error("expected the removed common label to be deleted")
+	}
+	for k := range role.Annotations {
+		if k != AppliedMetadataAnnotation {
+			t.Errorf("expected the %s annotation to be deleted", k)
+		}
+	}
+}
+
+func TestSecretsRotationStaggered(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	coroot := r.corootStatefulSet(cr, nil)
+	cr.Annotations = map[string]string{corootv1.RotateSecretsAnnotation: "1"}
+	clickhouse := r.clickhouseStatefulSets(cr)[0]
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(coroot, clickhouse).Build()
+	ctx := context.Background()
+
+	ss := r.corootStatefulSet(cr, nil)
+	if err := r.holdSecretsRotation(ctx, cr, ss); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := ss.Spec.Template.Annotations[corootv1.RotateSecretsAnnotation]; ok {
+		t.Errorf("expected Coroot to wait for ClickHouse, got rotation %q", v)
+	}
+
+	clickhouse.Status = appsv1.StatefulSetStatus{ReadyReplicas: *clickhouse.Spec.Replicas, UpdatedReplicas: *clickhouse.Spec.Replicas}
+	if err := r.Status().Update(ctx, clickhouse); err != nil {
+		t.Fatal(err)
+	}
+	ss = r.corootStatefulSet(cr, nil)
+	if err := r.holdSecretsRotation(ctx, cr, ss); err != nil {
+		t.Fatal(err)
+	}
+	if v := ss.Spec.Template.Annotations[corootv1.RotateSecretsAnnotation]; v != "1" {
+		t.Errorf("expected Coroot to restart once ClickHouse is ready, got rotation %q", v)
+	}
+}
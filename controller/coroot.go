@@ -1,12 +1,12 @@
 package controller
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/utils/ptr"
 	"strings"
-	"text/template"
 
 	corootv1 "github.io/coroot/operator/api/v1"
 	appsv1 "k8s.io/api/apps/v1"
@@ -29,7 +29,7 @@ func (r *CorootReconciler) corootService(cr *corootv1.Coroot) *corev1.Service {
 
 	port := cr.Spec.Service.Port
 	if port == 0 {
-		port = 8080
+		port = DefaultCorootServicePort
 	}
 	s.Spec = corev1.ServiceSpec{
 		Selector: ls,
@@ -49,11 +49,14 @@ func (r *CorootReconciler) corootService(cr *corootv1.Coroot) *corev1.Service {
 }
 
 func (r *CorootReconciler) corootPVCs(cr *corootv1.Coroot) []*corev1.PersistentVolumeClaim {
+	if !pvcStorage(cr.Spec.Storage) {
+		return nil
+	}
 	ls := Labels(cr, "coroot")
 
 	size := cr.Spec.Storage.Size
 	if size.IsZero() {
-		size, _ = resource.ParseQuantity("10Gi")
+		size, _ = resource.ParseQuantity(DefaultStorageSize)
 	}
 	replicas := cr.Spec.Replicas
 	if replicas == 0 {
@@ -64,9 +67,10 @@ func (r *CorootReconciler) corootPVCs(cr *corootv1.Coroot) []*corev1.PersistentV
 	for replica := 0; replica < replicas; replica++ {
 		pvc := &corev1.PersistentVolumeClaim{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      fmt.Sprintf("data-%s-coroot-%d", cr.Name, replica),
-				Namespace: cr.Namespace,
-				Labels:    ls,
+				Name:        fmt.Sprintf("data-%s-coroot-%d", cr.Name, replica),
+				Namespace:   cr.Namespace,
+				Labels:      mergeLabels(ls, cr.Spec.Storage.Labels),
+				Annotations: cr.Spec.Storage.Annotations,
 			},
 			Spec: corev1.PersistentVolumeClaimSpec{
 				AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
@@ -76,11 +80,13 @@ func (r *CorootReconciler) corootPVCs(cr *corootv1.Coroot) []*corev1.PersistentV
 					},
 				},
 				StorageClassName: cr.Spec.Storage.ClassName,
+				DataSourceRef:    cr.Spec.Storage.DataSourceRef,
+				Selector:         cr.Spec.Storage.Selector,
 			},
 		}
 		res = append(res, pvc)
 	}
-	return res
+	return snapshotDataSource(cr, res)
 }
 
 func (r *CorootReconciler) corootIngress(cr *corootv1.Coroot) *networkingv1.Ingress {
@@ -127,25 +133,75 @@ func (r *CorootReconciler) corootIngress(cr *corootv1.Coroot) *networkingv1.Ingr
 	return i
 }
 
-func (r *CorootReconciler) corootDeployment(cr *corootv1.Coroot) *appsv1.Deployment {
-	ls := Labels(cr, "coroot")
-	d := &appsv1.Deployment{
+func (r *CorootReconciler) corootTelemetryIngress(cr *corootv1.Coroot) *networkingv1.Ingress {
+	ls := Labels(cr, "ingress-telemetry")
+	i := &networkingv1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      cr.Name + "-coroot",
+			Name:      cr.Name + "-telemetry",
 			Namespace: cr.Namespace,
 			Labels:    ls,
 		},
 	}
-	return d
+	if cr.Spec.Ingress == nil || cr.Spec.Ingress.Telemetry == nil {
+		return i
+	}
+	t := cr.Spec.Ingress.Telemetry
+	i.Annotations = t.Annotations
+	basePath := strings.TrimRight(cr.Spec.Ingress.Path, "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	var paths []networkingv1.HTTPIngressPath
+	for _, p := range []string{"/v1/traces", "/v1/logs", "/v1/metrics"} {
+		paths = append(paths, networkingv1.HTTPIngressPath{
+			Path:     basePath + p,
+			PathType: ptr.To(networkingv1.PathTypePrefix),
+			Backend: networkingv1.IngressBackend{
+				Service: &networkingv1.IngressServiceBackend{
+					Name: fmt.Sprintf("%s-coroot", cr.Name),
+					Port: networkingv1.ServiceBackendPort{
+						Name: "http",
+					},
+				},
+			},
+		})
+	}
+	i.Spec = networkingv1.IngressSpec{
+		IngressClassName: t.ClassName,
+		Rules: []networkingv1.IngressRule{{
+			Host: t.Host,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{Paths: paths},
+			},
+		}},
+	}
+	if t.TLS != nil {
+		i.Spec.TLS = append(i.Spec.TLS, *t.TLS)
+	}
+	return i
 }
 
-func (r *CorootReconciler) corootStatefulSet(cr *corootv1.Coroot) *appsv1.StatefulSet {
+// uiIngressEnabled reports whether the Ingress for the UI is needed: it is skipped if only telemetry is configured
+// or if Gateway API is used instead.
+func uiIngressEnabled(cr *corootv1.Coroot) bool {
+	i := cr.Spec.Ingress
+	if i == nil || cr.Spec.Gateway != nil {
+		return false
+	}
+	return i.Telemetry == nil || i.ClassName != nil || i.Host != "" || i.Path != "" || i.TLS != nil
+}
+
+func telemetryIngressEnabled(cr *corootv1.Coroot) bool {
+	return cr.Spec.Ingress != nil && cr.Spec.Ingress.Telemetry != nil && cr.Spec.Gateway == nil
+}
+
+func (r *CorootReconciler) corootStatefulSet(cr *corootv1.Coroot, secrets map[string]string) *appsv1.StatefulSet {
 	ls := Labels(cr, "coroot")
 	ss := &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-coroot",
 			Namespace: cr.Namespace,
-			Labels:    ls,
+			Labels:    mergeLabels(ls, cr.Spec.Labels),
 		},
 	}
 
@@ -156,18 +212,27 @@ func (r *CorootReconciler) corootStatefulSet(cr *corootv1.Coroot) *appsv1.Statef
 
 	env := []corev1.EnvVar{
 		{Name: "GLOBAL_REFRESH_INTERVAL", Value: refreshInterval},
-		{Name: "GLOBAL_PROMETHEUS_URL", Value: fmt.Sprintf("http://%s-prometheus.%s:9090", cr.Name, cr.Namespace)},
+		{Name: "GLOBAL_PROMETHEUS_URL", Value: metricsURL(cr)},
 		{Name: "INSTALLATION_TYPE", Value: "k8s-operator"},
 	}
+	if u := metricsRemoteWriteURL(cr); u != "" {
+		env = append(env, corev1.EnvVar{Name: "GLOBAL_PROMETHEUS_REMOTE_WRITE_URL", Value: u})
+	}
 	if cr.Spec.CacheTTL.Duration > 0 {
 		env = append(env, corev1.EnvVar{Name: "CACHE_TTL", Value: cr.Spec.CacheTTL.Duration.String()})
 	}
 	if cr.Spec.AuthAnonymousRole != "" {
 		env = append(env, corev1.EnvVar{Name: "AUTH_ANONYMOUS_ROLE", Value: cr.Spec.AuthAnonymousRole})
 	}
-	if cr.Spec.AuthBootstrapAdminPassword != "" {
-		env = append(env, corev1.EnvVar{Name: "AUTH_BOOTSTRAP_ADMIN_PASSWORD", Value: cr.Spec.AuthBootstrapAdminPassword})
+	if generatedAdminPassword(cr) {
+		env = append(env, secretEnv("AUTH_BOOTSTRAP_ADMIN_PASSWORD", "", &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: cr.Name + "-coroot-admin"},
+			Key:                  "password",
+		}))
+	} else {
+		env = append(env, secretEnv("AUTH_BOOTSTRAP_ADMIN_PASSWORD", cr.Spec.AuthBootstrapAdminPassword, cr.Spec.AuthBootstrapAdminPasswordSecret))
 	}
+	env = append(env, proxyEnv(cr)...)
 	for _, e := range cr.Spec.Env {
 		env = append(env, e)
 	}
@@ -175,24 +240,24 @@ func (r *CorootReconciler) corootStatefulSet(cr *corootv1.Coroot) *appsv1.Statef
 	var image string
 	if cr.Spec.EnterpriseEdition != nil {
 		image = r.getAppImage(cr, AppCorootEE)
-		env = append(env, corev1.EnvVar{Name: "LICENSE_KEY", Value: cr.Spec.EnterpriseEdition.LicenseKey})
+		env = append(env, secretEnv("LICENSE_KEY", cr.Spec.EnterpriseEdition.LicenseKey, cr.Spec.EnterpriseEdition.LicenseKeySecret))
 	} else {
 		image = r.getAppImage(cr, AppCorootCE)
 	}
 
 	if ec := cr.Spec.ExternalClickhouse; ec != nil {
 		env = append(env,
-			corev1.EnvVar{Name: "GLOBAL_CLICKHOUSE_ADDRESS", Value: ec.Address},
+			corev1.EnvVar{Name: "GLOBAL_CLICKHOUSE_ADDRESS", Value: externalClickhouseAddress(cr)},
 			corev1.EnvVar{Name: "GLOBAL_CLICKHOUSE_USER", Value: ec.User},
 			corev1.EnvVar{Name: "GLOBAL_CLICKHOUSE_INITIAL_DATABASE", Value: ec.Database},
 		)
-		password := corev1.EnvVar{Name: "GLOBAL_CLICKHOUSE_PASSWORD"}
-		if ec.PasswordSecret != nil {
-			password.ValueFrom = &corev1.EnvVarSource{SecretKeyRef: ec.PasswordSecret}
-		} else {
-			password.Value = ec.Password
+		env = append(env, secretEnv("GLOBAL_CLICKHOUSE_PASSWORD", ec.Password, ec.PasswordSecret))
+		if ec.Secure {
+			env = append(env, corev1.EnvVar{Name: "GLOBAL_CLICKHOUSE_TLS_ENABLE", Value: "true"})
+		}
+		if ec.InsecureSkipVerify {
+			env = append(env, corev1.EnvVar{Name: "GLOBAL_CLICKHOUSE_TLS_SKIP_VERIFY", Value: "true"})
 		}
-		env = append(env, password)
 	} else {
 		env = append(env,
 			corev1.EnvVar{
@@ -207,14 +272,8 @@ func (r *CorootReconciler) corootStatefulSet(cr *corootv1.Coroot) *appsv1.Statef
 	}
 
 	if p := cr.Spec.Postgres; p != nil {
-		password := corev1.EnvVar{Name: "PG_PASSWORD"}
-		if p.PasswordSecret != nil {
-			password.ValueFrom = &corev1.EnvVarSource{SecretKeyRef: p.PasswordSecret}
-		} else {
-			password.Value = p.Password
-		}
-		env = append(env, password)
-		env = append(env, corev1.EnvVar{Name: "PG_CONNECTION_STRING", Value: postgresConnectionString(*p, "PG_PASSWORD")})
+		env = append(env, secretEnv("PG_PASSWORD", p.Password, p.PasswordSecret))
+		env = append(env, corev1.EnvVar{Name: "PG_CONNECTION_STRING", Value: postgresConnectionString(*p, "$(PG_PASSWORD)")})
 	}
 
 	if cr.Spec.Ingress != nil && cr.Spec.Ingress.Path != "" {
@@ -225,37 +284,41 @@ func (r *CorootReconciler) corootStatefulSet(cr *corootv1.Coroot) *appsv1.Statef
 	if replicas <= 0 {
 		replicas = 1
 	}
+	if hibernated(cr) {
+		replicas = 0
+	}
 
 	ss.Spec = appsv1.StatefulSetSpec{
 		Selector: &metav1.LabelSelector{
 			MatchLabels: ls,
 		},
-		Replicas: &replicas,
+		Replicas:       &replicas,
+		UpdateStrategy: corootUpdateStrategy(cr, replicas),
 		VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      "data",
-				Namespace: cr.Namespace,
+				Name:        "data",
+				Namespace:   cr.Namespace,
+				Labels:      mergeLabels(Labels(cr, "coroot"), cr.Spec.Storage.Labels),
+				Annotations: cr.Spec.Storage.Annotations,
 			},
 		}},
 		Template: corev1.PodTemplateSpec{
 			ObjectMeta: metav1.ObjectMeta{
-				Labels:      ls,
-				Annotations: cr.Spec.PodAnnotations,
+				Labels:      mergeLabels(ls, cr.Spec.PodLabels),
+				Annotations: podAnnotations(cr, corootConfigAnnotations(cr, secrets, secretsRotationAnnotations(cr, cr.Spec.PodAnnotations)), true),
 			},
 			Spec: corev1.PodSpec{
-				ServiceAccountName: cr.Name + "-coroot",
-				SecurityContext:    nonRootSecurityContext,
-				Affinity:           cr.Spec.Affinity,
+				ServiceAccountName: serviceAccountName(cr, "coroot"),
+				DNSPolicy:          cr.Spec.DNSPolicy,
+				DNSConfig:          cr.Spec.DNSConfig,
+				HostAliases:        cr.Spec.HostAliases,
+				SecurityContext:    podSecurityContext(cr.Spec.PodSecurityContext),
+				Affinity:           affinity(archAffinity(cr.Spec.Affinity, cr.Spec.Architectures), cr.Spec.PodAntiAffinityPreset, ls),
 				Tolerations:        cr.Spec.Tolerations,
-				InitContainers: []corev1.Container{
-					{
-						Image:        UBIMinimalImage,
-						Name:         "config",
-						Command:      []string{"/bin/sh", "-c"},
-						Args:         []string{corootConfigCmd("/config/config.yaml", cr)},
-						VolumeMounts: []corev1.VolumeMount{{Name: "config", MountPath: "/config"}},
-					},
-				},
+				NodeSelector:       linuxNodeSelector,
+				PriorityClassName:  cr.Spec.PriorityClassName,
+				SchedulerName:      cr.Spec.SchedulerName,
+				RuntimeClassName:   cr.Spec.RuntimeClassName,
 				Containers: []corev1.Container{
 					{
 						Image: image,
@@ -265,15 +328,17 @@ func (r *CorootReconciler) corootStatefulSet(cr *corootv1.Coroot) *appsv1.Statef
 							"--listen=:8080",
 							"--data-dir=/data",
 						},
-						Env: env,
+						Env: goRuntimeEnv(env, cr.Spec.Resources),
 						Ports: []corev1.ContainerPort{
 							{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
 						},
 						VolumeMounts: []corev1.VolumeMount{
-							{Name: "config", MountPath: "/config"},
+							{Name: "config", MountPath: "/config", ReadOnly: true},
+							{Name: "tmp", MountPath: "/tmp"},
 							{Name: "data", MountPath: "/data"},
 						},
-						Resources: cr.Spec.Resources,
+						Resources:       cr.Spec.Resources,
+						SecurityContext: containerSecurityContext(cr.Spec.SecurityContext),
 						ReadinessProbe: &corev1.Probe{
 							ProbeHandler: corev1.ProbeHandler{
 								HTTPGet: &corev1.HTTPGetAction{Path: "/health", Port: intstr.FromString("http")},
@@ -284,6 +349,12 @@ func (r *CorootReconciler) corootStatefulSet(cr *corootv1.Coroot) *appsv1.Statef
 				Volumes: []corev1.Volume{
 					{
 						Name: "config",
+						VolumeSource: corev1.VolumeSource{
+							Secret: &corev1.SecretVolumeSource{SecretName: cr.Name + "-coroot-config"},
+						},
+					},
+					{
+						Name: "tmp",
 						VolumeSource: corev1.VolumeSource{
 							EmptyDir: &corev1.EmptyDirVolumeSource{},
 						},
@@ -292,24 +363,86 @@ func (r *CorootReconciler) corootStatefulSet(cr *corootv1.Coroot) *appsv1.Statef
 			},
 		},
 	}
+	if spc := cr.Spec.SecretProviderClass; spc != "" {
+		ps := &ss.Spec.Template.Spec
+		ps.Volumes = append(ps.Volumes, corev1.Volume{
+			Name: "secrets-store",
+			VolumeSource: corev1.VolumeSource{
+				CSI: &corev1.CSIVolumeSource{
+					Driver:           "secrets-store.csi.k8s.io",
+					ReadOnly:         ptr.To(true),
+					VolumeAttributes: map[string]string{"secretProviderClass": spc},
+				},
+			},
+		})
+		ps.Containers[0].VolumeMounts = append(ps.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "secrets-store", MountPath: "/mnt/secrets-store", ReadOnly: true})
+	}
+	applyCustomCA(cr, &ss.Spec.Template.Spec, clickhouseCA(cr))
+	applyStatefulSetStorage(cr.Spec.Storage, ss)
+	applyContainerOverrides(&ss.Spec.Template.Spec.Containers[0], cr.Spec.ExtraArgs, cr.Spec.Lifecycle)
 
 	return ss
 }
 
-func corootConfigCmd(filename string, cr *corootv1.Coroot) string {
-	var out bytes.Buffer
-	_ = corootConfigTemplate.Execute(&out, cr.Spec)
-	return "cat <<EOF > " + filename + out.String() + "EOF"
+// corootConfigAnnotations adds the checksum of the config to the pod annotations, so Coroot is restarted when the config changes.
+// The checksum is taken over the config with the resolved secret values, so rotating a referenced secret restarts Coroot as well.
+func corootConfigAnnotations(cr *corootv1.Coroot, secrets map[string]string, annotations map[string]string) map[string]string {
+	res := map[string]string{"coroot.com/config-checksum": fmt.Sprintf("%x", sha256.Sum256([]byte(corootConfig(cr, secrets))))}
+	for k, v := range annotations {
+		res[k] = v
+	}
+	return res
+}
+
+func generatedAdminPassword(cr *corootv1.Coroot) bool {
+	return cr.Spec.AuthBootstrapAdminPassword == "" && cr.Spec.AuthBootstrapAdminPasswordSecret == nil
 }
 
-var corootConfigTemplate = template.Must(template.New("").Parse(`
-projects:
-{{- range $project := .Projects }}
-- name: {{ $project.Name }}
-  api_keys:
-  {{- range $key := $project.ApiKeys }}
-  - key: {{ $key.Key }}
-    description: {{ $key.Description }}
-  {{- end }}
-{{- end }}
-`))
+// corootAdminSecret holds the generated bootstrap admin password. It's created once and never rotated,
+// since Coroot uses the password only when it creates the admin user.
+func (r *CorootReconciler) corootAdminSecret(cr *corootv1.Coroot) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-coroot-admin",
+			Namespace: cr.Namespace,
+			Labels:    Labels(cr, "coroot"),
+		},
+		Data: map[string][]byte{"password": []byte(RandomString(16))},
+	}
+}
+
+func (r *CorootReconciler) corootConfigSecret(cr *corootv1.Coroot, secrets map[string]string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-coroot-config",
+			Namespace: cr.Namespace,
+			Labels:    Labels(cr, "coroot"),
+		},
+		Data: map[string][]byte{"config.yaml": []byte(corootConfig(cr, secrets))},
+	}
+}
+
+// corootConfigSecrets reads the values of the secrets referenced in the config.
+func (r *CorootReconciler) corootConfigSecrets(ctx context.Context, cr *corootv1.Coroot) (map[string]string, error) {
+	secrets := map[string]string{}
+	for name, ref := range corootConfigSecretRefs(cr) {
+		v, err := r.secretValue(ctx, cr, "", ref)
+		if err != nil {
+			return nil, err
+		}
+		secrets[name] = v
+	}
+	return secrets, nil
+}
+
+// CreateOrUpdateCorootConfig renders the config with the referenced secret values into a Secret mounted by Coroot,
+// so credentials never appear in the pod spec.
+func (r *CorootReconciler) CreateOrUpdateCorootConfig(ctx context.Context, cr *corootv1.Coroot, secrets map[string]string) error {
+	s := r.corootConfigSecret(cr, secrets)
+	labels, data := s.Labels, s.Data
+	return r.CreateOrUpdate(ctx, cr, s, false, func() error {
+		s.Labels = labels
+		s.Data = data
+		return nil
+	})
+}
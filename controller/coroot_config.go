@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// The structure of Coroot's config file. Marshaling it instead of templating takes care of quoting and escaping the values.
+type corootConfigFile struct {
+	Projects []projectConfig `json:"projects,omitempty"`
+}
+
+type projectConfig struct {
+	Name    string         `json:"name"`
+	ApiKeys []apiKeyConfig `json:"api_keys"`
+}
+
+type apiKeyConfig struct {
+	Key         string `json:"key"`
+	Description string `json:"description"`
+}
+
+// corootConfigSecretRefs returns the secrets referenced by the config, keyed by the names corootConfig looks them up by.
+func corootConfigSecretRefs(cr *corootv1.Coroot) map[string]*corev1.SecretKeySelector {
+	refs := map[string]*corev1.SecretKeySelector{}
+	for i, p := range cr.Spec.Projects {
+		for j, k := range p.ApiKeys {
+			if k.KeySecret != nil {
+				refs[projectApiKeySecret(i, j)] = k.KeySecret
+			}
+		}
+	}
+	return refs
+}
+
+func projectApiKeySecret(project, key int) string {
+	return fmt.Sprintf("PROJECT_%d_API_KEY_%d", project, key)
+}
+
+// corootConfig renders the config with the given secret values (empty if nil).
+func corootConfig(cr *corootv1.Coroot, secrets map[string]string) string {
+	var cfg corootConfigFile
+	for i, p := range cr.Spec.Projects {
+		pc := projectConfig{Name: p.Name, ApiKeys: []apiKeyConfig{}}
+		for j, k := range p.ApiKeys {
+			key := k.Key
+			if k.KeySecret != nil {
+				key = secrets[projectApiKeySecret(i, j)]
+			}
+			pc.ApiKeys = append(pc.ApiKeys, apiKeyConfig{Key: key, Description: k.Description})
+		}
+		cfg.Projects = append(cfg.Projects, pc)
+	}
+
+	data, _ := yaml.Marshal(cfg)
+	return string(data)
+}
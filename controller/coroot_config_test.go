@@ -0,0 +1,73 @@
+package controller
+
+import (
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+	"testing"
+)
+
+func TestCorootConfigEscaping(t *testing.T) {
+	for _, v := range []string{
+		"key: value",
+		"first line\nsecond line",
+		"# not a comment",
+		"- not a list item",
+		`'single' and "double" quotes`,
+		"{not: a map}",
+		"yes",
+		"null",
+		"0x1F",
+		" leading and trailing spaces ",
+		"tab\tinside",
+		"&anchor *alias",
+		"",
+	} {
+		cr := testCoroot()
+		cr.Spec.Projects = []corootv1.ProjectSpec{{
+			Name: v,
+			ApiKeys: []corootv1.ApiKeySpec{
+				{Key: v, Description: v},
+				{KeySecret: &corev1.SecretKeySelector{Key: "key"}, Description: v},
+			},
+		}}
+
+		var cfg corootConfigFile
+		if err := yaml.UnmarshalStrict([]byte(corootConfig(cr, map[string]string{projectApiKeySecret(0, 1): v})), &cfg); err != nil {
+			t.Errorf("%q: %s", v, err)
+			continue
+		}
+		if len(cfg.Projects) != 1 || len(cfg.Projects[0].ApiKeys) != 2 {
+			t.Errorf("%q: unexpected config %+v", v, cfg)
+			continue
+		}
+		p := cfg.Projects[0]
+		for _, actual := range []string{p.Name, p.ApiKeys[0].Key, p.ApiKeys[0].Description, p.ApiKeys[1].Key, p.ApiKeys[1].Description} {
+			if actual != v {
+				t.Errorf("expected %q, got %q", v, actual)
+			}
+		}
+	}
+}
+
+func TestCorootConfigChecksum(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.Spec.Projects = []corootv1.ProjectSpec{{
+		Name:    "default",
+		ApiKeys: []corootv1.ApiKeySpec{{KeySecret: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "keys"}, Key: "key"}}},
+	}}
+	checksum := func(secrets map[string]string) string {
+		return r.corootStatefulSet(cr, secrets).Spec.Template.Annotations["coroot.com/config-checksum"]
+	}
+	first := checksum(map[string]string{projectApiKeySecret(0, 0): "first"})
+	if first == "" {
+		t.Fatal("no config checksum")
+	}
+	if first != checksum(map[string]string{projectApiKeySecret(0, 0): "first"}) {
+		t.Error("checksum changed for the same secret value")
+	}
+	if first == checksum(map[string]string{projectApiKeySecret(0, 0): "second"}) {
+		t.Error("checksum didn't change when the secret value was rotated")
+	}
+}
@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"net/http"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"time"
+)
+
+const (
+	ConditionTypeCorootRolledOut = "CorootRolledOut"
+
+	CanaryCheckInterval             = 15 * time.Second
+	CanaryDefaultVerificationPeriod = time.Minute
+)
+
+var canaryClient = &http.Client{Timeout: PreflightTimeout}
+
+// corootUpdateStrategy returns the update strategy of the Coroot StatefulSet.
+// The auto canary is armed, see corootCanaryPartition for the partition applied to the existing StatefulSet.
+func corootUpdateStrategy(cr *corootv1.Coroot, replicas int32) appsv1.StatefulSetUpdateStrategy {
+	s := appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType}
+	us := cr.Spec.UpdateStrategy
+	if us == nil {
+		return s
+	}
+	var partition int32
+	switch us.Canary {
+	case corootv1.CanaryModeManual:
+		partition = us.Partition
+	case corootv1.CanaryModeAuto:
+		partition = replicas - 1
+	}
+	if partition > 0 {
+		s.RollingUpdate = &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition}
+	}
+	return s
+}
+
+// corootCanaryPartition returns the afterMerge hook applying the partition of the auto canary, or nil if it's not enabled.
+// The partition is decided against the StatefulSet being updated rather than the status, which can be stale:
+// a change of the pod template (a new revision) arms the canary, otherwise the partition of the StatefulSet is kept,
+// e.g., 0 set by promoteCanary. A concurrent change of the StatefulSet makes the update fail with a conflict.
+func corootCanaryPartition(cr *corootv1.Coroot) func(existing, merged *appsv1.StatefulSet) {
+	if us := cr.Spec.UpdateStrategy; us == nil || us.Canary != corootv1.CanaryModeAuto {
+		return nil
+	}
+	return func(existing, merged *appsv1.StatefulSet) {
+		if existing == nil || !equality.Semantic.DeepEqual(existing.Spec.Template, merged.Spec.Template) {
+			merged.Spec.UpdateStrategy = corootUpdateStrategy(cr, ptr.Deref(merged.Spec.Replicas, 1))
+			return
+		}
+		if ru := existing.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil {
+			if merged.Spec.UpdateStrategy.RollingUpdate == nil {
+				merged.Spec.UpdateStrategy.RollingUpdate = &appsv1.RollingUpdateStatefulSetStrategy{}
+			}
+			merged.Spec.UpdateStrategy.RollingUpdate.Partition = ptr.To(*ru.Partition)
+		} else {
+			merged.Spec.UpdateStrategy.RollingUpdate = nil
+		}
+	}
+}
+
+// checkCorootRollout publishes the progress of the Coroot StatefulSet rollout into the status.
+// The StatefulSet is owned by the Coroot, so its status changes trigger the reconciliation.
+// With the auto canary, it verifies the updated replica and promotes the new revision to the other replicas.
+// The StatefulSet is read from the API server, as the partition must not be decided from a stale status.
+// It returns the time after which the rollout should be checked again (0 if not needed).
+func (r *CorootReconciler) checkCorootRollout(ctx context.Context, cr *corootv1.Coroot) time.Duration {
+	if cr.Spec.AgentsOnly != nil {
+		cr.Status.Rollout = nil
+		meta.RemoveStatusCondition(&cr.Status.Conditions, ConditionTypeCorootRolledOut)
+		return 0
+	}
+	ss := &appsv1.StatefulSet{}
+	if err := r.apiReader.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name + "-coroot"}, ss); err != nil {
+		if !errors.IsNotFound(err) {
+			ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Error(err, "failed to get Coroot StatefulSet")
+		}
+		return 0
+	}
+	prev := cr.Status.Rollout
+	rollout := &corootv1.RolloutStatus{
+		Replicas:        1,
+		ReadyReplicas:   ss.Status.ReadyReplicas,
+		UpdatedReplicas: ss.Status.UpdatedReplicas,
+		Revision:        ss.Status.UpdateRevision,
+	}
+	if ss.Spec.Replicas != nil {
+		rollout.Replicas = *ss.Spec.Replicas
+	}
+	cr.Status.Rollout = rollout
+
+	condition := metav1.Condition{
+		Type:               ConditionTypeCorootRolledOut,
+		Status:             metav1.ConditionTrue,
+		Reason:             "RolledOut",
+		ObservedGeneration: cr.Generation,
+	}
+	done := statefulSetRolledOut(ss)
+	if !done {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "RollingOut"
+		condition.Message = fmt.Sprintf("%d of %d replicas updated, %d ready", rollout.UpdatedReplicas, rollout.Replicas, rollout.ReadyReplicas)
+	}
+
+	var requeue time.Duration
+	if us := cr.Spec.UpdateStrategy; us != nil && us.Canary == corootv1.CanaryModeAuto && rollout.Replicas > 1 {
+		partition := int32(0)
+		if ru := ss.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil {
+			partition = *ru.Partition
+		}
+		rollout.Partition = &partition
+		if prev != nil && prev.PromotedRevision == ss.Status.UpdateRevision {
+			rollout.PromotedRevision = prev.PromotedRevision
+		}
+		switch {
+		case done || partition == 0:
+		case ss.Status.ObservedGeneration < ss.Generation || ss.Status.UpdatedReplicas == 0:
+			// The StatefulSet controller hasn't picked up the new revision yet.
+			condition.Reason = "CanaryPending"
+			requeue = CanaryCheckInterval
+		default:
+			remaining, err := r.verifyCanary(ctx, cr, ss)
+			switch {
+			case err != nil:
+				condition.Reason = "CanaryUnhealthy"
+				condition.Message = err.Error()
+				requeue = CanaryCheckInterval
+			case remaining > 0:
+				condition.Reason = "CanaryVerification"
+				condition.Message = fmt.Sprintf("verifying the canary, the other replicas will be updated in %s", remaining.Round(time.Second))
+				requeue = remaining
+			default:
+				if err = r.promoteCanary(ctx, ss); err != nil {
+					condition.Reason = "CanaryUnhealthy"
+					condition.Message = fmt.Sprintf("failed to promote the canary: %s", err)
+					requeue = CanaryCheckInterval
+					break
+				}
+				ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Info("canary verified, rolling out", "revision", ss.Status.UpdateRevision)
+				rollout.Partition = ptr.To(int32(0))
+				rollout.PromotedRevision = ss.Status.UpdateRevision
+				condition.Reason = "CanaryPromoted"
+			}
+		}
+	}
+	meta.SetStatusCondition(&cr.Status.Conditions, condition)
+	return requeue
+}
+
+// promoteCanary rolls out the verified revision to the other replicas by setting the partition to 0.
+// The update is based on the StatefulSet the canary was verified against, so it fails with a conflict if it has changed since.
+// The last applied spec is updated as well, so the promotion isn't reported as drift.
+func (r *CorootReconciler) promoteCanary(ctx context.Context, ss *appsv1.StatefulSet) error {
+	ss = ss.DeepCopy()
+	ss.Spec.UpdateStrategy.RollingUpdate = nil
+	if lastApplied := ss.Annotations[LastAppliedAnnotation]; lastApplied != "" {
+		var spec appsv1.StatefulSetSpec
+		if err := json.Unmarshal([]byte(lastApplied), &spec); err != nil {
+			return err
+		}
+		spec.UpdateStrategy.RollingUpdate = nil
+		data, err := json.Marshal(spec)
+		if err != nil {
+			return err
+		}
+		ss.Annotations[LastAppliedAnnotation] = string(data)
+	}
+	return r.Update(ctx, ss)
+}
+
+// verifyCanary checks that the replica with the highest ordinal runs the update revision and has been Ready and healthy
+// for the verification period. It returns the remaining time of the verification.
+func (r *CorootReconciler) verifyCanary(ctx context.Context, cr *corootv1.Coroot, ss *appsv1.StatefulSet) (time.Duration, error) {
+	period := cr.Spec.UpdateStrategy.VerificationPeriod.Duration
+	if period == 0 {
+		period = CanaryDefaultVerificationPeriod
+	}
+	pod := &corev1.Pod{}
+	name := fmt.Sprintf("%s-%d", ss.Name, *ss.Spec.Replicas-1)
+	if err := r.apiReader.Get(ctx, types.NamespacedName{Namespace: ss.Namespace, Name: name}, pod); err != nil {
+		return 0, fmt.Errorf("canary %s: %w", name, err)
+	}
+	if pod.Labels[appsv1.ControllerRevisionHashLabelKey] != ss.Status.UpdateRevision {
+		return 0, fmt.Errorf("canary %s is not updated yet", name)
+	}
+	var readySince time.Time
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+			readySince = c.LastTransitionTime.Time
+		}
+	}
+	if readySince.IsZero() {
+		return 0, fmt.Errorf("canary %s is not ready", name)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s:8080/health", pod.Status.PodIP), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := canaryClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("canary %s: %w", name, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("canary %s: health check failed: %s", name, resp.Status)
+	}
+	return time.Until(readySince.Add(period)), nil
+}
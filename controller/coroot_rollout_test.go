@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"context"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func TestCorootCanaryPartition(t *testing.T) {
+	r := testReconciler(t)
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).Build()
+	ctx := context.Background()
+	cr := testCoroot()
+	cr.Spec.Replicas = 3
+	cr.Spec.UpdateStrategy = &corootv1.CorootUpdateStrategySpec{Canary: corootv1.CanaryModeAuto}
+
+	apply := func() *appsv1.StatefulSet {
+		t.Helper()
+		ss := r.corootStatefulSet(cr, nil)
+		if err := r.createOrUpdateStatefulSet(ctx, cr, ss, corootCanaryPartition(cr)); err != nil {
+			t.Fatal(err)
+		}
+		current := &appsv1.StatefulSet{}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(ss), current); err != nil {
+			t.Fatal(err)
+		}
+		return current
+	}
+	partition := func(ss *appsv1.StatefulSet) int32 {
+		if ru := ss.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil {
+			return *ru.Partition
+		}
+		return 0
+	}
+
+	ss := apply()
+	if p := partition(ss); p != 2 {
+		t.Fatalf("expected the canary to be armed, got partition %d", p)
+	}
+	if err := r.promoteCanary(ctx, ss); err != nil {
+		t.Fatal(err)
+	}
+	// The promoted revision keeps rolling out until the pod template changes.
+	if p := partition(apply()); p != 0 {
+		t.Errorf("expected the promotion to be kept, got partition %d", p)
+	}
+	cr.Spec.Env = append(cr.Spec.Env, corev1.EnvVar{Name: "NEW_SETTING", Value: "1"})
+	if p := partition(apply()); p != 2 {
+		t.Errorf("expected the canary to be armed for the new revision, got partition %d", p)
+	}
+}
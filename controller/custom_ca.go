@@ -0,0 +1,79 @@
+package controller
+
+import (
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// The CA bundle shipped with the UBI images the init container is based on.
+	SystemCABundle = "/etc/pki/tls/certs/ca-bundle.crt"
+	CABundleDir    = "/etc/coroot/ca"
+)
+
+// clickhouseCA returns the CA certificate of the external ClickHouse, if any.
+func clickhouseCA(cr *corootv1.Coroot) *corev1.SecretKeySelector {
+	if ec := cr.Spec.ExternalClickhouse; ec != nil && ec.Secure {
+		return ec.CASecret
+	}
+	return nil
+}
+
+// applyCustomCA makes the containers of the pod trust the custom CA and the extra CAs (e.g., the external ClickHouse one)
+// in addition to the system ones.
+// Since SSL_CERT_FILE replaces the system bundle, an init container concatenates all of them into a shared volume.
+func applyCustomCA(cr *corootv1.Coroot, ps *corev1.PodSpec, extra ...*corev1.SecretKeySelector) {
+	var sources []corev1.VolumeProjection
+	if ca := cr.Spec.CustomCA; ca != nil {
+		switch {
+		case ca.Secret != nil:
+			sources = append(sources, corev1.VolumeProjection{Secret: &corev1.SecretProjection{
+				LocalObjectReference: ca.Secret.LocalObjectReference,
+				Items:                []corev1.KeyToPath{{Key: ca.Secret.Key, Path: "ca.crt"}},
+			}})
+		case ca.ConfigMap != nil:
+			sources = append(sources, corev1.VolumeProjection{ConfigMap: &corev1.ConfigMapProjection{
+				LocalObjectReference: ca.ConfigMap.LocalObjectReference,
+				Items:                []corev1.KeyToPath{{Key: ca.ConfigMap.Key, Path: "ca.crt"}},
+			}})
+		}
+	}
+	for _, s := range extra {
+		if s == nil {
+			continue
+		}
+		sources = append(sources, corev1.VolumeProjection{Secret: &corev1.SecretProjection{
+			LocalObjectReference: s.LocalObjectReference,
+			Items:                []corev1.KeyToPath{{Key: s.Key, Path: s.Name + "-" + s.Key + ".crt"}},
+		}})
+	}
+	if len(sources) == 0 {
+		return
+	}
+	ps.Volumes = append(ps.Volumes,
+		corev1.Volume{Name: "custom-ca", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: sources}}},
+		corev1.Volume{Name: "ca-bundle", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+	)
+	ps.InitContainers = append(ps.InitContainers, corev1.Container{
+		Image:   UBIMinimalImage,
+		Name:    "ca-bundle",
+		Command: []string{"/bin/sh", "-c"},
+		Args:    []string{"cat " + SystemCABundle + " /custom-ca/*.crt > /ca-bundle/ca-bundle.crt"},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "custom-ca", MountPath: "/custom-ca", ReadOnly: true},
+			{Name: "ca-bundle", MountPath: "/ca-bundle"},
+		},
+		SecurityContext: ps.Containers[0].SecurityContext,
+	})
+	for i := range ps.Containers {
+		c := &ps.Containers[i]
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: "ca-bundle", MountPath: CABundleDir, ReadOnly: true})
+		defined := false
+		for _, e := range c.Env {
+			defined = defined || e.Name == "SSL_CERT_FILE"
+		}
+		if !defined {
+			c.Env = append(c.Env, corev1.EnvVar{Name: "SSL_CERT_FILE", Value: CABundleDir + "/ca-bundle.crt"})
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"time"
+)
+
+// The values the builders use for the fields not set in the spec.
+const (
+	DefaultCorootServicePort     = 8080
+	DefaultStorageSize           = "10Gi"
+	DefaultClickhouseStorageSize = "100Gi"
+	DefaultMetricsRetention      = 48 * time.Hour
+	DefaultClusterDomain         = "cluster.local"
+)
+
+// SetDefaults fills in the fields not set in the spec with the values the operator uses for them,
+// so the spec reflects the effective configuration.
+// The fields covered by the size profile are left unset if a profile is chosen, so they follow later changes of the profile.
+// Storage sizes are only defaulted for PVC-backed storage, since for ephemeral storage the size is a limit.
+func SetDefaults(cr *corootv1.Coroot) {
+	_, profile := sizeProfiles[cr.Spec.SizeProfile]
+	s := &cr.Spec
+	if s.MetricsRefreshInterval.Duration == 0 {
+		s.MetricsRefreshInterval.Duration, _ = time.ParseDuration(corootv1.DefaultMetricRefreshInterval)
+	}
+	if s.ClusterDomain == "" {
+		s.ClusterDomain = DefaultClusterDomain
+	}
+	if s.AgentsOnly != nil {
+		return
+	}
+	if s.Replicas == 0 {
+		s.Replicas = 1
+	}
+	if s.Service.Port == 0 {
+		s.Service.Port = DefaultCorootServicePort
+	}
+	defaultStorageSize(&s.Storage, DefaultStorageSize)
+
+	if victoriaMetricsEnabled(cr) {
+		if s.VictoriaMetrics.URL == "" {
+			defaultStorageSize(&s.VictoriaMetrics.Storage, DefaultStorageSize)
+			if s.VictoriaMetrics.Retention.Duration == 0 {
+				s.VictoriaMetrics.Retention.Duration = DefaultMetricsRetention
+			}
+		}
+	} else {
+		if s.Prometheus.Replicas == 0 {
+			s.Prometheus.Replicas = 1
+		}
+		defaultStorageSize(&s.Prometheus.Storage, DefaultStorageSize)
+		if s.Prometheus.Retention.Duration == 0 && !profile {
+			s.Prometheus.Retention.Duration = DefaultMetricsRetention
+		}
+	}
+
+	if s.ExternalClickhouse == nil {
+		if s.Clickhouse.Shards == 0 {
+			s.Clickhouse.Shards = 1
+		}
+		if s.Clickhouse.Replicas == 0 && !profile {
+			s.Clickhouse.Replicas = 1
+		}
+		defaultStorageSize(&s.Clickhouse.Storage, DefaultClickhouseStorageSize)
+		defaultStorageSize(&s.Clickhouse.Keeper.Storage, DefaultStorageSize)
+	}
+}
+
+func defaultStorageSize(s *corootv1.StorageSpec, size string) {
+	if s.Size.IsZero() && pvcStorage(*s) {
+		s.Size = resource.MustParse(size)
+	}
+}
+
+// +kubebuilder:webhook:path=/mutate-coroot-com-v1-coroot,mutating=true,failurePolicy=ignore,sideEffects=None,groups=coroot.com,resources=coroots,verbs=create;update,versions=v1,name=mcoroot.coroot.com,admissionReviewVersions=v1
+
+// CorootDefaulter is the mutating webhook storing the defaults into the Coroot resources.
+type CorootDefaulter struct{}
+
+func (d *CorootDefaulter) Default(_ context.Context, obj runtime.Object) error {
+	cr, ok := obj.(*corootv1.Coroot)
+	if !ok {
+		return fmt.Errorf("expected a Coroot, got %T", obj)
+	}
+	SetDefaults(cr)
+	return nil
+}
+
+func SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).For(&corootv1.Coroot{}).WithDefaulter(&CorootDefaulter{}).Complete()
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	corootv1 "github.io/coroot/operator/api/v1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSetDefaultsKeepsRenderedObjects(t *testing.T) {
+	r := testReconciler(t)
+	for name, spec := range map[string]func(cr *corootv1.Coroot){
+		"default":          func(cr *corootv1.Coroot) {},
+		"victoria-metrics": func(cr *corootv1.Coroot) { cr.Spec.MetricsEngine = corootv1.MetricsEngineVictoriaMetrics },
+		"size-profile":     func(cr *corootv1.Coroot) { cr.Spec.SizeProfile = corootv1.SizeProfileLarge },
+		"ephemeral": func(cr *corootv1.Coroot) {
+			cr.Spec.Storage.Ephemeral = true
+			cr.Spec.Clickhouse.Storage.Ephemeral = true
+		},
+		"agents-only": func(cr *corootv1.Coroot) {
+			cr.Spec.AgentsOnly = &corootv1.AgentsOnlySpec{CorootURL: "http://coroot:8080"}
+		},
+	} {
+		cr := testCoroot()
+		spec(cr)
+		defaulted := cr.DeepCopy()
+		SetDefaults(defaulted)
+		expected, actual := rendered(r, cr), rendered(r, defaulted)
+		if len(expected) != len(actual) {
+			t.Errorf("%s: expected %d objects, got %d", name, len(expected), len(actual))
+			continue
+		}
+		for key, obj := range expected {
+			// The generated passwords differ between the renderings.
+			if key == "*v1.Secret/coroot-clickhouse" || key == "*v1.Secret/coroot-coroot-admin" {
+				continue
+			}
+			if !reflect.DeepEqual(obj, actual[key]) {
+				t.Errorf("%s: %s changed after the defaults were set", name, key)
+			}
+		}
+	}
+}
+
+func TestSetDefaultsFollowsSizeProfile(t *testing.T) {
+	cr := testCoroot()
+	cr.Spec.SizeProfile = corootv1.SizeProfileSmall
+	SetDefaults(cr)
+	if cr.Spec.Clickhouse.Replicas != 0 || cr.Spec.Prometheus.Retention.Duration != 0 || len(cr.Spec.Resources.Requests) > 0 {
+		t.Fatalf("expected the profile fields to be left unset, got %+v", cr.Spec)
+	}
+	if cr.Spec.Service.Port != DefaultCorootServicePort || cr.Spec.Clickhouse.Storage.Size.String() != DefaultClickhouseStorageSize {
+		t.Errorf("expected the other fields to be defaulted, got %+v", cr.Spec)
+	}
+
+	cr.Spec.SizeProfile = corootv1.SizeProfileLarge
+	applySizeProfile(cr)
+	large := sizeProfiles[corootv1.SizeProfileLarge]
+	if cr.Spec.Clickhouse.Replicas != large.clickhouseReplicas || cr.Spec.Prometheus.Retention.Duration != large.prometheusRetention {
+		t.Errorf("expected the new profile to take effect, got %d replicas and %s retention", cr.Spec.Clickhouse.Replicas, cr.Spec.Prometheus.Retention.Duration)
+	}
+	if !reflect.DeepEqual(cr.Spec.Clickhouse.Resources, large.clickhouse) {
+		t.Errorf("expected the resources of the new profile, got %v", cr.Spec.Clickhouse.Resources)
+	}
+
+	cr = testCoroot()
+	SetDefaults(cr)
+	if cr.Spec.Clickhouse.Replicas != 1 || cr.Spec.Prometheus.Retention.Duration != DefaultMetricsRetention || cr.Spec.MetricsRefreshInterval.Duration != 15*time.Second {
+		t.Errorf("expected the defaults without a profile, got %+v", cr.Spec)
+	}
+}
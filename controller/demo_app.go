@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	DemoBackendImage = "nginxinc/nginx-unprivileged:1.27-alpine"
+	DemoLoadImage    = "curlimages/curl:8.11.0"
+)
+
+func demoAppEnabled(cr *corootv1.Coroot) bool {
+	return cr.Spec.DemoApp != nil && cr.Spec.DemoApp.Enabled && cr.Spec.AgentsOnly == nil
+}
+
+// CreateOrUpdateDemoApp applies the demo workload, or deletes it if it's disabled.
+func (r *CorootReconciler) CreateOrUpdateDemoApp(ctx context.Context, cr *corootv1.Coroot) []error {
+	if !demoAppEnabled(cr) {
+		return []error{
+			r.CreateOrUpdate(ctx, cr, r.demoLoadDeployment(cr), true, nil),
+			r.CreateOrUpdate(ctx, cr, r.demoBackendService(cr), true, nil),
+			r.CreateOrUpdate(ctx, cr, r.demoBackendDeployment(cr), true, nil),
+		}
+	}
+	return []error{
+		r.CreateOrUpdateDeployment(ctx, cr, r.demoBackendDeployment(cr)),
+		r.CreateOrUpdateService(ctx, cr, r.demoBackendService(cr)),
+		r.CreateOrUpdateDeployment(ctx, cr, r.demoLoadDeployment(cr)),
+	}
+}
+
+func (r *CorootReconciler) demoBackendService(cr *corootv1.Coroot) *corev1.Service {
+	ls := Labels(cr, "demo-backend")
+	s := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-demo-backend", cr.Name),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+	}
+
+	s.Spec = corev1.ServiceSpec{
+		Selector: ls,
+		Type:     corev1.ServiceTypeClusterIP,
+		Ports: []corev1.ServicePort{
+			{
+				Name:       "http",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       8080,
+				TargetPort: intstr.FromString("http"),
+			},
+		},
+	}
+
+	return s
+}
+
+func (r *CorootReconciler) demoBackendDeployment(cr *corootv1.Coroot) *appsv1.Deployment {
+	ls := Labels(cr, "demo-backend")
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-demo-backend",
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+	}
+	d.Spec = demoDeploymentSpec(cr, ls, corev1.Container{
+		Image: DemoBackendImage,
+		Name:  "backend",
+		Ports: []corev1.ContainerPort{
+			{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
+		},
+		SecurityContext: containerSecurityContext(nil),
+		VolumeMounts:    []corev1.VolumeMount{{Name: "tmp", MountPath: "/tmp"}},
+		ReadinessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{Path: "/", Port: intstr.FromString("http")},
+			},
+		},
+	})
+	return d
+}
+
+// demoLoadDeployment sends a steady stream of requests to the backend, some of them failing with 404,
+// so the node-agent has HTTP traffic, latency and errors to report.
+func (r *CorootReconciler) demoLoadDeployment(cr *corootv1.Coroot) *appsv1.Deployment {
+	ls := Labels(cr, "demo-load")
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-demo-load",
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+	}
+	url := fmt.Sprintf("http://%s-demo-backend:8080", cr.Name)
+	d.Spec = demoDeploymentSpec(cr, ls, corev1.Container{
+		Image:   DemoLoadImage,
+		Name:    "load",
+		Command: []string{"/bin/sh", "-c"},
+		Args: []string{fmt.Sprintf(
+			"while true; do curl -s -o /dev/null %[1]s/; curl -s -o /dev/null %[1]s/not-found; sleep 1; done", url,
+		)},
+		SecurityContext: containerSecurityContext(nil),
+		VolumeMounts:    []corev1.VolumeMount{{Name: "tmp", MountPath: "/tmp"}},
+	})
+	return d
+}
+
+func demoDeploymentSpec(cr *corootv1.Coroot, ls map[string]string, c corev1.Container) appsv1.DeploymentSpec {
+	replicas := int32(1)
+	if hibernated(cr) {
+		replicas = 0
+	}
+	return appsv1.DeploymentSpec{
+		Selector: &metav1.LabelSelector{
+			MatchLabels: ls,
+		},
+		Replicas: &replicas,
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: ls,
+			},
+			Spec: corev1.PodSpec{
+				SecurityContext: podSecurityContext(nil),
+				NodeSelector:    linuxNodeSelector,
+				Containers:      []corev1.Container{c},
+				Volumes: []corev1.Volume{
+					{
+						Name: "tmp",
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDriftDetectionInterval = 5 * time.Minute
+	maxDriftFields                = 10
+)
+
+// driftReport collects the drifted resources found by CreateOrUpdate during a reconciliation.
+type driftReport struct {
+	lock  sync.Mutex
+	items []corootv1.DriftStatus
+}
+
+type driftContextKey struct{}
+
+// withDriftReport returns a context collecting the drifted resources if drift detection is enabled.
+func withDriftReport(ctx context.Context, cr *corootv1.Coroot) (context.Context, *driftReport) {
+	if cr.Spec.DriftDetection == nil {
+		return ctx, nil
+	}
+	report := &driftReport{}
+	return context.WithValue(ctx, driftContextKey{}, report), report
+}
+
+func driftReportFrom(ctx context.Context) *driftReport {
+	report, _ := ctx.Value(driftContextKey{}).(*driftReport)
+	return report
+}
+
+func driftDetectionInterval(cr *corootv1.Coroot) time.Duration {
+	if cr.Spec.DriftDetection == nil {
+		return 0
+	}
+	if i := cr.Spec.DriftDetection.Interval.Duration; i > 0 {
+		return i
+	}
+	return DefaultDriftDetectionInterval
+}
+
+// setDriftStatus reports the drifted resources in the status and records an event for the ones that weren't drifted before.
+func (r *CorootReconciler) setDriftStatus(cr *corootv1.Coroot, report *driftReport) {
+	if report == nil {
+		cr.Status.Drift = nil
+		return
+	}
+	sort.Slice(report.items, func(i, j int) bool {
+		return report.items[i].Resource < report.items[j].Resource
+	})
+	previous := map[string]bool{}
+	for _, d := range cr.Status.Drift {
+		previous[d.Resource] = true
+	}
+	for _, d := range report.items {
+		if previous[d.Resource] || r.recorder == nil {
+			continue
+		}
+		action := "kept"
+		if d.Reverted {
+			action = "reverted"
+		}
+		r.recorder.Event(cr, corev1.EventTypeWarning, "DriftDetected",
+			fmt.Sprintf("%s has been changed outside the operator (%s), %s", d.Resource, strings.Join(d.Fields, ", "), action))
+	}
+	cr.Status.Drift = report.items
+}
+
+// mergeSpecsDetectingDrift applies the target spec like MergeSpecs and reports the fields changed since the spec was last applied.
+// With the Report policy, the changed fields are kept unless the target spec changes them as well.
+func mergeSpecsDetectingDrift[T any](ctx context.Context, r *CorootReconciler, cr *corootv1.Coroot, obj client.Object, currentSpec *T, targetSpec T) error {
+	report := driftReportFrom(ctx)
+	if report == nil {
+		return MergeSpecs(obj, currentSpec, targetSpec)
+	}
+	fields, err := specDrift(obj, currentSpec)
+	if err != nil || len(fields) == 0 {
+		return MergeSpecs(obj, currentSpec, targetSpec)
+	}
+	d := corootv1.DriftStatus{Resource: obj.GetName(), Fields: fields, Reverted: cr.Spec.DriftDetection.Policy != corootv1.DriftPolicyReport}
+	if gvk, err := apiutil.GVKForObject(obj, r.Scheme); err == nil {
+		d.Resource = gvk.Kind + "/" + obj.GetName()
+	}
+	report.lock.Lock()
+	report.items = append(report.items, d)
+	report.lock.Unlock()
+	if d.Reverted {
+		return MergeSpecs(obj, currentSpec, targetSpec)
+	}
+	return mergeSpecsKeepingDrift(obj, currentSpec, targetSpec)
+}
+
+// specDrift returns the paths of the fields of the current spec that differ from the last applied spec.
+// Fields the operator doesn't set, such as the defaults of the API server, aren't compared.
+func specDrift[T any](obj client.Object, currentSpec *T) ([]string, error) {
+	original := []byte(obj.GetAnnotations()[LastAppliedAnnotation])
+	if len(original) == 0 {
+		return nil, nil
+	}
+	current, err := json.Marshal(currentSpec)
+	if err != nil {
+		return nil, err
+	}
+	patchMeta, err := strategicpatch.NewPatchMetaFromStruct(currentSpec)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := strategicpatch.CreateThreeWayMergePatch(original, original, current, patchMeta, true)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err = json.Unmarshal(patch, &m); err != nil {
+		return nil, err
+	}
+	// The volume claim templates of StatefulSets are immutable and filled in with defaults, so they are never reverted.
+	delete(m, "volumeClaimTemplates")
+	var fields []string
+	patchPaths("spec", m, &fields)
+	sort.Strings(fields)
+	if len(fields) > maxDriftFields {
+		fields = append(fields[:maxDriftFields], "...")
+	}
+	return fields, nil
+}
+
+func patchPaths(prefix string, patch map[string]any, paths *[]string) {
+	for k, v := range patch {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		if m, ok := v.(map[string]any); ok && len(m) > 0 {
+			patchPaths(prefix+"."+k, m, paths)
+			continue
+		}
+		*paths = append(*paths, prefix+"."+k)
+	}
+}
+
+// mergeSpecsKeepingDrift applies only the changes between the last applied and the target spec to the current spec.
+func mergeSpecsKeepingDrift[T any](obj client.Object, currentSpec *T, targetSpec T) error {
+	annotations := obj.GetAnnotations()
+	original := []byte(annotations[LastAppliedAnnotation])
+	target, err := json.Marshal(targetSpec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal target: %w", err)
+	}
+	annotations[LastAppliedAnnotation] = string(target)
+	obj.SetAnnotations(annotations)
+
+	patchMeta, err := strategicpatch.NewPatchMetaFromStruct(currentSpec)
+	if err != nil {
+		return fmt.Errorf("failed to produce patch meta from struct: %w", err)
+	}
+	patch, err := strategicpatch.CreateTwoWayMergePatchUsingLookupPatchMeta(original, target, patchMeta)
+	if err != nil {
+		return fmt.Errorf("failed to create two way merge patch: %w", err)
+	}
+	if string(patch) == "{}" {
+		return nil
+	}
+	current, err := json.Marshal(currentSpec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal current: %w", err)
+	}
+	merged, err := strategicpatch.StrategicMergePatchUsingLookupPatchMeta(current, patch, patchMeta)
+	if err != nil {
+		return fmt.Errorf("failed to apply patch: %w", err)
+	}
+	into := reflect.New(reflect.TypeOf(currentSpec).Elem())
+	if err = json.Unmarshal(merged, into.Interface()); err != nil {
+		return fmt.Errorf("failed to unmarshal merged data: %w", err)
+	}
+	reflect.ValueOf(currentSpec).Elem().Set(into.Elem())
+	return nil
+}
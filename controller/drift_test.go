@@ -0,0 +1,64 @@
+package controller
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"reflect"
+	"testing"
+)
+
+func TestDrift(t *testing.T) {
+	spec := func(image, memory string) appsv1.StatefulSetSpec {
+		return appsv1.StatefulSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:      "clickhouse",
+						Image:     image,
+						Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse(memory)}},
+					}},
+				},
+			},
+		}
+	}
+
+	ss := &appsv1.StatefulSet{}
+	if err := MergeSpecs(ss, &ss.Spec, spec("clickhouse:1", "4Gi")); err != nil {
+		t.Fatal(err)
+	}
+	// Defaults aren't drift.
+	ss.Spec.Template.Spec.Containers[0].TerminationMessagePath = corev1.TerminationMessagePathDefault
+	if fields, err := specDrift(ss, &ss.Spec); err != nil || len(fields) != 0 {
+		t.Fatalf("expected no drift, got %v (%v)", fields, err)
+	}
+
+	ss.Spec.Template.Spec.Containers[0].Resources.Limits[corev1.ResourceMemory] = resource.MustParse("8Gi")
+	fields, err := specDrift(ss, &ss.Spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"spec.template.spec.containers"}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected %v, got %v", expected, fields)
+	}
+
+	// The Report policy keeps the changed limit while applying the new image.
+	if err = mergeSpecsKeepingDrift(ss, &ss.Spec, spec("clickhouse:2", "4Gi")); err != nil {
+		t.Fatal(err)
+	}
+	c := ss.Spec.Template.Spec.Containers[0]
+	if c.Image != "clickhouse:2" {
+		t.Errorf("expected the image to be updated, got %s", c.Image)
+	}
+	if memory := c.Resources.Limits[corev1.ResourceMemory]; memory.String() != "8Gi" {
+		t.Errorf("expected the changed limit to be kept, got %s", memory.String())
+	}
+
+	// The Revert policy restores it.
+	if err = MergeSpecs(ss, &ss.Spec, spec("clickhouse:2", "4Gi")); err != nil {
+		t.Fatal(err)
+	}
+	if memory := ss.Spec.Template.Spec.Containers[0].Resources.Limits[corev1.ResourceMemory]; memory.String() != "4Gi" {
+		t.Errorf("expected the limit to be reverted, got %s", memory.String())
+	}
+}
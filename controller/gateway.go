@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"context"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"strings"
+)
+
+var httpRouteGVK = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "HTTPRoute"}
+
+func (r *CorootReconciler) httpRoute(cr *corootv1.Coroot, name string, hostnames []string, paths []string) *unstructured.Unstructured {
+	route := &unstructured.Unstructured{}
+	route.SetGroupVersionKind(httpRouteGVK)
+	route.SetName(name)
+	route.SetNamespace(cr.Namespace)
+	route.SetLabels(Labels(cr, "gateway"))
+	g := cr.Spec.Gateway
+	if g == nil {
+		return route
+	}
+
+	parentRef := map[string]interface{}{"name": g.ParentRef.Name}
+	if g.ParentRef.Namespace != "" {
+		parentRef["namespace"] = g.ParentRef.Namespace
+	}
+	if g.ParentRef.SectionName != "" {
+		parentRef["sectionName"] = g.ParentRef.SectionName
+	}
+	port := cr.Spec.Service.Port
+	if port == 0 {
+		port = DefaultCorootServicePort
+	}
+	var matches []interface{}
+	for _, p := range paths {
+		matches = append(matches, map[string]interface{}{
+			"path": map[string]interface{}{"type": "PathPrefix", "value": p},
+		})
+	}
+	spec := map[string]interface{}{
+		"parentRefs": []interface{}{parentRef},
+		"rules": []interface{}{
+			map[string]interface{}{
+				"matches": matches,
+				"backendRefs": []interface{}{
+					map[string]interface{}{"name": cr.Name + "-coroot", "port": int64(port)},
+				},
+			},
+		},
+	}
+	if len(hostnames) > 0 {
+		var hs []interface{}
+		for _, h := range hostnames {
+			hs = append(hs, h)
+		}
+		spec["hostnames"] = hs
+	}
+	route.Object["spec"] = spec
+	return route
+}
+
+func (r *CorootReconciler) corootHTTPRoute(cr *corootv1.Coroot) *unstructured.Unstructured {
+	var hostnames []string
+	if cr.Spec.Gateway != nil {
+		hostnames = cr.Spec.Gateway.Hostnames
+	}
+	path := "/"
+	if cr.Spec.Ingress != nil && cr.Spec.Ingress.Path != "" {
+		path = "/" + strings.Trim(cr.Spec.Ingress.Path, "/")
+	}
+	return r.httpRoute(cr, cr.Name+"-coroot", hostnames, []string{path})
+}
+
+func (r *CorootReconciler) corootTelemetryHTTPRoute(cr *corootv1.Coroot) *unstructured.Unstructured {
+	var hostnames []string
+	if cr.Spec.Gateway != nil {
+		hostnames = cr.Spec.Gateway.TelemetryHostnames
+	}
+	basePath := ""
+	if cr.Spec.Ingress != nil && cr.Spec.Ingress.Path != "" {
+		basePath = "/" + strings.Trim(cr.Spec.Ingress.Path, "/")
+	}
+	return r.httpRoute(cr, cr.Name+"-telemetry", hostnames, []string{basePath + "/v1/traces", basePath + "/v1/logs", basePath + "/v1/metrics"})
+}
+
+func (r *CorootReconciler) CreateOrUpdateHTTPRoutes(ctx context.Context, cr *corootv1.Coroot) []error {
+	if !r.kindSupported(httpRouteGVK) {
+		if cr.Spec.Gateway != nil {
+			ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Info("Gateway API CRDs are not installed, skipping")
+		}
+		return nil
+	}
+	g := cr.Spec.Gateway
+	return []error{
+		r.CreateOrUpdateUnstructured(ctx, cr, r.corootHTTPRoute(cr), g == nil),
+		r.CreateOrUpdateUnstructured(ctx, cr, r.corootTelemetryHTTPRoute(cr), g == nil || len(g.TelemetryHostnames) == 0),
+	}
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
+	"sigs.k8s.io/yaml"
+)
+
+const GrafanaDatasourcesKey = "coroot-datasources.yaml"
+
+// grafanaDatasourcesSecret returns a Secret with a Grafana datasource provisioning file.
+// The Grafana Helm chart sidecar picks up Secrets labeled with grafana_datasource: "1".
+func (r *CorootReconciler) grafanaDatasourcesSecret(cr *corootv1.Coroot, clickhousePassword string) *corev1.Secret {
+	ls := Labels(cr, "grafana-datasources")
+	if cr.Spec.GrafanaDatasources != nil {
+		for k, v := range cr.Spec.GrafanaDatasources.Labels {
+			ls[k] = v
+		}
+	}
+	ls["grafana_datasource"] = "1"
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-grafana-datasources",
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+	}
+
+	clickhouseHost, clickhousePort := fmt.Sprintf("%s-clickhouse.%s", cr.Name, cr.Namespace), "9000"
+	clickhouseUser, clickhouseDatabase := "default", "default"
+	clickhouseSecure, clickhouseSkipVerify := false, false
+	if ec := cr.Spec.ExternalClickhouse; ec != nil {
+		clickhouseSecure, clickhouseSkipVerify = ec.Secure, ec.InsecureSkipVerify
+		address := externalClickhouseAddress(cr)
+		if host, port, err := net.SplitHostPort(address); err == nil {
+			clickhouseHost, clickhousePort = host, port
+		} else {
+			clickhouseHost = address
+		}
+		clickhouseUser, clickhouseDatabase = ec.User, ec.Database
+	}
+
+	datasources := map[string]any{
+		"apiVersion": 1,
+		"datasources": []any{
+			map[string]any{
+				"name":   fmt.Sprintf("Coroot Prometheus (%s/%s)", cr.Namespace, cr.Name),
+				"uid":    fmt.Sprintf("coroot-prometheus-%s-%s", cr.Namespace, cr.Name),
+				"type":   "prometheus",
+				"access": "proxy",
+				"url":    metricsURL(cr),
+			},
+			map[string]any{
+				"name": fmt.Sprintf("Coroot ClickHouse (%s/%s)", cr.Namespace, cr.Name),
+				"uid":  fmt.Sprintf("coroot-clickhouse-%s-%s", cr.Namespace, cr.Name),
+				"type": "grafana-clickhouse-datasource",
+				"jsonData": map[string]any{
+					"host":            clickhouseHost,
+					"port":            clickhousePort,
+					"protocol":        "native",
+					"username":        clickhouseUser,
+					"defaultDatabase": clickhouseDatabase,
+					"secure":          clickhouseSecure,
+					"tlsSkipVerify":   clickhouseSkipVerify,
+				},
+				"secureJsonData": map[string]any{
+					"password": clickhousePassword,
+				},
+			},
+		},
+	}
+	data, _ := yaml.Marshal(datasources)
+	s.Data = map[string][]byte{GrafanaDatasourcesKey: data}
+	return s
+}
+
+func (r *CorootReconciler) CreateOrUpdateGrafanaDatasources(ctx context.Context, cr *corootv1.Coroot) error {
+	if cr.Spec.GrafanaDatasources == nil {
+		return r.CreateOrUpdate(ctx, cr, r.grafanaDatasourcesSecret(cr, ""), true, nil)
+	}
+	selector := secretKeySelector(fmt.Sprintf("%s-clickhouse", cr.Name), "password")
+	password := ""
+	if ec := cr.Spec.ExternalClickhouse; ec != nil {
+		password, selector = ec.Password, ec.PasswordSecret
+	}
+	password, err := r.secretValue(ctx, cr, password, selector)
+	if err != nil {
+		return fmt.Errorf("failed to get ClickHouse password for Grafana datasources: %w", err)
+	}
+	s := r.grafanaDatasourcesSecret(cr, password)
+	labels, data := s.Labels, s.Data
+	return r.CreateOrUpdate(ctx, cr, s, false, func() error {
+		s.Labels = labels
+		s.Data = data
+		return nil
+	})
+}
@@ -0,0 +1,217 @@
+package controller
+
+import (
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+const (
+	ConditionTypeHibernated = "Hibernated"
+
+	// How far the schedules are searched for the previous and the next run.
+	// Covers the schedules running once in several years, e.g., on February 29 if it's a Monday.
+	cronSearchYears = 30
+)
+
+// hibernated reports whether the workloads should be scaled to zero, as decided by checkHibernation.
+func hibernated(cr *corootv1.Coroot) bool {
+	return meta.IsStatusConditionTrue(cr.Status.Conditions, ConditionTypeHibernated)
+}
+
+// checkHibernation sets the Hibernated condition according to the hibernation spec
+// and returns the time until the next scheduled transition (0 if there is no schedule).
+func checkHibernation(cr *corootv1.Coroot, now time.Time) time.Duration {
+	h := cr.Spec.Hibernation
+	if h == nil || cr.Spec.AgentsOnly != nil {
+		meta.RemoveStatusCondition(&cr.Status.Conditions, ConditionTypeHibernated)
+		return 0
+	}
+	condition := metav1.Condition{
+		Type:               ConditionTypeHibernated,
+		Status:             metav1.ConditionFalse,
+		Reason:             "Awake",
+		ObservedGeneration: cr.Generation,
+	}
+	var next time.Duration
+	switch {
+	case h.Enabled:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "Enabled"
+	case h.Schedule != nil:
+		asleep, transition, err := hibernationSchedule(h.Schedule, now)
+		switch {
+		case err != nil:
+			condition.Reason = "InvalidSchedule"
+			condition.Message = err.Error()
+		case asleep:
+			condition.Status = metav1.ConditionTrue
+			condition.Reason = "Scheduled"
+		}
+		if !transition.IsZero() {
+			next = transition.Sub(now)
+			condition.Message = "next transition at " + transition.Format(time.RFC3339)
+		}
+	}
+	meta.SetStatusCondition(&cr.Status.Conditions, condition)
+	return next
+}
+
+// hibernationSchedule reports whether the workloads are asleep now, i.e., the last sleep is more recent than the last wake-up,
+// and returns the moment of the next transition.
+func hibernationSchedule(s *corootv1.HibernationScheduleSpec, now time.Time) (bool, time.Time, error) {
+	loc := time.UTC
+	if s.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return false, time.Time{}, err
+		}
+	}
+	sleep, err := parseCron(s.Sleep)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("invalid sleep schedule: %w", err)
+	}
+	wakeUp, err := parseCron(s.WakeUp)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("invalid wake-up schedule: %w", err)
+	}
+	now = now.In(loc)
+	asleep := sleep.prev(now).After(wakeUp.prev(now))
+	next := wakeUp.next(now)
+	if !asleep {
+		next = sleep.next(now)
+	}
+	return asleep, next, nil
+}
+
+// cronSchedule is a parsed five-field cron expression (minute, hour, day of month, month, day of week).
+type cronSchedule struct {
+	fields [5]map[int]bool
+	anyDom bool
+	anyDow bool
+}
+
+var cronFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("%q: expected 5 fields", expr)
+	}
+	s := &cronSchedule{anyDom: parts[2] == "*", anyDow: parts[4] == "*"}
+	for i, part := range parts {
+		values, err := parseCronField(part, cronFieldRanges[i][0], cronFieldRanges[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", expr, err)
+		}
+		s.fields[i] = values
+	}
+	if s.fields[4][7] {
+		s.fields[4][0] = true
+	}
+	return s, nil
+}
+
+// parseCronField parses a comma-separated list of *, values and ranges with optional steps (e.g., */15 or 1-5).
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, item := range strings.Split(field, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", item)
+			}
+			rng = item[:i]
+		}
+		from, to := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", item)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", item)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%q is out of range %d-%d", item, min, max)
+		}
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	if !s.fields[3][int(t.Month())] {
+		return false
+	}
+	dom, dow := s.fields[2][t.Day()], s.fields[4][int(t.Weekday())]
+	// As in the standard cron, if both the day of month and the day of week are restricted, either of them matches.
+	if !s.anyDom && !s.anyDow {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// prev returns the most recent run not after t, or the zero time if there is none within the search window.
+// Days and hours that don't match are skipped as a whole.
+func (s *cronSchedule) prev(t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	for end := t.AddDate(-cronSearchYears, 0, 0); t.After(end); {
+		y, m, d := t.Date()
+		var p time.Time
+		switch {
+		case !s.matchesDay(t):
+			p = time.Date(y, m, d, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !s.fields[1][t.Hour()]:
+			p = time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !s.fields[0][t.Minute()]:
+			p = t.Add(-time.Minute)
+		default:
+			return t
+		}
+		// Around DST transitions the wall clock can map to an earlier or later moment than expected.
+		if !p.Before(t) {
+			p = t.Add(-time.Minute)
+		}
+		t = p
+	}
+	return time.Time{}
+}
+
+// next returns the first run after t, or the zero time if there is none within the search window.
+// Days and hours that don't match are skipped as a whole.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(cronSearchYears, 0, 0); t.Before(end); {
+		y, m, d := t.Date()
+		var n time.Time
+		switch {
+		case !s.matchesDay(t):
+			n = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+		case !s.fields[1][t.Hour()]:
+			n = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.fields[0][t.Minute()]:
+			n = t.Add(time.Minute)
+		default:
+			return t
+		}
+		if !n.After(t) {
+			n = t.Add(time.Minute)
+		}
+		t = n
+	}
+	return time.Time{}
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	corootv1 "github.io/coroot/operator/api/v1"
+	"testing"
+	"time"
+)
+
+func TestCronSchedule(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(loc *time.Location, value string) time.Time {
+		if value == "" {
+			return time.Time{}
+		}
+		ts, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	for _, c := range []struct {
+		expr       string
+		loc        *time.Location
+		now        string
+		prev, next string
+	}{
+		{expr: "*/15 * * * *", loc: time.UTC, now: "2024-03-05 10:20", prev: "2024-03-05 10:15", next: "2024-03-05 10:30"},
+		{expr: "*/15 * * * *", loc: time.UTC, now: "2024-03-05 10:30", prev: "2024-03-05 10:30", next: "2024-03-05 10:45"},
+		{expr: "0 2 * * 1-5", loc: time.UTC, now: "2024-03-09 12:00", prev: "2024-03-08 02:00", next: "2024-03-11 02:00"},
+		{expr: "0 0 1 * *", loc: time.UTC, now: "2024-03-15 00:00", prev: "2024-03-01 00:00", next: "2024-04-01 00:00"},
+		{expr: "0 3 1 */3 *", loc: time.UTC, now: "2024-05-20 00:00", prev: "2024-04-01 03:00", next: "2024-07-01 03:00"},
+		{expr: "30 23 31 12 *", loc: time.UTC, now: "2024-06-01 00:00", prev: "2023-12-31 23:30", next: "2024-12-31 23:30"},
+		{expr: "0 0 29 2 *", loc: time.UTC, now: "2025-01-01 00:00", prev: "2024-02-29 00:00", next: "2028-02-29 00:00"},
+		// Either the day of month or the day of week matches if both are restricted.
+		{expr: "0 0 13 * 5", loc: time.UTC, now: "2024-09-10 00:00", prev: "2024-09-06 00:00", next: "2024-09-13 00:00"},
+		{expr: "0 0 * * 7", loc: time.UTC, now: "2024-09-10 00:00", prev: "2024-09-08 00:00", next: "2024-09-15 00:00"},
+		{expr: "0 0 30 2 *", loc: time.UTC, now: "2024-01-01 00:00", prev: "", next: ""},
+		// 02:30 doesn't exist on the day the clocks are moved forward.
+		{expr: "30 2 * * *", loc: berlin, now: "2024-03-31 12:00", prev: "2024-03-30 02:30", next: "2024-04-01 02:30"},
+		{expr: "0 * * * *", loc: berlin, now: "2024-03-31 01:30", prev: "2024-03-31 01:00", next: "2024-03-31 03:00"},
+	} {
+		s, err := parseCron(c.expr)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err)
+			continue
+		}
+		now := at(c.loc, c.now)
+		if prev := s.prev(now); !prev.Equal(at(c.loc, c.prev)) {
+			t.Errorf("%s at %s: expected the previous run at %s, got %s", c.expr, c.now, c.prev, prev)
+		}
+		if next := s.next(now); !next.Equal(at(c.loc, c.next)) {
+			t.Errorf("%s at %s: expected the next run at %s, got %s", c.expr, c.now, c.next, next)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestSnapshotScheduleTimezone(t *testing.T) {
+	s := &corootv1.SnapshotsSpec{Schedule: "0 3 * * *", Timezone: "America/New_York"}
+	prev, next, err := snapshotSchedule(s, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prev.Equal(time.Date(2024, 6, 1, 7, 0, 0, 0, time.UTC)) || !next.Equal(time.Date(2024, 6, 2, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected schedule: %s, %s", prev, next)
+	}
+	s.Timezone = "Nowhere/Nothing"
+	if _, _, err = snapshotSchedule(s, time.Now()); err == nil {
+		t.Error("expected an error for an unknown timezone")
+	}
+}
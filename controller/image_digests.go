@@ -0,0 +1,557 @@
+package controller
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	"net/http"
+	"net/url"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Tags are resolved again after this period, so new images pushed under the same tag are rolled out.
+	ImageDigestsCacheTTL = 10 * time.Minute
+	ImageDigestsTimeout  = 30 * time.Second
+
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	dockerHubRegistry         = "registry-1.docker.io"
+	maxRegistryResponseSize   = 4 << 20
+)
+
+var (
+	// Overridden in tests.
+	imageRegistryClient = proxyClient
+
+	manifestMediaTypes = []string{
+		"application/vnd.oci.image.index.v1+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+	}
+)
+
+type cachedImageDigest struct {
+	digest  string
+	expires time.Time
+}
+
+// imageDigestKey identifies an image of the spec resolved to a digest.
+type imageDigestKey struct {
+	image  string
+	digest string
+}
+
+type imageRef struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// parseImageRef splits an image reference, e.g., ghcr.io/coroot/coroot:1.0.0, into the registry, repository, tag and digest.
+func parseImageRef(image string) imageRef {
+	ref := imageRef{}
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.digest = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.tag = name[:i], name[i+1:]
+	}
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = "latest"
+	}
+	if i := strings.Index(name, "/"); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		ref.registry, ref.repository = name[:i], name[i+1:]
+	} else {
+		ref.registry, ref.repository = "docker.io", name
+	}
+	if ref.registry == "docker.io" || ref.registry == "index.docker.io" {
+		ref.registry = dockerHubRegistry
+		if !strings.Contains(ref.repository, "/") {
+			ref.repository = "library/" + ref.repository
+		}
+	}
+	return ref
+}
+
+// imageDigestsResult holds the digests of the images of a workload resolved in the background.
+type imageDigestsResult struct {
+	digests map[string]string
+	err     error
+}
+
+// pinImageDigests replaces the image tags of the workload with their digests, verifying the cosign signatures if configured.
+// The digests are resolved in the background, so slow registries don't block the reconciliation. Workloads with images
+// that haven't been resolved yet, or can't be resolved or verified, aren't applied, so the running pods are kept.
+func (r *CorootReconciler) pinImageDigests(ctx context.Context, cr *corootv1.Coroot, obj client.Object) error {
+	spec := workloadPodSpec(obj)
+	if spec == nil || cr.Spec.ImageDigests == nil {
+		return nil
+	}
+	var images []string
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for _, c := range containers {
+			if c.Image != "" {
+				images = append(images, c.Image)
+			}
+		}
+	}
+	if len(images) == 0 {
+		return nil
+	}
+	sort.Strings(images)
+	name := fmt.Sprintf("image-digests/%T/%s", obj, obj.GetName())
+	r.trackWorkloadImages(backgroundCheckKey(cr, name), images)
+
+	var key crypto.PublicKey
+	var keyID string
+	if c := cr.Spec.ImageDigests.Cosign; c != nil {
+		data, err := r.secretValue(ctx, cr, c.PublicKey, c.PublicKeySecret)
+		if err != nil {
+			return err
+		}
+		if key, err = parseCosignPublicKey(data); err != nil {
+			return err
+		}
+		sum := sha256.Sum256([]byte(data))
+		keyID = hex.EncodeToString(sum[:])
+	}
+	auths, err := r.registryAuths(ctx, cr)
+	if err != nil {
+		return err
+	}
+	registry := r.registryClient(cr, auths)
+	input := backgroundCheckInput(images, keyID, cr.Spec.ImageDigests.Cosign, auths, cr.Spec.Proxy)
+	res, ok := runBackgroundCheck(r, cr, name, input, ImageDigestsCacheTTL, func(ctx context.Context) imageDigestsResult {
+		ctx, cancel := context.WithTimeout(ctx, ImageDigestsTimeout)
+		defer cancel()
+		res := imageDigestsResult{digests: map[string]string{}}
+		for _, image := range images {
+			ref := parseImageRef(image)
+			digest, err := r.imageDigest(ctx, registry, image, ref)
+			if err != nil {
+				res.err = fmt.Errorf("failed to resolve the digest of %s: %w", image, err)
+				return res
+			}
+			if key != nil && cosignVerificationRequired(cr, image) {
+				if err = r.verifyImageSignature(ctx, registry, key, keyID, image, ref, digest); err != nil {
+					res.err = fmt.Errorf("failed to verify the signature of %s: %w", image, err)
+					return res
+				}
+			}
+			res.digests[image] = digest
+		}
+		return res
+	})
+	switch {
+	case !ok:
+		return fmt.Errorf("waiting for the image digests to be resolved")
+	case res.err != nil:
+		return res.err
+	}
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			c := &containers[i]
+			if digest := res.digests[c.Image]; digest != "" && parseImageRef(c.Image).digest == "" {
+				c.Image += "@" + digest
+			}
+		}
+	}
+	return nil
+}
+
+// registryClient returns the registry client of the instance, so the tokens are shared by all its workloads.
+// The client is replaced when the credentials or the proxy change.
+func (r *CorootReconciler) registryClient(cr *corootv1.Coroot, auths map[string]registryAuth) *registryClient {
+	input := backgroundCheckInput(auths, cr.Spec.Proxy)
+	key := backgroundCheckKey(cr, "registry")
+	r.imageDigestsLock.Lock()
+	defer r.imageDigestsLock.Unlock()
+	if c := r.registryClients[key]; c != nil && c.input == input {
+		return c
+	}
+	if r.registryClients == nil {
+		r.registryClients = map[string]*registryClient{}
+	}
+	c := &registryClient{client: imageRegistryClient(cr), auths: auths, tokens: map[string]string{}, input: input}
+	r.registryClients[key] = c
+	return c
+}
+
+// forgetImageDigests drops the registry client and the images of the workloads of a deleted instance.
+func (r *CorootReconciler) forgetImageDigests(cr *corootv1.Coroot) {
+	r.imageDigestsLock.Lock()
+	defer r.imageDigestsLock.Unlock()
+	delete(r.registryClients, backgroundCheckKey(cr, "registry"))
+	prefix := backgroundCheckKey(cr, "")
+	for workload := range r.workloadImages {
+		if strings.HasPrefix(workload, prefix) {
+			delete(r.workloadImages, workload)
+		}
+	}
+	r.pruneImageDigests()
+}
+
+// trackWorkloadImages records the images of the workload, so the cached digests and signatures of the images
+// that are no longer referenced by any workload are evicted.
+func (r *CorootReconciler) trackWorkloadImages(workload string, images []string) {
+	r.imageDigestsLock.Lock()
+	defer r.imageDigestsLock.Unlock()
+	if r.workloadImages == nil {
+		r.workloadImages = map[string][]string{}
+	}
+	r.workloadImages[workload] = images
+	r.pruneImageDigests()
+}
+
+// pruneImageDigests drops the digests of the images that are no longer referenced, and the signatures verified
+// for the digests the images no longer resolve to. It must be called with imageDigestsLock held.
+func (r *CorootReconciler) pruneImageDigests() {
+	referenced := map[string]bool{}
+	for _, images := range r.workloadImages {
+		for _, image := range images {
+			referenced[image] = true
+		}
+	}
+	for image := range r.imageDigests {
+		if !referenced[image] {
+			delete(r.imageDigests, image)
+		}
+	}
+	for k := range r.verifiedImages {
+		digest := parseImageRef(k.image).digest
+		if digest == "" {
+			digest = r.imageDigests[k.image].digest
+		}
+		if !referenced[k.image] || k.digest != digest {
+			delete(r.verifiedImages, k)
+		}
+	}
+}
+
+func cosignVerificationRequired(cr *corootv1.Coroot, image string) bool {
+	prefixes := cr.Spec.ImageDigests.Cosign.Images
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(image, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CorootReconciler) imageDigest(ctx context.Context, registry *registryClient, image string, ref imageRef) (string, error) {
+	if ref.digest != "" {
+		return ref.digest, nil
+	}
+	r.imageDigestsLock.Lock()
+	cached, ok := r.imageDigests[image]
+	r.imageDigestsLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.digest, nil
+	}
+	digest, err := registry.manifestDigest(ctx, ref, ref.tag)
+	if err != nil {
+		return "", err
+	}
+	r.imageDigestsLock.Lock()
+	if r.imageDigests == nil {
+		r.imageDigests = map[string]cachedImageDigest{}
+	}
+	r.imageDigests[image] = cachedImageDigest{digest: digest, expires: time.Now().Add(ImageDigestsCacheTTL)}
+	r.imageDigestsLock.Unlock()
+	return digest, nil
+}
+
+// verifyImageSignature checks that the image has a cosign signature made with the key for its repository and covering the digest.
+// The signatures are looked up by the tag cosign stores them under: sha256-<digest>.sig.
+func (r *CorootReconciler) verifyImageSignature(ctx context.Context, registry *registryClient, key crypto.PublicKey, keyID string, image string, ref imageRef, digest string) error {
+	cacheKey := imageDigestKey{image: image, digest: digest}
+	r.imageDigestsLock.Lock()
+	verifiedWith := r.verifiedImages[cacheKey]
+	r.imageDigestsLock.Unlock()
+	if verifiedWith == keyID {
+		return nil
+	}
+	data, err := registry.get(ctx, ref, "manifests/"+strings.Replace(digest, ":", "-", 1)+".sig", manifestMediaTypes)
+	if err != nil {
+		return fmt.Errorf("failed to get the signatures: %w", err)
+	}
+	var manifest struct {
+		Layers []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to parse the signatures: %w", err)
+	}
+	for _, l := range manifest.Layers {
+		sig, err := base64.StdEncoding.DecodeString(l.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(sig) == 0 {
+			continue
+		}
+		payload, err := registry.get(ctx, ref, "blobs/"+l.Digest, nil)
+		if err != nil {
+			return fmt.Errorf("failed to get the signature payload: %w", err)
+		}
+		if sum := sha256.Sum256(payload); "sha256:"+hex.EncodeToString(sum[:]) != l.Digest {
+			continue
+		}
+		if !verifyCosignSignature(key, payload, sig) {
+			continue
+		}
+		var p struct {
+			Critical struct {
+				Identity struct {
+					DockerReference string `json:"docker-reference"`
+				} `json:"identity"`
+				Image struct {
+					Digest string `json:"docker-manifest-digest"`
+				} `json:"image"`
+			} `json:"critical"`
+		}
+		if json.Unmarshal(payload, &p) != nil || p.Critical.Image.Digest != digest {
+			continue
+		}
+		// The signature must be made for the repository of the image, otherwise a signature of the same content
+		// in another repository signed with the key could be copied next to the image and replayed.
+		if signed := parseImageRef(p.Critical.Identity.DockerReference); signed.registry != ref.registry || signed.repository != ref.repository {
+			continue
+		}
+		r.imageDigestsLock.Lock()
+		if r.verifiedImages == nil {
+			r.verifiedImages = map[imageDigestKey]string{}
+		}
+		r.verifiedImages[cacheKey] = keyID
+		r.imageDigestsLock.Unlock()
+		return nil
+	}
+	return errors.New("no valid signature found")
+}
+
+func parseCosignPublicKey(data string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid cosign public key: no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cosign public key: %w", err)
+	}
+	return key, nil
+}
+
+func verifyCosignSignature(key crypto.PublicKey, payload, sig []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, hash[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	}
+	return false
+}
+
+type registryAuth struct {
+	username string
+	password string
+}
+
+// registryAuths returns the registry credentials from the image pull secrets of the Coroot.
+func (r *CorootReconciler) registryAuths(ctx context.Context, cr *corootv1.Coroot) (map[string]registryAuth, error) {
+	auths := map[string]registryAuth{}
+	for _, ref := range cr.Spec.ImagePullSecrets {
+		data, err := r.secretValue(ctx, cr, "", &corev1.SecretKeySelector{
+			LocalObjectReference: ref,
+			Key:                  corev1.DockerConfigJsonKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var cfg struct {
+			Auths map[string]struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+				Auth     string `json:"auth"`
+			} `json:"auths"`
+		}
+		if err = json.Unmarshal([]byte(data), &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse secret %s: %w", ref.Name, err)
+		}
+		for server, a := range cfg.Auths {
+			auth := registryAuth{username: a.Username, password: a.Password}
+			if decoded, err := base64.StdEncoding.DecodeString(a.Auth); err == nil && a.Auth != "" {
+				auth.username, auth.password, _ = strings.Cut(string(decoded), ":")
+			}
+			auths[registryHost(server)] = auth
+		}
+	}
+	return auths, nil
+}
+
+// registryHost normalizes the server of a Docker config, e.g., https://index.docker.io/v1/.
+func registryHost(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	server, _, _ = strings.Cut(server, "/")
+	switch server {
+	case "docker.io", "index.docker.io":
+		return dockerHubRegistry
+	}
+	return server
+}
+
+// registryClient is a minimal client of the OCI distribution API supporting the basic and token authentication.
+// The tokens are reused until the registry rejects them.
+type registryClient struct {
+	client *http.Client
+	auths  map[string]registryAuth
+	// The checksum of the credentials and the proxy the client was created with.
+	input string
+
+	tokens     map[string]string
+	tokensLock sync.Mutex
+}
+
+func (c *registryClient) manifestDigest(ctx context.Context, ref imageRef, reference string) (string, error) {
+	resp, err := c.do(ctx, http.MethodHead, ref, "manifests/"+reference, manifestMediaTypes)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	// Not all registries return the digest, so it's computed from the manifest.
+	data, err := c.get(ctx, ref, "manifests/"+reference, manifestMediaTypes)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+func (c *registryClient) get(ctx context.Context, ref imageRef, path string, accept []string) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, ref, path, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, maxRegistryResponseSize))
+}
+
+func (c *registryClient) do(ctx context.Context, method string, ref imageRef, path string, accept []string) (*http.Response, error) {
+	u := "https://" + ref.registry + "/v2/" + ref.repository + "/" + path
+	tokenKey := ref.registry + "/" + ref.repository
+	var resp *http.Response
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range accept {
+			req.Header.Add("Accept", t)
+		}
+		auth, hasAuth := c.auths[ref.registry]
+		c.tokensLock.Lock()
+		token := c.tokens[tokenKey]
+		c.tokensLock.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		} else if hasAuth {
+			req.SetBasicAuth(auth.username, auth.password)
+		}
+		if resp, err = c.client.Do(req); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			break
+		}
+		_ = resp.Body.Close()
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			return nil, fmt.Errorf("%s: unauthorized", u)
+		}
+		if token, err = c.token(ctx, challenge, auth, hasAuth); err != nil {
+			return nil, err
+		}
+		c.tokensLock.Lock()
+		c.tokens[tokenKey] = "Bearer " + token
+		c.tokensLock.Unlock()
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// token gets a bearer token from the authorization server specified in the challenge.
+func (c *registryClient) token(ctx context.Context, challenge string, auth registryAuth, hasAuth bool) (string, error) {
+	params := map[string]string{}
+	for _, p := range strings.Split(challenge[len("bearer "):], ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok {
+			params[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid authentication challenge: %s", challenge)
+	}
+	q := u.Query()
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			q.Set(k, params[k])
+		}
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasAuth {
+		req.SetBasicAuth(auth.username, auth.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get a registry token: %s", resp.Status)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxRegistryResponseSize)).Decode(&t); err != nil {
+		return "", fmt.Errorf("failed to parse the registry token: %w", err)
+	}
+	if t.Token != "" {
+		return t.Token, nil
+	}
+	return t.AccessToken, nil
+}
@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseImageRef(t *testing.T) {
+	for image, expected := range map[string]imageRef{
+		"ghcr.io/coroot/coroot:1.0.0":        {registry: "ghcr.io", repository: "coroot/coroot", tag: "1.0.0"},
+		"coroot/coroot-node-agent":           {registry: dockerHubRegistry, repository: "coroot/coroot-node-agent", tag: "latest"},
+		"nginx@sha256:abc":                   {registry: dockerHubRegistry, repository: "library/nginx", digest: "sha256:abc"},
+		"localhost:5000/coroot/coroot:1.0.0": {registry: "localhost:5000", repository: "coroot/coroot", tag: "1.0.0"},
+	} {
+		if actual := parseImageRef(image); actual != expected {
+			t.Errorf("%s: expected %+v, got %+v", image, expected, actual)
+		}
+	}
+}
+
+func TestPinImageDigests(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload, sig []byte
+	var payloadDigest string
+	// sign signs the digest for the repository the way cosign does.
+	sign := func(repository string) {
+		payload = []byte(`{"critical":{"identity":{"docker-reference":"` + repository + `"},"image":{"docker-manifest-digest":"` + digest + `"},"type":"cosign container image signature"}}`)
+		sum := sha256.Sum256(payload)
+		payloadDigest = "sha256:" + hex.EncodeToString(sum[:])
+		if sig, err = ecdsa.SignASN1(rand.Reader, key, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tokens atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			tokens.Add(1)
+			_ = json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://`+req.Host+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/v2/coroot/coroot/manifests/1.0.0":
+			w.Header().Set("Docker-Content-Digest", digest)
+		case "/v2/coroot/coroot/manifests/" + strings.Replace(digest, ":", "-", 1) + ".sig":
+			_ = json.NewEncoder(w).Encode(map[string]any{"layers": []any{map[string]any{
+				"digest":      payloadDigest,
+				"annotations": map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+			}}})
+		case "/v2/coroot/coroot/blobs/" + payloadDigest:
+			_, _ = w.Write(payload)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	defer func(c func(*corootv1.Coroot) *http.Client) { imageRegistryClient = c }(imageRegistryClient)
+	imageRegistryClient = func(*corootv1.Coroot) *http.Client { return srv.Client() }
+
+	publicKey := func(k *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	image := strings.TrimPrefix(srv.URL, "https://") + "/coroot/coroot:1.0.0"
+	sign(strings.TrimPrefix(srv.URL, "https://") + "/coroot/coroot")
+	deployment := func(name string) *appsv1.Deployment {
+		d := &appsv1.Deployment{}
+		d.Name = name
+		d.Spec.Template.Spec.Containers = []corev1.Container{{Name: "coroot", Image: image}}
+		return d
+	}
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.Spec.ImageDigests = &corootv1.ImageDigestsSpec{Cosign: &corootv1.CosignSpec{PublicKey: publicKey(key)}}
+	// The digests are resolved in the background, the workload isn't applied until then.
+	pin := func(d *appsv1.Deployment) error {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if err := r.pinImageDigests(context.Background(), cr, d); err == nil || !strings.HasPrefix(err.Error(), "waiting") {
+				return err
+			}
+		}
+		t.Fatal("the image digests haven't been resolved")
+		return nil
+	}
+
+	d := deployment("first")
+	if err = r.pinImageDigests(context.Background(), cr, d); err == nil {
+		t.Error("expected the workload to wait for the digests")
+	}
+	if err = pin(d); err != nil {
+		t.Fatal(err)
+	}
+	if actual := d.Spec.Template.Spec.Containers[0].Image; actual != image+"@"+digest {
+		t.Errorf("expected the image to be pinned, got %s", actual)
+	}
+	// The registry client and its tokens are shared by the workloads.
+	if err = pin(deployment("second")); err != nil {
+		t.Fatal(err)
+	}
+	if n := tokens.Load(); n != 1 {
+		t.Errorf("expected the token to be reused, got %d token requests", n)
+	}
+
+	// Images signed with another key aren't applied.
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.Spec.ImageDigests.Cosign.PublicKey = publicKey(otherKey)
+	if err = pin(deployment("first")); err == nil {
+		t.Error("expected the verification to fail")
+	}
+
+	// Unless they aren't required to be verified.
+	cr.Spec.ImageDigests.Cosign.Images = []string{"ghcr.io/coroot/"}
+	if err = pin(deployment("first")); err != nil {
+		t.Error(err)
+	}
+
+	// Signatures made for another repository aren't accepted, even if they cover the same digest.
+	sign("ghcr.io/coroot/other")
+	r = testReconciler(t)
+	cr.Spec.ImageDigests.Cosign = &corootv1.CosignSpec{PublicKey: publicKey(key)}
+	if err = pin(deployment("first")); err == nil {
+		t.Error("expected a signature for another repository to be rejected")
+	}
+}
+
+func TestImageDigestsPruned(t *testing.T) {
+	r := testReconciler(t)
+	r.imageDigests = map[string]cachedImageDigest{"coroot:1.0.0": {digest: "sha256:2"}, "coroot:1.1.0": {digest: "sha256:3"}}
+	r.verifiedImages = map[imageDigestKey]string{
+		{image: "coroot:1.0.0", digest: "sha256:1"}:    "key",
+		{image: "coroot:1.0.0", digest: "sha256:2"}:    "key",
+		{image: "coroot:1.1.0", digest: "sha256:3"}:    "key",
+		{image: "coroot@sha256:4", digest: "sha256:4"}: "key",
+	}
+	r.workloadImages = map[string][]string{"monitoring/coroot/second": {"coroot@sha256:4"}}
+	r.trackWorkloadImages("monitoring/coroot/first", []string{"coroot:1.0.0"})
+
+	if _, ok := r.imageDigests["coroot:1.1.0"]; ok || len(r.imageDigests) != 1 {
+		t.Errorf("expected the digest of the image that is no longer referenced to be evicted, got %v", r.imageDigests)
+	}
+	expected := map[imageDigestKey]string{
+		{image: "coroot:1.0.0", digest: "sha256:2"}:    "key",
+		{image: "coroot@sha256:4", digest: "sha256:4"}: "key",
+	}
+	if !reflect.DeepEqual(r.verifiedImages, expected) {
+		t.Errorf("expected the signatures of the current digests only, got %v", r.verifiedImages)
+	}
+
+	cr := testCoroot()
+	r.trackWorkloadImages(backgroundCheckKey(cr, "image-digests/first"), []string{"coroot:1.0.0"})
+	r.forgetImageDigests(cr)
+	if len(r.workloadImages) != 2 {
+		t.Errorf("expected the workloads of the deleted instance to be forgotten, got %v", r.workloadImages)
+	}
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"context"
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+	"sort"
+)
+
+const ImagesReportKey = "images.yaml"
+
+type imageReportItem struct {
+	Component string `json:"component,omitempty"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	Version   string `json:"version,omitempty"`
+	// Set if the image is pinned, see pinImageDigests.
+	Digest string `json:"digest,omitempty"`
+}
+
+// workloadImages returns the images of the containers of the workload as applied, including the init containers.
+func workloadImages(kind string, obj client.Object) []imageReportItem {
+	spec := workloadPodSpec(obj)
+	if spec == nil {
+		return nil
+	}
+	var items []imageReportItem
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for _, c := range containers {
+			ref := parseImageRef(c.Image)
+			items = append(items, imageReportItem{
+				Component: obj.GetLabels()["app.kubernetes.io/component"],
+				Kind:      kind,
+				Name:      obj.GetName(),
+				Container: c.Name,
+				Image:     c.Image,
+				Version:   ref.tag,
+				Digest:    ref.digest,
+			})
+		}
+	}
+	return items
+}
+
+func (r *CorootReconciler) imagesReportConfigMap(cr *corootv1.Coroot, inv *inventory) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-images",
+			Namespace: cr.Namespace,
+			Labels:    Labels(cr, "images"),
+		},
+	}
+	if inv == nil {
+		return cm
+	}
+	items := []imageReportItem{}
+	for _, images := range inv.images {
+		items = append(items, images...)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Kind != items[j].Kind {
+			return items[i].Kind < items[j].Kind
+		}
+		if items[i].Name != items[j].Name {
+			return items[i].Name < items[j].Name
+		}
+		return items[i].Container < items[j].Container
+	})
+	data, _ := yaml.Marshal(items)
+	cm.Data = map[string]string{ImagesReportKey: string(data)}
+	return cm
+}
+
+// CreateOrUpdateImagesReport stores the images of the workloads applied during the reconciliation into the <name>-images ConfigMap,
+// or deletes it if the report is disabled.
+func (r *CorootReconciler) CreateOrUpdateImagesReport(ctx context.Context, cr *corootv1.Coroot, inv *inventory) error {
+	if !cr.Spec.ImagesReport {
+		inv = nil
+	}
+	cm := r.imagesReportConfigMap(cr, inv)
+	data := cm.Data
+	return r.CreateOrUpdate(ctx, cr, cm, inv == nil, func() error {
+		cm.Data = data
+		return nil
+	})
+}
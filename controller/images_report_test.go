@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"testing"
+)
+
+func TestImagesReport(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	_, inv := withInventory(context.Background())
+
+	d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "coroot", Name: "coroot-cluster-agent", Labels: Labels(cr, "cluster-agent")}}
+	d.Spec.Template.Spec.Containers = []corev1.Container{{Name: "cluster-agent", Image: "ghcr.io/coroot/coroot-cluster-agent:1.2.3@sha256:abc"}}
+	inv.add(r.Scheme, d, objectHash(d))
+	inv.add(r.Scheme, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "coroot", Name: "coroot-coroot"}}, "")
+
+	cm := r.imagesReportConfigMap(cr, inv)
+	var items []imageReportItem
+	if err := yaml.Unmarshal([]byte(cm.Data[ImagesReportKey]), &items); err != nil {
+		t.Fatal(err)
+	}
+	expected := []imageReportItem{{
+		Component: "cluster-agent",
+		Kind:      "Deployment",
+		Name:      "coroot-cluster-agent",
+		Container: "cluster-agent",
+		Image:     "ghcr.io/coroot/coroot-cluster-agent:1.2.3@sha256:abc",
+		Version:   "1.2.3",
+		Digest:    "sha256:abc",
+	}}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("expected %+v, got %+v", expected, items)
+	}
+}
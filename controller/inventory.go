@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"sync"
+)
+
+const InventoryKey = "inventory.yaml"
+
+// The child resources are ignored by Argo CD when comparing and syncing the application, and never pruned by Flux.
+var gitOpsIgnoreAnnotations = map[string]string{
+	"argocd.argoproj.io/compare-options": "IgnoreExtraneous",
+	"argocd.argoproj.io/sync-options":    "Prune=false",
+	"kustomize.toolkit.fluxcd.io/prune":  "disabled",
+}
+
+type inventoryItem struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	Generation int64  `json:"generation,omitempty"`
+	Hash       string `json:"hash"`
+}
+
+// inventory collects the resources applied by CreateOrUpdate during a reconciliation.
+type inventory struct {
+	lock   sync.Mutex
+	items  map[string]inventoryItem
+	images map[string][]imageReportItem
+}
+
+type inventoryContextKey struct{}
+
+// withInventory returns a context collecting the applied resources.
+func withInventory(ctx context.Context) (context.Context, *inventory) {
+	inv := &inventory{items: map[string]inventoryItem{}, images: map[string][]imageReportItem{}}
+	return context.WithValue(ctx, inventoryContextKey{}, inv), inv
+}
+
+func inventoryFrom(ctx context.Context) *inventory {
+	inv, _ := ctx.Value(inventoryContextKey{}).(*inventory)
+	return inv
+}
+
+func inventoryKey(kind string, obj client.Object) string {
+	return fmt.Sprintf("%s/%s/%s", kind, obj.GetNamespace(), obj.GetName())
+}
+
+func (inv *inventory) add(scheme *runtime.Scheme, obj client.Object, hash string) {
+	if inv == nil {
+		return
+	}
+	gvk, err := apiutil.GVKForObject(obj, scheme)
+	if err != nil {
+		return
+	}
+	apiVersion, kind := gvk.ToAPIVersionAndKind()
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	inv.items[inventoryKey(kind, obj)] = inventoryItem{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+		Generation: obj.GetGeneration(),
+		Hash:       hash,
+	}
+	if images := workloadImages(kind, obj); len(images) > 0 {
+		inv.images[inventoryKey(kind, obj)] = images
+	}
+}
+
+// has reports whether the object has been applied during the reconciliation.
+func (inv *inventory) has(kind string, obj client.Object) bool {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	_, ok := inv.items[inventoryKey(kind, obj)]
+	return ok
+}
+
+func inventoryEnabled(cr *corootv1.Coroot) bool {
+	return cr.Spec.GitOps != nil && cr.Spec.GitOps.Inventory
+}
+
+// objectHash returns the hash of the desired state of the object built by the operator.
+func objectHash(obj client.Object) string {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:16]
+}
+
+func (r *CorootReconciler) inventoryConfigMap(cr *corootv1.Coroot, inv *inventory) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-inventory",
+			Namespace: cr.Namespace,
+			Labels:    Labels(cr, "inventory"),
+		},
+	}
+	if inv == nil {
+		return cm
+	}
+	var items []inventoryItem
+	for _, i := range inv.items {
+		items = append(items, i)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Kind != items[j].Kind {
+			return items[i].Kind < items[j].Kind
+		}
+		if items[i].Namespace != items[j].Namespace {
+			return items[i].Namespace < items[j].Namespace
+		}
+		return items[i].Name < items[j].Name
+	})
+	data, _ := yaml.Marshal(items)
+	cm.Data = map[string]string{InventoryKey: string(data)}
+	return cm
+}
+
+// CreateOrUpdateInventory stores the resources applied during the reconciliation into the <name>-inventory ConfigMap,
+// or deletes it if the inventory is disabled.
+func (r *CorootReconciler) CreateOrUpdateInventory(ctx context.Context, cr *corootv1.Coroot, inv *inventory) error {
+	if !inventoryEnabled(cr) {
+		inv = nil
+	}
+	cm := r.inventoryConfigMap(cr, inv)
+	data := cm.Data
+	return r.CreateOrUpdate(ctx, cr, cm, inv == nil, func() error {
+		cm.Data = data
+		return nil
+	})
+}
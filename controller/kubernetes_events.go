@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	OtelCollectorImage = "otel/opentelemetry-collector-contrib:0.115.1"
+)
+
+func kubernetesEventsEnabled(cr *corootv1.Coroot) bool {
+	return cr.Spec.ClusterAgent.KubernetesEvents != nil
+}
+
+func kubernetesEventsRules(cr *corootv1.Coroot) []rbacv1.PolicyRule {
+	if !kubernetesEventsEnabled(cr) {
+		return nil
+	}
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{"", "events.k8s.io"},
+			Resources: []string{"events"},
+			Verbs:     []string{"get", "list", "watch"},
+		},
+	}
+}
+
+// kubernetesEventsCollectorConfig watches the events of the namespaces (all if empty)
+// and sends them to Coroot as OpenTelemetry logs of the kubernetes-events service.
+func kubernetesEventsCollectorConfig(corootURL string, namespaces []string) string {
+	events := map[string]any{"name": "events", "mode": "watch"}
+	if len(namespaces) > 0 {
+		events["namespaces"] = namespaces
+	}
+	data, _ := yaml.Marshal(map[string]any{
+		"receivers": map[string]any{
+			"k8sobjects": map[string]any{
+				"auth_type": "serviceAccount",
+				"objects":   []any{events},
+			},
+		},
+		"processors": map[string]any{
+			"resource": map[string]any{
+				"attributes": []any{
+					map[string]any{"key": "service.name", "value": "kubernetes-events", "action": "upsert"},
+				},
+			},
+			"batch": map[string]any{},
+		},
+		"exporters": map[string]any{
+			"otlphttp": map[string]any{
+				"endpoint": corootURL,
+				"headers":  map[string]string{"x-api-key": "${env:API_KEY}"},
+			},
+		},
+		"service": map[string]any{
+			"telemetry": map[string]any{"metrics": map[string]any{"level": "none"}},
+			"pipelines": map[string]any{
+				"logs": map[string]any{
+					"receivers":  []string{"k8sobjects"},
+					"processors": []string{"resource", "batch"},
+					"exporters":  []string{"otlphttp"},
+				},
+			},
+		},
+	})
+	return string(data)
+}
+
+// kubernetesEventsDeployment runs the collector as a single replica regardless of the cluster-agent replicas,
+// so each event is exported once. It uses the cluster-agent's service account to share its RBAC and namespace restrictions.
+func (r *CorootReconciler) kubernetesEventsDeployment(cr *corootv1.Coroot, namespaces []string) *appsv1.Deployment {
+	ls := Labels(cr, "kubernetes-events")
+	ca := cr.Spec.ClusterAgent
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-kubernetes-events",
+			Namespace: cr.Namespace,
+			Labels:    mergeLabels(ls, ca.Labels),
+		},
+	}
+	if !kubernetesEventsEnabled(cr) {
+		return d
+	}
+
+	corootURL := fmt.Sprintf("http://%s-coroot.%s:8080", cr.Name, cr.Namespace)
+	if cr.Spec.AgentsOnly != nil {
+		corootURL = cr.Spec.AgentsOnly.CorootURL
+	}
+	if r.namespaceScoped(cr) {
+		namespaces = []string{cr.Namespace}
+	}
+	env := []corev1.EnvVar{
+		{Name: "COLLECTOR_CONFIG", Value: kubernetesEventsCollectorConfig(corootURL, namespaces)},
+		secretEnv("API_KEY", cr.Spec.ApiKey, cr.Spec.ApiKeySecret),
+	}
+	env = append(env, proxyEnv(cr)...)
+	resources := ca.KubernetesEvents.Resources
+
+	d.Spec = appsv1.DeploymentSpec{
+		Selector: &metav1.LabelSelector{
+			MatchLabels: ls,
+		},
+		Replicas: ptr.To(int32(1)),
+		// The replicas of the old and the new version must not export the same events at the same time.
+		Strategy: appsv1.DeploymentStrategy{
+			Type: appsv1.RecreateDeploymentStrategyType,
+		},
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:      mergeLabels(ls, ca.PodLabels),
+				Annotations: podAnnotations(cr, ca.PodAnnotations, false),
+			},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: serviceAccountName(cr, "cluster-agent"),
+				DNSPolicy:          ca.DNSPolicy,
+				DNSConfig:          ca.DNSConfig,
+				HostAliases:        ca.HostAliases,
+				SecurityContext:    podSecurityContext(ca.PodSecurityContext),
+				Affinity:           archAffinity(ca.Affinity, ca.Architectures),
+				Tolerations:        ca.Tolerations,
+				NodeSelector:       linuxNodeSelector,
+				PriorityClassName:  ca.PriorityClassName,
+				SchedulerName:      ca.SchedulerName,
+				RuntimeClassName:   ca.RuntimeClassName,
+				Containers: []corev1.Container{
+					{
+						Image:           OtelCollectorImage,
+						Name:            "kubernetes-events",
+						Args:            []string{"--config=env:COLLECTOR_CONFIG"},
+						Env:             goRuntimeEnv(env, resources),
+						Resources:       resources,
+						SecurityContext: containerSecurityContext(ca.SecurityContext),
+					},
+				},
+			},
+		},
+	}
+	applyCustomCA(cr, &d.Spec.Template.Spec)
+
+	return d
+}
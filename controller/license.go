@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"time"
+)
+
+const (
+	LicenseCheckInterval              = time.Hour
+	LicenseCheckRetryInterval         = 5 * time.Minute
+	DefaultLicenseExpiryWarningPeriod = 14 * 24 * time.Hour
+)
+
+var (
+	licenseClient = &http.Client{Timeout: PreflightTimeout}
+	// Overridden in tests.
+	// Coroot serves the API under URL_BASE_PATH, which is set to the path of the Ingress.
+	corootAPIURL = func(cr *corootv1.Coroot) string {
+		port := cr.Spec.Service.Port
+		if port == 0 {
+			port = DefaultCorootServicePort
+		}
+		var basePath string
+		if cr.Spec.Ingress != nil {
+			basePath = strings.TrimSuffix(cr.Spec.Ingress.Path, "/")
+		}
+		return fmt.Sprintf("http://%s-coroot.%s:%d%s", cr.Name, cr.Namespace, port, basePath)
+	}
+)
+
+// The email of the admin user Coroot creates with AUTH_BOOTSTRAP_ADMIN_PASSWORD.
+const corootAdminEmail = "admin"
+
+// checkLicense publishes the license of the Enterprise Edition reported by the rolled out Coroot into the status,
+// and records an event when the license becomes invalid or is about to expire.
+// It returns the time after which the license should be checked again (0 if not needed).
+func (r *CorootReconciler) checkLicense(ctx context.Context, cr *corootv1.Coroot, now time.Time) time.Duration {
+	ee := cr.Spec.EnterpriseEdition
+	if ee == nil || cr.Spec.AgentsOnly != nil {
+		cr.Status.License = nil
+		return 0
+	}
+	// The rollout of a new license key triggers the reconciliation, as the StatefulSet is owned by the Coroot.
+	if !meta.IsStatusConditionTrue(cr.Status.Conditions, ConditionTypeCorootRolledOut) || cr.Status.Rollout == nil {
+		return 0
+	}
+	prev := cr.Status.License
+	revision := cr.Status.Rollout.Revision
+	if prev != nil && prev.Revision == revision && prev.Error == "" && prev.CheckedAt != nil {
+		if next := prev.CheckedAt.Add(LicenseCheckInterval); now.Before(next) {
+			return next.Sub(now)
+		}
+	}
+
+	password, err := r.corootAdminPassword(ctx, cr)
+	var license *corootv1.LicenseStatus
+	if err == nil {
+		license, err = fetchLicense(ctx, corootAPIURL(cr), password)
+	}
+	if err != nil {
+		failed := &corootv1.LicenseStatus{Revision: revision, Error: err.Error()}
+		if prev != nil {
+			failed.Valid, failed.ExpiresAt, failed.CheckedAt, failed.Message = prev.Valid, prev.ExpiresAt, prev.CheckedAt, prev.Message
+		}
+		cr.Status.License = failed
+		return LicenseCheckRetryInterval
+	}
+	license.Revision = revision
+	license.CheckedAt = &metav1.Time{Time: now}
+	cr.Status.License = license
+
+	warning := ee.LicenseExpiryWarning.Duration
+	if warning <= 0 {
+		warning = DefaultLicenseExpiryWarningPeriod
+	}
+	expiring := func(l *corootv1.LicenseStatus) bool {
+		return l != nil && l.Valid && l.ExpiresAt != nil && l.ExpiresAt.Sub(now) < warning
+	}
+	if r.recorder != nil {
+		switch {
+		case !license.Valid && (prev == nil || prev.Valid || prev.CheckedAt == nil):
+			r.recorder.Event(cr, corev1.EventTypeWarning, "LicenseInvalid", fmt.Sprintf("the Coroot license is invalid: %s", license.Message))
+		case expiring(license) && !expiring(prev):
+			r.recorder.Event(cr, corev1.EventTypeWarning, "LicenseExpiring",
+				fmt.Sprintf("the Coroot license expires on %s", license.ExpiresAt.UTC().Format(time.DateOnly)))
+		}
+	}
+	return LicenseCheckInterval
+}
+
+// corootAdminPassword returns the bootstrap admin password the license is requested with.
+// The check fails if the password has been changed in the UI, as Coroot uses the bootstrap password only once.
+func (r *CorootReconciler) corootAdminPassword(ctx context.Context, cr *corootv1.Coroot) (string, error) {
+	if generatedAdminPassword(cr) {
+		return r.secretValue(ctx, cr, "", secretKeySelector(cr.Name+"-coroot-admin", "password"))
+	}
+	return r.secretValue(ctx, cr, cr.Spec.AuthBootstrapAdminPassword, cr.Spec.AuthBootstrapAdminPasswordSecret)
+}
+
+// fetchLicense logs in as the admin (POST /api/login sets the session cookie) and gets the license status.
+// The response must contain the valid field, so an unexpected response isn't reported as an invalid license.
+func fetchLicense(ctx context.Context, url, password string) (*corootv1.LicenseStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, PreflightTimeout)
+	defer cancel()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Client{Transport: licenseClient.Transport, Timeout: licenseClient.Timeout, Jar: jar}
+
+	login, _ := json.Marshal(map[string]string{"email": corootAdminEmail, "password": password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/api/login", bytes.NewReader(login))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to log in to Coroot: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to log in to Coroot as %s: %s", corootAdminEmail, resp.Status)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/license", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err = c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the license status: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get the license status: %s", resp.Status)
+	}
+	var l struct {
+		Valid     *bool      `json:"valid"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		Message   string     `json:"message"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		return nil, fmt.Errorf("failed to parse the license status: %w", err)
+	}
+	if l.Valid == nil {
+		return nil, fmt.Errorf("failed to parse the license status: no valid field in the response")
+	}
+	res := &corootv1.LicenseStatus{Valid: *l.Valid, Message: l.Message}
+	if l.ExpiresAt != nil {
+		res.ExpiresAt = &metav1.Time{Time: *l.ExpiresAt}
+	}
+	return res, nil
+}
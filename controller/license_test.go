@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLicense(t *testing.T) {
+	now := time.Now()
+	expiresAt := now.Add(7 * 24 * time.Hour).UTC().Format(time.RFC3339)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/coroot/api/login":
+			var form map[string]string
+			if err := json.NewDecoder(req.Body).Decode(&form); err != nil || form["email"] != "admin" || form["password"] != "secret" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "coroot_session", Value: "session", Path: "/"})
+		case "/coroot/api/license":
+			if c, err := req.Cookie("coroot_session"); err != nil || c.Value != "session" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"valid":true,"expires_at":"` + expiresAt + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	apiURL := corootAPIURL
+	defer func() { corootAPIURL = apiURL }()
+	// Keeps the base path of the in-cluster URL.
+	corootAPIURL = func(cr *corootv1.Coroot) string {
+		return srv.URL + strings.TrimPrefix(apiURL(cr), "http://coroot-coroot.coroot:8080")
+	}
+
+	r := testReconciler(t)
+	recorder := record.NewFakeRecorder(10)
+	r.recorder = recorder
+	cr := testCoroot()
+	cr.Spec.EnterpriseEdition = &corootv1.EnterpriseEditionSpec{}
+	cr.Spec.AuthBootstrapAdminPassword = "secret"
+	cr.Spec.Ingress = &corootv1.IngressSpec{Path: "/coroot/"}
+	cr.Status.Rollout = &corootv1.RolloutStatus{Revision: "rev-1"}
+
+	// The license isn't checked until Coroot is rolled out.
+	if r.checkLicense(context.Background(), cr, now); cr.Status.License != nil {
+		t.Fatalf("expected no license status, got %+v", cr.Status.License)
+	}
+	meta.SetStatusCondition(&cr.Status.Conditions, metav1.Condition{Type: ConditionTypeCorootRolledOut, Status: metav1.ConditionTrue, Reason: "RolledOut"})
+
+	if requeue := r.checkLicense(context.Background(), cr, now); requeue != LicenseCheckInterval {
+		t.Errorf("expected the license to be checked again in %s, got %s", LicenseCheckInterval, requeue)
+	}
+	l := cr.Status.License
+	if l == nil || !l.Valid || l.ExpiresAt == nil || l.ExpiresAt.UTC().Format(time.RFC3339) != expiresAt {
+		t.Fatalf("unexpected license status: %+v", l)
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, "LicenseExpiring") {
+			t.Errorf("expected a LicenseExpiring event, got %s", e)
+		}
+	default:
+		t.Error("expected a LicenseExpiring event")
+	}
+
+	// The next check is scheduled without querying Coroot and recording the event again.
+	if requeue := r.checkLicense(context.Background(), cr, now.Add(time.Minute)); requeue != LicenseCheckInterval-time.Minute {
+		t.Errorf("unexpected requeue interval: %s", requeue)
+	}
+	if requeue := r.checkLicense(context.Background(), cr, now.Add(LicenseCheckInterval)); requeue != LicenseCheckInterval {
+		t.Errorf("unexpected requeue interval: %s", requeue)
+	}
+	if len(recorder.Events) > 0 {
+		t.Errorf("unexpected event: %s", <-recorder.Events)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/utils/ptr"
 )
 
@@ -16,7 +17,7 @@ func (r *CorootReconciler) nodeAgentDaemonSet(cr *corootv1.Coroot) *appsv1.Daemo
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      cr.Name + "-node-agent",
 			Namespace: cr.Namespace,
-			Labels:    ls,
+			Labels:    mergeLabels(ls, cr.Spec.NodeAgent.Labels),
 		},
 	}
 
@@ -30,13 +31,52 @@ func (r *CorootReconciler) nodeAgentDaemonSet(cr *corootv1.Coroot) *appsv1.Daemo
 	}
 	env := []corev1.EnvVar{
 		{Name: "COLLECTOR_ENDPOINT", Value: collectorEndpoint},
-		{Name: "API_KEY", Value: cr.Spec.ApiKey},
+		secretEnv("API_KEY", cr.Spec.ApiKey, cr.Spec.ApiKeySecret),
 		{Name: "SCRAPE_INTERVAL", Value: scrapeInterval},
 	}
+	if cr.Spec.NodeAgent.DisableLogParsing {
+		env = append(env, corev1.EnvVar{Name: "DISABLE_LOG_PARSING", Value: "true"})
+	}
+	if cr.Spec.NodeAgent.DisableL7Tracing {
+		env = append(env, corev1.EnvVar{Name: "DISABLE_L7_TRACING", Value: "true"})
+	}
+	if cr.Spec.NodeAgent.DisablePinger {
+		env = append(env, corev1.EnvVar{Name: "DISABLE_PINGER", Value: "true"})
+	}
+	if s := cr.Spec.NodeAgent.Spool; s != nil {
+		size := nodeAgentSpoolSize(s)
+		env = append(env,
+			corev1.EnvVar{Name: "WAL_DIR", Value: "/spool"},
+			corev1.EnvVar{Name: "MAX_SPOOL_SIZE", Value: fmt.Sprintf("%dB", size.Value())},
+		)
+	}
+	var ports []corev1.ContainerPort
+	if m := cr.Spec.NodeAgent.Metrics; m != nil {
+		port := m.Port
+		if port == 0 {
+			port = 80
+		}
+		env = append(env, corev1.EnvVar{Name: "LISTEN", Value: fmt.Sprintf("0.0.0.0:%d", port)})
+		ports = append(ports, corev1.ContainerPort{Name: "metrics", ContainerPort: port, HostPort: m.HostPort, Protocol: corev1.ProtocolTCP})
+	}
+	env = append(env, proxyEnv(cr)...)
 	for _, e := range cr.Spec.NodeAgent.Env {
 		env = append(env, e)
 	}
 
+	args := []string{
+		"--cgroupfs-root=/host/sys/fs/cgroup",
+	}
+	for _, n := range cr.Spec.NodeAgent.TrackPublicNetworks {
+		args = append(args, "--track-public-network="+n)
+	}
+	for _, re := range cr.Spec.NodeAgent.ContainerAllowlist {
+		args = append(args, "--container-allowlist="+re)
+	}
+	for _, re := range cr.Spec.NodeAgent.ContainerDenylist {
+		args = append(args, "--container-denylist="+re)
+	}
+
 	resources := cr.Spec.NodeAgent.Resources
 	if resources.Requests == nil {
 		resources.Requests = corev1.ResourceList{
@@ -56,6 +96,63 @@ func (r *CorootReconciler) nodeAgentDaemonSet(cr *corootv1.Coroot) *appsv1.Daemo
 		tolerations = []corev1.Toleration{{Operator: corev1.TolerationOpExists}}
 	}
 
+	dnsPolicy := corev1.DNSClusterFirst
+	if cr.Spec.NodeAgent.HostNetwork {
+		dnsPolicy = corev1.DNSClusterFirstWithHostNet
+	}
+	if cr.Spec.NodeAgent.DNSPolicy != "" {
+		dnsPolicy = cr.Spec.NodeAgent.DNSPolicy
+	}
+
+	mounts := []corev1.VolumeMount{
+		{Name: "cgroupfs", MountPath: "/host/sys/fs/cgroup", ReadOnly: true},
+		{Name: "tracefs", MountPath: "/sys/kernel/tracing"},
+		{Name: "debugfs", MountPath: "/sys/kernel/debug"},
+		{Name: "tmp", MountPath: "/tmp"},
+	}
+	volumes := []corev1.Volume{
+		{
+			Name: "cgroupfs",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: "/sys/fs/cgroup",
+				},
+			},
+		},
+		{
+			Name: "tracefs",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: "/sys/kernel/tracing",
+				},
+			},
+		},
+		{
+			Name: "debugfs",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: "/sys/kernel/debug",
+				},
+			},
+		},
+		{
+			Name: "tmp",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+	}
+	if s := cr.Spec.NodeAgent.Spool; s != nil {
+		spool := corev1.Volume{Name: "spool"}
+		if s.Path != "" {
+			spool.HostPath = &corev1.HostPathVolumeSource{Path: s.Path, Type: ptr.To(corev1.HostPathDirectoryOrCreate)}
+		} else {
+			spool.EmptyDir = &corev1.EmptyDirVolumeSource{SizeLimit: ptr.To(nodeAgentSpoolSize(s))}
+		}
+		volumes = append(volumes, spool)
+		mounts = append(mounts, corev1.VolumeMount{Name: "spool", MountPath: "/spool"})
+	}
+
 	ds.Spec = appsv1.DaemonSetSpec{
 		Selector: &metav1.LabelSelector{
 			MatchLabels: ls,
@@ -63,68 +160,79 @@ func (r *CorootReconciler) nodeAgentDaemonSet(cr *corootv1.Coroot) *appsv1.Daemo
 		UpdateStrategy: cr.Spec.NodeAgent.UpdateStrategy,
 		Template: corev1.PodTemplateSpec{
 			ObjectMeta: metav1.ObjectMeta{
-				Labels:      ls,
+				Labels:      mergeLabels(ls, cr.Spec.NodeAgent.PodLabels),
 				Annotations: cr.Spec.NodeAgent.PodAnnotations,
 			},
 			Spec: corev1.PodSpec{
-				ServiceAccountName: cr.Name + "-node-agent",
+				ServiceAccountName: serviceAccountName(cr, "node-agent"),
 				HostPID:            true,
+				HostNetwork:        cr.Spec.NodeAgent.HostNetwork,
+				DNSPolicy:          dnsPolicy,
+				DNSConfig:          cr.Spec.NodeAgent.DNSConfig,
+				HostAliases:        cr.Spec.NodeAgent.HostAliases,
 				Tolerations:        tolerations,
+				NodeSelector:       linuxNodeSelector,
 				PriorityClassName:  cr.Spec.NodeAgent.PriorityClassName,
-				Affinity:           cr.Spec.NodeAgent.Affinity,
+				SchedulerName:      cr.Spec.NodeAgent.SchedulerName,
+				RuntimeClassName:   cr.Spec.NodeAgent.RuntimeClassName,
+				Affinity:           archAffinity(cr.Spec.NodeAgent.Affinity, cr.Spec.NodeAgent.Architectures),
 				Containers: []corev1.Container{
 					{
-						Name:  "node-agent",
-						Image: r.getAppImage(cr, AppNodeAgent),
-						Args: []string{
-							"--cgroupfs-root=/host/sys/fs/cgroup",
-						},
+						Name:            "node-agent",
+						Image:           r.getAppImage(cr, AppNodeAgent),
+						Args:            args,
+						Ports:           ports,
 						SecurityContext: &corev1.SecurityContext{Privileged: ptr.To(true)},
-						Env:             env,
+						Env:             goRuntimeEnv(env, resources),
 						Resources:       resources,
-						VolumeMounts: []corev1.VolumeMount{
-							{Name: "cgroupfs", MountPath: "/host/sys/fs/cgroup", ReadOnly: true},
-							{Name: "tracefs", MountPath: "/sys/kernel/tracing"},
-							{Name: "debugfs", MountPath: "/sys/kernel/debug"},
-							{Name: "tmp", MountPath: "/tmp"},
-						},
-					},
-				},
-				Volumes: []corev1.Volume{
-					{
-						Name: "cgroupfs",
-						VolumeSource: corev1.VolumeSource{
-							HostPath: &corev1.HostPathVolumeSource{
-								Path: "/sys/fs/cgroup",
-							},
-						},
-					},
-					{
-						Name: "tracefs",
-						VolumeSource: corev1.VolumeSource{
-							HostPath: &corev1.HostPathVolumeSource{
-								Path: "/sys/kernel/tracing",
-							},
-						},
-					},
-					{
-						Name: "debugfs",
-						VolumeSource: corev1.VolumeSource{
-							HostPath: &corev1.HostPathVolumeSource{
-								Path: "/sys/kernel/debug",
-							},
-						},
-					},
-					{
-						Name: "tmp",
-						VolumeSource: corev1.VolumeSource{
-							EmptyDir: &corev1.EmptyDirVolumeSource{},
-						},
+						VolumeMounts:    mounts,
 					},
 				},
+				Volumes: volumes,
 			},
 		},
 	}
+	applyCustomCA(cr, &ds.Spec.Template.Spec)
+	applyContainerOverrides(&ds.Spec.Template.Spec.Containers[0], cr.Spec.NodeAgent.ExtraArgs, cr.Spec.NodeAgent.Lifecycle)
 
 	return ds
 }
+
+func nodeAgentSpoolSize(s *corootv1.NodeAgentSpoolSpec) resource.Quantity {
+	if s.Size.IsZero() {
+		return resource.MustParse("1Gi")
+	}
+	return s.Size
+}
+
+func (r *CorootReconciler) nodeAgentServiceHeadless(cr *corootv1.Coroot) *corev1.Service {
+	ls := Labels(cr, "coroot-node-agent")
+	s := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-node-agent-headless",
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+	}
+	if cr.Spec.NodeAgent.Metrics == nil {
+		return s
+	}
+	port := cr.Spec.NodeAgent.Metrics.Port
+	if port == 0 {
+		port = 80
+	}
+	s.Spec = corev1.ServiceSpec{
+		Selector:  ls,
+		ClusterIP: corev1.ClusterIPNone,
+		Type:      corev1.ServiceTypeClusterIP,
+		Ports: []corev1.ServicePort{
+			{
+				Name:       "metrics",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       port,
+				TargetPort: intstr.FromString("metrics"),
+			},
+		},
+	}
+	return s
+}
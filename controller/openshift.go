@@ -39,7 +39,7 @@ func (r *CorootReconciler) openshiftSCCRoleBinding(cr *corootv1.Coroot, componen
 		Subjects: []rbacv1.Subject{
 			{
 				Kind:      rbacv1.ServiceAccountKind,
-				Name:      cr.Name + "-" + component,
+				Name:      serviceAccountName(cr, component),
 				Namespace: cr.Namespace,
 			},
 		},
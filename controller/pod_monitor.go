@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"context"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var podMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PodMonitor"}
+
+type podMonitorTarget struct {
+	component string
+	port      string
+	path      string
+}
+
+func podMonitorTargets(cr *corootv1.Coroot) []podMonitorTarget {
+	targets := []podMonitorTarget{
+		{component: "coroot", port: "http", path: "/metrics"},
+		{component: "prometheus", port: "http", path: "/metrics"},
+	}
+	if cr.Spec.ExternalClickhouse == nil {
+		targets = append(targets,
+			podMonitorTarget{component: "clickhouse", port: "metrics", path: "/metrics"},
+			podMonitorTarget{component: "clickhouse-keeper", port: "metrics", path: "/metrics"},
+		)
+	}
+	return targets
+}
+
+func (r *CorootReconciler) podMonitor(cr *corootv1.Coroot, t podMonitorTarget) *unstructured.Unstructured {
+	pm := &unstructured.Unstructured{}
+	pm.SetGroupVersionKind(podMonitorGVK)
+	pm.SetName(cr.Name + "-" + t.component)
+	pm.SetNamespace(cr.Namespace)
+	ls := Labels(cr, t.component)
+	if cr.Spec.PodMonitor != nil {
+		for k, v := range cr.Spec.PodMonitor.Labels {
+			ls[k] = v
+		}
+	}
+	pm.SetLabels(ls)
+
+	endpoint := map[string]interface{}{
+		"port": t.port,
+		"path": t.path,
+	}
+	if cr.Spec.PodMonitor != nil && cr.Spec.PodMonitor.Interval.Duration > 0 {
+		endpoint["interval"] = cr.Spec.PodMonitor.Interval.Duration.String()
+	}
+	selector := map[string]interface{}{}
+	for k, v := range Labels(cr, t.component) {
+		selector[k] = v
+	}
+	pm.Object["spec"] = map[string]interface{}{
+		"selector":            map[string]interface{}{"matchLabels": selector},
+		"podMetricsEndpoints": []interface{}{endpoint},
+	}
+	return pm
+}
+
+func (r *CorootReconciler) podMonitors(cr *corootv1.Coroot) []*unstructured.Unstructured {
+	var res []*unstructured.Unstructured
+	for _, t := range podMonitorTargets(cr) {
+		res = append(res, r.podMonitor(cr, t))
+	}
+	return res
+}
+
+func (r *CorootReconciler) CreateOrUpdatePodMonitors(ctx context.Context, cr *corootv1.Coroot) []error {
+	if !r.kindSupported(podMonitorGVK) {
+		if cr.Spec.PodMonitor != nil {
+			ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Info("PodMonitor CRD is not installed, skipping")
+		}
+		return nil
+	}
+	var errs []error
+	for _, pm := range r.podMonitors(cr) {
+		errs = append(errs, r.CreateOrUpdateUnstructured(ctx, cr, pm, cr.Spec.PodMonitor == nil))
+	}
+	return errs
+}
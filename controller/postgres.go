@@ -7,17 +7,17 @@ import (
 	"strings"
 )
 
-func postgresConnectionString(p corootv1.PostgresSpec, passwordEnvVar string) string {
-	kv := p.Params
-	if kv == nil {
-		kv = map[string]string{}
+func postgresConnectionString(p corootv1.PostgresSpec, password string) string {
+	kv := map[string]string{}
+	for k, v := range p.Params {
+		kv[k] = v
 	}
 	kv["host"] = p.Host
 	if p.Port > 0 {
 		kv["port"] = fmt.Sprintf("%d", p.Port)
 	}
 	kv["user"] = p.User
-	kv["password"] = fmt.Sprintf("$(%s)", passwordEnvVar)
+	kv["password"] = password
 	kv["dbname"] = p.Database
 	if kv["sslmode"] == "" {
 		kv["sslmode"] = "disable"
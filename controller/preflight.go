@@ -0,0 +1,582 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	_ "github.com/lib/pq"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/http"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	PreflightTimeout = 5 * time.Second
+	// The external dependencies are checked this often, e.g., to fail over if several ClickHouse addresses are configured.
+	ExternalClickhouseCheckInterval = time.Minute
+	// Coroot is restarted on every switch of the ClickHouse address, so it's switched back to a more preferred address
+	// no sooner than this after the last switch, e.g., if the primary is flapping. Failing over isn't delayed.
+	ExternalClickhouseFailbackDelay = 15 * time.Minute
+
+	ConditionTypeDependenciesReady = "DependenciesReady"
+	ConditionTypeStorageReady      = "StorageReady"
+
+	defaultStorageClassAnnotation = "storageclass.kubernetes.io/is-default-class"
+)
+
+// validateCoroot checks connectivity and authentication to the external dependencies configured in the spec
+// and publishes the results into the status. The checks run in the background, see runBackgroundCheck,
+// so the status reflects the last completed check.
+func (r *CorootReconciler) validateCoroot(ctx context.Context, cr *corootv1.Coroot) {
+	if cr.Spec.AgentsOnly != nil || cr.Spec.ExternalClickhouse == nil {
+		cr.Status.ExternalClickhouseAddress = ""
+		cr.Status.ExternalClickhouseSwitchedAt = nil
+	}
+	var inputs []any
+	var checks []func(ctx context.Context) corootv1.DependencyStatus
+	failed := func(dep corootv1.DependencyStatus) func(ctx context.Context) corootv1.DependencyStatus {
+		return func(context.Context) corootv1.DependencyStatus { return dep }
+	}
+	if ao := cr.Spec.AgentsOnly; ao != nil {
+		client := proxyClient(cr)
+		inputs = append(inputs, ao.CorootURL, cr.Spec.Proxy)
+		checks = append(checks, func(ctx context.Context) corootv1.DependencyStatus { return checkCoroot(ctx, client, ao.CorootURL) })
+	} else {
+		if ec := cr.Spec.ExternalClickhouse; ec != nil {
+			password, err := r.secretValue(ctx, cr, ec.Password, ec.PasswordSecret)
+			var tlsConfig *tls.Config
+			if err == nil {
+				tlsConfig, err = r.clickhouseTLSConfig(ctx, cr, ec)
+			}
+			inputs = append(inputs, ec, password, fmt.Sprint(err))
+			for _, address := range externalClickhouseAddresses(ec) {
+				if err != nil {
+					checks = append(checks, failed(corootv1.DependencyStatus{Name: "clickhouse", Address: address, Message: err.Error()}))
+					continue
+				}
+				checks = append(checks, func(ctx context.Context) corootv1.DependencyStatus {
+					return checkClickhouse(ctx, address, ec.User, password, ec.Database, tlsConfig)
+				})
+			}
+		}
+		if p := cr.Spec.Postgres; p != nil {
+			password, err := r.secretValue(ctx, cr, p.Password, p.PasswordSecret)
+			inputs = append(inputs, p, password, fmt.Sprint(err))
+			if err != nil {
+				checks = append(checks, failed(corootv1.DependencyStatus{Name: "postgres", Address: postgresAddress(*p), Message: err.Error()}))
+			} else {
+				spec := *p
+				checks = append(checks, func(ctx context.Context) corootv1.DependencyStatus { return checkPostgres(ctx, spec, password) })
+			}
+		}
+	}
+
+	var deps []corootv1.DependencyStatus
+	if len(checks) > 0 {
+		var ok bool
+		deps, ok = runBackgroundCheck(r, cr, "dependencies", backgroundCheckInput(inputs...), ExternalClickhouseCheckInterval, func(ctx context.Context) []corootv1.DependencyStatus {
+			var res []corootv1.DependencyStatus
+			for _, check := range checks {
+				res = append(res, check(ctx))
+			}
+			return res
+		})
+		if !ok {
+			// The dependencies are being checked, the previous results are kept until then.
+			if meta.FindStatusCondition(cr.Status.Conditions, ConditionTypeDependenciesReady) == nil {
+				meta.SetStatusCondition(&cr.Status.Conditions, metav1.Condition{
+					Type:               ConditionTypeDependenciesReady,
+					Status:             metav1.ConditionUnknown,
+					Reason:             "Checking",
+					ObservedGeneration: cr.Generation,
+				})
+			}
+			return
+		}
+	}
+	if ec := cr.Spec.ExternalClickhouse; ec != nil && cr.Spec.AgentsOnly == nil {
+		var healthy []string
+		for _, d := range deps {
+			if d.Name == "clickhouse" && d.Reachable && d.Authenticated {
+				healthy = append(healthy, d.Address)
+			}
+		}
+		r.setExternalClickhouseAddress(cr, healthy, time.Now())
+	}
+	cr.Status.Dependencies = deps
+
+	condition := metav1.Condition{
+		Type:               ConditionTypeDependenciesReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Ready",
+		ObservedGeneration: cr.Generation,
+	}
+	var failures []string
+	for _, d := range deps {
+		if !d.Reachable || !d.Authenticated {
+			failures = append(failures, fmt.Sprintf("%s: %s", d.Name, d.Message))
+		}
+	}
+	if len(failures) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "CheckFailed"
+		condition.Message = strings.Join(failures, "; ")
+	}
+	meta.SetStatusCondition(&cr.Status.Conditions, condition)
+}
+
+// checkStorage validates the PVCs that don't exist yet against the StorageClasses and the ResourceQuotas of the namespace
+// and publishes the result into the status. Otherwise, such PVCs silently stay Pending or are rejected one by one.
+func (r *CorootReconciler) checkStorage(ctx context.Context, cr *corootv1.Coroot) error {
+	pvcs := r.corootPVCs(cr)
+	switch {
+	case victoriaMetricsEnabled(cr):
+		if cr.Spec.VictoriaMetrics.URL == "" && pvcStorage(cr.Spec.VictoriaMetrics.Storage) {
+			pvcs = append(pvcs, r.victoriaMetricsPVC(cr))
+		}
+	case pvcStorage(cr.Spec.Prometheus.Storage):
+		for replica := 0; replica < prometheusReplicas(cr); replica++ {
+			pvcs = append(pvcs, r.prometheusPVC(cr, replica))
+		}
+	}
+	if cr.Spec.ExternalClickhouse == nil {
+		pvcs = append(pvcs, r.clickhouseKeeperPVCs(cr)...)
+		pvcs = append(pvcs, r.clickhousePVCs(cr)...)
+	}
+	var pending []*corev1.PersistentVolumeClaim
+	for _, pvc := range pvcs {
+		err := r.Get(ctx, client.ObjectKeyFromObject(pvc), &corev1.PersistentVolumeClaim{})
+		switch {
+		case errors.IsNotFound(err):
+			pending = append(pending, pvc)
+		case err != nil:
+			return err
+		}
+	}
+
+	var problems []string
+	if len(pending) > 0 {
+		// StorageClasses are cluster-scoped, so they can't be checked in the namespace-scoped mode.
+		var classes *storagev1.StorageClassList
+		if len(r.watchNamespaces) == 0 {
+			classes = &storagev1.StorageClassList{}
+			if err := r.apiReader.List(ctx, classes); err != nil {
+				if !errors.IsForbidden(err) {
+					return err
+				}
+				classes = nil
+			}
+		}
+		quotas := &corev1.ResourceQuotaList{}
+		if err := r.apiReader.List(ctx, quotas, client.InNamespace(cr.Namespace)); err != nil && !errors.IsForbidden(err) {
+			return err
+		}
+		problems = storageProblems(pending, classes, quotas.Items)
+	}
+
+	condition := metav1.Condition{
+		Type:               ConditionTypeStorageReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Ready",
+		ObservedGeneration: cr.Generation,
+	}
+	if len(problems) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Misconfigured"
+		condition.Message = strings.Join(problems, "; ")
+	}
+	meta.SetStatusCondition(&cr.Status.Conditions, condition)
+	if len(problems) > 0 {
+		return fmt.Errorf("storage misconfigured: %s", condition.Message)
+	}
+	return nil
+}
+
+// storageProblems returns the PVCs referring to missing StorageClasses or exceeding the quotas.
+// PVCs without a storage class use the default one, if there is any.
+// If the StorageClasses are unknown (nil), only the quotas not specific to a storage class are checked for such PVCs.
+func storageProblems(pvcs []*corev1.PersistentVolumeClaim, classes *storagev1.StorageClassList, quotas []corev1.ResourceQuota) []string {
+	var problems []string
+	exists := map[string]bool{}
+	defaultClass := ""
+	if classes != nil {
+		for _, c := range classes.Items {
+			exists[c.Name] = true
+			if c.Annotations[defaultStorageClassAnnotation] == "true" {
+				defaultClass = c.Name
+			}
+		}
+		for _, pvc := range pvcs {
+			if className := pvc.Spec.StorageClassName; className != nil && *className != "" && !exists[*className] {
+				problems = append(problems, fmt.Sprintf("%s: StorageClass %q not found", pvc.Name, *className))
+			}
+		}
+	}
+	for _, q := range quotas {
+		requested := corev1.ResourceList{}
+		for _, pvc := range pvcs {
+			className := defaultClass
+			if pvc.Spec.StorageClassName != nil {
+				className = *pvc.Spec.StorageClassName
+			}
+			size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+			add := corev1.ResourceList{
+				corev1.ResourceRequestsStorage:        size,
+				corev1.ResourcePersistentVolumeClaims: resource.MustParse("1"),
+			}
+			if className != "" {
+				add[corev1.ResourceName(className+".storageclass.storage.k8s.io/requests.storage")] = size
+				add[corev1.ResourceName(className+".storageclass.storage.k8s.io/persistentvolumeclaims")] = resource.MustParse("1")
+			}
+			for name, v := range add {
+				hard, ok := q.Spec.Hard[name]
+				if !ok {
+					continue
+				}
+				total := requested[name]
+				total.Add(v)
+				requested[name] = total
+				used := q.Status.Used[name]
+				used.Add(total)
+				if used.Cmp(hard) > 0 {
+					problems = append(problems, fmt.Sprintf("%s: exceeds %s of ResourceQuota %s (%s with the new PVCs, %s hard)",
+						pvc.Name, name, q.Name, used.String(), hard.String()))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func (r *CorootReconciler) secretValue(ctx context.Context, cr *corootv1.Coroot, value string, selector *corev1.SecretKeySelector) (string, error) {
+	return r.namespacedSecretValue(ctx, cr.Namespace, value, selector)
+}
+
+func (r *CorootReconciler) namespacedSecretValue(ctx context.Context, namespace, value string, selector *corev1.SecretKeySelector) (string, error) {
+	if selector == nil {
+		return value, nil
+	}
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: selector.Name}, secret); err != nil {
+		return "", fmt.Errorf("failed to get secret %s: %w", selector.Name, err)
+	}
+	data, ok := secret.Data[selector.Key]
+	if !ok {
+		return "", fmt.Errorf("key %s not found in secret %s", selector.Key, selector.Name)
+	}
+	return string(data), nil
+}
+
+// missingSecrets returns the secrets referenced by the Coroot pods that don't exist yet, e.g., haven't been produced by an ExternalSecret.
+// The secrets synced by the Secrets Store CSI driver appear only once a pod mounts the SecretProviderClass, so they are not waited for.
+func (r *CorootReconciler) missingSecrets(ctx context.Context, cr *corootv1.Coroot) ([]string, error) {
+	if cr.Spec.SecretProviderClass != "" {
+		return nil, nil
+	}
+	selectors := []*corev1.SecretKeySelector{cr.Spec.AuthBootstrapAdminPasswordSecret}
+	if ee := cr.Spec.EnterpriseEdition; ee != nil {
+		selectors = append(selectors, ee.LicenseKeySecret)
+	}
+	if ec := cr.Spec.ExternalClickhouse; ec != nil {
+		selectors = append(selectors, ec.PasswordSecret, clickhouseCA(cr))
+	}
+	if p := cr.Spec.Postgres; p != nil {
+		selectors = append(selectors, p.PasswordSecret)
+	}
+	for _, ref := range corootConfigSecretRefs(cr) {
+		selectors = append(selectors, ref)
+	}
+	var missing []string
+	for _, s := range selectors {
+		if s == nil {
+			continue
+		}
+		err := r.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: s.Name}, &corev1.Secret{})
+		switch {
+		case errors.IsNotFound(err):
+			missing = append(missing, s.Name)
+		case err != nil:
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+func checkCoroot(ctx context.Context, client *http.Client, url string) corootv1.DependencyStatus {
+	res := corootv1.DependencyStatus{Name: "coroot", Address: url}
+	ctx, cancel := context.WithTimeout(ctx, PreflightTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(url, "/")+"/health", nil)
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	res.Reachable = true
+	if resp.StatusCode != http.StatusOK {
+		res.Message = resp.Status
+		return res
+	}
+	res.Authenticated = true
+	return res
+}
+
+func postgresAddress(p corootv1.PostgresSpec) string {
+	port := p.Port
+	if port == 0 {
+		port = 5432
+	}
+	return net.JoinHostPort(p.Host, fmt.Sprintf("%d", port))
+}
+
+func checkPostgres(ctx context.Context, p corootv1.PostgresSpec, password string) corootv1.DependencyStatus {
+	res := corootv1.DependencyStatus{Name: "postgres", Address: postgresAddress(p)}
+	ctx, cancel := context.WithTimeout(ctx, PreflightTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", res.Address)
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	_ = conn.Close()
+	res.Reachable = true
+
+	db, err := sql.Open("postgres", postgresConnectionString(p, password))
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	defer db.Close()
+	if err = db.QueryRowContext(ctx, "SHOW server_version").Scan(&res.Version); err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	res.Authenticated = true
+	return res
+}
+
+const (
+	clickhouseClientName       = "coroot-operator"
+	clickhouseProtocolRevision = 54213
+
+	clickhouseClientHello     = 0
+	clickhouseServerHello     = 0
+	clickhouseServerException = 2
+)
+
+// externalClickhouseAddresses returns the addresses of the external ClickHouse in the order of preference.
+func externalClickhouseAddresses(ec *corootv1.ExternalClickhouseSpec) []string {
+	addresses := slices.Clone(ec.Addresses)
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return addresses[i].Weight > addresses[j].Weight
+	})
+	var res []string
+	if ec.Address != "" {
+		res = append(res, ec.Address)
+	}
+	for _, a := range addresses {
+		res = append(res, a.Address)
+	}
+	return res
+}
+
+// externalClickhouseAddress returns the address of the external ClickHouse Coroot is pointed to:
+// the one selected by the last check, or the most preferred one if it hasn't been checked yet.
+func externalClickhouseAddress(cr *corootv1.Coroot) string {
+	addresses := externalClickhouseAddresses(cr.Spec.ExternalClickhouse)
+	if slices.Contains(addresses, cr.Status.ExternalClickhouseAddress) {
+		return cr.Status.ExternalClickhouseAddress
+	}
+	if len(addresses) > 0 {
+		return addresses[0]
+	}
+	return ""
+}
+
+// setExternalClickhouseAddress switches Coroot to the most preferred healthy address (in the order of preference)
+// if several addresses are configured. If none of them is healthy, Coroot keeps using the current one.
+// While the current address is healthy, failing back is held off for ExternalClickhouseFailbackDelay after the last switch.
+func (r *CorootReconciler) setExternalClickhouseAddress(cr *corootv1.Coroot, healthy []string, now time.Time) {
+	if len(cr.Spec.ExternalClickhouse.Addresses) == 0 {
+		cr.Status.ExternalClickhouseAddress = ""
+		cr.Status.ExternalClickhouseSwitchedAt = nil
+		return
+	}
+	checked := cr.Status.ExternalClickhouseAddress != ""
+	current := externalClickhouseAddress(cr)
+	cr.Status.ExternalClickhouseAddress = current
+	if len(healthy) == 0 || healthy[0] == current {
+		return
+	}
+	failback := slices.Contains(healthy, current)
+	if at := cr.Status.ExternalClickhouseSwitchedAt; failback && at != nil && now.Sub(at.Time) < ExternalClickhouseFailbackDelay {
+		return
+	}
+	if checked {
+		ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Info("switching to another ClickHouse address", "from", current, "to", healthy[0])
+	}
+	if checked && r.recorder != nil {
+		if failback {
+			r.recorder.Event(cr, corev1.EventTypeNormal, "ClickhouseFailback", fmt.Sprintf("ClickHouse at %s is available again, switched back from %s", healthy[0], current))
+		} else {
+			r.recorder.Event(cr, corev1.EventTypeWarning, "ClickhouseFailover", fmt.Sprintf("ClickHouse at %s is not available, switched to %s", current, healthy[0]))
+		}
+	}
+	cr.Status.ExternalClickhouseAddress = healthy[0]
+	cr.Status.ExternalClickhouseSwitchedAt = &metav1.Time{Time: now}
+}
+
+// clickhouseTLSConfig returns the TLS config used to connect to the external ClickHouse, or nil if TLS is disabled.
+func (r *CorootReconciler) clickhouseTLSConfig(ctx context.Context, cr *corootv1.Coroot, ec *corootv1.ExternalClickhouseSpec) (*tls.Config, error) {
+	if !ec.Secure {
+		return nil, nil
+	}
+	res := &tls.Config{InsecureSkipVerify: ec.InsecureSkipVerify}
+	if ec.CASecret != nil {
+		ca, err := r.secretValue(ctx, cr, "", ec.CASecret)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, fmt.Errorf("no PEM certificates found in secret %s", ec.CASecret.Name)
+		}
+		res.RootCAs = pool
+	}
+	return res, nil
+}
+
+// checkClickhouse performs the ClickHouse native protocol handshake, which is enough to verify the credentials
+// and to get the server version without pulling in a full-featured client.
+func checkClickhouse(ctx context.Context, address, user, password, database string, tlsConfig *tls.Config) corootv1.DependencyStatus {
+	res := corootv1.DependencyStatus{Name: "clickhouse", Address: address}
+	ctx, cancel := context.WithTimeout(ctx, PreflightTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	defer conn.Close()
+	res.Reachable = true
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			tlsConfig.ServerName = host
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			res.Message = fmt.Sprintf("TLS handshake failed: %s", err)
+			return res
+		}
+		conn = tlsConn
+	}
+
+	var hello []byte
+	hello = binary.AppendUvarint(hello, clickhouseClientHello)
+	hello = appendClickhouseString(hello, clickhouseClientName)
+	hello = binary.AppendUvarint(hello, 1)
+	hello = binary.AppendUvarint(hello, 0)
+	hello = binary.AppendUvarint(hello, clickhouseProtocolRevision)
+	hello = appendClickhouseString(hello, database)
+	hello = appendClickhouseString(hello, user)
+	hello = appendClickhouseString(hello, password)
+	if _, err = conn.Write(hello); err != nil {
+		res.Message = err.Error()
+		return res
+	}
+
+	rd := bufio.NewReader(conn)
+	packet, err := binary.ReadUvarint(rd)
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	switch packet {
+	case clickhouseServerHello:
+		if _, err = readClickhouseString(rd); err != nil {
+			res.Message = err.Error()
+			return res
+		}
+		major, err := binary.ReadUvarint(rd)
+		if err != nil {
+			res.Message = err.Error()
+			return res
+		}
+		minor, err := binary.ReadUvarint(rd)
+		if err != nil {
+			res.Message = err.Error()
+			return res
+		}
+		res.Version = fmt.Sprintf("%d.%d", major, minor)
+		res.Authenticated = true
+	case clickhouseServerException:
+		var code int32
+		if err = binary.Read(rd, binary.LittleEndian, &code); err != nil {
+			res.Message = err.Error()
+			return res
+		}
+		if _, err = readClickhouseString(rd); err != nil {
+			res.Message = err.Error()
+			return res
+		}
+		msg, err := readClickhouseString(rd)
+		if err != nil {
+			res.Message = err.Error()
+			return res
+		}
+		res.Message = fmt.Sprintf("code %d: %s", code, msg)
+	default:
+		res.Message = fmt.Sprintf("unexpected packet: %d", packet)
+	}
+	return res
+}
+
+func appendClickhouseString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readClickhouseString(rd *bufio.Reader) (string, error) {
+	l, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return "", err
+	}
+	if l > 1<<20 {
+		return "", fmt.Errorf("string is too long: %d", l)
+	}
+	buf := make([]byte, l)
+	if _, err = io.ReadFull(rd, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
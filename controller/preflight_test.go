@@ -0,0 +1,69 @@
+package controller
+
+import (
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	"testing"
+	"time"
+)
+
+func TestStorageProblems(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data-coroot-coroot-0"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: ptr.To("fast"),
+			Resources:        corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}},
+		},
+	}
+	quota := corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "storage"},
+		Spec:       corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{corev1.ResourceRequestsStorage: resource.MustParse("5Gi")}},
+	}
+	classes := &storagev1.StorageClassList{Items: []storagev1.StorageClass{{ObjectMeta: metav1.ObjectMeta{Name: "standard"}}}}
+	if problems := storageProblems([]*corev1.PersistentVolumeClaim{pvc}, classes, nil); len(problems) != 1 {
+		t.Errorf("expected the missing StorageClass to be reported, got %v", problems)
+	}
+	// The StorageClasses are unknown in the namespace-scoped mode, but the quotas are still checked.
+	if problems := storageProblems([]*corev1.PersistentVolumeClaim{pvc}, nil, nil); len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+	if problems := storageProblems([]*corev1.PersistentVolumeClaim{pvc}, nil, []corev1.ResourceQuota{quota}); len(problems) != 1 {
+		t.Errorf("expected the quota to be reported, got %v", problems)
+	}
+}
+
+func TestExternalClickhouseFailback(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.Spec.ExternalClickhouse = &corootv1.ExternalClickhouseSpec{
+		Addresses: []corootv1.ExternalClickhouseAddress{{Address: "primary:9000", Weight: 2}, {Address: "secondary:9000", Weight: 1}},
+	}
+	now := time.Now()
+	set := func(at time.Duration, healthy ...string) string {
+		r.setExternalClickhouseAddress(cr, healthy, now.Add(at))
+		return cr.Status.ExternalClickhouseAddress
+	}
+
+	if a := set(0, "primary:9000", "secondary:9000"); a != "primary:9000" {
+		t.Fatalf("expected the primary, got %s", a)
+	}
+	// Failing over isn't delayed.
+	if a := set(time.Minute, "secondary:9000"); a != "secondary:9000" {
+		t.Fatalf("expected the failover to the secondary, got %s", a)
+	}
+	// The flapping primary doesn't restart Coroot again until the failback delay passes.
+	if a := set(2*time.Minute, "primary:9000", "secondary:9000"); a != "secondary:9000" {
+		t.Errorf("expected the failback to be held off, got %s", a)
+	}
+	if a := set(time.Minute+ExternalClickhouseFailbackDelay, "primary:9000", "secondary:9000"); a != "primary:9000" {
+		t.Errorf("expected the failback to the primary, got %s", a)
+	}
+	// None of the addresses is healthy, the current one is kept.
+	if a := set(time.Hour); a != "primary:9000" {
+		t.Errorf("expected the current address to be kept, got %s", a)
+	}
+}
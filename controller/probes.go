@@ -0,0 +1,235 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	BlackboxExporterImage = "prom/blackbox-exporter:v0.25.0"
+
+	probeRegionLabel = "coroot.com/probe-region"
+)
+
+// The probes are scraped by the embedded Prometheus, so they aren't run with VictoriaMetrics.
+func probesEnabled(cr *corootv1.Coroot) bool {
+	return cr.Spec.Probes != nil && len(cr.Spec.Probes.Targets) > 0 && !victoriaMetricsEnabled(cr) && cr.Spec.AgentsOnly == nil
+}
+
+func probeRegions(cr *corootv1.Coroot) []corootv1.ProbeRegionSpec {
+	if len(cr.Spec.Probes.Regions) == 0 {
+		return []corootv1.ProbeRegionSpec{{Name: "default"}}
+	}
+	return cr.Spec.Probes.Regions
+}
+
+func probeLabels(cr *corootv1.Coroot, region string) map[string]string {
+	ls := Labels(cr, "blackbox-exporter")
+	ls[probeRegionLabel] = region
+	return ls
+}
+
+func blackboxExporterName(cr *corootv1.Coroot, region string) string {
+	return fmt.Sprintf("%s-blackbox-exporter-%s", cr.Name, region)
+}
+
+// probeScrapeConfigs returns a scrape config per target probing it from each of the regions.
+// The region label of a target selects the blackbox exporter it's probed through.
+func probeScrapeConfigs(cr *corootv1.Coroot) []any {
+	if !probesEnabled(cr) {
+		return nil
+	}
+	var res []any
+	for _, t := range cr.Spec.Probes.Targets {
+		var staticConfigs []any
+		for _, region := range probeRegions(cr) {
+			staticConfigs = append(staticConfigs, map[string]any{
+				"targets": []string{t.Target},
+				"labels":  map[string]string{"region": region.Name},
+			})
+		}
+		sc := map[string]any{
+			"job_name":       "probe-" + t.Name,
+			"metrics_path":   "/probe",
+			"params":         map[string]any{"module": []string{string(t.Protocol)}},
+			"static_configs": staticConfigs,
+			"relabel_configs": []any{
+				map[string]any{"source_labels": []string{"__address__"}, "target_label": "__param_target"},
+				map[string]any{"source_labels": []string{"__address__"}, "target_label": "instance"},
+				map[string]any{
+					"source_labels": []string{"region"},
+					"target_label":  "__address__",
+					"replacement":   fmt.Sprintf("%s-blackbox-exporter-$1.%s:9115", cr.Name, cr.Namespace),
+				},
+			},
+		}
+		if t.Interval.Duration > 0 {
+			sc["scrape_interval"] = t.Interval.Duration.String()
+		}
+		res = append(res, sc)
+	}
+	return res
+}
+
+func blackboxExporterConfig() string {
+	data, _ := yaml.Marshal(map[string]any{
+		"modules": map[string]any{
+			string(corootv1.ProbeProtocolHTTP): map[string]any{"prober": "http"},
+			string(corootv1.ProbeProtocolTCP):  map[string]any{"prober": "tcp"},
+			string(corootv1.ProbeProtocolICMP): map[string]any{"prober": "icmp"},
+		},
+	})
+	return string(data)
+}
+
+// CreateOrUpdateProbes applies a blackbox exporter per region and deletes the ones of the removed regions.
+func (r *CorootReconciler) CreateOrUpdateProbes(ctx context.Context, cr *corootv1.Coroot) []error {
+	var errs []error
+	keep := map[string]bool{}
+	if probesEnabled(cr) {
+		for _, region := range probeRegions(cr) {
+			keep[region.Name] = true
+			errs = append(errs, r.CreateOrUpdateDeployment(ctx, cr, r.blackboxExporterDeployment(cr, region)))
+			errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.blackboxExporterService(cr, region.Name)))
+		}
+	}
+	ls := client.MatchingLabels(Labels(cr, "blackbox-exporter"))
+	deployments := &appsv1.DeploymentList{}
+	if err := r.List(ctx, deployments, client.InNamespace(cr.Namespace), ls); err != nil {
+		return append(errs, fmt.Errorf("failed to list blackbox exporter Deployments: %w", err))
+	}
+	for i := range deployments.Items {
+		if d := &deployments.Items[i]; !keep[d.Labels[probeRegionLabel]] {
+			errs = append(errs, r.CreateOrUpdate(ctx, cr, d, true, nil))
+		}
+	}
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services, client.InNamespace(cr.Namespace), ls); err != nil {
+		return append(errs, fmt.Errorf("failed to list blackbox exporter Services: %w", err))
+	}
+	for i := range services.Items {
+		if s := &services.Items[i]; !keep[s.Labels[probeRegionLabel]] {
+			errs = append(errs, r.CreateOrUpdate(ctx, cr, s, true, nil))
+		}
+	}
+	return errs
+}
+
+func (r *CorootReconciler) blackboxExporterService(cr *corootv1.Coroot, region string) *corev1.Service {
+	ls := probeLabels(cr, region)
+	s := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      blackboxExporterName(cr, region),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+	}
+
+	s.Spec = corev1.ServiceSpec{
+		Selector: ls,
+		Type:     corev1.ServiceTypeClusterIP,
+		Ports: []corev1.ServicePort{
+			{
+				Name:       "http",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       9115,
+				TargetPort: intstr.FromString("http"),
+			},
+		},
+	}
+
+	return s
+}
+
+func (r *CorootReconciler) blackboxExporterDeployment(cr *corootv1.Coroot, region corootv1.ProbeRegionSpec) *appsv1.Deployment {
+	ls := probeLabels(cr, region.Name)
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      blackboxExporterName(cr, region.Name),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+	}
+
+	replicas := int32(1)
+	if hibernated(cr) {
+		replicas = 0
+	}
+
+	securityContext := podSecurityContext(nil)
+	for _, t := range cr.Spec.Probes.Targets {
+		if t.Protocol == corootv1.ProbeProtocolICMP {
+			// Allows the unprivileged ICMP sockets used by the exporter running as non-root.
+			securityContext = securityContext.DeepCopy()
+			securityContext.Sysctls = append(securityContext.Sysctls, corev1.Sysctl{Name: "net.ipv4.ping_group_range", Value: "0 2147483647"})
+			break
+		}
+	}
+
+	d.Spec = appsv1.DeploymentSpec{
+		Selector: &metav1.LabelSelector{
+			MatchLabels: ls,
+		},
+		Replicas: &replicas,
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: ls,
+			},
+			Spec: corev1.PodSpec{
+				SecurityContext: securityContext,
+				DNSPolicy:       cr.Spec.Probes.DNSPolicy,
+				DNSConfig:       cr.Spec.Probes.DNSConfig,
+				HostAliases:     cr.Spec.Probes.HostAliases,
+				NodeSelector:    mergeLabels(linuxNodeSelector, region.NodeSelector),
+				InitContainers: []corev1.Container{
+					{
+						Image:           UBIMinimalImage,
+						Name:            "config",
+						Command:         []string{"/bin/sh", "-c"},
+						Args:            []string{configCmd("/config/blackbox.yml", blackboxExporterConfig(), "", "")},
+						VolumeMounts:    []corev1.VolumeMount{{Name: "config", MountPath: "/config"}},
+						SecurityContext: containerSecurityContext(nil),
+					},
+				},
+				Containers: []corev1.Container{
+					{
+						Image: BlackboxExporterImage,
+						Name:  "blackbox-exporter",
+						Args: []string{
+							"--config.file=/config/blackbox.yml",
+							"--web.listen-address=:9115",
+						},
+						Ports: []corev1.ContainerPort{
+							{Name: "http", ContainerPort: 9115, Protocol: corev1.ProtocolTCP},
+						},
+						Resources:       cr.Spec.Probes.Resources,
+						SecurityContext: containerSecurityContext(nil),
+						VolumeMounts:    []corev1.VolumeMount{{Name: "config", MountPath: "/config"}},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{Path: "/-/healthy", Port: intstr.FromString("http")},
+							},
+						},
+					},
+				},
+				Volumes: []corev1.Volume{
+					{
+						Name: "config",
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return d
+}
@@ -1,19 +1,105 @@
 package controller
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
 	corootv1 "github.io/coroot/operator/api/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	PrometheusImage = "ghcr.io/coroot/prometheus:2.54.1-ubi9-0"
+	PrometheusImage               = "ghcr.io/coroot/prometheus:2.54.1-ubi9-0"
+	VMAgentImage                  = "victoriametrics/vmagent:v1.106.1"
+	PrometheusConfigReloaderImage = "quay.io/prometheus-operator/prometheus-config-reloader:v0.78.2"
+
+	// The port of vmagent relabeling the metrics written to the first replica.
+	prometheusRemoteWritePort = 8429
 )
 
+func prometheusReplicas(cr *corootv1.Coroot) int {
+	if cr.Spec.Prometheus.Replicas > 1 {
+		return cr.Spec.Prometheus.Replicas
+	}
+	return 1
+}
+
+// prometheusName returns the name of the objects of the replica. The first replica keeps the names used before
+// the replicas were introduced, so its Deployment and PVC are retained when the number of replicas is changed.
+func prometheusName(cr *corootv1.Coroot, replica int) string {
+	if replica == 0 {
+		return cr.Name + "-prometheus"
+	}
+	return fmt.Sprintf("%s-prometheus-%d", cr.Name, replica)
+}
+
+// prometheusPairSelector selects the pods of all the replicas, which have distinct component labels.
+func prometheusPairSelector(cr *corootv1.Coroot) *metav1.LabelSelector {
+	ls := Labels(cr, "prometheus")
+	var components []string
+	for replica := 0; replica < PrometheusMaxReplicas; replica++ {
+		components = append(components, prometheusLabels(cr, replica)["app.kubernetes.io/component"])
+	}
+	delete(ls, "app.kubernetes.io/component")
+	return &metav1.LabelSelector{
+		MatchLabels:      ls,
+		MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app.kubernetes.io/component", Operator: metav1.LabelSelectorOpIn, Values: components}},
+	}
+}
+
+// prometheusAffinity spreads the active and standby replicas across the nodes and zones, unless pod anti-affinity is configured.
+func prometheusAffinity(cr *corootv1.Coroot) *corev1.Affinity {
+	a := archAffinity(cr.Spec.Prometheus.Affinity, cr.Spec.Prometheus.Architectures)
+	if prometheusReplicas(cr) < 2 || (a != nil && a.PodAntiAffinity != nil) {
+		return a
+	}
+	res := &corev1.Affinity{}
+	if a != nil {
+		res = a.DeepCopy()
+	}
+	selector := prometheusPairSelector(cr)
+	res.PodAntiAffinity = &corev1.PodAntiAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+			{Weight: 100, PodAffinityTerm: corev1.PodAffinityTerm{LabelSelector: selector, TopologyKey: corev1.LabelHostname}},
+			{Weight: 50, PodAffinityTerm: corev1.PodAffinityTerm{LabelSelector: selector, TopologyKey: corev1.LabelTopologyZone}},
+		},
+	}
+	return res
+}
+
+// prometheusPDB keeps a voluntary disruption, e.g., a node drain, from evicting both replicas at once.
+func (r *CorootReconciler) prometheusPDB(cr *corootv1.Coroot) *policyv1.PodDisruptionBudget {
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-prometheus",
+			Namespace: cr.Namespace,
+			Labels:    Labels(cr, "prometheus"),
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MaxUnavailable: ptr.To(intstr.FromInt32(1)),
+			Selector:       prometheusPairSelector(cr),
+		},
+	}
+}
+
+func prometheusLabels(cr *corootv1.Coroot, replica int) map[string]string {
+	if replica == 0 {
+		return Labels(cr, "prometheus")
+	}
+	return Labels(cr, fmt.Sprintf("prometheus-%d", replica))
+}
+
+// prometheusService is queried by Coroot. With multiple replicas, it's served by promxy merging the data of the replicas.
 func (r *CorootReconciler) prometheusService(cr *corootv1.Coroot) *corev1.Service {
 	ls := Labels(cr, "prometheus")
 	s := &corev1.Service{
@@ -24,6 +110,40 @@ func (r *CorootReconciler) prometheusService(cr *corootv1.Coroot) *corev1.Servic
 		},
 	}
 
+	selector := ls
+	if prometheusReplicas(cr) > 1 {
+		selector = Labels(cr, "promxy")
+	}
+	s.Spec = corev1.ServiceSpec{
+		Selector: selector,
+		Type:     corev1.ServiceTypeClusterIP,
+		Ports: []corev1.ServicePort{
+			{
+				Name:       "http",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       9090,
+				TargetPort: intstr.FromString("http"),
+			},
+		},
+	}
+	if prometheusRemoteWriteRelabeling(cr) && prometheusReplicas(cr) == 1 {
+		s.Spec.Ports = append(s.Spec.Ports, prometheusRemoteWriteServicePort())
+	}
+
+	return s
+}
+
+// prometheusReplicaService addresses a single replica, e.g., to forward the metrics to it or to query it from promxy.
+func (r *CorootReconciler) prometheusReplicaService(cr *corootv1.Coroot, replica int) *corev1.Service {
+	ls := prometheusLabels(cr, replica)
+	s := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-prometheus-%d", cr.Name, replica),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+	}
+
 	s.Spec = corev1.ServiceSpec{
 		Selector: ls,
 		Type:     corev1.ServiceTypeClusterIP,
@@ -36,22 +156,54 @@ func (r *CorootReconciler) prometheusService(cr *corootv1.Coroot) *corev1.Servic
 			},
 		},
 	}
+	if prometheusRemoteWriteRelabeling(cr) && replica == 0 {
+		s.Spec.Ports = append(s.Spec.Ports, prometheusRemoteWriteServicePort())
+	}
 
 	return s
 }
 
-func (r *CorootReconciler) prometheusPVC(cr *corootv1.Coroot) *corev1.PersistentVolumeClaim {
+func prometheusRemoteWriteServicePort() corev1.ServicePort {
+	return corev1.ServicePort{
+		Name:       "remote-write",
+		Protocol:   corev1.ProtocolTCP,
+		Port:       prometheusRemoteWritePort,
+		TargetPort: intstr.FromString("remote-write"),
+	}
+}
+
+func prometheusReplicaURL(cr *corootv1.Coroot, replica int) string {
+	return fmt.Sprintf("http://%s-prometheus-%d.%s:9090", cr.Name, replica, cr.Namespace)
+}
+
+// prometheusRemoteWriteRelabeling reports whether the metrics written to Prometheus go through vmagent,
+// since Prometheus doesn't relabel the samples it receives through remote write.
+func prometheusRemoteWriteRelabeling(cr *corootv1.Coroot) bool {
+	return strings.TrimSpace(cr.Spec.Prometheus.MetricRelabelConfigs) != ""
+}
+
+// prometheusRemoteWriteURL returns the vmagent URL the metrics are written to, so the relabeling applies to them.
+func prometheusRemoteWriteURL(cr *corootv1.Coroot) string {
+	host := fmt.Sprintf("%s-prometheus.%s", cr.Name, cr.Namespace)
+	if prometheusReplicas(cr) > 1 {
+		host = fmt.Sprintf("%s-prometheus-0.%s", cr.Name, cr.Namespace)
+	}
+	return fmt.Sprintf("http://%s:%d/api/v1/write", host, prometheusRemoteWritePort)
+}
+
+func (r *CorootReconciler) prometheusPVC(cr *corootv1.Coroot, replica int) *corev1.PersistentVolumeClaim {
 	pvc := &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "data-" + cr.Name + "-prometheus",
-			Namespace: cr.Namespace,
-			Labels:    Labels(cr, "prometheus"),
+			Name:        "data-" + prometheusName(cr, replica),
+			Namespace:   cr.Namespace,
+			Labels:      mergeLabels(prometheusLabels(cr, replica), cr.Spec.Prometheus.Storage.Labels),
+			Annotations: cr.Spec.Prometheus.Storage.Annotations,
 		},
 	}
 
 	size := cr.Spec.Prometheus.Storage.Size
 	if size.IsZero() {
-		size, _ = resource.ParseQuantity("10Gi")
+		size, _ = resource.ParseQuantity(DefaultStorageSize)
 	}
 	pvc.Spec = corev1.PersistentVolumeClaimSpec{
 		AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
@@ -61,59 +213,353 @@ func (r *CorootReconciler) prometheusPVC(cr *corootv1.Coroot) *corev1.Persistent
 			},
 		},
 		StorageClassName: cr.Spec.Prometheus.Storage.ClassName,
+		DataSourceRef:    cr.Spec.Prometheus.Storage.DataSourceRef,
+		Selector:         cr.Spec.Prometheus.Storage.Selector,
 	}
 
 	return pvc
 }
 
-func (r *CorootReconciler) prometheusDeployment(cr *corootv1.Coroot) *appsv1.Deployment {
-	ls := Labels(cr, "prometheus")
+const (
+	prometheusRulesFile          = "rules.yml"
+	prometheusRelabelFile        = "relabel.yml"
+	prometheusRulesConfigMapPath = "/etc/prometheus/rules"
+)
+
+// prometheusConfig returns the config of the replica, or an empty string if there are no custom scrape configs, rules,
+// and other replicas, and the config shipped with the image is used.
+// With multiple replicas, each one has a distinct external label. The first replica scrapes the targets, evaluates the rules,
+// and forwards all the metrics to the others without its external label, so the replicas hold the same series.
+func prometheusConfig(cr *corootv1.Coroot, replica int) (string, error) {
+	p := cr.Spec.Prometheus
+	replicas := prometheusReplicas(cr)
+	if strings.TrimSpace(p.ScrapeConfigs) == "" && strings.TrimSpace(p.RecordingRules) == "" && p.RecordingRulesConfigMap == nil && replicas == 1 && !probesEnabled(cr) &&
+		!prometheusRemoteWriteRelabeling(cr) {
+		return "", nil
+	}
+	var scrapeConfigs []any
+	if err := yaml.Unmarshal([]byte(p.ScrapeConfigs), &scrapeConfigs); err != nil {
+		return "", fmt.Errorf("invalid prometheus.scrapeConfigs: %w", err)
+	}
+	var relabelConfigs []any
+	if err := yaml.Unmarshal([]byte(p.MetricRelabelConfigs), &relabelConfigs); err != nil {
+		return "", fmt.Errorf("invalid prometheus.metricRelabelConfigs: %w", err)
+	}
+	if len(relabelConfigs) > 0 {
+		for _, sc := range scrapeConfigs {
+			c, ok := sc.(map[string]any)
+			if !ok {
+				return "", fmt.Errorf("invalid prometheus.scrapeConfigs: a scrape config must be an object")
+			}
+			existing, _ := c["metric_relabel_configs"].([]any)
+			c["metric_relabel_configs"] = append(existing, relabelConfigs...)
+		}
+	}
+	scrapeConfigs = append(scrapeConfigs, probeScrapeConfigs(cr)...)
+	rules, err := prometheusRules(cr)
+	if err != nil {
+		return "", err
+	}
+	interval := cr.Spec.MetricsRefreshInterval.Duration.String()
+	if cr.Spec.MetricsRefreshInterval.Duration == 0 {
+		interval = corootv1.DefaultMetricRefreshInterval
+	}
+	global := map[string]any{"scrape_interval": interval}
+	config := map[string]any{"global": global}
+	if replicas > 1 {
+		global["external_labels"] = map[string]string{"prometheus_replica": strconv.Itoa(replica)}
+	}
+	if replica == 0 {
+		if len(scrapeConfigs) > 0 {
+			config["scrape_configs"] = scrapeConfigs
+		}
+		var ruleFiles []string
+		if rules != "" {
+			ruleFiles = append(ruleFiles, "/etc/prometheus/custom/"+prometheusRulesFile)
+		}
+		if cm := p.RecordingRulesConfigMap; cm != nil {
+			ruleFiles = append(ruleFiles, prometheusRulesConfigMapPath+"/"+cm.Key)
+		}
+		if len(ruleFiles) > 0 {
+			config["rule_files"] = ruleFiles
+		}
+		var remoteWrite []any
+		for i := 1; i < replicas; i++ {
+			remoteWrite = append(remoteWrite, map[string]any{
+				"url": prometheusReplicaURL(cr, i) + "/api/v1/write",
+				"write_relabel_configs": []any{
+					map[string]any{"action": "labeldrop", "regex": "prometheus_replica"},
+				},
+			})
+		}
+		if len(remoteWrite) > 0 {
+			config["remote_write"] = remoteWrite
+		}
+	}
+	data, err := yaml.Marshal(config)
+	return string(data), err
+}
+
+// prometheusRules returns the rule file with the inline recording rules, or an empty string if there are none.
+func prometheusRules(cr *corootv1.Coroot) (string, error) {
+	if strings.TrimSpace(cr.Spec.Prometheus.RecordingRules) == "" {
+		return "", nil
+	}
+	var groups []any
+	if err := yaml.Unmarshal([]byte(cr.Spec.Prometheus.RecordingRules), &groups); err != nil {
+		return "", fmt.Errorf("invalid prometheus.recordingRules: %w", err)
+	}
+	data, err := yaml.Marshal(map[string]any{"groups": groups})
+	return string(data), err
+}
+
+// prometheusRelabelConfig returns the relabeling rules vmagent applies to the written metrics, or an empty string if there are none.
+func prometheusRelabelConfig(cr *corootv1.Coroot) (string, error) {
+	if !prometheusRemoteWriteRelabeling(cr) {
+		return "", nil
+	}
+	var relabelConfigs []any
+	if err := yaml.Unmarshal([]byte(cr.Spec.Prometheus.MetricRelabelConfigs), &relabelConfigs); err != nil {
+		return "", fmt.Errorf("invalid prometheus.metricRelabelConfigs: %w", err)
+	}
+	data, err := yaml.Marshal(relabelConfigs)
+	return string(data), err
+}
+
+func prometheusConfigFile(replica int) string {
+	if replica == 0 {
+		return "prometheus.yml"
+	}
+	return fmt.Sprintf("prometheus-%d.yml", replica)
+}
+
+// prometheusConfigs returns the configs of the replicas by the file names, or nil if the image's config is used.
+func prometheusConfigs(cr *corootv1.Coroot) (map[string][]byte, error) {
+	res := map[string][]byte{}
+	for replica := 0; replica < prometheusReplicas(cr); replica++ {
+		config, err := prometheusConfig(cr, replica)
+		if err != nil {
+			return nil, err
+		}
+		if config != "" {
+			res[prometheusConfigFile(replica)] = []byte(config)
+		}
+	}
+	rules, err := prometheusRules(cr)
+	if err != nil {
+		return nil, err
+	}
+	if rules != "" {
+		res[prometheusRulesFile] = []byte(rules)
+	}
+	relabel, err := prometheusRelabelConfig(cr)
+	if err != nil {
+		return nil, err
+	}
+	if relabel != "" {
+		res[prometheusRelabelFile] = []byte(relabel)
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return res, nil
+}
+
+func (r *CorootReconciler) prometheusConfigSecret(cr *corootv1.Coroot, configs map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-prometheus-config",
+			Namespace: cr.Namespace,
+			Labels:    Labels(cr, "prometheus"),
+		},
+		Data: configs,
+	}
+}
+
+// CreateOrUpdatePrometheus applies the Prometheus replicas, or deletes them if another metrics engine is used.
+// The PVCs of the removed replicas are retained.
+func (r *CorootReconciler) CreateOrUpdatePrometheus(ctx context.Context, cr *corootv1.Coroot, delete bool) []error {
+	var errs []error
+	errs = append(errs, r.CreateOrUpdatePrometheusConfig(ctx, cr, delete))
+	replicas := prometheusReplicas(cr)
+	if delete {
+		replicas = 0
+	}
+	for replica := 0; replica < replicas; replica++ {
+		if pvcStorage(cr.Spec.Prometheus.Storage) {
+			errs = append(errs, r.CreateOrUpdatePVC(ctx, cr, r.prometheusPVC(cr, replica), cr.Spec.Prometheus.Storage.ClassChangePolicy))
+		}
+		errs = append(errs, r.CreateOrUpdateDeployment(ctx, cr, r.prometheusDeployment(cr, replica)))
+	}
+	for replica := replicas; replica < PrometheusMaxReplicas; replica++ {
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.prometheusDeployment(cr, replica), true, nil))
+	}
+	for replica := 0; replica < PrometheusMaxReplicas; replica++ {
+		if replicas > 1 && replica < replicas {
+			errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.prometheusReplicaService(cr, replica)))
+		} else {
+			errs = append(errs, r.CreateOrUpdate(ctx, cr, r.prometheusReplicaService(cr, replica), true, nil))
+		}
+	}
+	if replicas > 1 {
+		errs = append(errs, r.CreateOrUpdateDeployment(ctx, cr, r.promxyDeployment(cr)))
+		errs = append(errs, r.CreateOrUpdatePDB(ctx, cr, r.prometheusPDB(cr)))
+	} else {
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.promxyDeployment(cr), true, nil))
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.prometheusPDB(cr), true, nil))
+	}
+	if delete {
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.prometheusService(cr), true, nil))
+	} else {
+		errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.prometheusService(cr)))
+	}
+	return errs
+}
+
+// CreateOrUpdatePrometheusConfig stores the config in a Secret, since scrape configs may contain credentials.
+func (r *CorootReconciler) CreateOrUpdatePrometheusConfig(ctx context.Context, cr *corootv1.Coroot, delete bool) error {
+	configs, err := prometheusConfigs(cr)
+	if err != nil && !delete {
+		return err
+	}
+	s := r.prometheusConfigSecret(cr, configs)
+	labels, data := s.Labels, s.Data
+	return r.CreateOrUpdate(ctx, cr, s, delete || configs == nil, func() error {
+		s.Labels = labels
+		s.Data = data
+		return nil
+	})
+}
+
+func (r *CorootReconciler) prometheusDeployment(cr *corootv1.Coroot, replica int) *appsv1.Deployment {
+	ls := prometheusLabels(cr, replica)
 	d := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      cr.Name + "-prometheus",
+			Name:      prometheusName(cr, replica),
 			Namespace: cr.Namespace,
-			Labels:    ls,
+			Labels:    mergeLabels(ls, cr.Spec.Prometheus.Labels),
 		},
 	}
 
+	// The default is passed as it always has been, so setting it explicitly doesn't restart Prometheus.
+	retention := fmt.Sprintf("%dd", int64(DefaultMetricsRetention/(24*time.Hour)))
+	if r := cr.Spec.Prometheus.Retention.Duration; r > 0 && r != DefaultMetricsRetention {
+		retention = fmt.Sprintf("%ds", int64(r.Seconds()))
+	}
+
+	replicas := int32(1)
+	if hibernated(cr) {
+		replicas = 0
+	}
+
+	configFile := "/etc/prometheus/prometheus.yml"
+	annotations := cr.Spec.Prometheus.PodAnnotations
+	volumes := []corev1.Volume{
+		{
+			Name: "config",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+		{
+			Name: "tmp",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+		{
+			Name: "data",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: "data-" + prometheusName(cr, replica),
+				},
+			},
+		},
+	}
+	mounts := []corev1.VolumeMount{
+		{Name: "config", MountPath: "/config"},
+		{Name: "tmp", MountPath: "/tmp"},
+		{Name: "data", MountPath: "/data"},
+	}
+	// An invalid config is reported by CreateOrUpdatePrometheusConfig, Prometheus keeps the image's one meanwhile.
+	if config, _ := prometheusConfig(cr, replica); config != "" {
+		configFile = "/etc/prometheus/custom/" + prometheusConfigFile(replica)
+		// Prometheus is restarted to pick up the changes.
+		if replica == 0 {
+			rules, _ := prometheusRules(cr)
+			relabel, _ := prometheusRelabelConfig(cr)
+			config += rules + relabel
+		}
+		annotations = map[string]string{"coroot.com/config-checksum": fmt.Sprintf("%x", sha256.Sum256([]byte(config)))}
+		for k, v := range cr.Spec.Prometheus.PodAnnotations {
+			annotations[k] = v
+		}
+		volumes = append(volumes, corev1.Volume{
+			Name: "custom-config",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: cr.Name + "-prometheus-config"},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: "custom-config", MountPath: "/etc/prometheus/custom", ReadOnly: true})
+	}
+	if cm := cr.Spec.Prometheus.RecordingRulesConfigMap; cm != nil && replica == 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name: "rules",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: cm.LocalObjectReference,
+					Items:                []corev1.KeyToPath{{Key: cm.Key, Path: cm.Key}},
+					Optional:             cm.Optional,
+				},
+			},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: "rules", MountPath: prometheusRulesConfigMapPath, ReadOnly: true})
+	}
+
 	d.Spec = appsv1.DeploymentSpec{
 		Selector: &metav1.LabelSelector{
 			MatchLabels: ls,
 		},
+		Replicas: &replicas,
 		Strategy: appsv1.DeploymentStrategy{
 			Type: appsv1.RecreateDeploymentStrategyType,
 		},
 		Template: corev1.PodTemplateSpec{
 			ObjectMeta: metav1.ObjectMeta{
-				Labels:      ls,
-				Annotations: cr.Spec.Prometheus.PodAnnotations,
+				Labels:      mergeLabels(ls, cr.Spec.Prometheus.PodLabels),
+				Annotations: podAnnotations(cr, annotations, false),
 			},
 			Spec: corev1.PodSpec{
-				ServiceAccountName: cr.Name + "-prometheus",
-				SecurityContext:    nonRootSecurityContext,
-				Affinity:           cr.Spec.Prometheus.Affinity,
+				ServiceAccountName: serviceAccountName(cr, "prometheus"),
+				DNSPolicy:          cr.Spec.Prometheus.DNSPolicy,
+				DNSConfig:          cr.Spec.Prometheus.DNSConfig,
+				HostAliases:        cr.Spec.Prometheus.HostAliases,
+				SecurityContext:    podSecurityContext(cr.Spec.Prometheus.PodSecurityContext),
+				Affinity:           prometheusAffinity(cr),
 				Tolerations:        cr.Spec.Prometheus.Tolerations,
+				NodeSelector:       linuxNodeSelector,
+				PriorityClassName:  cr.Spec.Prometheus.PriorityClassName,
+				SchedulerName:      cr.Spec.Prometheus.SchedulerName,
+				RuntimeClassName:   cr.Spec.Prometheus.RuntimeClassName,
 				Containers: []corev1.Container{
 					{
 						Image:   PrometheusImage,
 						Name:    "prometheus",
 						Command: []string{"prometheus"},
 						Args: []string{
-							"--config.file=/etc/prometheus/prometheus.yml",
+							"--config.file=" + configFile,
 							"--web.listen-address=0.0.0.0:9090",
 							"--storage.tsdb.path=/data",
-							"--storage.tsdb.retention.time=2d",
+							"--storage.tsdb.retention.time=" + retention,
 							"--web.enable-remote-write-receiver",
 							"--query.max-samples=100000000",
 						},
 						Ports: []corev1.ContainerPort{
 							{Name: "http", ContainerPort: 9090, Protocol: corev1.ProtocolTCP},
 						},
-						Resources: cr.Spec.Prometheus.Resources,
-						VolumeMounts: []corev1.VolumeMount{
-							{Name: "config", MountPath: "/config"},
-							{Name: "data", MountPath: "/data"},
-						},
+						Resources:       cr.Spec.Prometheus.Resources,
+						SecurityContext: containerSecurityContext(cr.Spec.Prometheus.SecurityContext),
+						VolumeMounts:    mounts,
 						ReadinessProbe: &corev1.Probe{
 							ProbeHandler: corev1.ProbeHandler{
 								HTTPGet: &corev1.HTTPGetAction{Path: "/-/healthy", Port: intstr.FromString("http")},
@@ -122,25 +568,68 @@ func (r *CorootReconciler) prometheusDeployment(cr *corootv1.Coroot) *appsv1.Dep
 						},
 					},
 				},
-				Volumes: []corev1.Volume{
-					{
-						Name: "config",
-						VolumeSource: corev1.VolumeSource{
-							EmptyDir: &corev1.EmptyDirVolumeSource{},
-						},
-					},
-					{
-						Name: "data",
-						VolumeSource: corev1.VolumeSource{
-							PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-								ClaimName: "data-" + cr.Name + "-prometheus",
-							},
-						},
-					},
-				},
+				Volumes: volumes,
 			},
 		},
 	}
+	if replica == 0 {
+		d.Spec.Template.Spec.Containers = append(d.Spec.Template.Spec.Containers, prometheusSidecars(cr)...)
+		if cr.Spec.Prometheus.RecordingRulesConfigMap != nil {
+			c := &d.Spec.Template.Spec.Containers[0]
+			c.Args = append(c.Args, "--web.enable-lifecycle")
+		}
+	}
+	applyPodStorage(cr.Spec.Prometheus.Storage, &d.Spec.Template.Spec, false)
+	applyContainerOverrides(&d.Spec.Template.Spec.Containers[0], cr.Spec.Prometheus.ExtraArgs, cr.Spec.Prometheus.Lifecycle)
 
 	return d
 }
+
+// prometheusSidecars returns the containers running next to the first replica:
+// vmagent applying the relabeling rules to the written metrics before passing them to Prometheus,
+// and the reloader making Prometheus pick up the changes of the rules ConfigMap once the kubelet updates the mounted file.
+func prometheusSidecars(cr *corootv1.Coroot) []corev1.Container {
+	var res []corev1.Container
+	if prometheusRemoteWriteRelabeling(cr) {
+		res = append(res, corev1.Container{
+			Image: VMAgentImage,
+			Name:  "vmagent",
+			Args: []string{
+				fmt.Sprintf("-httpListenAddr=:%d", prometheusRemoteWritePort),
+				"-remoteWrite.url=http://127.0.0.1:9090/api/v1/write",
+				"-remoteWrite.relabelConfig=/etc/prometheus/custom/" + prometheusRelabelFile,
+				"-remoteWrite.tmpDataPath=/tmp/vmagent",
+			},
+			Ports: []corev1.ContainerPort{
+				{Name: "remote-write", ContainerPort: prometheusRemoteWritePort, Protocol: corev1.ProtocolTCP},
+			},
+			SecurityContext: containerSecurityContext(cr.Spec.Prometheus.SecurityContext),
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "custom-config", MountPath: "/etc/prometheus/custom", ReadOnly: true},
+				{Name: "tmp", MountPath: "/tmp"},
+			},
+			ReadinessProbe: &corev1.Probe{
+				ProbeHandler: corev1.ProbeHandler{
+					HTTPGet: &corev1.HTTPGetAction{Path: "/health", Port: intstr.FromString("remote-write")},
+				},
+				TimeoutSeconds: 10,
+			},
+		})
+	}
+	if cr.Spec.Prometheus.RecordingRulesConfigMap != nil {
+		res = append(res, corev1.Container{
+			Image: PrometheusConfigReloaderImage,
+			Name:  "rules-reloader",
+			Args: []string{
+				"--listen-address=:8081",
+				"--watched-dir=" + prometheusRulesConfigMapPath,
+				"--reload-url=http://127.0.0.1:9090/-/reload",
+			},
+			SecurityContext: containerSecurityContext(cr.Spec.Prometheus.SecurityContext),
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "rules", MountPath: prometheusRulesConfigMapPath, ReadOnly: true},
+			},
+		})
+	}
+	return res
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	PromxyImage = "quay.io/jacksontj/promxy:v0.0.92"
+
+	// Prometheus replicas are validated to not exceed this number, the objects of the replicas beyond the configured number are removed.
+	PrometheusMaxReplicas = 2
+)
+
+// promxyConfig puts all the Prometheus replicas into a single server group,
+// so promxy treats them as replicas of each other and merges their data filling the gaps.
+func promxyConfig(cr *corootv1.Coroot) string {
+	var targets []string
+	for replica := 0; replica < prometheusReplicas(cr); replica++ {
+		targets = append(targets, fmt.Sprintf("%s-prometheus-%d.%s:9090", cr.Name, replica, cr.Namespace))
+	}
+	data, _ := yaml.Marshal(map[string]any{
+		"promxy": map[string]any{
+			"server_groups": []any{
+				map[string]any{
+					"static_configs": []any{map[string]any{"targets": targets}},
+					"anti_affinity":  "10s",
+				},
+			},
+		},
+	})
+	return string(data)
+}
+
+func (r *CorootReconciler) promxyDeployment(cr *corootv1.Coroot) *appsv1.Deployment {
+	ls := Labels(cr, "promxy")
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-promxy",
+			Namespace: cr.Namespace,
+			Labels:    mergeLabels(ls, cr.Spec.Prometheus.Labels),
+		},
+	}
+
+	replicas := int32(1)
+	if hibernated(cr) {
+		replicas = 0
+	}
+
+	d.Spec = appsv1.DeploymentSpec{
+		Selector: &metav1.LabelSelector{
+			MatchLabels: ls,
+		},
+		Replicas: &replicas,
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:      mergeLabels(ls, cr.Spec.Prometheus.PodLabels),
+				Annotations: podAnnotations(cr, cr.Spec.Prometheus.PodAnnotations, false),
+			},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: serviceAccountName(cr, "prometheus"),
+				DNSPolicy:          cr.Spec.Prometheus.DNSPolicy,
+				DNSConfig:          cr.Spec.Prometheus.DNSConfig,
+				HostAliases:        cr.Spec.Prometheus.HostAliases,
+				SecurityContext:    podSecurityContext(cr.Spec.Prometheus.PodSecurityContext),
+				Affinity:           archAffinity(cr.Spec.Prometheus.Affinity, cr.Spec.Prometheus.Architectures),
+				Tolerations:        cr.Spec.Prometheus.Tolerations,
+				NodeSelector:       linuxNodeSelector,
+				PriorityClassName:  cr.Spec.Prometheus.PriorityClassName,
+				SchedulerName:      cr.Spec.Prometheus.SchedulerName,
+				RuntimeClassName:   cr.Spec.Prometheus.RuntimeClassName,
+				InitContainers: []corev1.Container{
+					{
+						Image:           UBIMinimalImage,
+						Name:            "config",
+						Command:         []string{"/bin/sh", "-c"},
+						Args:            []string{configCmd("/config/config.yaml", promxyConfig(cr), "", "")},
+						VolumeMounts:    []corev1.VolumeMount{{Name: "config", MountPath: "/config"}},
+						SecurityContext: containerSecurityContext(cr.Spec.Prometheus.SecurityContext),
+					},
+				},
+				Containers: []corev1.Container{
+					{
+						Image:   PromxyImage,
+						Name:    "promxy",
+						Command: []string{"/bin/promxy"},
+						Args: []string{
+							"--config=/config/config.yaml",
+							"--bind-addr=:9090",
+						},
+						Ports: []corev1.ContainerPort{
+							{Name: "http", ContainerPort: 9090, Protocol: corev1.ProtocolTCP},
+						},
+						SecurityContext: containerSecurityContext(cr.Spec.Prometheus.SecurityContext),
+						VolumeMounts:    []corev1.VolumeMount{{Name: "config", MountPath: "/config"}},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromString("http")},
+							},
+						},
+					},
+				},
+				Volumes: []corev1.Volume{
+					{
+						Name: "config",
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return d
+}
@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// prunableLists are the kinds of the child resources deleted once the spec no longer produces them, e.g.,
+// the StatefulSets and Services of removed ClickHouse shards or the resources renamed by newer versions of the operator.
+// PVCs and Secrets are never pruned, as they keep the data and the generated passwords.
+func prunableLists() []client.ObjectList {
+	return []client.ObjectList{
+		&appsv1.DeploymentList{},
+		&appsv1.StatefulSetList{},
+		&appsv1.DaemonSetList{},
+		&corev1.ServiceList{},
+		&corev1.ConfigMapList{},
+		&corev1.ServiceAccountList{},
+		&rbacv1.RoleList{},
+		&rbacv1.RoleBindingList{},
+		&networkingv1.IngressList{},
+	}
+}
+
+// pruneObsolete deletes the child resources controlled by the Coroot instance that haven't been applied during the reconciliation.
+// It must be called only if all the components have been applied, as the resources of the skipped ones would be deleted otherwise.
+func (r *CorootReconciler) pruneObsolete(ctx context.Context, cr *corootv1.Coroot, inv *inventory) error {
+	logger := ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name)
+	var errs []error
+	for _, list := range prunableLists() {
+		err := r.List(ctx, list, client.InNamespace(cr.Namespace), client.MatchingLabels{"app.kubernetes.io/managed-by": "coroot-operator"})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, item := range items {
+			obj, ok := item.(client.Object)
+			if !ok || !metav1.IsControlledBy(obj, cr) || !obj.GetDeletionTimestamp().IsZero() {
+				continue
+			}
+			gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+			if err != nil || inv.has(gvk.Kind, obj) {
+				continue
+			}
+			if err = r.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+				logger.Error(err, "failed to prune", "kind", gvk.Kind, "resource", obj.GetName())
+				errs = append(errs, r.applyError(cr, obj, "prune", err))
+				continue
+			}
+			logger.Info("pruned", "kind", gvk.Kind, "resource", obj.GetName())
+			if r.recorder != nil {
+				r.recorder.Event(cr, corev1.EventTypeNormal, "Pruned", fmt.Sprintf("%s/%s is no longer produced by the spec", gvk.Kind, obj.GetName()))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func TestPruneObsolete(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.UID = "uid"
+	owned := func(obj client.Object) client.Object {
+		obj.SetNamespace(cr.Namespace)
+		obj.SetLabels(Labels(cr, "clickhouse"))
+		if err := ctrl.SetControllerReference(cr, obj, r.Scheme); err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+	applied := owned(&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-shard-0"}})
+	obsolete := owned(&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-shard-1"}})
+	obsoleteService := owned(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-shard-1"}})
+	secret := owned(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse"}})
+	foreign := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: cr.Namespace, Labels: Labels(cr, "clickhouse")}}
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(applied, obsolete, obsoleteService, secret, foreign).Build()
+
+	ctx, inv := withInventory(context.Background())
+	inv.add(r.Scheme, applied, "")
+	if err := r.pruneObsolete(ctx, cr, inv); err != nil {
+		t.Fatal(err)
+	}
+	for obj, pruned := range map[client.Object]bool{applied: false, obsolete: true, obsoleteService: true, secret: false, foreign: false} {
+		err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+		if pruned != errors.IsNotFound(err) {
+			t.Errorf("%T %s: expected pruned=%v, got %v", obj, obj.GetName(), pruned, err)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"path/filepath"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"testing"
+)
+
+// startEnv runs an API server without controllers, so the children are created but never become ready.
+// The binaries are installed by make test (setup-envtest), which also sets ENVTEST_REQUIRED so the tests fail instead of being skipped.
+// Run without them (e.g., plain go test), the tests are skipped.
+func startEnv(t *testing.T) client.Client {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		if os.Getenv("ENVTEST_REQUIRED") != "" {
+			t.Fatal("KUBEBUILDER_ASSETS isn't set")
+		}
+		t.Skip("KUBEBUILDER_ASSETS isn't set, run make test")
+	}
+	env := &envtest.Environment{
+		CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd")},
+		ErrorIfCRDPathMissing: true,
+	}
+	cfg, err := env.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = env.Stop() })
+	c, err := client.New(cfg, client.Options{Scheme: testScheme(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// reconcileCoroot fails the test on the errors of the failed components too, as they are retried with their own backoffs
+// and only reported in the conditions.
+func reconcileCoroot(t *testing.T, r *CorootReconciler, cr *corootv1.Coroot) {
+	t.Helper()
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cr)}); err != nil {
+		t.Fatal(err)
+	}
+	reconciled := cr.DeepCopy()
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(cr), reconciled); err != nil {
+		t.Fatal(err)
+	}
+	if c := meta.FindStatusCondition(reconciled.Status.Conditions, ConditionTypeReconciled); c != nil && c.Status == metav1.ConditionFalse {
+		t.Fatalf("failed to reconcile: %s", c.Message)
+	}
+}
+
+// workloadVersions returns the resource versions of the workloads, which change on every update.
+func workloadVersions(t *testing.T, c client.Client, namespace string) map[string]string {
+	t.Helper()
+	ctx := context.Background()
+	res := map[string]string{}
+	deployments := &appsv1.DeploymentList{}
+	statefulSets := &appsv1.StatefulSetList{}
+	daemonSets := &appsv1.DaemonSetList{}
+	for _, l := range []client.ObjectList{deployments, statefulSets, daemonSets} {
+		if err := c.List(ctx, l, client.InNamespace(namespace)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, o := range deployments.Items {
+		res["Deployment/"+o.Name] = o.ResourceVersion
+	}
+	for _, o := range statefulSets.Items {
+		res["StatefulSet/"+o.Name] = o.ResourceVersion
+	}
+	for _, o := range daemonSets.Items {
+		res["DaemonSet/"+o.Name] = o.ResourceVersion
+	}
+	return res
+}
+
+func TestReconcile(t *testing.T) {
+	c := startEnv(t)
+	ctx := context.Background()
+	r := testReconciler(t)
+	r.Client, r.apiReader = c, c
+
+	if err := c.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "coroot"}}); err != nil {
+		t.Fatal(err)
+	}
+	cr := testCoroot()
+	cr.Spec.Clickhouse.Shards, cr.Spec.Clickhouse.Replicas = 1, 1
+	if err := c.Create(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	reconcileCoroot(t, r, cr)
+
+	versions := workloadVersions(t, c, cr.Namespace)
+	for _, k := range []string{"StatefulSet/coroot-coroot", "Deployment/coroot-prometheus", "StatefulSet/coroot-clickhouse-shard-0", "DaemonSet/coroot-node-agent", "Deployment/coroot-cluster-agent"} {
+		if versions[k] == "" {
+			t.Errorf("%s isn't created", k)
+		}
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(cr), cr); err != nil {
+		t.Fatal(err)
+	}
+	if c := meta.FindStatusCondition(cr.Status.Conditions, ConditionTypeReconciled); c == nil || c.Status != metav1.ConditionTrue {
+		t.Errorf("expected the Reconciled condition, got %+v", c)
+	}
+
+	t.Run("idempotent", func(t *testing.T) {
+		// Updates of unchanged children restart their pods, e.g., because of merge bugs or unstable configs.
+		reconcileCoroot(t, r, cr)
+		for k, v := range workloadVersions(t, c, cr.Namespace) {
+			if versions[k] != v {
+				t.Errorf("%s is updated by a reconciliation without changes", k)
+			}
+		}
+	})
+
+	t.Run("foreign changes", func(t *testing.T) {
+		d := &appsv1.Deployment{}
+		key := types.NamespacedName{Namespace: cr.Namespace, Name: "coroot-prometheus"}
+		if err := c.Get(ctx, key, d); err != nil {
+			t.Fatal(err)
+		}
+		d.Spec.Template.Annotations = map[string]string{"kubectl.kubernetes.io/restartedAt": "now"}
+		d.Spec.Template.Spec.Containers[0].Image = "prometheus:edited"
+		if err := c.Update(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+		reconcileCoroot(t, r, cr)
+		if err := c.Get(ctx, key, d); err != nil {
+			t.Fatal(err)
+		}
+		if d.Spec.Template.Spec.Containers[0].Image != PrometheusImage {
+			t.Errorf("expected the image to be reverted, got %s", d.Spec.Template.Spec.Containers[0].Image)
+		}
+		if d.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] != "now" {
+			t.Errorf("expected the annotation set by others to be kept")
+		}
+	})
+
+	t.Run("metrics engine switch", func(t *testing.T) {
+		if err := c.Get(ctx, client.ObjectKeyFromObject(cr), cr); err != nil {
+			t.Fatal(err)
+		}
+		cr.Spec.MetricsEngine = corootv1.MetricsEngineVictoriaMetrics
+		if err := c.Update(ctx, cr); err != nil {
+			t.Fatal(err)
+		}
+		reconcileCoroot(t, r, cr)
+		versions := workloadVersions(t, c, cr.Namespace)
+		if versions["Deployment/coroot-victoria-metrics"] == "" {
+			t.Errorf("VictoriaMetrics isn't created")
+		}
+		if versions["Deployment/coroot-prometheus"] != "" {
+			t.Errorf("Prometheus isn't deleted")
+		}
+	})
+}
+
+func TestReconcileBuilders(t *testing.T) {
+	c := startEnv(t)
+	ctx := context.Background()
+	r := testReconciler(t)
+	r.Client, r.apiReader = c, c
+
+	for _, tc := range []struct {
+		name string
+		spec func(s *corootv1.CorootSpec)
+	}{
+		{"default", func(s *corootv1.CorootSpec) {}},
+		{"victoria-metrics", func(s *corootv1.CorootSpec) { s.MetricsEngine = corootv1.MetricsEngineVictoriaMetrics }},
+		{"prometheus-pair", func(s *corootv1.CorootSpec) { s.Prometheus.Replicas = 2 }},
+		{"clickhouse-cluster", func(s *corootv1.CorootSpec) { s.Clickhouse.Shards, s.Clickhouse.Replicas = 2, 2 }},
+		{"ingress", func(s *corootv1.CorootSpec) { s.Ingress = &corootv1.IngressSpec{Host: "coroot.example.com"} }},
+		{"agents-only", func(s *corootv1.CorootSpec) {
+			s.AgentsOnly = &corootv1.AgentsOnlySpec{CorootURL: "http://coroot.example.com:8080"}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := c.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: tc.name}}); err != nil {
+				t.Fatal(err)
+			}
+			cr := testCoroot()
+			cr.Namespace = tc.name
+			tc.spec(&cr.Spec)
+			if err := c.Create(ctx, cr); err != nil {
+				t.Fatal(err)
+			}
+			reconcileCoroot(t, r, cr)
+
+			// Every object the builders render must be accepted by the API server.
+			for _, obj := range r.Render(cr) {
+				applied := obj.DeepCopyObject().(client.Object)
+				if err := c.Get(ctx, client.ObjectKeyFromObject(obj), applied); err != nil {
+					t.Errorf("%T %s isn't applied: %s", obj, obj.GetName(), err)
+				}
+			}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(cr), cr); err != nil {
+				t.Fatal(err)
+			}
+			if c := meta.FindStatusCondition(cr.Status.Conditions, ConditionTypeReconciled); c == nil || c.Status != metav1.ConditionTrue {
+				t.Errorf("expected the Reconciled condition, got %+v", c)
+			}
+		})
+	}
+}
+
+// TestReconcileUpgrade reconciles the children created by a previous operator version:
+// older images and an env variable the current builders don't produce, recorded in the last applied spec.
+func TestReconcileUpgrade(t *testing.T) {
+	c := startEnv(t)
+	ctx := context.Background()
+	r := testReconciler(t)
+	r.Client, r.apiReader = c, c
+
+	if err := c.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "coroot"}}); err != nil {
+		t.Fatal(err)
+	}
+	cr := testCoroot()
+	if err := c.Create(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+
+	const oldImage = "ghcr.io/coroot/old:0.0.1"
+	images := map[string][]string{}
+	previous := func(key string, tpl *corev1.PodTemplateSpec) {
+		tpl.Annotations = nil
+		for i := range tpl.Spec.Containers {
+			images[key] = append(images[key], tpl.Spec.Containers[i].Image)
+			tpl.Spec.Containers[i].Image = oldImage
+			tpl.Spec.Containers[i].Env = append(tpl.Spec.Containers[i].Env, corev1.EnvVar{Name: "REMOVED_SETTING", Value: "1"})
+		}
+	}
+	for _, obj := range r.Render(cr) {
+		key := fmt.Sprintf("%T/%s", obj, obj.GetName())
+		var spec any
+		switch o := obj.(type) {
+		case *appsv1.Deployment:
+			previous(key, &o.Spec.Template)
+			spec = o.Spec
+		case *appsv1.StatefulSet:
+			previous(key, &o.Spec.Template)
+			spec = o.Spec
+		case *appsv1.DaemonSet:
+			previous(key, &o.Spec.Template)
+			spec = o.Spec
+		default:
+			continue
+		}
+		lastApplied, err := json.Marshal(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj.SetAnnotations(map[string]string{LastAppliedAnnotation: string(lastApplied)})
+		if err := ctrl.SetControllerReference(cr, obj, r.Scheme); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Create(ctx, obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(images) == 0 {
+		t.Fatal("no workloads rendered")
+	}
+
+	reconcileCoroot(t, r, cr)
+
+	for _, obj := range r.Render(cr) {
+		key := fmt.Sprintf("%T/%s", obj, obj.GetName())
+		if images[key] == nil {
+			continue
+		}
+		applied := obj.DeepCopyObject().(client.Object)
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), applied); err != nil {
+			t.Fatal(err)
+		}
+		var tpl corev1.PodTemplateSpec
+		switch o := applied.(type) {
+		case *appsv1.Deployment:
+			tpl = o.Spec.Template
+		case *appsv1.StatefulSet:
+			tpl = o.Spec.Template
+		case *appsv1.DaemonSet:
+			tpl = o.Spec.Template
+		}
+		for i, container := range tpl.Spec.Containers {
+			if i < len(images[key]) && container.Image != images[key][i] {
+				t.Errorf("%s: expected %s, got %s", key, images[key][i], container.Image)
+			}
+			for _, e := range container.Env {
+				if e.Name == "REMOVED_SETTING" {
+					t.Errorf("%s: the env variable of the previous version isn't removed", key)
+				}
+			}
+		}
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(cr), cr); err != nil {
+		t.Fatal(err)
+	}
+	if c := meta.FindStatusCondition(cr.Status.Conditions, ConditionTypeReconciled); c == nil || c.Status != metav1.ConditionTrue {
+		t.Errorf("expected the Reconciled condition, got %+v", c)
+	}
+}
@@ -0,0 +1,246 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"io"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+)
+
+// Render returns the objects the operator would create or update for the given Coroot.
+func (r *CorootReconciler) Render(cr *corootv1.Coroot) []client.Object {
+	cr = cr.DeepCopy()
+	applySizeProfile(cr)
+	var objs []client.Object
+	serviceAccount := func(component, scc string) {
+		if serviceAccountSpec(cr, component).Name == "" {
+			objs = append(objs, r.serviceAccount(cr, component))
+		}
+		objs = append(objs, r.openshiftSCCRoleBinding(cr, component, scc))
+	}
+
+	objs = append(objs, r.openshiftSCCRole(cr, sccNonroot), r.openshiftSCCRole(cr, sccPrivileged))
+
+	serviceAccount("node-agent", sccPrivileged)
+	objs = append(objs, r.nodeAgentDaemonSet(cr))
+	if m := cr.Spec.NodeAgent.Metrics; m != nil && m.HeadlessService {
+		objs = append(objs, r.nodeAgentServiceHeadless(cr))
+	}
+
+	serviceAccount("cluster-agent", sccNonroot)
+	// Namespace selectors can't be resolved without the cluster, so only the listed namespaces are rendered.
+	namespaces := r.clusterAgentNamespaces(cr, nil)
+	if r.namespaceScoped(cr) {
+		objs = append(objs, r.clusterAgentRole(cr), r.clusterAgentRoleBinding(cr))
+	} else {
+		objs = append(objs, r.clusterAgentClusterRole(cr, namespaces), r.clusterAgentClusterRoleBinding(cr))
+		for _, ns := range namespaces {
+			objs = append(objs, r.clusterAgentDiscoveryRole(cr, ns), r.clusterAgentDiscoveryRoleBinding(cr, ns))
+		}
+	}
+	objs = append(objs, r.clusterAgentDeployment(cr, namespaces))
+	if kubernetesEventsEnabled(cr) {
+		objs = append(objs, r.kubernetesEventsDeployment(cr, namespaces))
+	}
+	for _, t := range vpaTargets(cr) {
+		if t.mode != "" {
+			objs = append(objs, r.verticalPodAutoscaler(cr, t))
+		}
+	}
+
+	if cr.Spec.AgentsOnly != nil {
+		return withImagePullSettings(cr, objs)
+	}
+
+	if cr.Spec.Replicas > 1 && cr.Spec.Postgres == nil {
+		cr.Spec.Replicas = 1
+	}
+	serviceAccount("coroot", sccNonroot)
+	for _, pvc := range r.corootPVCs(cr) {
+		objs = append(objs, pvc)
+	}
+	if generatedAdminPassword(cr) {
+		objs = append(objs, r.corootAdminSecret(cr))
+	}
+	// Secret values aren't read while rendering, so they are left empty in the config.
+	objs = append(objs, r.corootConfigSecret(cr, nil), r.corootStatefulSet(cr, nil), r.corootService(cr))
+	if uiIngressEnabled(cr) {
+		objs = append(objs, r.corootIngress(cr))
+	}
+	if telemetryIngressEnabled(cr) {
+		objs = append(objs, r.corootTelemetryIngress(cr))
+	}
+	if g := cr.Spec.Gateway; g != nil {
+		objs = append(objs, r.corootHTTPRoute(cr))
+		if len(g.TelemetryHostnames) > 0 {
+			objs = append(objs, r.corootTelemetryHTTPRoute(cr))
+		}
+	}
+
+	serviceAccount("prometheus", sccNonroot)
+	switch {
+	case victoriaMetricsEnabled(cr):
+		if cr.Spec.VictoriaMetrics.URL == "" {
+			if pvcStorage(cr.Spec.VictoriaMetrics.Storage) {
+				objs = append(objs, r.victoriaMetricsPVC(cr))
+			}
+			objs = append(objs, r.victoriaMetricsDeployment(cr), r.victoriaMetricsService(cr))
+		}
+	default:
+		if configs, _ := prometheusConfigs(cr); configs != nil {
+			objs = append(objs, r.prometheusConfigSecret(cr, configs))
+		}
+		for replica := 0; replica < prometheusReplicas(cr); replica++ {
+			if pvcStorage(cr.Spec.Prometheus.Storage) {
+				objs = append(objs, r.prometheusPVC(cr, replica))
+			}
+			objs = append(objs, r.prometheusDeployment(cr, replica))
+			if prometheusReplicas(cr) > 1 {
+				objs = append(objs, r.prometheusReplicaService(cr, replica))
+			}
+		}
+		if prometheusReplicas(cr) > 1 {
+			objs = append(objs, r.promxyDeployment(cr), r.prometheusPDB(cr))
+		}
+		objs = append(objs, r.prometheusService(cr))
+	}
+
+	if cr.Spec.ExternalClickhouse == nil {
+		objs = append(objs, r.clickhouseSecret(cr))
+
+		serviceAccount("clickhouse-keeper", sccNonroot)
+		objs = append(objs, r.clickhouseKeeperServiceHeadless(cr), r.clickhouseKeeperServiceMetrics(cr))
+		for _, pvc := range r.clickhouseKeeperPVCs(cr) {
+			objs = append(objs, pvc)
+		}
+		objs = append(objs, r.clickhouseKeeperStatefulSet(cr))
+
+		serviceAccount("clickhouse", sccNonroot)
+		objs = append(objs, r.clickhouseServiceHeadless(cr))
+		for _, pvc := range r.clickhousePVCs(cr) {
+			objs = append(objs, pvc)
+		}
+		for _, ss := range r.clickhouseStatefulSets(cr) {
+			objs = append(objs, ss)
+		}
+		objs = append(objs, r.clickhouseService(cr))
+		if cr.Spec.Clickhouse.Service != nil {
+			objs = append(objs, r.clickhouseExternalService(cr))
+		}
+	}
+
+	if cr.Spec.PodMonitor != nil {
+		for _, pm := range r.podMonitors(cr) {
+			objs = append(objs, pm)
+		}
+	}
+	if sm := cr.Spec.ServiceMesh; sm != nil {
+		if sm.PeerAuthenticationMode != "" {
+			objs = append(objs, r.peerAuthentication(cr))
+		}
+		if sm.DestinationRules {
+			for _, dr := range r.destinationRules(cr) {
+				objs = append(objs, dr)
+			}
+		}
+	}
+	if cr.Spec.GrafanaDatasources != nil {
+		// The generated ClickHouse password is unknown until the operator creates the secret.
+		password := ""
+		if ec := cr.Spec.ExternalClickhouse; ec != nil && ec.PasswordSecret == nil {
+			password = ec.Password
+		}
+		objs = append(objs, r.grafanaDatasourcesSecret(cr, password))
+	}
+	if probesEnabled(cr) {
+		for _, region := range probeRegions(cr) {
+			objs = append(objs, r.blackboxExporterDeployment(cr, region), r.blackboxExporterService(cr, region.Name))
+		}
+	}
+	if demoAppEnabled(cr) {
+		objs = append(objs, r.demoBackendDeployment(cr), r.demoBackendService(cr), r.demoLoadDeployment(cr))
+	}
+	return withImagePullSettings(cr, objs)
+}
+
+// withImagePullSettings applies the image pull settings to the workloads, as CreateOrUpdateDeployment and the like do.
+// The image digests aren't pinned, as rendering doesn't access the registries.
+func withImagePullSettings(cr *corootv1.Coroot, objs []client.Object) []client.Object {
+	for _, obj := range objs {
+		applyImagePullSettings(cr, obj)
+	}
+	return objs
+}
+
+// RenderManifests reads Coroot resources from the input and writes the manifests the operator would apply
+// for them to the output, without touching the cluster.
+func RenderManifests(scheme *runtime.Scheme, in io.Reader, out io.Writer, fetchVersions bool, appVersionsURL string) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	r := &CorootReconciler{
+		Scheme:         scheme,
+		versions:       map[App]string{},
+		appVersionsURL: appVersionsURL,
+	}
+	if fetchVersions {
+		ctx, cancel := context.WithTimeout(context.Background(), AppVersionsFetchTimeout)
+		defer cancel()
+		if _, err = r.fetchAppVersions(ctx); err != nil {
+			return err
+		}
+	} else {
+		for _, app := range apps {
+			r.versions[app] = "latest"
+		}
+	}
+	decoder := serializer.NewCodecFactory(scheme).UniversalDeserializer()
+	rd := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		doc, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		cr := &corootv1.Coroot{}
+		if _, _, err = decoder.Decode(doc, nil, cr); err != nil {
+			return fmt.Errorf("failed to decode Coroot: %w", err)
+		}
+		if cr.Namespace == "" {
+			cr.Namespace = "default"
+		}
+		if invalid := validateSpec(cr); len(invalid) > 0 {
+			return fmt.Errorf("invalid Coroot %s: %w", cr.Name, invalid.ToAggregate())
+		}
+		for _, obj := range r.Render(cr) {
+			setCommonMetadata(cr, obj, obj.GetLabels(), obj.GetAnnotations())
+			gvk, err := apiutil.GVKForObject(obj, scheme)
+			if err != nil {
+				return err
+			}
+			obj.GetObjectKind().SetGroupVersionKind(gvk)
+			data, err := yaml.Marshal(obj)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(out, "---\n%s", data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	kscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"os"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	s := runtime.NewScheme()
+	if err := kscheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := corootv1.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testReconciler(t *testing.T) *CorootReconciler {
+	r := &CorootReconciler{Scheme: testScheme(t), versions: map[App]string{}}
+	for _, app := range apps {
+		r.versions[app] = "1.0.0"
+	}
+	return r
+}
+
+func testCoroot() *corootv1.Coroot {
+	return &corootv1.Coroot{ObjectMeta: metav1.ObjectMeta{Name: "coroot", Namespace: "coroot"}}
+}
+
+// rendered returns the rendered objects by kind/name.
+func rendered(r *CorootReconciler, cr *corootv1.Coroot) map[string]client.Object {
+	res := map[string]client.Object{}
+	for _, obj := range r.Render(cr) {
+		res[fmt.Sprintf("%T/%s", obj, obj.GetName())] = obj
+	}
+	return res
+}
+
+func TestRenderSamples(t *testing.T) {
+	for _, f := range []string{"../config/samples/coroot.yaml"} {
+		in, err := os.Open(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		err = RenderManifests(testScheme(t), in, &out, false, "")
+		in.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", f, err)
+		}
+		if !strings.Contains(out.String(), "image: ghcr.io/coroot/coroot:latest") {
+			t.Errorf("%s: coroot image isn't rendered", f)
+		}
+	}
+}
+
+func TestRenderBackends(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		spec    func(*corootv1.CorootSpec)
+		present []string
+		absent  []string
+	}{
+		{
+			name:    "default",
+			spec:    func(*corootv1.CorootSpec) {},
+			present: []string{"*v1.StatefulSet/coroot-coroot", "*v1.Deployment/coroot-prometheus", "*v1.StatefulSet/coroot-clickhouse-shard-0", "*v1.DaemonSet/coroot-node-agent"},
+			absent:  []string{"*v1.Deployment/coroot-victoria-metrics"},
+		},
+		{
+			name:    "victoria metrics",
+			spec:    func(s *corootv1.CorootSpec) { s.MetricsEngine = corootv1.MetricsEngineVictoriaMetrics },
+			present: []string{"*v1.Deployment/coroot-victoria-metrics"},
+			absent:  []string{"*v1.Deployment/coroot-prometheus"},
+		},
+		{
+			name: "external clickhouse",
+			spec: func(s *corootv1.CorootSpec) {
+				s.ExternalClickhouse = &corootv1.ExternalClickhouseSpec{Address: "clickhouse:9000", User: "default", Database: "coroot"}
+			},
+			present: []string{"*v1.StatefulSet/coroot-coroot"},
+			absent:  []string{"*v1.StatefulSet/coroot-clickhouse-shard-0", "*v1.StatefulSet/coroot-clickhouse-keeper"},
+		},
+		{
+			name:    "agents only",
+			spec:    func(s *corootv1.CorootSpec) { s.AgentsOnly = &corootv1.AgentsOnlySpec{CorootURL: "http://coroot:8080"} },
+			present: []string{"*v1.DaemonSet/coroot-node-agent", "*v1.Deployment/coroot-cluster-agent"},
+			absent:  []string{"*v1.StatefulSet/coroot-coroot", "*v1.Deployment/coroot-prometheus", "*v1.StatefulSet/coroot-clickhouse-shard-0"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cr := testCoroot()
+			tc.spec(&cr.Spec)
+			objs := rendered(testReconciler(t), cr)
+			for _, k := range tc.present {
+				if objs[k] == nil {
+					t.Errorf("%s isn't rendered", k)
+				}
+			}
+			for _, k := range tc.absent {
+				if objs[k] != nil {
+					t.Errorf("%s is rendered", k)
+				}
+			}
+		})
+	}
+}
+
+func TestPrometheusActiveStandby(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.Spec.Prometheus.Replicas = 2
+	objs := rendered(r, cr)
+	pdb, ok := objs["*v1.PodDisruptionBudget/coroot-prometheus"].(*policyv1.PodDisruptionBudget)
+	if !ok {
+		t.Fatal("PodDisruptionBudget isn't rendered")
+	}
+	selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"coroot-prometheus", "coroot-prometheus-1"} {
+		d := objs["*v1.Deployment/"+name].(*appsv1.Deployment)
+		if !selector.Matches(labels.Set(d.Spec.Template.Labels)) {
+			t.Errorf("%s: the pods aren't covered by the PodDisruptionBudget", name)
+		}
+		a := d.Spec.Template.Spec.Affinity
+		if a == nil || a.PodAntiAffinity == nil || len(a.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution) == 0 {
+			t.Fatalf("%s: expected pod anti-affinity, got %v", name, a)
+		}
+		term := a.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0].PodAffinityTerm
+		if term.TopologyKey != corev1.LabelHostname || !reflect.DeepEqual(term.LabelSelector, pdb.Spec.Selector) {
+			t.Errorf("%s: expected anti-affinity across the nodes, got %v", name, term)
+		}
+	}
+	promxy := objs["*v1.Deployment/coroot-promxy"].(*appsv1.Deployment)
+	if selector.Matches(labels.Set(promxy.Spec.Template.Labels)) {
+		t.Error("promxy is covered by the PodDisruptionBudget")
+	}
+
+	cr.Spec.Prometheus.Replicas = 1
+	objs = rendered(r, cr)
+	if objs["*v1.PodDisruptionBudget/coroot-prometheus"] != nil {
+		t.Error("PodDisruptionBudget is rendered for a single replica")
+	}
+	if a := objs["*v1.Deployment/coroot-prometheus"].(*appsv1.Deployment).Spec.Template.Spec.Affinity; a != nil && a.PodAntiAffinity != nil {
+		t.Errorf("expected no pod anti-affinity for a single replica, got %v", a.PodAntiAffinity)
+	}
+}
+
+func TestPrometheusRemoteWriteRelabeling(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.Spec.Prometheus.MetricRelabelConfigs = "- action: labeldrop\n  regex: pod_uid\n"
+	cr.Spec.Prometheus.RecordingRulesConfigMap = &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "rules"}, Key: "rules.yml"}
+	objs := rendered(r, cr)
+
+	secret := objs["*v1.Secret/coroot-prometheus-config"].(*corev1.Secret)
+	if string(secret.Data[prometheusRelabelFile]) != "- action: labeldrop\n  regex: pod_uid\n" {
+		t.Errorf("unexpected relabeling rules: %q", secret.Data[prometheusRelabelFile])
+	}
+	spec := objs["*v1.Deployment/coroot-prometheus"].(*appsv1.Deployment).Spec.Template.Spec
+	containers := map[string]corev1.Container{}
+	for _, c := range spec.Containers {
+		containers[c.Name] = c
+	}
+	if _, ok := containers["vmagent"]; !ok {
+		t.Error("vmagent isn't rendered")
+	}
+	if _, ok := containers["rules-reloader"]; !ok {
+		t.Error("the rules reloader isn't rendered")
+	}
+	if !slices.Contains(containers["prometheus"].Args, "--web.enable-lifecycle") {
+		t.Error("the reload endpoint isn't enabled")
+	}
+	env := map[string]string{}
+	for _, e := range objs["*v1.StatefulSet/coroot-coroot"].(*appsv1.StatefulSet).Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	if u := env["GLOBAL_PROMETHEUS_REMOTE_WRITE_URL"]; u != "http://coroot-prometheus.coroot:8429/api/v1/write" {
+		t.Errorf("expected the metrics to be written through vmagent, got %q", u)
+	}
+	if ports := objs["*v1.Service/coroot-prometheus"].(*corev1.Service).Spec.Ports; len(ports) != 2 {
+		t.Errorf("expected the remote write port, got %v", ports)
+	}
+
+	cr.Spec.Prometheus.Replicas = 2
+	objs = rendered(r, cr)
+	if ports := objs["*v1.Service/coroot-prometheus-0"].(*corev1.Service).Spec.Ports; len(ports) != 2 {
+		t.Errorf("expected the remote write port on the first replica, got %v", ports)
+	}
+	for _, c := range objs["*v1.Deployment/coroot-prometheus-1"].(*appsv1.Deployment).Spec.Template.Spec.Containers {
+		if c.Name != "prometheus" {
+			t.Errorf("unexpected sidecar on the second replica: %s", c.Name)
+		}
+	}
+}
+
+func TestCorootIngressPath(t *testing.T) {
+	for path, expected := range map[string]string{"": "/", "coroot": "/coroot", "/coroot": "/coroot", "/coroot/": "/coroot/"} {
+		cr := testCoroot()
+		cr.Spec.Ingress = &corootv1.IngressSpec{Host: "coroot.example.com", Path: path}
+		i := testReconciler(t).corootIngress(cr)
+		if actual := i.Spec.Rules[0].HTTP.Paths[0].Path; actual != expected {
+			t.Errorf("path %q: expected %q, got %q", path, expected, actual)
+		}
+		if pt := i.Spec.Rules[0].HTTP.Paths[0].PathType; pt == nil || *pt != networkingv1.PathTypePrefix {
+			t.Errorf("path %q: expected the Prefix path type", path)
+		}
+	}
+}
+
+func TestPodDNSAndHostAliases(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	ndots := "2"
+	cr.Spec.Clickhouse.DNSConfig = &corev1.PodDNSConfig{Options: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}}}
+	cr.Spec.NodeAgent.HostNetwork = true
+	cr.Spec.NodeAgent.Metrics = &corootv1.NodeAgentMetricsSpec{Port: 10300}
+	spec := r.clickhouseStatefulSet(cr, 0).Spec.Template.Spec
+	if spec.DNSConfig == nil || *spec.DNSConfig.Options[0].Value != ndots {
+		t.Errorf("expected the DNS config to be set, got %v", spec.DNSConfig)
+	}
+	if p := r.nodeAgentDaemonSet(cr).Spec.Template.Spec.DNSPolicy; p != corev1.DNSClusterFirstWithHostNet {
+		t.Errorf("expected the host network DNS policy, got %s", p)
+	}
+	cr.Spec.NodeAgent.DNSPolicy = corev1.DNSDefault
+	if p := r.nodeAgentDaemonSet(cr).Spec.Template.Spec.DNSPolicy; p != corev1.DNSDefault {
+		t.Errorf("expected the DNS policy to be overridden, got %s", p)
+	}
+	cr.Spec.ClusterAgent.HostAliases = []corev1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"postgres.corp"}}}
+	if aliases := r.clusterAgentDeployment(cr, nil).Spec.Template.Spec.HostAliases; len(aliases) != 1 {
+		t.Errorf("expected the host aliases to be set, got %v", aliases)
+	}
+
+	cr.Spec.DNSPolicy = corev1.DNSNone
+	if errs := validateSpec(cr); len(errs) != 1 || errs[0].Field != "spec.dnsConfig.nameservers" {
+		t.Errorf("expected the nameservers to be required, got %v", errs)
+	}
+}
+
+func TestSizeProfileKeepsShards(t *testing.T) {
+	for _, profile := range []corootv1.SizeProfile{corootv1.SizeProfileSmall, corootv1.SizeProfileMedium, corootv1.SizeProfileLarge} {
+		cr := testCoroot()
+		cr.Spec.SizeProfile = profile
+		applySizeProfile(cr)
+		if cr.Spec.Clickhouse.Shards != 0 {
+			t.Errorf("%s: expected the shard count to be left unset, got %d", profile, cr.Spec.Clickhouse.Shards)
+		}
+		if len(cr.Spec.Clickhouse.Resources.Requests) == 0 {
+			t.Errorf("%s: expected the ClickHouse resources to be defaulted", profile)
+		}
+	}
+}
+
+func TestHostPathStorage(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.Spec.Clickhouse.Storage.HostPath = &corootv1.HostPathStorageSpec{Path: "/var/lib/coroot/clickhouse"}
+	cr.Spec.Prometheus.Storage.HostPath = &corootv1.HostPathStorageSpec{Path: "/var/lib/coroot/prometheus"}
+	root := func(spec corev1.PodSpec) []string {
+		var res []string
+		for _, c := range append(spec.InitContainers, spec.Containers...) {
+			if sc := c.SecurityContext; sc != nil && sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+				res = append(res, c.Name)
+			}
+		}
+		return res
+	}
+
+	ch := r.clickhouseStatefulSet(cr, 0).Spec.Template.Spec
+	if len(ch.InitContainers) == 0 || ch.InitContainers[0].Name != "data-dir" {
+		t.Errorf("expected the per-pod directory to be created by an init container, got %v", ch.InitContainers)
+	}
+	if names := root(ch); len(names) > 0 {
+		t.Errorf("expected no containers running as root, got %v", names)
+	}
+	for _, c := range r.prometheusDeployment(cr, 0).Spec.Template.Spec.InitContainers {
+		if c.Name == "data-dir" {
+			t.Error("expected no init container for a shared directory")
+		}
+	}
+
+	cr.Spec.Clickhouse.Storage.HostPath.FixPermissions = true
+	ch = r.clickhouseStatefulSet(cr, 0).Spec.Template.Spec
+	if names := root(ch); len(names) != 1 || names[0] != "data-permissions" {
+		t.Errorf("expected the permissions to be fixed by a root init container, got %v", names)
+	}
+}
+
+func TestKubernetesEventsSingleReplica(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.Spec.ClusterAgent.Replicas = ptr.To(int32(3))
+	cr.Spec.ClusterAgent.KubernetesEvents = &corootv1.KubernetesEventsSpec{}
+	objs := rendered(r, cr)
+	for _, c := range objs["*v1.Deployment/coroot-cluster-agent"].(*appsv1.Deployment).Spec.Template.Spec.Containers {
+		if c.Name == "kubernetes-events" {
+			t.Error("the events collector runs in every cluster-agent replica")
+		}
+	}
+	d, ok := objs["*v1.Deployment/coroot-kubernetes-events"].(*appsv1.Deployment)
+	if !ok {
+		t.Fatal("the events collector isn't rendered")
+	}
+	if *d.Spec.Replicas != 1 || d.Spec.Template.Spec.ServiceAccountName != serviceAccountName(cr, "cluster-agent") {
+		t.Errorf("expected a single replica with the cluster-agent service account, got %d replicas and %s", *d.Spec.Replicas, d.Spec.Template.Spec.ServiceAccountName)
+	}
+
+	cr.Spec.ClusterAgent.KubernetesEvents = nil
+	if objs = rendered(r, cr); objs["*v1.Deployment/coroot-kubernetes-events"] != nil {
+		t.Error("the events collector is rendered while disabled")
+	}
+}
+
+func TestImagePullSettings(t *testing.T) {
+	cr := testCoroot()
+	cr.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "registry"}}
+	cr.Spec.ImagePullPolicy = corev1.PullAlways
+	workloads := 0
+	for _, obj := range testReconciler(t).Render(cr) {
+		spec := workloadPodSpec(obj)
+		if spec == nil {
+			continue
+		}
+		workloads++
+		if len(spec.ImagePullSecrets) != 1 || spec.ImagePullSecrets[0].Name != "registry" {
+			t.Errorf("%T %s: expected the pull secret, got %v", obj, obj.GetName(), spec.ImagePullSecrets)
+		}
+		for _, c := range append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...) {
+			if c.ImagePullPolicy != corev1.PullAlways {
+				t.Errorf("%T %s: expected the pull policy of %s to be set", obj, obj.GetName(), c.Name)
+			}
+		}
+	}
+	if workloads == 0 {
+		t.Fatal("no workloads rendered")
+	}
+}
+
+func TestMissingAppImages(t *testing.T) {
+	r := testReconciler(t)
+	delete(r.versions, AppCorootEE)
+	cr := testCoroot()
+	if missing := r.missingAppImages(cr); len(missing) != 0 {
+		t.Errorf("expected no missing images, got %v", missing)
+	}
+	cr.Spec.EnterpriseEdition = &corootv1.EnterpriseEditionSpec{}
+	if missing := r.missingAppImages(cr); len(missing) != 1 || missing[0] != AppCorootEE {
+		t.Errorf("expected %s to be missing, got %v", AppCorootEE, missing)
+	}
+	cr.Spec.EnterpriseEdition.Version = "1.0.0"
+	if missing := r.missingAppImages(cr); len(missing) != 0 {
+		t.Errorf("expected the pinned version to be used, got %v", missing)
+	}
+
+	ds := &appsv1.DaemonSet{}
+	ds.Spec.Template.Spec.Containers = []corev1.Container{{Name: "node-agent"}}
+	if c := containerWithoutImage(ds); c != "node-agent" {
+		t.Errorf("expected the node-agent container to have no image, got %q", c)
+	}
+}
+
+func TestClusterDomain(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.Spec.ServiceMesh = &corootv1.ServiceMeshSpec{DestinationRules: true}
+	cr.Spec.Proxy = &corootv1.ProxySpec{HTTPSProxy: "http://proxy:3128"}
+	for domain, expected := range map[string]string{"": "cluster.local", "corp.internal.": "corp.internal"} {
+		cr.Spec.ClusterDomain = domain
+		host := r.destinationRules(cr)[0].Object["spec"].(map[string]interface{})["host"]
+		if host != "coroot-coroot.coroot.svc."+expected {
+			t.Errorf("%q: unexpected DestinationRule host %v", domain, host)
+		}
+		if np := noProxy(cr); !strings.Contains(np, ",."+expected+",") {
+			t.Errorf("%q: expected the cluster domain in %s", domain, np)
+		}
+	}
+}
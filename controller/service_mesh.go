@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// The ClickHouse native, interserver and Keeper ports aren't HTTP, so the mesh is bypassed for them.
+const serviceMeshExcludedPorts = "9000,9009,9181,9234"
+
+var (
+	peerAuthenticationGVK = schema.GroupVersionKind{Group: "security.istio.io", Version: "v1beta1", Kind: "PeerAuthentication"}
+	destinationRuleGVK    = schema.GroupVersionKind{Group: "networking.istio.io", Version: "v1beta1", Kind: "DestinationRule"}
+)
+
+// podAnnotations returns the user-defined pod annotations extended with the service mesh ones.
+// excludePorts must be set for the pods talking to ClickHouse or Keeper.
+func podAnnotations(cr *corootv1.Coroot, annotations map[string]string, excludePorts bool) map[string]string {
+	sm := cr.Spec.ServiceMesh
+	if sm == nil {
+		return annotations
+	}
+	res := map[string]string{}
+	if excludePorts {
+		res["traffic.sidecar.istio.io/excludeInboundPorts"] = serviceMeshExcludedPorts
+		res["traffic.sidecar.istio.io/excludeOutboundPorts"] = serviceMeshExcludedPorts
+	}
+	if sm.HoldApplicationUntilProxyStarts {
+		res["proxy.istio.io/config"] = `{"holdApplicationUntilProxyStarts": true}`
+	}
+	for k, v := range annotations {
+		res[k] = v
+	}
+	return res
+}
+
+func (r *CorootReconciler) peerAuthentication(cr *corootv1.Coroot) *unstructured.Unstructured {
+	pa := &unstructured.Unstructured{}
+	pa.SetGroupVersionKind(peerAuthenticationGVK)
+	pa.SetName(cr.Name)
+	pa.SetNamespace(cr.Namespace)
+	pa.SetLabels(Labels(cr, "service-mesh"))
+	if cr.Spec.ServiceMesh == nil {
+		return pa
+	}
+	pa.Object["spec"] = map[string]interface{}{
+		"selector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{"app.kubernetes.io/part-of": cr.Name},
+		},
+		"mtls": map[string]interface{}{"mode": cr.Spec.ServiceMesh.PeerAuthenticationMode},
+	}
+	return pa
+}
+
+func (r *CorootReconciler) destinationRules(cr *corootv1.Coroot) []*unstructured.Unstructured {
+	var res []*unstructured.Unstructured
+	for _, component := range []string{"coroot", "prometheus"} {
+		dr := &unstructured.Unstructured{}
+		dr.SetGroupVersionKind(destinationRuleGVK)
+		dr.SetName(cr.Name + "-" + component)
+		dr.SetNamespace(cr.Namespace)
+		dr.SetLabels(Labels(cr, "service-mesh"))
+		dr.Object["spec"] = map[string]interface{}{
+			"host": fmt.Sprintf("%s-%s.%s.svc.%s", cr.Name, component, cr.Namespace, clusterDomain(cr)),
+			"trafficPolicy": map[string]interface{}{
+				"tls": map[string]interface{}{"mode": "ISTIO_MUTUAL"},
+			},
+		}
+		res = append(res, dr)
+	}
+	return res
+}
+
+func (r *CorootReconciler) CreateOrUpdateServiceMesh(ctx context.Context, cr *corootv1.Coroot) []error {
+	sm := cr.Spec.ServiceMesh
+	var errs []error
+	if r.kindSupported(peerAuthenticationGVK) {
+		errs = append(errs, r.CreateOrUpdateUnstructured(ctx, cr, r.peerAuthentication(cr), sm == nil || sm.PeerAuthenticationMode == ""))
+	} else if sm != nil && sm.PeerAuthenticationMode != "" {
+		ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Info("PeerAuthentication CRD is not installed, skipping")
+	}
+	if r.kindSupported(destinationRuleGVK) {
+		for _, dr := range r.destinationRules(cr) {
+			errs = append(errs, r.CreateOrUpdateUnstructured(ctx, cr, dr, sm == nil || !sm.DestinationRules))
+		}
+	} else if sm != nil && sm.DestinationRules {
+		ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Info("DestinationRule CRD is not installed, skipping")
+	}
+	return errs
+}
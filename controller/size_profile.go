@@ -0,0 +1,84 @@
+package controller
+
+import (
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"time"
+)
+
+// sizeProfile doesn't include the ClickHouse shard count: changing it reshards the data, so it's only set explicitly.
+type sizeProfile struct {
+	coroot, clickhouse, keeper, prometheus, clusterAgent corev1.ResourceRequirements
+
+	clickhouseReplicas  int
+	prometheusRetention time.Duration
+}
+
+var sizeProfiles = map[corootv1.SizeProfile]sizeProfile{
+	corootv1.SizeProfileSmall: {
+		coroot:              resources("500m", "1Gi", "2Gi"),
+		clickhouse:          resources("1", "2Gi", "4Gi"),
+		keeper:              resources("100m", "256Mi", "512Mi"),
+		prometheus:          resources("250m", "1Gi", "2Gi"),
+		clusterAgent:        resources("100m", "256Mi", "1Gi"),
+		clickhouseReplicas:  1,
+		prometheusRetention: DefaultMetricsRetention,
+	},
+	corootv1.SizeProfileMedium: {
+		coroot:              resources("1", "4Gi", "8Gi"),
+		clickhouse:          resources("2", "8Gi", "16Gi"),
+		keeper:              resources("250m", "512Mi", "1Gi"),
+		prometheus:          resources("500m", "4Gi", "8Gi"),
+		clusterAgent:        resources("250m", "512Mi", "2Gi"),
+		clickhouseReplicas:  2,
+		prometheusRetention: DefaultMetricsRetention,
+	},
+	corootv1.SizeProfileLarge: {
+		coroot:              resources("2", "8Gi", "16Gi"),
+		clickhouse:          resources("4", "16Gi", "32Gi"),
+		keeper:              resources("500m", "1Gi", "2Gi"),
+		prometheus:          resources("1", "8Gi", "16Gi"),
+		clusterAgent:        resources("500m", "1Gi", "4Gi"),
+		clickhouseReplicas:  2,
+		prometheusRetention: 24 * time.Hour,
+	},
+}
+
+func resources(cpu, memory, memoryLimit string) corev1.ResourceRequirements {
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(memory),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceMemory: resource.MustParse(memoryLimit),
+		},
+	}
+}
+
+// applySizeProfile fills in the fields not set in the spec with the defaults of the size profile.
+// Resources are only defaulted if neither requests nor limits are set for the component.
+func applySizeProfile(cr *corootv1.Coroot) {
+	p, ok := sizeProfiles[cr.Spec.SizeProfile]
+	if !ok {
+		return
+	}
+	defaultResources(&cr.Spec.Resources, p.coroot)
+	defaultResources(&cr.Spec.Clickhouse.Resources, p.clickhouse)
+	defaultResources(&cr.Spec.Clickhouse.Keeper.Resources, p.keeper)
+	defaultResources(&cr.Spec.Prometheus.Resources, p.prometheus)
+	defaultResources(&cr.Spec.ClusterAgent.Resources, p.clusterAgent)
+	if cr.Spec.Clickhouse.Replicas == 0 {
+		cr.Spec.Clickhouse.Replicas = p.clickhouseReplicas
+	}
+	if cr.Spec.Prometheus.Retention.Duration == 0 {
+		cr.Spec.Prometheus.Retention.Duration = p.prometheusRetention
+	}
+}
+
+func defaultResources(r *corev1.ResourceRequirements, defaults corev1.ResourceRequirements) {
+	if len(r.Requests) == 0 && len(r.Limits) == 0 {
+		*r = *defaults.DeepCopy()
+	}
+}
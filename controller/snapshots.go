@@ -0,0 +1,300 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	SnapshotCheckInterval = 30 * time.Second
+	SnapshotDefaultRetain = 7
+
+	snapshotSetLabel          = "coroot.com/snapshot-set"
+	snapshotSetSizeAnnotation = "coroot.com/snapshot-set-size"
+	snapshotSetTimeFormat     = "20060102-150405"
+)
+
+var volumeSnapshotGVK = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}
+
+func snapshotName(pvc, set string) string {
+	return pvc + "-" + set
+}
+
+// snapshotPVCs returns the names of the PVCs included in the snapshot sets.
+func (r *CorootReconciler) snapshotPVCs(cr *corootv1.Coroot) []string {
+	if cr.Spec.AgentsOnly != nil {
+		return nil
+	}
+	pvcs := r.corootPVCs(cr)
+	if cr.Spec.ExternalClickhouse == nil {
+		pvcs = append(pvcs, r.clickhouseKeeperPVCs(cr)...)
+		pvcs = append(pvcs, r.clickhousePVCs(cr)...)
+	}
+	var res []string
+	for _, pvc := range pvcs {
+		res = append(res, pvc.Name)
+	}
+	return res
+}
+
+// snapshotDataSource makes the PVCs populated from the snapshot set specified in snapshots.restoreFrom
+// unless the data source is configured in the storage settings.
+func snapshotDataSource(cr *corootv1.Coroot, pvcs []*corev1.PersistentVolumeClaim) []*corev1.PersistentVolumeClaim {
+	if cr.Spec.Snapshots == nil || cr.Spec.Snapshots.RestoreFrom == "" {
+		return pvcs
+	}
+	for _, pvc := range pvcs {
+		if pvc.Spec.DataSourceRef != nil {
+			continue
+		}
+		pvc.Spec.DataSourceRef = &corev1.TypedObjectReference{
+			APIGroup: ptr.To(volumeSnapshotGVK.Group),
+			Kind:     volumeSnapshotGVK.Kind,
+			Name:     snapshotName(pvc.Name, cr.Spec.Snapshots.RestoreFrom),
+		}
+	}
+	return pvcs
+}
+
+func (r *CorootReconciler) volumeSnapshot(cr *corootv1.Coroot, pvc, set string, size int) *unstructured.Unstructured {
+	vs := &unstructured.Unstructured{}
+	vs.SetGroupVersionKind(volumeSnapshotGVK)
+	vs.SetName(snapshotName(pvc, set))
+	vs.SetNamespace(cr.Namespace)
+	ls := Labels(cr, "snapshot")
+	ls[snapshotSetLabel] = set
+	vs.SetLabels(ls)
+	// The size of the set tells an incomplete set, e.g., with a snapshot deleted manually, from a complete one.
+	vs.SetAnnotations(map[string]string{snapshotSetSizeAnnotation: strconv.Itoa(size)})
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": pvc,
+		},
+	}
+	if className := cr.Spec.Snapshots.ClassName; className != nil {
+		spec["volumeSnapshotClassName"] = *className
+	}
+	vs.Object["spec"] = spec
+	return vs
+}
+
+// checkSnapshots takes a snapshot set if it is due by the schedule or requested with the coroot.com/snapshot annotation,
+// tracks the readiness of the sets and removes the ones beyond the retention.
+// The sets are listed by the labels of the VolumeSnapshots rather than taken from the status, so the snapshots taken
+// before the status was lost, e.g., after the instance was recreated, are still tracked and removed.
+// It returns when the snapshots need to be checked again.
+func (r *CorootReconciler) checkSnapshots(ctx context.Context, cr *corootv1.Coroot, now time.Time) time.Duration {
+	s := cr.Spec.Snapshots
+	if s == nil || cr.Spec.AgentsOnly != nil {
+		return 0
+	}
+	logger := ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name)
+	if !r.kindSupported(volumeSnapshotGVK) {
+		logger.Info("VolumeSnapshots are not supported by the cluster, skipping snapshots")
+		return 0
+	}
+	var res ctrl.Result
+
+	listed, err := r.listSnapshotSets(ctx, cr)
+	if err != nil {
+		logger.Error(err, "failed to list snapshot sets")
+		return SnapshotCheckInterval
+	}
+
+	trigger := cr.Annotations[corootv1.SnapshotAnnotation]
+	due := trigger != "" && trigger != cr.Status.LastSnapshotTrigger
+	if s.Schedule != "" {
+		prev, next, err := snapshotSchedule(s, now)
+		if err != nil {
+			logger.Error(err, "invalid snapshot schedule")
+		} else {
+			if !next.IsZero() {
+				requeueAfter(&res, next.Sub(now))
+			}
+			last := cr.CreationTimestamp.Time
+			if n := len(listed); n > 0 {
+				last = listed[n-1].Time.Time
+			}
+			if prev.After(last) {
+				due = true
+			}
+		}
+	}
+
+	if due {
+		set, err := r.takeSnapshotSet(ctx, cr, now)
+		if err != nil {
+			logger.Error(err, "failed to take snapshot set")
+			r.recorder.Event(cr, corev1.EventTypeWarning, "SnapshotFailed", err.Error())
+			requeueAfter(&res, SnapshotCheckInterval)
+		} else {
+			logger.Info("snapshot set taken", "set", set.Name)
+			r.recorder.Event(cr, corev1.EventTypeNormal, "SnapshotTaken", fmt.Sprintf("Snapshot set %s taken", set.Name))
+			if n := len(listed); n == 0 || listed[n-1].Name != set.Name {
+				listed = append(listed, snapshotSet{SnapshotSetStatus: *set})
+			}
+			if trigger != "" {
+				cr.Status.LastSnapshotTrigger = trigger
+			}
+		}
+	}
+
+	var sets []corootv1.SnapshotSetStatus
+	for _, set := range listed {
+		if set.incomplete {
+			// A set missing any of its snapshots can't be restored from.
+			if err = r.deleteSnapshotSet(ctx, cr, set.SnapshotSetStatus); err != nil {
+				logger.Error(err, "failed to delete incomplete snapshot set", "set", set.Name)
+			} else {
+				logger.Info("incomplete snapshot set deleted", "set", set.Name)
+			}
+			continue
+		}
+		if !set.ReadyToUse {
+			requeueAfter(&res, SnapshotCheckInterval)
+		}
+		sets = append(sets, set.SnapshotSetStatus)
+	}
+
+	retain := s.Retain
+	if retain <= 0 {
+		retain = SnapshotDefaultRetain
+	}
+	// The newest ready set is always kept, even if the newer sets are still pending, so there is a set to restore from.
+	lastReady := -1
+	for i, set := range sets {
+		if set.ReadyToUse {
+			lastReady = i
+		}
+	}
+	var kept []corootv1.SnapshotSetStatus
+	for i, set := range sets {
+		if i >= len(sets)-retain || i == lastReady {
+			kept = append(kept, set)
+			continue
+		}
+		if err = r.deleteSnapshotSet(ctx, cr, set); err != nil {
+			logger.Error(err, "failed to delete snapshot set", "set", set.Name)
+			kept = append(kept, set)
+			continue
+		}
+		logger.Info("snapshot set deleted", "set", set.Name)
+	}
+	cr.Status.Snapshots = kept
+	return res.RequeueAfter
+}
+
+type snapshotSet struct {
+	corootv1.SnapshotSetStatus
+	incomplete bool
+}
+
+// listSnapshotSets returns the snapshot sets of the instance, from the oldest to the newest.
+func (r *CorootReconciler) listSnapshotSets(ctx context.Context, cr *corootv1.Coroot) ([]snapshotSet, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(volumeSnapshotGVK.GroupVersion().WithKind(volumeSnapshotGVK.Kind + "List"))
+	if err := r.List(ctx, list, client.InNamespace(cr.Namespace), client.MatchingLabels(Labels(cr, "snapshot"))); err != nil {
+		return nil, err
+	}
+	sets := map[string]*snapshotSet{}
+	sizes := map[string]int{}
+	for _, vs := range list.Items {
+		name := vs.GetLabels()[snapshotSetLabel]
+		if name == "" || !vs.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+		set := sets[name]
+		if set == nil {
+			t, err := time.Parse(snapshotSetTimeFormat, name)
+			if err != nil {
+				t = vs.GetCreationTimestamp().Time
+			}
+			set = &snapshotSet{SnapshotSetStatus: corootv1.SnapshotSetStatus{Name: name, Time: metav1.NewTime(t), ReadyToUse: true}}
+			sets[name] = set
+		}
+		set.VolumeSnapshots = append(set.VolumeSnapshots, vs.GetName())
+		if ok, _, _ := unstructured.NestedBool(vs.Object, "status", "readyToUse"); !ok {
+			set.ReadyToUse = false
+		}
+		if size, err := strconv.Atoi(vs.GetAnnotations()[snapshotSetSizeAnnotation]); err == nil && size > sizes[name] {
+			sizes[name] = size
+		}
+	}
+	var res []snapshotSet
+	for name, set := range sets {
+		sort.Strings(set.VolumeSnapshots)
+		set.incomplete = len(set.VolumeSnapshots) < sizes[name]
+		res = append(res, *set)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// takeSnapshotSet flushes the buffered ClickHouse data to the disks and creates VolumeSnapshots of the PVCs.
+// If any of the snapshots can't be created, the ones already created are deleted.
+func (r *CorootReconciler) takeSnapshotSet(ctx context.Context, cr *corootv1.Coroot, now time.Time) (*corootv1.SnapshotSetStatus, error) {
+	if cr.Spec.ExternalClickhouse == nil && !hibernated(cr) {
+		for _, q := range []string{"SYSTEM FLUSH LOGS ON CLUSTER default", "SYSTEM FLUSH ASYNC INSERT QUEUE ON CLUSTER default"} {
+			if _, err := r.clickhouseQuery(ctx, cr, q); err != nil {
+				return nil, fmt.Errorf("failed to flush ClickHouse: %w", err)
+			}
+		}
+	}
+	set := &corootv1.SnapshotSetStatus{
+		Name: now.UTC().Format(snapshotSetTimeFormat),
+		Time: metav1.NewTime(now),
+	}
+	pvcs := r.snapshotPVCs(cr)
+	for _, pvc := range pvcs {
+		vs := r.volumeSnapshot(cr, pvc, set.Name, len(pvcs))
+		setCommonMetadata(cr, vs, vs.GetLabels(), nil)
+		if err := r.Create(ctx, vs); err != nil {
+			_ = r.deleteSnapshotSet(ctx, cr, *set)
+			return nil, fmt.Errorf("failed to create VolumeSnapshot %s: %w", vs.GetName(), err)
+		}
+		set.VolumeSnapshots = append(set.VolumeSnapshots, vs.GetName())
+	}
+	return set, nil
+}
+
+func (r *CorootReconciler) deleteSnapshotSet(ctx context.Context, cr *corootv1.Coroot, set corootv1.SnapshotSetStatus) error {
+	for _, name := range set.VolumeSnapshots {
+		vs := &unstructured.Unstructured{}
+		vs.SetGroupVersionKind(volumeSnapshotGVK)
+		vs.SetNamespace(cr.Namespace)
+		vs.SetName(name)
+		if err := r.Delete(ctx, vs); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotSchedule returns the last and the next moments of the snapshot schedule.
+func snapshotSchedule(s *corootv1.SnapshotsSpec, now time.Time) (time.Time, time.Time, error) {
+	loc := time.UTC
+	if s.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	schedule, err := parseCron(s.Schedule)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	now = now.In(loc)
+	return schedule.prev(now), schedule.next(now), nil
+}
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRetention(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	cr.Spec.Snapshots = &corootv1.SnapshotsSpec{Retain: 1}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(volumeSnapshotGVK, meta.RESTScopeNamespace)
+	var objs []client.Object
+	snapshot := func(pvc, set string, size int, ready bool) {
+		vs := r.volumeSnapshot(cr, pvc, set, size)
+		_ = unstructured.SetNestedField(vs.Object, ready, "status", "readyToUse")
+		objs = append(objs, vs)
+	}
+	snapshot("data-coroot-coroot", "20240101-000000", 2, true)
+	snapshot("data-coroot-clickhouse-keeper-0", "20240101-000000", 2, true)
+	snapshot("data-coroot-coroot", "20240102-000000", 2, true)
+	snapshot("data-coroot-clickhouse-keeper-0", "20240102-000000", 2, true)
+	// A snapshot of the set has been deleted.
+	snapshot("data-coroot-coroot", "20240103-000000", 2, true)
+	snapshot("data-coroot-coroot", "20240104-000000", 2, false)
+	snapshot("data-coroot-clickhouse-keeper-0", "20240104-000000", 2, true)
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithRESTMapper(mapper).WithObjects(objs...).Build()
+	ctx := context.Background()
+
+	// The status has been lost, but the sets are still tracked. The newest ready set is kept while the newer one is pending.
+	if next := r.checkSnapshots(ctx, cr, time.Now()); next != SnapshotCheckInterval {
+		t.Errorf("expected a check in %s, got %s", SnapshotCheckInterval, next)
+	}
+	var names []string
+	for _, set := range cr.Status.Snapshots {
+		names = append(names, set.Name+"/"+strconv.FormatBool(set.ReadyToUse))
+	}
+	if expected := []string{"20240102-000000/true", "20240104-000000/false"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+	sets, err := r.listSnapshotSets(ctx, cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 {
+		t.Errorf("expected the snapshots of the other sets to be deleted, got %v", sets)
+	}
+}
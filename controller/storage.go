@@ -0,0 +1,202 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/utils/ptr"
+	"maps"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// pvcStorage reports whether the data is stored in PVCs, rather than in directories on the nodes or emptyDir volumes.
+func pvcStorage(storage corootv1.StorageSpec) bool {
+	return storage.HostPath == nil && !storage.Ephemeral
+}
+
+// storageClassName returns the storage class of the component's PVCs.
+// Falls back to spec.storage.className, which the ClickHouse and Keeper PVCs used to be created with.
+func storageClassName(storage corootv1.StorageSpec, cr *corootv1.Coroot) *string {
+	if storage.ClassName != nil {
+		return storage.ClassName
+	}
+	return cr.Spec.Storage.ClassName
+}
+
+// applyStatefulSetStorage replaces the volume claim templates of the StatefulSet with the hostPath or emptyDir data volume.
+func applyStatefulSetStorage(storage corootv1.StorageSpec, ss *appsv1.StatefulSet) {
+	if pvcStorage(storage) {
+		return
+	}
+	ss.Spec.VolumeClaimTemplates = nil
+	applyPodStorage(storage, &ss.Spec.Template.Spec, true)
+}
+
+// applyPodStorage replaces the data volume of the pod with an emptyDir volume or a directory on the node.
+// With hostPath, the replicas of StatefulSets (perPod) store their data in subdirectories named after the pods,
+// which are created by a non-root init container. Since hostPath volumes ignore fsGroup, the directory is handed over
+// to the user of the pod by a root init container only if fixPermissions is set.
+func applyPodStorage(storage corootv1.StorageSpec, spec *corev1.PodSpec, perPod bool) {
+	if pvcStorage(storage) {
+		return
+	}
+	if storage.Ephemeral {
+		emptyDir := &corev1.EmptyDirVolumeSource{}
+		if !storage.Size.IsZero() {
+			emptyDir.SizeLimit = ptr.To(storage.Size)
+		}
+		setVolume(spec, corev1.Volume{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: emptyDir}})
+		return
+	}
+	hp := storage.HostPath
+	volume := corev1.Volume{
+		Name: "data",
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: hp.Path, Type: ptr.To(corev1.HostPathDirectoryOrCreate)},
+		},
+	}
+	setVolume(spec, volume)
+
+	podName := corev1.EnvVar{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}}
+	dir := "/data"
+	if perPod {
+		dir = "/data/$POD_NAME"
+		for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+			for i := range containers {
+				c := &containers[i]
+				mounted := false
+				for j := range c.VolumeMounts {
+					if c.VolumeMounts[j].Name == volume.Name {
+						c.VolumeMounts[j].SubPathExpr = "$(POD_NAME)"
+						mounted = true
+					}
+				}
+				if mounted && !hasEnv(c.Env, podName.Name) {
+					c.Env = append(c.Env, podName)
+				}
+			}
+		}
+	}
+
+	init := corev1.Container{
+		Name:            "data-dir",
+		Image:           UBIMinimalImage,
+		Command:         []string{"/bin/sh", "-c"},
+		Args:            []string{fmt.Sprintf("mkdir -p %s", dir)},
+		Env:             []corev1.EnvVar{podName},
+		VolumeMounts:    []corev1.VolumeMount{{Name: volume.Name, MountPath: "/data"}},
+		SecurityContext: restrictedSecurityContext,
+	}
+	if hp.FixPermissions {
+		uid, gid := int64(65534), int64(65534)
+		if sc := spec.SecurityContext; sc != nil {
+			if sc.RunAsUser != nil {
+				uid = *sc.RunAsUser
+			}
+			if sc.RunAsGroup != nil {
+				gid = *sc.RunAsGroup
+			}
+		}
+		init.Name = "data-permissions"
+		init.Args = []string{fmt.Sprintf("mkdir -p %[1]s && chown %[2]d:%[3]d %[1]s", dir, uid, gid)}
+		init.SecurityContext = &corev1.SecurityContext{
+			RunAsUser:                ptr.To(int64(0)),
+			RunAsNonRoot:             ptr.To(false),
+			AllowPrivilegeEscalation: ptr.To(false),
+			ReadOnlyRootFilesystem:   ptr.To(true),
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+				Add:  []corev1.Capability{"CHOWN", "DAC_OVERRIDE"},
+			},
+		}
+	}
+	if perPod || hp.FixPermissions {
+		spec.InitContainers = append([]corev1.Container{init}, spec.InitContainers...)
+	}
+
+	if hp.NodeName != "" {
+		spec.NodeSelector = maps.Clone(spec.NodeSelector)
+		if spec.NodeSelector == nil {
+			spec.NodeSelector = map[string]string{}
+		}
+		spec.NodeSelector[corev1.LabelHostname] = hp.NodeName
+	}
+}
+
+func setVolume(spec *corev1.PodSpec, volume corev1.Volume) {
+	for i := range spec.Volumes {
+		if spec.Volumes[i].Name == volume.Name {
+			spec.Volumes[i] = volume
+			return
+		}
+	}
+	spec.Volumes = append(spec.Volumes, volume)
+}
+
+func hasEnv(env []corev1.EnvVar, name string) bool {
+	for _, e := range env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPVCStorageClass handles a change of the storage class of an existing PVC, which can't be changed in place.
+// With the Recreate policy, the PVC and the pods using it are deleted, and the returned error makes the reconciliation
+// retried until the PVC is gone and can be created with the new storage class.
+func (r *CorootReconciler) checkPVCStorageClass(ctx context.Context, cr *corootv1.Coroot, pvc *corev1.PersistentVolumeClaim, policy corootv1.StorageClassChangePolicy) error {
+	if pvc.Spec.StorageClassName == nil {
+		return nil
+	}
+	existing := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, client.ObjectKeyFromObject(pvc), existing)
+	switch {
+	case errors.IsNotFound(err):
+		return nil
+	case err != nil:
+		return err
+	case existing.DeletionTimestamp != nil:
+		return fmt.Errorf("waiting for PVC %s to be deleted", pvc.Name)
+	}
+	className := ptr.Deref(existing.Spec.StorageClassName, "")
+	if className == *pvc.Spec.StorageClassName {
+		return nil
+	}
+
+	logger := ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name)
+	if policy != corootv1.StorageClassChangePolicyRecreate {
+		msg := fmt.Sprintf("PVC %s keeps the storage class %q instead of %q, set storage.classChangePolicy to Recreate to recreate it (the data will be lost)",
+			pvc.Name, className, *pvc.Spec.StorageClassName)
+		logger.Info(msg)
+		r.recorder.Event(cr, corev1.EventTypeWarning, "StorageClassChangeIgnored", msg)
+		return nil
+	}
+
+	msg := fmt.Sprintf("recreating PVC %s with the storage class %q instead of %q, the data is lost", pvc.Name, *pvc.Spec.StorageClassName, className)
+	logger.Info(msg)
+	r.recorder.Event(cr, corev1.EventTypeWarning, "StorageClassChanged", msg)
+	if err = r.Delete(ctx, existing); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	// The PVC is protected from deletion while it's used by pods.
+	pods := &corev1.PodList{}
+	if err = r.apiReader.List(ctx, pods, client.InNamespace(cr.Namespace)); err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		for _, v := range pod.Spec.Volumes {
+			if v.PersistentVolumeClaim == nil || v.PersistentVolumeClaim.ClaimName != pvc.Name {
+				continue
+			}
+			if err = r.Delete(ctx, &pod); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("waiting for PVC %s to be deleted", pvc.Name)
+}
@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sort"
+)
+
+const (
+	ConditionTypeAccepted = "Accepted"
+)
+
+// +kubebuilder:rbac:groups=coroot.com,resources=coroottenants,verbs=get;list;watch
+// +kubebuilder:rbac:groups=coroot.com,resources=coroottenants/status,verbs=get;update;patch
+
+// applyTenants adds the projects of the CorootTenants referencing the Coroot to its spec and reports to the tenants whether they are accepted.
+// Project name conflicts are resolved in favor of spec.projects and then the older tenants.
+func (r *CorootReconciler) applyTenants(ctx context.Context, cr *corootv1.Coroot) error {
+	list := &corootv1.CorootTenantList{}
+	// Tenants are optional, so the Coroot is reconciled without them, e.g., if the CorootTenant CRD isn't installed.
+	if err := r.List(ctx, list); err != nil {
+		if !meta.IsNoMatchError(err) {
+			ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Error(err, "failed to list CorootTenants")
+		}
+		return nil
+	}
+	var tenants []*corootv1.CorootTenant
+	for i := range list.Items {
+		t := &list.Items[i]
+		if t.Spec.Coroot == cr.Name && t.CorootNamespace() == cr.Namespace && t.DeletionTimestamp.IsZero() {
+			tenants = append(tenants, t)
+		}
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		ti, tj := tenants[i], tenants[j]
+		if !ti.CreationTimestamp.Equal(&tj.CreationTimestamp) {
+			return ti.CreationTimestamp.Before(&tj.CreationTimestamp)
+		}
+		return ti.Namespace+"/"+ti.Name < tj.Namespace+"/"+tj.Name
+	})
+
+	projects := map[string]bool{}
+	for _, p := range cr.Spec.Projects {
+		projects[p.Name] = true
+	}
+	for _, t := range tenants {
+		status := t.Status.DeepCopy()
+		accepted := metav1.Condition{Type: ConditionTypeAccepted, Status: metav1.ConditionTrue, Reason: "Accepted", ObservedGeneration: t.Generation}
+		project, reason, err := r.tenantProject(ctx, cr, t, projects)
+		if err != nil {
+			accepted.Status = metav1.ConditionFalse
+			accepted.Reason = reason
+			accepted.Message = err.Error()
+			t.Status.Project = ""
+		} else {
+			projects[project.Name] = true
+			cr.Spec.Projects = append(cr.Spec.Projects, *project)
+			t.Status.Project = project.Name
+		}
+		meta.SetStatusCondition(&t.Status.Conditions, accepted)
+		if equality.Semantic.DeepEqual(status, &t.Status) {
+			continue
+		}
+		if err = r.Status().Update(ctx, t); err != nil {
+			ctrl.Log.WithValues("namespace", t.Namespace, "name", t.Name).Error(err, "failed to update CorootTenant status")
+		}
+	}
+	return nil
+}
+
+// tenantProject returns the project of the tenant with the API keys resolved from the tenant's namespace,
+// or the reason the tenant can't be accepted.
+func (r *CorootReconciler) tenantProject(ctx context.Context, cr *corootv1.Coroot, t *corootv1.CorootTenant, projects map[string]bool) (*corootv1.ProjectSpec, string, error) {
+	allowed, err := r.tenantNamespaceAllowed(ctx, cr, t.Namespace)
+	if err != nil {
+		return nil, "NamespaceNotAllowed", err
+	}
+	if !allowed {
+		return nil, "NamespaceNotAllowed", fmt.Errorf("namespace %s isn't matched by the tenantNamespaceSelector of the Coroot", t.Namespace)
+	}
+	name := t.ProjectName()
+	if projects[name] {
+		return nil, "ProjectConflict", fmt.Errorf("project %s is already defined by the Coroot or another tenant", name)
+	}
+	project := &corootv1.ProjectSpec{Name: name}
+	for _, k := range t.Spec.ApiKeys {
+		key, err := r.namespacedSecretValue(ctx, t.Namespace, k.Key, k.KeySecret)
+		if err != nil {
+			return nil, "SecretError", err
+		}
+		project.ApiKeys = append(project.ApiKeys, corootv1.ApiKeySpec{Key: key, Description: k.Description})
+	}
+	return project, "", nil
+}
+
+func (r *CorootReconciler) tenantNamespaceAllowed(ctx context.Context, cr *corootv1.Coroot, namespace string) (bool, error) {
+	if namespace == cr.Namespace {
+		return true, nil
+	}
+	if cr.Spec.TenantNamespaceSelector == nil {
+		return false, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(cr.Spec.TenantNamespaceSelector)
+	if err != nil {
+		return false, fmt.Errorf("invalid tenantNamespaceSelector: %w", err)
+	}
+	ns := &corev1.Namespace{}
+	if err = r.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		return false, fmt.Errorf("failed to get namespace %s: %w", namespace, err)
+	}
+	return selector.Matches(labels.Set(ns.Labels)), nil
+}
+
+// tenantRequests enqueues the Coroot referenced by the tenant.
+func tenantRequests(_ context.Context, obj client.Object) []reconcile.Request {
+	t, ok := obj.(*corootv1.CorootTenant)
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: t.CorootNamespace(), Name: t.Spec.Coroot}}}
+}
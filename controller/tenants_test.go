@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"context"
+	corootv1 "github.io/coroot/operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func TestApplyTenants(t *testing.T) {
+	r := testReconciler(t)
+	cr := testCoroot()
+	tenant := &corootv1.CorootTenant{
+		ObjectMeta: metav1.ObjectMeta{Name: "payments", Namespace: cr.Namespace},
+		Spec:       corootv1.CorootTenantSpec{Coroot: cr.Name, ApiKeys: []corootv1.ApiKeySpec{{Key: "secret"}}},
+	}
+	r.Client = fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(tenant).WithStatusSubresource(tenant).Build()
+	if err := r.applyTenants(context.Background(), cr); err != nil {
+		t.Fatal(err)
+	}
+	if len(cr.Spec.Projects) != 1 || cr.Spec.Projects[0].Name != "payments" {
+		t.Errorf("expected the tenant project to be added, got %+v", cr.Spec.Projects)
+	}
+
+	// The Coroot is reconciled without tenants if they can't be listed, e.g., if the CRD isn't installed.
+	r.Client = fake.NewClientBuilder().Build()
+	cr = testCoroot()
+	if err := r.applyTenants(context.Background(), cr); err != nil {
+		t.Fatal(err)
+	}
+	if len(cr.Spec.Projects) != 0 {
+		t.Errorf("expected no projects, got %+v", cr.Spec.Projects)
+	}
+}
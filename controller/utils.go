@@ -4,16 +4,24 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"golang.org/x/net/http/httpproxy"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"math/big"
+	"net/http"
+	"net/url"
 	"reflect"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const (
-	LastAppliedAnnotation = "operator.coroot.com/last-applied-configuration"
-	RandomStringCharset   = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	LastAppliedAnnotation     = "operator.coroot.com/last-applied-configuration"
+	AppliedMetadataAnnotation = "operator.coroot.com/applied-metadata"
+	RandomStringCharset       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 )
 
 func RandomString(length int) string {
@@ -74,6 +82,14 @@ func MergeSpecs[T any](obj client.Object, currentSpec *T, targetSpec T) error {
 	return nil
 }
 
+// applyContainerOverrides adds the user-defined arguments and lifecycle hooks to the main container of a component.
+func applyContainerOverrides(c *corev1.Container, extraArgs []string, lifecycle *corev1.Lifecycle) {
+	c.Args = append(c.Args, extraArgs...)
+	if lifecycle != nil {
+		c.Lifecycle = lifecycle
+	}
+}
+
 func secretKeySelector(name, key string) *corev1.SecretKeySelector {
 	return &corev1.SecretKeySelector{
 		LocalObjectReference: corev1.LocalObjectReference{
@@ -82,3 +98,99 @@ func secretKeySelector(name, key string) *corev1.SecretKeySelector {
 		Key: key,
 	}
 }
+
+// secretEnv returns an env var with the value taken from the secret if it's referenced, otherwise with the plain value.
+func secretEnv(name, value string, secret *corev1.SecretKeySelector) corev1.EnvVar {
+	if secret != nil {
+		return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: secret}}
+	}
+	return corev1.EnvVar{Name: name, Value: value}
+}
+
+// goRuntimeEnv appends GOMEMLIMIT and GOMAXPROCS derived from the container limits to the env
+// unless they are set explicitly. This makes the Go runtime respect the limits and prevents OOM kills and CPU throttling.
+func goRuntimeEnv(env []corev1.EnvVar, resources corev1.ResourceRequirements) []corev1.EnvVar {
+	defined := map[string]bool{}
+	for _, e := range env {
+		defined[e.Name] = true
+	}
+	if memory, ok := resources.Limits[corev1.ResourceMemory]; ok && !defined["GOMEMLIMIT"] {
+		// Leaving some headroom for the non-heap memory.
+		if limit := memory.Value() * 9 / 10; limit > 0 {
+			env = append(env, corev1.EnvVar{Name: "GOMEMLIMIT", Value: strconv.FormatInt(limit, 10)})
+		}
+	}
+	if cpu, ok := resources.Limits[corev1.ResourceCPU]; ok && !defined["GOMAXPROCS"] {
+		procs := (cpu.MilliValue() + 999) / 1000
+		if procs < 1 {
+			procs = 1
+		}
+		env = append(env, corev1.EnvVar{Name: "GOMAXPROCS", Value: strconv.FormatInt(procs, 10)})
+	}
+	return env
+}
+
+func clusterDomain(cr *corootv1.Coroot) string {
+	if cr.Spec.ClusterDomain != "" {
+		return strings.Trim(cr.Spec.ClusterDomain, ".")
+	}
+	return DefaultClusterDomain
+}
+
+// noProxy returns the configured exclusions along with the cluster-internal addresses, so the agents keep sending
+// telemetry to the in-cluster Coroot and reaching the Kubernetes API directly.
+func noProxy(cr *corootv1.Coroot) string {
+	hosts := []string{"localhost", "127.0.0.1", cr.Namespace, ".svc", "." + clusterDomain(cr), "$(KUBERNETES_SERVICE_HOST)"}
+	if p := cr.Spec.Proxy; p != nil && p.NoProxy != "" {
+		hosts = append(hosts, strings.Trim(p.NoProxy, ", "))
+	}
+	return strings.Join(hosts, ",")
+}
+
+func proxyEnv(cr *corootv1.Coroot) []corev1.EnvVar {
+	p := cr.Spec.Proxy
+	if p == nil {
+		return nil
+	}
+	var env []corev1.EnvVar
+	if p.HTTPProxy != "" {
+		env = append(env, corev1.EnvVar{Name: "HTTP_PROXY", Value: p.HTTPProxy})
+	}
+	if p.HTTPSProxy != "" {
+		env = append(env, corev1.EnvVar{Name: "HTTPS_PROXY", Value: p.HTTPSProxy})
+	}
+	return append(env, corev1.EnvVar{Name: "NO_PROXY", Value: noProxy(cr)})
+}
+
+var (
+	// The clients are shared by the instances with the same proxy settings, so their connections are reused.
+	proxyClients     = map[corootv1.ProxySpec]*http.Client{}
+	proxyClientsLock sync.Mutex
+)
+
+// proxyClient returns an HTTP client for the operator's requests on behalf of the Coroot instance.
+// Without the proxy settings, the operator's own environment (HTTP_PROXY, HTTPS_PROXY, NO_PROXY) is used.
+func proxyClient(cr *corootv1.Coroot) *http.Client {
+	p := cr.Spec.Proxy
+	if p == nil {
+		return http.DefaultClient
+	}
+	proxyClientsLock.Lock()
+	defer proxyClientsLock.Unlock()
+	if c := proxyClients[*p]; c != nil {
+		return c
+	}
+	proxy := (&httpproxy.Config{
+		HTTPProxy:  p.HTTPProxy,
+		HTTPSProxy: p.HTTPSProxy,
+		// The operator doesn't run in the Coroot namespace, so only the configured exclusions apply.
+		NoProxy: p.NoProxy,
+	}).ProxyFunc()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+	c := &http.Client{Transport: transport}
+	proxyClients[*p] = c
+	return c
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"net/http"
+	"testing"
+)
+
+func TestMergeSpecs(t *testing.T) {
+	spec := func(image string, args ...string) appsv1.DeploymentSpec {
+		return appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: image, Args: args}},
+				},
+			},
+		}
+	}
+
+	d := &appsv1.Deployment{}
+	if err := MergeSpecs(d, &d.Spec, spec("app:1", "--a", "--b")); err != nil {
+		t.Fatal(err)
+	}
+	// Changes made by others, e.g., by kubectl rollout restart.
+	d.Spec.Template.Annotations = map[string]string{"kubectl.kubernetes.io/restartedAt": "now"}
+
+	if err := MergeSpecs(d, &d.Spec, spec("app:2", "--a")); err != nil {
+		t.Fatal(err)
+	}
+	c := d.Spec.Template.Spec.Containers[0]
+	if c.Image != "app:2" {
+		t.Errorf("expected the image to be updated, got %q", c.Image)
+	}
+	if len(c.Args) != 1 || c.Args[0] != "--a" {
+		t.Errorf("expected the removed argument to be deleted, got %v", c.Args)
+	}
+	if d.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] != "now" {
+		t.Errorf("expected the annotation set by others to be kept")
+	}
+
+	// Objects created before the last applied annotation was introduced.
+	d.Annotations = nil
+	if err := MergeSpecs(d, &d.Spec, spec("app:3", "--a")); err != nil {
+		t.Fatal(err)
+	}
+	if image := d.Spec.Template.Spec.Containers[0].Image; image != "app:3" {
+		t.Errorf("expected the image to be updated without the last applied annotation, got %q", image)
+	}
+	if d.Annotations[LastAppliedAnnotation] == "" {
+		t.Errorf("expected the last applied annotation to be set")
+	}
+}
+
+func TestProxyClient(t *testing.T) {
+	cr := testCoroot()
+	if proxyClient(cr) != http.DefaultClient {
+		t.Error("expected the default client without the proxy settings")
+	}
+	cr.Spec.Proxy = &corootv1.ProxySpec{HTTPSProxy: "http://proxy:3128"}
+	c := proxyClient(cr)
+	other := testCoroot()
+	other.Spec.Proxy = &corootv1.ProxySpec{HTTPSProxy: "http://proxy:3128"}
+	if proxyClient(other) != c {
+		t.Error("expected the client to be shared by the instances with the same proxy settings")
+	}
+	other.Spec.Proxy.NoProxy = "registry.example.com"
+	if proxyClient(other) == c {
+		t.Error("expected a separate client for different proxy settings")
+	}
+}
@@ -0,0 +1,233 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"slices"
+	"strings"
+)
+
+var readOnlyVerbs = []string{"get", "list", "watch"}
+
+// validateSpec checks the values the CRD schema can't validate. Such values would break the generated configs
+// or fail the child resources one by one, so the reconciliation is stopped with the offending fields in the status instead.
+func validateSpec(cr *corootv1.Coroot) field.ErrorList {
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+	s := cr.Spec
+
+	errs = append(errs, validateAffinity(s.NodeAgent.Affinity, spec.Child("nodeAgent", "affinity"))...)
+	errs = append(errs, validateAffinity(s.ClusterAgent.Affinity, spec.Child("clusterAgent", "affinity"))...)
+	errs = append(errs, validateDNS(s.NodeAgent.PodDNSSpec, spec.Child("nodeAgent"))...)
+	errs = append(errs, validateDNS(s.ClusterAgent.PodDNSSpec, spec.Child("clusterAgent"))...)
+	errs = append(errs, validateExtraRBACRules(s.ClusterAgent.ExtraRBACRules, spec.Child("clusterAgent", "extraRBACRules"))...)
+	errs = append(errs, validateRegexps(s.NodeAgent.ContainerAllowlist, spec.Child("nodeAgent", "containerAllowlist"))...)
+	errs = append(errs, validateRegexps(s.NodeAgent.ContainerDenylist, spec.Child("nodeAgent", "containerDenylist"))...)
+	if s.NodeAgent.HostNetwork && (s.NodeAgent.Metrics == nil || s.NodeAgent.Metrics.Port == 0) {
+		errs = append(errs, field.Required(spec.Child("nodeAgent", "metrics", "port"),
+			"must be set with hostNetwork, otherwise the node-agent listens on port 80 of every node"))
+	}
+	if s.AgentsOnly != nil {
+		return errs
+	}
+	errs = append(errs, validateAffinity(s.Affinity, spec.Child("affinity"))...)
+	errs = append(errs, validateDNS(s.PodDNSSpec, spec)...)
+
+	if victoriaMetricsEnabled(cr) {
+		errs = append(errs, validateAffinity(s.VictoriaMetrics.Affinity, spec.Child("victoriaMetrics", "affinity"))...)
+		errs = append(errs, validateDNS(s.VictoriaMetrics.PodDNSSpec, spec.Child("victoriaMetrics"))...)
+	} else {
+		prometheus := spec.Child("prometheus")
+		errs = append(errs, validateAffinity(s.Prometheus.Affinity, prometheus.Child("affinity"))...)
+		errs = append(errs, validateDNS(s.Prometheus.PodDNSSpec, prometheus)...)
+		errs = append(errs, validateYAMLList(s.Prometheus.ScrapeConfigs, prometheus.Child("scrapeConfigs"))...)
+		errs = append(errs, validateYAMLList(s.Prometheus.MetricRelabelConfigs, prometheus.Child("metricRelabelConfigs"))...)
+		errs = append(errs, validateYAMLList(s.Prometheus.RecordingRules, prometheus.Child("recordingRules"))...)
+	}
+
+	if p := s.Probes; p != nil {
+		errs = append(errs, validateDNS(p.PodDNSSpec, spec.Child("probes"))...)
+		regions := map[string]bool{}
+		for i, region := range p.Regions {
+			if regions[region.Name] {
+				errs = append(errs, field.Duplicate(spec.Child("probes", "regions").Index(i).Child("name"), region.Name))
+			}
+			regions[region.Name] = true
+		}
+		targets := map[string]bool{}
+		for i, t := range p.Targets {
+			if targets[t.Name] {
+				errs = append(errs, field.Duplicate(spec.Child("probes", "targets").Index(i).Child("name"), t.Name))
+			}
+			targets[t.Name] = true
+		}
+	}
+
+	if s.ExternalClickhouse == nil {
+		clickhouse := spec.Child("clickhouse")
+		errs = append(errs, validateAffinity(s.Clickhouse.Affinity, clickhouse.Child("affinity"))...)
+		errs = append(errs, validateDNS(s.Clickhouse.PodDNSSpec, clickhouse)...)
+		errs = append(errs, validateExtraConfig(s.Clickhouse.ExtraConfig, clickhouse.Child("extraConfig"))...)
+		errs = append(errs, validateAffinity(s.Clickhouse.Keeper.Affinity, clickhouse.Child("keeper", "affinity"))...)
+		errs = append(errs, validateDNS(s.Clickhouse.Keeper.PodDNSSpec, clickhouse.Child("keeper"))...)
+		errs = append(errs, validateExtraConfig(s.Clickhouse.Keeper.ExtraConfig, clickhouse.Child("keeper", "extraConfig"))...)
+	}
+	return errs
+}
+
+func validateYAMLList(data string, path *field.Path) field.ErrorList {
+	var v []any
+	if err := yaml.Unmarshal([]byte(data), &v); err != nil {
+		return field.ErrorList{field.Invalid(path, field.OmitValueType{}, "must be a YAML list: "+err.Error())}
+	}
+	return nil
+}
+
+// validateExtraConfig checks that the raw XML is well-formed and doesn't terminate the heredoc it's written with (see configCmd).
+func validateExtraConfig(data string, path *field.Path) field.ErrorList {
+	if data == "" {
+		return nil
+	}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		if scanner.Text() == "EOF" {
+			return field.ErrorList{field.Invalid(path, field.OmitValueType{}, "must not contain an EOF line")}
+		}
+	}
+	d := xml.NewDecoder(strings.NewReader(data))
+	for {
+		_, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return field.ErrorList{field.Invalid(path, field.OmitValueType{}, "must be valid XML: "+err.Error())}
+		}
+	}
+}
+
+// validateExtraRBACRules allows only reading resources other than secrets, as anyone who can edit the Coroot
+// would otherwise be able to grant the cluster-agent ServiceAccount arbitrary permissions through the operator.
+func validateExtraRBACRules(rules []rbacv1.PolicyRule, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for i, rule := range rules {
+		p := path.Index(i)
+		for j, verb := range rule.Verbs {
+			if !slices.Contains(readOnlyVerbs, verb) {
+				errs = append(errs, field.NotSupported(p.Child("verbs").Index(j), verb, readOnlyVerbs))
+			}
+		}
+		for j, group := range rule.APIGroups {
+			if group == rbacv1.APIGroupAll {
+				errs = append(errs, field.Forbidden(p.Child("apiGroups").Index(j), "wildcards aren't allowed"))
+			}
+		}
+		for j, resource := range rule.Resources {
+			switch {
+			case strings.Contains(resource, rbacv1.ResourceAll):
+				errs = append(errs, field.Forbidden(p.Child("resources").Index(j), "wildcards aren't allowed"))
+			case resource == "secrets" || strings.HasPrefix(resource, "secrets/"):
+				errs = append(errs, field.Forbidden(p.Child("resources").Index(j), "secrets can't be granted"))
+			}
+		}
+	}
+	return errs
+}
+
+// validateRegexps checks the regular expressions passed to the agents, which would otherwise fail to start.
+func validateRegexps(exprs []string, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for i, expr := range exprs {
+		if _, err := regexp.Compile(expr); err != nil {
+			errs = append(errs, field.Invalid(path.Index(i), expr, err.Error()))
+		}
+	}
+	return errs
+}
+
+// validateDNS checks that the None DNS policy comes with nameservers, as the pods would be rejected otherwise.
+func validateDNS(dns corootv1.PodDNSSpec, path *field.Path) field.ErrorList {
+	if dns.DNSPolicy != corev1.DNSNone || (dns.DNSConfig != nil && len(dns.DNSConfig.Nameservers) > 0) {
+		return nil
+	}
+	return field.ErrorList{field.Required(path.Child("dnsConfig", "nameservers"), "required when dnsPolicy is None")}
+}
+
+// validateAffinity checks the parts of the affinity that are only validated when the pods are created,
+// which would leave the component without pods rather than fail the reconciliation.
+func validateAffinity(a *corev1.Affinity, path *field.Path) field.ErrorList {
+	if a == nil {
+		return nil
+	}
+	var errs field.ErrorList
+	if na := a.NodeAffinity; na != nil {
+		if required := na.RequiredDuringSchedulingIgnoredDuringExecution; required != nil {
+			p := path.Child("nodeAffinity", "requiredDuringSchedulingIgnoredDuringExecution", "nodeSelectorTerms")
+			for i, term := range required.NodeSelectorTerms {
+				errs = append(errs, validateNodeSelectorTerm(term, p.Index(i))...)
+			}
+		}
+		p := path.Child("nodeAffinity", "preferredDuringSchedulingIgnoredDuringExecution")
+		for i, term := range na.PreferredDuringSchedulingIgnoredDuringExecution {
+			errs = append(errs, validateNodeSelectorTerm(term.Preference, p.Index(i).Child("preference"))...)
+		}
+	}
+	if pa := a.PodAffinity; pa != nil {
+		errs = append(errs, validatePodAffinityTerms(pa.RequiredDuringSchedulingIgnoredDuringExecution, pa.PreferredDuringSchedulingIgnoredDuringExecution, path.Child("podAffinity"))...)
+	}
+	if pa := a.PodAntiAffinity; pa != nil {
+		errs = append(errs, validatePodAffinityTerms(pa.RequiredDuringSchedulingIgnoredDuringExecution, pa.PreferredDuringSchedulingIgnoredDuringExecution, path.Child("podAntiAffinity"))...)
+	}
+	return errs
+}
+
+func validateNodeSelectorTerm(term corev1.NodeSelectorTerm, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for i, req := range term.MatchExpressions {
+		p := path.Child("matchExpressions").Index(i)
+		switch req.Operator {
+		case corev1.NodeSelectorOpIn, corev1.NodeSelectorOpNotIn:
+			if len(req.Values) == 0 {
+				errs = append(errs, field.Required(p.Child("values"), "must be specified when operator is In or NotIn"))
+			}
+		case corev1.NodeSelectorOpExists, corev1.NodeSelectorOpDoesNotExist:
+			if len(req.Values) > 0 {
+				errs = append(errs, field.Forbidden(p.Child("values"), "may not be specified when operator is Exists or DoesNotExist"))
+			}
+		case corev1.NodeSelectorOpGt, corev1.NodeSelectorOpLt:
+			if len(req.Values) != 1 {
+				errs = append(errs, field.Required(p.Child("values"), "must be specified single value when operator is Gt or Lt"))
+			}
+		default:
+			errs = append(errs, field.Invalid(p.Child("operator"), req.Operator, "not a valid selector operator"))
+		}
+	}
+	return errs
+}
+
+func validatePodAffinityTerms(required []corev1.PodAffinityTerm, preferred []corev1.WeightedPodAffinityTerm, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	validate := func(term corev1.PodAffinityTerm, p *field.Path) {
+		if term.TopologyKey == "" {
+			errs = append(errs, field.Required(p.Child("topologyKey"), "can not be empty"))
+		}
+		errs = append(errs, metav1validation.ValidateLabelSelector(term.LabelSelector, metav1validation.LabelSelectorValidationOptions{}, p.Child("labelSelector"))...)
+		errs = append(errs, metav1validation.ValidateLabelSelector(term.NamespaceSelector, metav1validation.LabelSelectorValidationOptions{}, p.Child("namespaceSelector"))...)
+	}
+	for i, term := range required {
+		validate(term, path.Child("requiredDuringSchedulingIgnoredDuringExecution").Index(i))
+	}
+	for i, term := range preferred {
+		validate(term.PodAffinityTerm, path.Child("preferredDuringSchedulingIgnoredDuringExecution").Index(i).Child("podAffinityTerm"))
+	}
+	return errs
+}
@@ -0,0 +1,50 @@
+package controller
+
+import (
+	corootv1 "github.io/coroot/operator/api/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"testing"
+)
+
+func TestValidateExtraRBACRules(t *testing.T) {
+	path := field.NewPath("spec", "clusterAgent", "extraRBACRules")
+	allowed := []rbacv1.PolicyRule{
+		{APIGroups: []string{"argoproj.io"}, Resources: []string{"rollouts"}, Verbs: []string{"get", "list", "watch"}},
+	}
+	if errs := validateExtraRBACRules(allowed, path); len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	for _, rule := range []rbacv1.PolicyRule{
+		{APIGroups: []string{"rbac.authorization.k8s.io"}, Resources: []string{"clusterroles"}, Verbs: []string{"escalate"}},
+		{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"*"}},
+		{APIGroups: []string{"*"}, Resources: []string{"pods"}, Verbs: []string{"get"}},
+		{APIGroups: []string{""}, Resources: []string{"*"}, Verbs: []string{"get"}},
+		{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"list"}},
+	} {
+		if errs := validateExtraRBACRules([]rbacv1.PolicyRule{rule}, path); len(errs) == 0 {
+			t.Errorf("expected %+v to be rejected", rule)
+		}
+	}
+}
+
+func TestValidateNodeAgentContainerFilters(t *testing.T) {
+	cr := testCoroot()
+	cr.Spec.NodeAgent.ContainerAllowlist = []string{"/k8s/production/.*"}
+	cr.Spec.NodeAgent.ContainerDenylist = []string{"/k8s/batch/.*", "/k8s/(test"}
+	if errs := validateSpec(cr); len(errs) != 1 || errs[0].Field != "spec.nodeAgent.containerDenylist[1]" {
+		t.Errorf("expected the invalid regexp to be rejected, got %v", errs)
+	}
+}
+
+func TestValidateNodeAgentHostNetwork(t *testing.T) {
+	cr := testCoroot()
+	cr.Spec.NodeAgent.HostNetwork = true
+	if errs := validateSpec(cr); len(errs) != 1 || errs[0].Field != "spec.nodeAgent.metrics.port" {
+		t.Errorf("expected hostNetwork without a port to be rejected, got %v", errs)
+	}
+	cr.Spec.NodeAgent.Metrics = &corootv1.NodeAgentMetricsSpec{Port: 10300}
+	if errs := validateSpec(cr); len(errs) > 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
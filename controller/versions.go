@@ -1,13 +1,31 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	corootv1 "github.io/coroot/operator/api/v1"
 	"io"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"maps"
 	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"strings"
+	"time"
+)
+
+const (
+	AppVersionsUpdateJitter  = 0.1
+	AppVersionsRetryInterval = 30 * time.Second
+	AppVersionsFetchTimeout  = time.Minute
+
+	AppVersionsStartupRetryInterval = 2 * time.Second
 )
 
 type App string
@@ -36,7 +54,7 @@ func (r *CorootReconciler) getAppImage(cr *corootv1.Coroot, app App) string {
 		defer r.versionsLock.Unlock()
 		v = r.versions[app]
 		if v == "" {
-			return "latest"
+			return ""
 		}
 	}
 	if strings.Contains(v, ":") {
@@ -45,44 +63,290 @@ func (r *CorootReconciler) getAppImage(cr *corootv1.Coroot, app App) string {
 	return fmt.Sprintf("ghcr.io/coroot/%s:%s", app, v)
 }
 
-func (r *CorootReconciler) fetchAppVersions() {
-	logger := log.FromContext(nil)
-	versions := map[App]string{}
-	for _, app := range []App{AppCorootCE, AppCorootEE, AppNodeAgent, AppClusterAgent} {
-		v, err := r.fetchAppVersion(app)
-		if err != nil {
-			logger.Error(err, "failed to get version", "app", app)
+// imageVersion returns the tag or the digest of the image.
+func imageVersion(image string) string {
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		return image[i+1:]
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return "latest"
+}
+
+var apps = []App{AppCorootCE, AppCorootEE, AppNodeAgent, AppClusterAgent}
+
+// missingAppImages returns the apps of the instance with no image, because neither the spec nor the fetched versions set it.
+func (r *CorootReconciler) missingAppImages(cr *corootv1.Coroot) []App {
+	used := []App{AppNodeAgent, AppClusterAgent}
+	if cr.Spec.AgentsOnly == nil {
+		if cr.Spec.EnterpriseEdition != nil {
+			used = append(used, AppCorootEE)
+		} else {
+			used = append(used, AppCorootCE)
 		}
-		versions[app] = v
 	}
-	logger.Info(fmt.Sprintf("got app versions: %v", versions))
+	var missing []App
+	for _, app := range used {
+		if r.getAppImage(cr, app) == "" {
+			missing = append(missing, app)
+		}
+	}
+	return missing
+}
+
+func (r *CorootReconciler) allAppVersionsKnown() bool {
 	r.versionsLock.Lock()
 	defer r.versionsLock.Unlock()
+	for _, app := range apps {
+		if r.versions[app] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchAppVersions updates the known versions of the apps and reports whether any of them has changed.
+// The versions are taken from the ConfigMap or the manifest URL if configured, otherwise from the latest GitHub releases.
+func (r *CorootReconciler) fetchAppVersions(ctx context.Context) (bool, error) {
+	logger := log.FromContext(ctx)
+	var versions map[App]string
+	var err error
+	switch {
+	case r.appVersionsConfigMap != "":
+		versions, err = r.appVersionsFromConfigMap(ctx, r.appVersionsConfigMap)
+	case r.appVersionsURL != "":
+		versions, err = fetchAppVersionsManifest(ctx, r.appVersionsURL)
+	default:
+		versions, err = fetchLatestReleases(ctx)
+	}
+	if err == nil {
+		logger.Info(fmt.Sprintf("got app versions: %v", versions))
+	}
+	r.versionsLock.Lock()
+	changed := false
 	for app, v := range versions {
-		if v != "" {
+		if v != "" && r.versions[app] != v {
 			r.versions[app] = v
+			changed = true
+		}
+	}
+	known := maps.Clone(r.versions)
+	r.versionsLock.Unlock()
+	if changed {
+		if cacheErr := r.saveAppVersionsCache(ctx, known); cacheErr != nil {
+			logger.Error(cacheErr, "failed to save app versions cache")
 		}
 	}
+	return changed, err
 }
 
-func (r *CorootReconciler) fetchAppVersion(app App) (string, error) {
-	resp, err := http.Get(fmt.Sprintf("https://api.github.com/repos/coroot/%s/releases/latest", app))
+// loadAppVersionsCache restores the versions known before the restart, so the components keep their images
+// if the sources of the versions are unavailable at startup.
+func (r *CorootReconciler) loadAppVersionsCache(ctx context.Context) error {
+	if r.appVersionsCacheConfigMap == "" {
+		return nil
+	}
+	ns, name, ok := strings.Cut(r.appVersionsCacheConfigMap, "/")
+	if !ok {
+		return fmt.Errorf("invalid app versions cache ConfigMap %q, expected namespace/name", r.appVersionsCacheConfigMap)
+	}
+	cm := &corev1.ConfigMap{}
+	if err := r.apiReader.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get app versions cache ConfigMap %s: %w", r.appVersionsCacheConfigMap, err)
+	}
+	r.versionsLock.Lock()
+	defer r.versionsLock.Unlock()
+	for app, v := range knownAppVersions(cm.Data) {
+		if r.versions[app] == "" {
+			r.versions[app] = v
+		}
+	}
+	return nil
+}
+
+func (r *CorootReconciler) saveAppVersionsCache(ctx context.Context, versions map[App]string) error {
+	if r.appVersionsCacheConfigMap == "" || r.Client == nil || r.apiReader == nil {
+		return nil
+	}
+	ns, name, ok := strings.Cut(r.appVersionsCacheConfigMap, "/")
+	if !ok {
+		return fmt.Errorf("invalid app versions cache ConfigMap %q, expected namespace/name", r.appVersionsCacheConfigMap)
+	}
+	data := map[string]string{}
+	for app, v := range versions {
+		data[string(app)] = v
+	}
+	// It's read bypassing the cache, as it may be outside the watched namespaces.
+	// The label makes the ConfigMap visible to the cache, which only watches the ConfigMaps managed by the operator.
+	cm := &corev1.ConfigMap{}
+	err := r.apiReader.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, cm)
+	switch {
+	case apierrors.IsNotFound(err):
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: ns,
+				Name:      name,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "coroot-operator"},
+			},
+			Data: data,
+		}
+		return r.Create(ctx, cm)
+	case err != nil:
+		return err
+	}
+	metav1.SetMetaDataLabel(&cm.ObjectMeta, "app.kubernetes.io/managed-by", "coroot-operator")
+	cm.Data = data
+	return r.Update(ctx, cm)
+}
+
+func fetchLatestReleases(ctx context.Context) (map[App]string, error) {
+	versions := map[App]string{}
+	var errs []error
+	for _, app := range apps {
+		var release struct {
+			TagName string `json:"tag_name"`
+		}
+		err := getJSON(ctx, fmt.Sprintf("https://api.github.com/repos/coroot/%s/releases/latest", app), &release)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get %s version: %w", app, err))
+		}
+		versions[app] = strings.TrimPrefix(release.TagName, "v")
+	}
+	return versions, errors.Join(errs...)
+}
+
+// fetchAppVersionsManifest reads the versions from a JSON object mapping the app names to their versions or images,
+// e.g., {"coroot": "1.8.0", "coroot-node-agent": "registry.example.com/coroot-node-agent:1.23.0"}.
+// The apps missing from the manifest keep their previous versions.
+func fetchAppVersionsManifest(ctx context.Context, url string) (map[App]string, error) {
+	manifest := map[string]string{}
+	if err := getJSON(ctx, url, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to get app versions from %s: %w", url, err)
+	}
+	return knownAppVersions(manifest), nil
+}
+
+// appVersionsFromConfigMap reads the versions from the data of the ConfigMap (namespace/name) in the manifest format.
+func (r *CorootReconciler) appVersionsFromConfigMap(ctx context.Context, ref string) (map[App]string, error) {
+	ns, name, ok := strings.Cut(ref, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid app versions ConfigMap %q, expected namespace/name", ref)
+	}
+	cm := &corev1.ConfigMap{}
+	// The ConfigMap may be outside the watched namespaces, so it's read bypassing the cache.
+	if err := r.apiReader.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, cm); err != nil {
+		return nil, fmt.Errorf("failed to get app versions from ConfigMap %s: %w", ref, err)
+	}
+	return knownAppVersions(cm.Data), nil
+}
+
+func knownAppVersions(manifest map[string]string) map[App]string {
+	versions := map[App]string{}
+	for _, app := range apps {
+		if v := strings.TrimSpace(manifest[string(app)]); v != "" {
+			versions[app] = strings.TrimPrefix(v, "v")
+		}
+	}
+	return versions
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return "", err
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf(resp.Status)
+		return fmt.Errorf(resp.Status)
 	}
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// appVersionsUpdater loads the cached app versions, fetches them, and then periodically refreshes them
+// and requeues all Coroot instances. It runs only on the leader, so the standby replicas neither query
+// the sources nor write the cache, and the operator starts without waiting for the sources.
+type appVersionsUpdater struct {
+	r *CorootReconciler
+}
+
+func (u *appVersionsUpdater) NeedLeaderElection() bool {
+	return true
+}
+
+func (u *appVersionsUpdater) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("app-versions-updater")
+	loadCtx, cancel := context.WithTimeout(ctx, AppVersionsFetchTimeout)
+	err := u.r.loadAppVersionsCache(loadCtx)
+	cancel()
+	if err != nil {
+		logger.Error(err, "failed to load app versions cache")
+	}
+	interval := u.r.appVersionsUpdateInterval
+	var backoff time.Duration
+	for first := true; ; first = false {
+		delay := wait.Jitter(interval, AppVersionsUpdateJitter)
+		retry := backoff > 0 && backoff < interval
+		switch {
+		case first:
+			delay = 0
+		case retry:
+			delay = backoff
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+
+		fetchCtx, cancel := context.WithTimeout(ctx, AppVersionsFetchTimeout)
+		changed, err := u.r.fetchAppVersions(fetchCtx)
+		cancel()
+		if err != nil {
+			minBackoff := AppVersionsRetryInterval
+			if !u.r.allAppVersionsKnown() {
+				// The instances missing versions aren't fully applied, so the retries are more frequent.
+				minBackoff = AppVersionsStartupRetryInterval
+			}
+			backoff = min(max(2*backoff, minBackoff), interval)
+			logger.Error(err, "failed to update app versions", "retry_in", backoff)
+		} else {
+			backoff = 0
+		}
+		// Retries only requeue instances when they actually bring new versions. The first fetch always does,
+		// as the instances may have been reconciled before the versions were loaded.
+		if retry && !changed {
+			continue
+		}
+		if err = u.enqueueAll(ctx); err != nil {
+			logger.Error(err, "failed to requeue Coroot instances")
+		}
 	}
-	var release struct {
-		TagName string `json:"tag_name"`
+}
+
+func (u *appVersionsUpdater) enqueueAll(ctx context.Context) error {
+	var list corootv1.CorootList
+	if err := u.r.List(ctx, &list); err != nil {
+		return err
 	}
-	if err = json.Unmarshal(data, &release); err != nil {
-		return "", err
+	for i := range list.Items {
+		select {
+		case <-ctx.Done():
+			return nil
+		case u.r.refresh <- event.GenericEvent{Object: &list.Items[i]}:
+		}
 	}
-	return strings.TrimPrefix(release.TagName, "v"), nil
+	return nil
 }
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"maps"
+	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"testing"
+	"time"
+)
+
+func TestAppVersionsCache(t *testing.T) {
+	r := testReconciler(t)
+	// A cache written by a previous version of the operator, without the label.
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "coroot-operator", Name: "app-versions"}}
+	c := fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(cm).Build()
+	r.Client, r.apiReader = c, c
+	r.appVersionsCacheConfigMap = "coroot-operator/app-versions"
+	ctx := context.Background()
+
+	if err := r.saveAppVersionsCache(ctx, map[App]string{"coroot": "1.2.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "coroot-operator", Name: "app-versions"}, cm); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Labels["app.kubernetes.io/managed-by"] != "coroot-operator" {
+		t.Errorf("expected the ConfigMap to be labeled, got %v", cm.Labels)
+	}
+	if cm.Data["coroot"] != "1.2.3" {
+		t.Errorf("expected the version to be saved, got %v", cm.Data)
+	}
+
+	r.versions = map[App]string{}
+	if err := r.loadAppVersionsCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if r.versions["coroot"] != "1.2.3" {
+		t.Errorf("expected the version to be restored, got %v", r.versions)
+	}
+}
+
+func TestAppVersionsUpdater(t *testing.T) {
+	r := testReconciler(t)
+	r.versions = map[App]string{}
+	cache := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "coroot-operator", Name: "app-versions-cache"},
+		Data:       map[string]string{"coroot-node-agent": "1.0.0"},
+	}
+	source := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "coroot-operator", Name: "app-versions"},
+		Data:       map[string]string{"coroot": "1.2.3"},
+	}
+	c := fake.NewClientBuilder().WithScheme(r.Scheme).WithObjects(cache, source, testCoroot()).Build()
+	r.Client, r.apiReader = c, c
+	r.appVersionsCacheConfigMap = "coroot-operator/app-versions-cache"
+	r.appVersionsConfigMap = "coroot-operator/app-versions"
+	r.appVersionsUpdateInterval = time.Hour
+	r.refresh = make(chan event.GenericEvent)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The versions are loaded and fetched by the updater, so the instances are requeued once they are known.
+	go func() { _ = (&appVersionsUpdater{r: r}).Start(ctx) }()
+	select {
+	case e := <-r.refresh:
+		if e.Object.GetName() != "coroot" {
+			t.Errorf("unexpected instance requeued: %s", e.Object.GetName())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the instances haven't been requeued after the first fetch")
+	}
+	r.versionsLock.Lock()
+	versions := maps.Clone(r.versions)
+	r.versionsLock.Unlock()
+	if expected := map[App]string{AppCorootCE: "1.2.3", AppNodeAgent: "1.0.0"}; !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected %v, got %v", expected, versions)
+	}
+}
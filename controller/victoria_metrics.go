@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"time"
+)
+
+const (
+	VictoriaMetricsImage = "victoriametrics/victoria-metrics:v1.106.1"
+)
+
+func victoriaMetricsEnabled(cr *corootv1.Coroot) bool {
+	return cr.Spec.MetricsEngine == corootv1.MetricsEngineVictoriaMetrics
+}
+
+// metricsURL returns the Prometheus-compatible URL Coroot queries the metrics from.
+func metricsURL(cr *corootv1.Coroot) string {
+	if victoriaMetricsEnabled(cr) {
+		if u := cr.Spec.VictoriaMetrics.URL; u != "" {
+			return u
+		}
+		return fmt.Sprintf("http://%s-victoria-metrics.%s:8428", cr.Name, cr.Namespace)
+	}
+	return fmt.Sprintf("http://%s-prometheus.%s:9090", cr.Name, cr.Namespace)
+}
+
+// metricsRemoteWriteURL returns the URL Coroot writes the metrics to if it differs from the metricsURL.
+func metricsRemoteWriteURL(cr *corootv1.Coroot) string {
+	switch {
+	case victoriaMetricsEnabled(cr):
+		return cr.Spec.VictoriaMetrics.RemoteWriteURL
+	case prometheusRemoteWriteRelabeling(cr):
+		return prometheusRemoteWriteURL(cr)
+	case prometheusReplicas(cr) > 1:
+		// Prometheus is queried through promxy, which doesn't accept writes, so the metrics are written to the first replica.
+		return prometheusReplicaURL(cr, 0) + "/api/v1/write"
+	}
+	return ""
+}
+
+// CreateOrUpdateVictoriaMetrics applies vmsingle, or deletes it if it isn't used. The PVC is retained.
+func (r *CorootReconciler) CreateOrUpdateVictoriaMetrics(ctx context.Context, cr *corootv1.Coroot, delete bool) []error {
+	var errs []error
+	if !delete && pvcStorage(cr.Spec.VictoriaMetrics.Storage) {
+		errs = append(errs, r.CreateOrUpdatePVC(ctx, cr, r.victoriaMetricsPVC(cr), cr.Spec.VictoriaMetrics.Storage.ClassChangePolicy))
+	}
+	if delete {
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.victoriaMetricsDeployment(cr), true, nil))
+		errs = append(errs, r.CreateOrUpdate(ctx, cr, r.victoriaMetricsService(cr), true, nil))
+	} else {
+		errs = append(errs, r.CreateOrUpdateDeployment(ctx, cr, r.victoriaMetricsDeployment(cr)))
+		errs = append(errs, r.CreateOrUpdateService(ctx, cr, r.victoriaMetricsService(cr)))
+	}
+	return errs
+}
+
+func (r *CorootReconciler) victoriaMetricsService(cr *corootv1.Coroot) *corev1.Service {
+	ls := Labels(cr, "victoria-metrics")
+	s := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-victoria-metrics", cr.Name),
+			Namespace: cr.Namespace,
+			Labels:    ls,
+		},
+	}
+
+	s.Spec = corev1.ServiceSpec{
+		Selector: ls,
+		Type:     corev1.ServiceTypeClusterIP,
+		Ports: []corev1.ServicePort{
+			{
+				Name:       "http",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       8428,
+				TargetPort: intstr.FromString("http"),
+			},
+		},
+	}
+
+	return s
+}
+
+func (r *CorootReconciler) victoriaMetricsPVC(cr *corootv1.Coroot) *corev1.PersistentVolumeClaim {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "data-" + cr.Name + "-victoria-metrics",
+			Namespace:   cr.Namespace,
+			Labels:      mergeLabels(Labels(cr, "victoria-metrics"), cr.Spec.VictoriaMetrics.Storage.Labels),
+			Annotations: cr.Spec.VictoriaMetrics.Storage.Annotations,
+		},
+	}
+
+	size := cr.Spec.VictoriaMetrics.Storage.Size
+	if size.IsZero() {
+		size, _ = resource.ParseQuantity(DefaultStorageSize)
+	}
+	pvc.Spec = corev1.PersistentVolumeClaimSpec{
+		AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		Resources: corev1.VolumeResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceStorage: size,
+			},
+		},
+		StorageClassName: cr.Spec.VictoriaMetrics.Storage.ClassName,
+		DataSourceRef:    cr.Spec.VictoriaMetrics.Storage.DataSourceRef,
+		Selector:         cr.Spec.VictoriaMetrics.Storage.Selector,
+	}
+
+	return pvc
+}
+
+func (r *CorootReconciler) victoriaMetricsDeployment(cr *corootv1.Coroot) *appsv1.Deployment {
+	ls := Labels(cr, "victoria-metrics")
+	vm := cr.Spec.VictoriaMetrics
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-victoria-metrics",
+			Namespace: cr.Namespace,
+			Labels:    mergeLabels(ls, vm.Labels),
+		},
+	}
+
+	// VictoriaMetrics doesn't accept a retention shorter than a day.
+	retention := fmt.Sprintf("%dd", int64(DefaultMetricsRetention/(24*time.Hour)))
+	if r := vm.Retention.Duration; r > 0 && r != DefaultMetricsRetention {
+		retention = fmt.Sprintf("%dh", max(int64(r.Hours()), 24))
+	}
+
+	replicas := int32(1)
+	if hibernated(cr) {
+		replicas = 0
+	}
+
+	d.Spec = appsv1.DeploymentSpec{
+		Selector: &metav1.LabelSelector{
+			MatchLabels: ls,
+		},
+		Replicas: &replicas,
+		Strategy: appsv1.DeploymentStrategy{
+			Type: appsv1.RecreateDeploymentStrategyType,
+		},
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:      mergeLabels(ls, vm.PodLabels),
+				Annotations: podAnnotations(cr, vm.PodAnnotations, false),
+			},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: serviceAccountName(cr, "prometheus"),
+				DNSPolicy:          vm.DNSPolicy,
+				DNSConfig:          vm.DNSConfig,
+				HostAliases:        vm.HostAliases,
+				SecurityContext:    podSecurityContext(vm.PodSecurityContext),
+				Affinity:           archAffinity(vm.Affinity, vm.Architectures),
+				Tolerations:        vm.Tolerations,
+				NodeSelector:       linuxNodeSelector,
+				PriorityClassName:  vm.PriorityClassName,
+				SchedulerName:      vm.SchedulerName,
+				RuntimeClassName:   vm.RuntimeClassName,
+				Containers: []corev1.Container{
+					{
+						Image:   VictoriaMetricsImage,
+						Name:    "victoria-metrics",
+						Command: []string{"/victoria-metrics-prod"},
+						Args: []string{
+							"-httpListenAddr=:8428",
+							"-storageDataPath=/data",
+							"-retentionPeriod=" + retention,
+						},
+						Ports: []corev1.ContainerPort{
+							{Name: "http", ContainerPort: 8428, Protocol: corev1.ProtocolTCP},
+						},
+						Resources:       vm.Resources,
+						SecurityContext: containerSecurityContext(vm.SecurityContext),
+						VolumeMounts: []corev1.VolumeMount{
+							{Name: "tmp", MountPath: "/tmp"},
+							{Name: "data", MountPath: "/data"},
+						},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{Path: "/health", Port: intstr.FromString("http")},
+							},
+							TimeoutSeconds: 10,
+						},
+					},
+				},
+				Volumes: []corev1.Volume{
+					{
+						Name: "tmp",
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
+						},
+					},
+					{
+						Name: "data",
+						VolumeSource: corev1.VolumeSource{
+							PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+								ClaimName: "data-" + cr.Name + "-victoria-metrics",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	applyPodStorage(vm.Storage, &d.Spec.Template.Spec, false)
+	applyContainerOverrides(&d.Spec.Template.Spec.Containers[0], vm.ExtraArgs, vm.Lifecycle)
+
+	return d
+}
@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"context"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var vpaGVK = schema.GroupVersionKind{Group: "autoscaling.k8s.io", Version: "v1", Kind: "VerticalPodAutoscaler"}
+
+var vpaUpdateModes = map[corootv1.VPAMode]string{
+	corootv1.VPAModeOff:     "Off",
+	corootv1.VPAModeInitial: "Initial",
+	corootv1.VPAModeAuto:    "Auto",
+}
+
+type vpaTarget struct {
+	component string
+	kind      string
+	mode      corootv1.VPAMode
+}
+
+func vpaTargets(cr *corootv1.Coroot) []vpaTarget {
+	var spec corootv1.VerticalPodAutoscalerSpec
+	if cr.Spec.VerticalPodAutoscaler != nil {
+		spec = *cr.Spec.VerticalPodAutoscaler
+	}
+	targets := []vpaTarget{
+		{component: "node-agent", kind: "DaemonSet", mode: spec.NodeAgent},
+		{component: "cluster-agent", kind: "Deployment", mode: spec.ClusterAgent},
+	}
+	if cr.Spec.AgentsOnly == nil {
+		targets = append(targets,
+			vpaTarget{component: "coroot", kind: "StatefulSet", mode: spec.Coroot},
+			vpaTarget{component: "prometheus", kind: "Deployment", mode: spec.Prometheus},
+		)
+	}
+	return targets
+}
+
+func (r *CorootReconciler) verticalPodAutoscaler(cr *corootv1.Coroot, t vpaTarget) *unstructured.Unstructured {
+	vpa := &unstructured.Unstructured{}
+	vpa.SetGroupVersionKind(vpaGVK)
+	vpa.SetName(cr.Name + "-" + t.component)
+	vpa.SetNamespace(cr.Namespace)
+	vpa.SetLabels(Labels(cr, t.component))
+	vpa.Object["spec"] = map[string]interface{}{
+		"targetRef": map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       t.kind,
+			"name":       cr.Name + "-" + t.component,
+		},
+		"updatePolicy": map[string]interface{}{
+			"updateMode": vpaUpdateModes[t.mode],
+		},
+	}
+	return vpa
+}
+
+// CreateOrUpdateVerticalPodAutoscalers applies the VerticalPodAutoscalers of the components with a mode set and deletes the others.
+// VPA changes the resources of the pods on admission, so it doesn't conflict with the resources in the specs managed by the operator.
+func (r *CorootReconciler) CreateOrUpdateVerticalPodAutoscalers(ctx context.Context, cr *corootv1.Coroot) []error {
+	if !r.kindSupported(vpaGVK) {
+		if cr.Spec.VerticalPodAutoscaler != nil {
+			ctrl.Log.WithValues("namespace", cr.Namespace, "name", cr.Name).Info("VerticalPodAutoscaler CRD is not installed, skipping")
+		}
+		return nil
+	}
+	var errs []error
+	for _, t := range vpaTargets(cr) {
+		errs = append(errs, r.CreateOrUpdateUnstructured(ctx, cr, r.verticalPodAutoscaler(cr, t), t.mode == ""))
+	}
+	return errs
+}
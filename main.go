@@ -1,22 +1,31 @@
 package main
 
 import (
+	"flag"
 	"github.io/coroot/operator/controller"
 	"go.uber.org/zap/zapcore"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	corootv1 "github.io/coroot/operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -32,25 +41,100 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+	if filepath.Base(os.Args[0]) == kubectlPluginName {
+		usage()
+		os.Exit(2)
+	}
+
+	leaderElect := flag.Bool("leader-elect", false, "enable leader election to run multiple operator replicas safely")
+	appVersionsUpdateInterval := flag.Duration("app-versions-update-interval", controller.AppVersionsUpdateInterval, "how often to check for new versions of Coroot components")
+	appVersionsURL := flag.String("app-versions-url", "", "a URL of a JSON manifest with the versions of Coroot components (by default, the latest GitHub releases are used)")
+	appVersionsConfigMap := flag.String("app-versions-configmap", "", "a ConfigMap (namespace/name) with the versions of Coroot components, takes precedence over --app-versions-url")
+	appVersionsCacheConfigMap := flag.String("app-versions-cache-configmap", "", "a ConfigMap (namespace/name) persisting the last known versions of Coroot components across restarts (coroot-operator-app-versions in the POD_NAMESPACE by default)")
+	syncPeriod := flag.Duration("sync-period", 10*time.Hour, "the minimum frequency at which all watched resources are reconciled")
+	maxConcurrentReconciles := flag.Int("max-concurrent-reconciles", 1, "the maximum number of Coroot instances reconciled concurrently")
+	kubeAPIQPS := flag.Float64("kube-api-qps", 20, "the maximum QPS to the Kubernetes API")
+	kubeAPIBurst := flag.Int("kube-api-burst", 30, "the maximum burst of requests to the Kubernetes API")
+	enableWebhooks := flag.Bool("enable-webhooks", false, "serve the defaulting webhook storing the effective defaults into the Coroot resources")
+	webhookCertDir := flag.String("webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "a directory with the tls.crt and tls.key of the webhook server")
+	flag.Parse()
+
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&zap.Options{Development: true, StacktraceLevel: zapcore.DPanicLevel})))
 	logger := ctrl.Log
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	// A comma-separated list of namespaces to watch. If empty, the operator watches all namespaces.
+	var watchNamespaces []string
+	cacheOptions := cache.Options{
+		SyncPeriod: syncPeriod,
+		// Only the pods of the components are watched to report their issues.
+		ByObject: map[client.Object]cache.ByObject{
+			&corev1.Pod{}: {Label: labels.SelectorFromSet(labels.Set{"app.kubernetes.io/managed-by": "coroot-operator"})},
+			// Only the inventory ConfigMaps are read through the cache.
+			&corev1.ConfigMap{}: {Label: labels.SelectorFromSet(labels.Set{"app.kubernetes.io/managed-by": "coroot-operator"})},
+		},
+	}
+	if v := os.Getenv("WATCH_NAMESPACE"); v != "" {
+		cacheOptions.DefaultNamespaces = map[string]cache.Config{}
+		for _, ns := range strings.Split(v, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				watchNamespaces = append(watchNamespaces, ns)
+				cacheOptions.DefaultNamespaces[ns] = cache.Config{}
+			}
+		}
+		logger.Info("watching namespaces", "namespaces", watchNamespaces)
+	}
+
+	if *appVersionsCacheConfigMap == "" {
+		if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+			*appVersionsCacheConfigMap = ns + "/coroot-operator-app-versions"
+		}
+	}
+
+	cfg := ctrl.GetConfigOrDie()
+	cfg.QPS = float32(*kubeAPIQPS)
+	cfg.Burst = *kubeAPIBurst
+
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
 		Scheme:                 scheme,
 		Metrics:                metricsserver.Options{BindAddress: "0"},
 		HealthProbeBindAddress: ":8081",
+		Cache:                  cacheOptions,
+		WebhookServer:          webhook.NewServer(webhook.Options{CertDir: *webhookCertDir}),
+
+		LeaderElection:                *leaderElect,
+		LeaderElectionID:              "coroot-operator.coroot.com",
+		LeaderElectionReleaseOnCancel: true,
 	})
 	if err != nil {
 		logger.Error(err, "failed to start manager")
 		os.Exit(1)
 	}
 
-	reconciler := controller.NewCorootReconciler(mgr)
+	reconciler := controller.NewCorootReconciler(mgr, controller.Options{
+		WatchNamespaces:           watchNamespaces,
+		AppVersionsUpdateInterval: *appVersionsUpdateInterval,
+		AppVersionsURL:            *appVersionsURL,
+		AppVersionsConfigMap:      *appVersionsConfigMap,
+		AppVersionsCacheConfigMap: *appVersionsCacheConfigMap,
+		MaxConcurrentReconciles:   *maxConcurrentReconciles,
+	})
 
 	if err = reconciler.SetupWithManager(mgr); err != nil {
 		logger.Error(err, "failed to create controller")
 		os.Exit(1)
 	}
+	if *enableWebhooks {
+		if err = controller.SetupWebhookWithManager(mgr); err != nil {
+			logger.Error(err, "failed to create webhook")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	if err = mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -0,0 +1,151 @@
+//go:build e2e
+
+// Package e2e runs the operator against a real cluster (see make test-e2e) and waits for the Coroot components to become ready.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	corootv1 "github.io/coroot/operator/api/v1"
+	"github.io/coroot/operator/controller"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"testing"
+	"time"
+)
+
+const (
+	readyTimeout = 15 * time.Minute
+	pollInterval = 5 * time.Second
+)
+
+func TestCoroot(t *testing.T) {
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = corootv1.AddToScheme(scheme)
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		Scheme:                 scheme,
+		Metrics:                metricsserver.Options{BindAddress: "0"},
+		HealthProbeBindAddress: "0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = controller.NewCorootReconciler(mgr, controller.Options{}).SetupWithManager(mgr); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		if err := mgr.Start(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	c, err := client.New(mgr.GetConfig(), client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := fmt.Sprintf("coroot-e2e-%d", time.Now().Unix())
+	if err = c.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}}); err != nil {
+		t.Fatal(err)
+	}
+	// The Coroot is deleted while the operator is running, so its finalizer is removed.
+	t.Cleanup(func() {
+		cr := &corootv1.Coroot{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "coroot"}}
+		if err := c.Delete(context.Background(), cr); client.IgnoreNotFound(err) == nil {
+			waitDeleted(t, c, cr)
+		}
+		_ = c.Delete(context.Background(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}})
+	})
+
+	cr := &corootv1.Coroot{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "coroot"}}
+	cr.Spec.Clickhouse.Shards, cr.Spec.Clickhouse.Replicas = 1, 1
+	if err = c.Create(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+
+	waitReconciled(t, c, cr)
+	for _, obj := range []client.Object{
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "coroot-coroot"}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-shard-0"}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "coroot-clickhouse-keeper"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "coroot-prometheus"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "coroot-cluster-agent"}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "coroot-node-agent"}},
+	} {
+		obj.SetNamespace(ns)
+		waitReady(t, c, obj)
+	}
+
+	t.Run("metrics engine switch", func(t *testing.T) {
+		if err := c.Get(ctx, client.ObjectKeyFromObject(cr), cr); err != nil {
+			t.Fatal(err)
+		}
+		cr.Spec.MetricsEngine = corootv1.MetricsEngineVictoriaMetrics
+		if err := c.Update(ctx, cr); err != nil {
+			t.Fatal(err)
+		}
+		waitReady(t, c, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "coroot-victoria-metrics"}})
+		waitDeleted(t, c, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "coroot-prometheus"}})
+		waitReady(t, c, &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "coroot-coroot"}})
+	})
+}
+
+func poll(t *testing.T, what string, f func(ctx context.Context) (bool, error)) {
+	t.Helper()
+	if err := wait.PollUntilContextTimeout(context.Background(), pollInterval, readyTimeout, true, f); err != nil {
+		t.Fatalf("%s: %s", what, err)
+	}
+}
+
+func waitReconciled(t *testing.T, c client.Client, cr *corootv1.Coroot) {
+	t.Helper()
+	poll(t, "Coroot isn't reconciled", func(ctx context.Context) (bool, error) {
+		if err := c.Get(ctx, client.ObjectKeyFromObject(cr), cr); err != nil {
+			return false, err
+		}
+		return meta.IsStatusConditionTrue(cr.Status.Conditions, controller.ConditionTypeReconciled), nil
+	})
+}
+
+func waitReady(t *testing.T, c client.Client, obj client.Object) {
+	t.Helper()
+	poll(t, fmt.Sprintf("%T %s isn't ready", obj, obj.GetName()), func(ctx context.Context) (bool, error) {
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		switch o := obj.(type) {
+		case *appsv1.Deployment:
+			return o.Status.ObservedGeneration == o.Generation && o.Status.ReadyReplicas == *o.Spec.Replicas && o.Status.UpdatedReplicas == *o.Spec.Replicas, nil
+		case *appsv1.StatefulSet:
+			return o.Status.ObservedGeneration == o.Generation && o.Status.ReadyReplicas == *o.Spec.Replicas && o.Status.UpdatedReplicas == *o.Spec.Replicas, nil
+		case *appsv1.DaemonSet:
+			return o.Status.ObservedGeneration == o.Generation && o.Status.DesiredNumberScheduled > 0 && o.Status.NumberReady == o.Status.DesiredNumberScheduled, nil
+		}
+		return true, nil
+	})
+}
+
+func waitDeleted(t *testing.T, c client.Client, obj client.Object) {
+	t.Helper()
+	poll(t, fmt.Sprintf("%T %s isn't deleted", obj, obj.GetName()), func(ctx context.Context) (bool, error) {
+		err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+}